@@ -0,0 +1,520 @@
+// Package api implements the requests which control grinklers, independently of the transport (MQTT or HTTP)
+// they are made over.
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/config"
+	"git.amikhalev.com/amikhalev/grinklers/datamodel"
+	"git.amikhalev.com/amikhalev/grinklers/history"
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+)
+
+// Response is the data returned in response to a request
+type Response map[string]interface{}
+
+// SetResult sets the result of the request in the response. If err is not nil, it is converted to a
+// util.Error which is described in the response and returned.
+func (res Response) SetResult(err error) (uerr *util.Error) {
+	if err == nil {
+		res["result"] = "success"
+		return
+	}
+	var ok bool
+	if uerr, ok = err.(*util.Error); !ok {
+		uerr = util.NewInternalError(err)
+	}
+	res["result"] = "error"
+	res["code"] = uerr.Code
+	res["message"] = uerr.Error()
+	if uerr.Name != "" {
+		res["name"] = uerr.Name
+	}
+	if uerr.Cause != nil {
+		res["cause"] = uerr.Cause.Error()
+		if e, ok := uerr.Cause.(*json.SyntaxError); ok {
+			res["offset"] = e.Offset
+		}
+	}
+	return
+}
+
+// Handler handles a request with the JSON data, filling in res
+type Handler func(data []byte, res Response) (err error)
+
+// Handlers handles requests to control the sections, programs and section runner in a ConfigData
+type Handlers struct {
+	config    *config.ConfigData
+	secRunner *logic.SectionRunner
+	history   *history.History
+	handlers  map[string]Handler
+}
+
+// NewHandlers creates new Handlers for the specified data
+func NewHandlers(configData *config.ConfigData, secRunner *logic.SectionRunner) *Handlers {
+	h := &Handlers{configData, secRunner, nil, nil}
+	h.handlers = map[string]Handler{
+		"getSections":          h.getSections,
+		"getSection":           h.getSection,
+		"updateSection":        h.updateSection,
+		"createSection":        h.createSection,
+		"deleteSection":        h.deleteSection,
+		"getPrograms":          h.getPrograms,
+		"getProgram":           h.getProgram,
+		"getSectionRunner":     h.getSectionRunner,
+		"runProgram":           h.runProgram,
+		"cancelProgram":        h.cancelProgram,
+		"updateProgram":        h.updateProgram,
+		"createProgram":        h.createProgram,
+		"deleteProgram":        h.deleteProgram,
+		"reorderProgram":       h.reorderProgram,
+		"duplicateProgram":     h.duplicateProgram,
+		"runSection":           h.runSection,
+		"cancelSection":        h.cancelSection,
+		"cancelSectionRunId":   h.cancelSectionRunID,
+		"cancelAllSectionRuns": h.cancelAllSectionRuns,
+		"pauseSectionRunner":   h.pauseSectionRunner,
+		"getHistory":           h.getHistory,
+	}
+	return h
+}
+
+// SetHistory sets the History which is queried by getHistory requests
+func (h *Handlers) SetHistory(hist *history.History) {
+	h.history = hist
+}
+
+// Handle handles a request of the type requestType with the JSON data, filling in res. If tokens are configured,
+// the request must be made with a token whose role allows it.
+func (h *Handlers) Handle(requestType, token string, data []byte, res Response) (err error) {
+	handler, ok := h.handlers[requestType]
+	if !ok {
+		return util.NewError(util.EC_NotImplemented, fmt.Sprintf("invalid api request type: %s", requestType))
+	}
+	if err = h.Authorize(requestType, token); err != nil {
+		return
+	}
+	return handler(data, res)
+}
+
+// save logs err if a change made by a request could not be saved with one of the config.Save functions. The
+// change has already been applied, so the request does not fail.
+func save(err error) {
+	if err != nil {
+		log.WithError(err).Error("error saving change")
+	}
+}
+
+func (h *Handlers) findProgram(progID *int) (program *logic.Program, err error) {
+	return h.config.FindProgram(progID)
+}
+
+func (h *Handlers) findSection(secID *int) (section *logic.Section, err error) {
+	return h.config.FindSection(secID)
+}
+
+func (h *Handlers) sectionToJSON(sec *logic.Section) datamodel.SectionStateJSON {
+	return datamodel.SectionToStateJSON(sec, h.config.SectionInterface)
+}
+
+func (h *Handlers) getSections(data []byte, res Response) (err error) {
+	sectionList := h.config.SectionList()
+	sections := make([]datamodel.SectionStateJSON, len(sectionList))
+	for i := range sectionList {
+		sections[i] = h.sectionToJSON(sectionList[i])
+	}
+	res["data"] = sections
+	return
+}
+
+func (h *Handlers) getSection(data []byte, res Response) (err error) {
+	var req struct {
+		SectionID *int
+	}
+	if err = json.Unmarshal(data, &req); err != nil {
+		return util.NewParseError("getSection request", err)
+	}
+	sec, err := h.findSection(req.SectionID)
+	if err != nil {
+		return
+	}
+	res["data"] = h.sectionToJSON(sec)
+	return
+}
+
+func (h *Handlers) updateSection(data []byte, res Response) (err error) {
+	var req struct {
+		SectionID *int
+		Data      *datamodel.SectionDataJSON
+	}
+	if err = json.Unmarshal(data, &req); err != nil {
+		return util.NewParseError("updateSection request", err)
+	}
+	sec, err := h.findSection(req.SectionID)
+	if err != nil {
+		return
+	}
+	if req.Data == nil {
+		return util.NewNotSpecifiedError("data")
+	}
+	if err = req.Data.Validate(); err != nil {
+		return util.NewInvalidDataError("section update", err)
+	}
+	current := sec.Snapshot()
+	if req.Data.InterfaceID != nil && *req.Data.InterfaceID != current.InterfaceID {
+		if err = h.config.CheckInterfaceID(*req.Data.InterfaceID); err != nil {
+			return
+		}
+		if sec.GetState(h.config.SectionInterface) {
+			return util.NewError(util.EC_InvalidData,
+				fmt.Sprintf("section '%s' must be off to change its interface id", current.Name))
+		}
+		sec.SetInterfaceID(*req.Data.InterfaceID)
+	}
+	name, maxRunTime := current.Name, current.MaxRunTime
+	if req.Data.Name != nil {
+		name = *req.Data.Name
+	}
+	if req.Data.MaxRunTime != nil {
+		maxRunTime = *req.Data.MaxRunTime
+	}
+	sec.SetData(name, maxRunTime)
+	save(config.SaveSection(h.config, sec))
+	res["message"] = fmt.Sprintf("updated section '%s'", name)
+	res["data"] = h.sectionToJSON(sec)
+	return
+}
+
+func (h *Handlers) createSection(data []byte, res Response) (err error) {
+	var req struct {
+		Data *datamodel.SectionDataJSON
+	}
+	if err = json.Unmarshal(data, &req); err != nil {
+		return util.NewParseError("createSection request", err)
+	}
+	if req.Data == nil {
+		return util.NewNotSpecifiedError("data")
+	}
+	newSec, err := req.Data.ToSection()
+	if err != nil {
+		return util.NewInvalidDataError("section", err)
+	}
+	sec, err := h.config.AddSection(newSec)
+	if err != nil {
+		return
+	}
+	save(config.SaveSections(h.config))
+	res["message"] = fmt.Sprintf("created section '%s'", sec.Snapshot().Name)
+	res["data"] = h.sectionToJSON(sec)
+	return
+}
+
+func (h *Handlers) deleteSection(data []byte, res Response) (err error) {
+	var req struct {
+		SectionID          *int
+		RemoveFromPrograms bool
+	}
+	if err = json.Unmarshal(data, &req); err != nil {
+		return util.NewParseError("deleteSection request", err)
+	}
+	sec, err := h.config.RemoveSection(req.SectionID, req.RemoveFromPrograms)
+	if err != nil {
+		return
+	}
+	save(config.SaveSections(h.config))
+	if req.RemoveFromPrograms {
+		save(config.SavePrograms(h.config))
+	}
+	res["message"] = fmt.Sprintf("deleted section '%s'", sec.Name)
+	return
+}
+
+func (h *Handlers) getPrograms(data []byte, res Response) (err error) {
+	programList := h.config.ProgramList()
+	programs := make([]datamodel.ProgramStateJSON, len(programList))
+	for i, prog := range programList {
+		programs[i] = datamodel.ProgramToStateJSON(prog)
+	}
+	res["data"] = programs
+	return
+}
+
+func (h *Handlers) getProgram(data []byte, res Response) (err error) {
+	var req struct {
+		ProgramID *int
+	}
+	if err = json.Unmarshal(data, &req); err != nil {
+		return util.NewParseError("getProgram request", err)
+	}
+	program, err := h.findProgram(req.ProgramID)
+	if err != nil {
+		return
+	}
+	res["data"] = datamodel.ProgramToStateJSON(program)
+	return
+}
+
+func (h *Handlers) getSectionRunner(data []byte, res Response) (err error) {
+	state := &h.secRunner.State
+	state.Lock()
+	stateJSON, err := datamodel.SRStateToJSON(state)
+	state.Unlock()
+	if err != nil {
+		return
+	}
+	res["data"] = stateJSON
+	return
+}
+
+func (h *Handlers) runProgram(data []byte, res Response) (err error) {
+	var req struct {
+		ProgramID *int
+	}
+	if err = json.Unmarshal(data, &req); err != nil {
+		return util.NewParseError("runProgram request", err)
+	}
+	program, err := h.findProgram(req.ProgramID)
+	if err != nil {
+		return
+	}
+	program.Run()
+	res["message"] = fmt.Sprintf("running program '%s'", program.Name)
+	return
+}
+
+func (h *Handlers) cancelProgram(data []byte, res Response) (err error) {
+	var req struct {
+		ProgramID *int
+	}
+	if err = json.Unmarshal(data, &req); err != nil {
+		return util.NewParseError("cancelProgram request", err)
+	}
+	program, err := h.findProgram(req.ProgramID)
+	if err != nil {
+		return
+	}
+	program.Cancel()
+	res["message"] = fmt.Sprintf("cancelled program '%s'", program.Name)
+	return
+}
+
+func (h *Handlers) updateProgram(data []byte, res Response) (err error) {
+	var req struct {
+		ProgramID *int
+		Data      datamodel.ProgramJSON
+	}
+	if err = json.Unmarshal(data, &req); err != nil {
+		return util.NewParseError("updateProgram request", err)
+	}
+	program, err := h.findProgram(req.ProgramID)
+	if err != nil {
+		return
+	}
+	err = req.Data.Update(program, h.config.SectionList())
+	if err != nil {
+		return util.NewInvalidDataError("program update", err)
+	}
+	save(config.SaveProgram(h.config, program))
+	res["message"] = fmt.Sprintf("updated program '%s'", program.Name)
+	res["data"] = datamodel.ProgramToJSON(program)
+	return
+}
+
+func (h *Handlers) createProgram(data []byte, res Response) (err error) {
+	var req struct {
+		Data *datamodel.ProgramJSON
+	}
+	if err = json.Unmarshal(data, &req); err != nil {
+		return util.NewParseError("createProgram request", err)
+	}
+	if req.Data == nil {
+		return util.NewNotSpecifiedError("data")
+	}
+	program, err := req.Data.ToProgram(h.config.SectionList())
+	if err != nil {
+		return util.NewInvalidDataError("program", err)
+	}
+	h.config.AddProgram(program)
+	save(config.SavePrograms(h.config))
+	res["message"] = fmt.Sprintf("created program '%s'", program.Name)
+	res["data"] = datamodel.ProgramToJSON(program)
+	return
+}
+
+func (h *Handlers) deleteProgram(data []byte, res Response) (err error) {
+	var req struct {
+		ProgramID *int
+	}
+	if err = json.Unmarshal(data, &req); err != nil {
+		return util.NewParseError("deleteProgram request", err)
+	}
+	program, err := h.config.RemoveProgram(req.ProgramID)
+	if err != nil {
+		return
+	}
+	save(config.SavePrograms(h.config))
+	res["message"] = fmt.Sprintf("deleted program '%s'", program.Name)
+	return
+}
+
+func (h *Handlers) reorderProgram(data []byte, res Response) (err error) {
+	var req struct {
+		ProgramID *int
+		Position  *int
+	}
+	if err = json.Unmarshal(data, &req); err != nil {
+		return util.NewParseError("reorderProgram request", err)
+	}
+	program, err := h.config.MoveProgram(req.ProgramID, req.Position)
+	if err != nil {
+		return
+	}
+	save(config.SavePrograms(h.config))
+	res["message"] = fmt.Sprintf("moved program '%s' to position %d", program.Name, *req.Position)
+	res["data"] = datamodel.ProgramToJSON(program)
+	return
+}
+
+func (h *Handlers) duplicateProgram(data []byte, res Response) (err error) {
+	var req struct {
+		ProgramID *int
+		Name      *string
+	}
+	if err = json.Unmarshal(data, &req); err != nil {
+		return util.NewParseError("duplicateProgram request", err)
+	}
+	original, err := h.findProgram(req.ProgramID)
+	if err != nil {
+		return
+	}
+	progData := datamodel.ProgramToJSON(original)
+	name := *progData.Name + " (copy)"
+	if req.Name != nil {
+		name = *req.Name
+	}
+	progData.Name = &name
+	program, err := progData.ToProgram(h.config.SectionList())
+	if err != nil {
+		return
+	}
+	h.config.AddProgram(program)
+	save(config.SavePrograms(h.config))
+	res["message"] = fmt.Sprintf("duplicated program '%s' as '%s'", original.Name, program.Name)
+	res["data"] = datamodel.ProgramToJSON(program)
+	return
+}
+
+func (h *Handlers) runSection(data []byte, res Response) (err error) {
+	var req struct {
+		SectionID *int
+		Duration  float64
+	}
+	if err = json.Unmarshal(data, &req); err != nil {
+		return util.NewParseError("runSection request", err)
+	}
+	sec, err := h.findSection(req.SectionID)
+	if err != nil {
+		return
+	}
+	duration := time.Duration(req.Duration * float64(time.Second))
+	id := h.secRunner.QueueSectionRun(sec, duration)
+	res["message"] = fmt.Sprintf("running section '%s' for %v", sec.Snapshot().Name, duration)
+	res["runId"] = id
+	return
+}
+
+func (h *Handlers) cancelSection(data []byte, res Response) (err error) {
+	var req struct {
+		SectionID *int
+	}
+	if err = json.Unmarshal(data, &req); err != nil {
+		return util.NewParseError("cancelSection request", err)
+	}
+	sec, err := h.findSection(req.SectionID)
+	if err != nil {
+		return
+	}
+	h.secRunner.CancelSection(sec)
+	res["message"] = fmt.Sprintf("cancelled section '%s'", sec.Snapshot().Name)
+	return
+}
+
+func (h *Handlers) cancelSectionRunID(data []byte, res Response) (err error) {
+	var req struct {
+		RunID *int32
+	}
+	err = json.Unmarshal(data, &req)
+	if err != nil || req.RunID == nil {
+		return util.NewParseError("cancelSectionRunId request", err)
+	}
+	h.secRunner.CancelID(*req.RunID)
+	res["message"] = fmt.Sprintf("cancelled section run with id %v", *req.RunID)
+	return
+}
+
+func (h *Handlers) cancelAllSectionRuns(data []byte, res Response) (err error) {
+	var req struct{}
+	if err = json.Unmarshal(data, &req); err != nil {
+		return util.NewParseError("cancelAllSectionRuns request", err)
+	}
+	h.secRunner.CancelAll()
+	res["message"] = "cancelled all section runs"
+	return
+}
+
+func (h *Handlers) pauseSectionRunner(data []byte, res Response) (err error) {
+	var req struct {
+		Paused *bool
+	}
+	err = json.Unmarshal(data, &req)
+	if err != nil || req.Paused == nil {
+		return util.NewParseError("parse pauseSectionRunner request", err)
+	}
+	res["paused"] = req.Paused
+	if *req.Paused {
+		h.secRunner.Pause()
+		res["message"] = "paused section runner"
+	} else {
+		h.secRunner.Unpause()
+		res["message"] = "unpaused section runner"
+	}
+	return
+}
+
+func (h *Handlers) getHistory(data []byte, res Response) (err error) {
+	var req struct {
+		Period *string
+		Count  *int
+	}
+	if err = json.Unmarshal(data, &req); err != nil {
+		return util.NewParseError("getHistory request", err)
+	}
+	if h.history == nil {
+		return util.NewError(util.EC_NotImplemented, "history is not enabled")
+	}
+	if req.Period == nil {
+		return util.NewNotSpecifiedError("period")
+	}
+	period, err := history.ParsePeriod(*req.Period)
+	if err != nil {
+		return util.NewParseError("period", err)
+	}
+	count := 1
+	if req.Count != nil {
+		count = *req.Count
+		if count < 1 || count > 366 {
+			return util.NewError(util.EC_Range, "count must be between 1 and 366")
+		}
+	}
+	totals, err := h.history.Totals(period, count, time.Now())
+	if err != nil {
+		return
+	}
+	res["message"] = fmt.Sprintf("got history for %d %s(s)", count, period)
+	res["data"] = totals
+	return
+}
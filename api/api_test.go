@@ -0,0 +1,409 @@
+package api
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/config"
+	"git.amikhalev.com/amikhalev/grinklers/datamodel"
+	"git.amikhalev.com/amikhalev/grinklers/history"
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/sched"
+	"git.amikhalev.com/amikhalev/grinklers/storage"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type HandlersSuite struct {
+	suite.Suite
+	config    *config.ConfigData
+	secRunner *logic.SectionRunner
+	handlers  *Handlers
+	wait      sync.WaitGroup
+}
+
+func (s *HandlersSuite) SetupTest() {
+	util.Logger.Out = ioutil.Discard
+	secInterface := logic.NewMockSectionInterface(2)
+	secInterface.Initialize()
+	sections := logic.Sections{logic.NewSection(0, "sec 0", 0), logic.NewSection(1, "sec 1", 1)}.Pointers()
+	// changes made by requests are saved in memory instead of to the config file
+	store, err := storage.OpenSQLite(":memory:")
+	s.Require().NoError(err)
+	s.config = &config.ConfigData{SectionInterface: secInterface, Sections: sections, Store: store}
+	s.config.Programs = []*logic.Program{logic.NewProgram("prog", []logic.ProgItem{
+		{Sec: s.config.Sections[0], Duration: time.Minute},
+	}, sched.Schedule{}, false)}
+	s.secRunner = logic.NewSectionRunner(secInterface)
+	s.secRunner.Start(&s.wait)
+	s.config.StartPrograms(s.secRunner, &s.wait)
+	s.handlers = NewHandlers(s.config, s.secRunner)
+}
+
+func (s *HandlersSuite) TearDownTest() {
+	s.config.QuitPrograms()
+	s.secRunner.Quit()
+	s.wait.Wait()
+	s.config.Store.Close()
+}
+
+func (s *HandlersSuite) handle(requestType string, data string) (Response, error) {
+	res := make(Response)
+	err := s.handlers.Handle(requestType, "", []byte(data), res)
+	return res, err
+}
+
+// saved loads what has been saved to the Store
+func (s *HandlersSuite) saved() *storage.Data {
+	data, err := s.config.Store.Load()
+	s.Require().NoError(err)
+	return data
+}
+
+func (s *HandlersSuite) TestSections() {
+	ass, req := s.Assert(), s.Require()
+	res, err := s.handle("runSection", `{"sectionId": 1, "duration": 60}`)
+	req.NoError(err)
+	ass.Equal("running section 'sec 1' for 1m0s", res["message"])
+	ass.Equal(int32(0), res["runId"])
+	time.Sleep(10 * time.Millisecond)
+
+	res, err = s.handle("getSection", `{"sectionId": 1}`)
+	req.NoError(err)
+	sec := res["data"].(datamodel.SectionStateJSON)
+	ass.Equal("sec 1", sec.Name)
+	ass.True(sec.State)
+
+	res, err = s.handle("getSections", `{}`)
+	req.NoError(err)
+	ass.Len(res["data"], 2)
+
+	res, err = s.handle("getSectionRunner", `{}`)
+	req.NoError(err)
+	state := res["data"].(datamodel.SRStateJSON)
+	req.NotNil(state.Current)
+	ass.Equal(1, state.Current.Section)
+
+	_, err = s.handle("cancelSection", `{"sectionId": 1}`)
+	req.NoError(err)
+	time.Sleep(10 * time.Millisecond)
+	ass.False(s.config.Sections[1].GetState(s.config.SectionInterface))
+
+	_, err = s.handle("runSection", `{"sectionId": 2, "duration": 60}`)
+	ass.Error(err)
+	_, err = s.handle("runSection", `{"duration": 60}`)
+	ass.Error(err)
+}
+
+func (s *HandlersSuite) TestManageSections() {
+	ass, req := s.Assert(), s.Require()
+	res, err := s.handle("createSection", `{"data": {"name": "sec 2", "interfaceId": 1}}`)
+	req.NoError(err)
+	ass.Equal("created section 'sec 2'", res["message"])
+	ass.Equal(2, res["data"].(datamodel.SectionStateJSON).ID)
+	_, err = s.handle("createSection", `{"data": {"name": "sec 3", "interfaceId": 2}}`)
+	ass.Equal(util.ErrorCode(util.EC_Range), err.(*util.Error).Code)
+	_, err = s.handle("createSection", `{"data": {"interfaceId": 0}}`)
+	ass.Equal(util.ErrorCode(util.EC_InvalidData), err.(*util.Error).Code)
+
+	res, err = s.handle("updateSection", `{"sectionId": 2, "data": {"name": "renamed", "maxRunTime": 30}}`)
+	req.NoError(err)
+	ass.Equal("updated section 'renamed'", res["message"])
+	ass.Equal(30.0, s.config.Sections[2].MaxRunTime)
+	saved := s.saved()
+	req.Len(saved.Sections, 3, "the created section should be saved")
+	ass.Equal("renamed", saved.Sections[2].Name, "the updated section should be saved")
+	_, err = s.handle("updateSection", `{"sectionId": 2, "data": {"maxRunTime": -1}}`)
+	ass.Error(err)
+	_, err = s.handle("updateSection", `{"sectionId": 2, "data": {"interfaceId": 0}}`)
+	req.NoError(err)
+	ass.Equal(logic.SectionID(0), s.config.Sections[2].InterfaceID)
+
+	sec1 := s.config.Sections[1]
+	_, err = s.handle("runSection", `{"sectionId": 1, "duration": 60}`)
+	req.NoError(err)
+	time.Sleep(10 * time.Millisecond)
+	_, err = s.handle("updateSection", `{"sectionId": 1, "data": {"interfaceId": 0}}`)
+	ass.Error(err, "the interface id can not be changed while the section is on")
+
+	_, err = s.handle("deleteSection", `{"sectionId": 0}`)
+	ass.Equal(util.ErrorCode(util.EC_InvalidData), err.(*util.Error).Code)
+	ass.Contains(err.Error(), "'prog'")
+	res, err = s.handle("deleteSection", `{"sectionId": 0, "removeFromPrograms": true}`)
+	req.NoError(err)
+	ass.Equal("deleted section 'sec 0'", res["message"])
+	sections := s.config.SectionList()
+	req.Len(sections, 2)
+	ass.Equal(1, sections[0].ID, "the other sections keep their ids")
+	ass.Same(sec1, sections[0], "the other sections keep their addresses")
+	_, err = s.handle("runSection", `{"sectionId": 0, "duration": 60}`)
+	ass.Equal(util.ErrorCode(util.EC_Range), err.(*util.Error).Code)
+	ass.Empty(s.config.Programs[0].Sequence)
+	saved = s.saved()
+	ass.Len(saved.Sections, 2, "the deleted section should be removed from the saved sections")
+	req.Len(saved.Programs, 1)
+	ass.Empty(saved.Programs[0].Sequence, "the program it was removed from should be saved")
+
+	// the run of the other section is kept, so it can still be cancelled
+	time.Sleep(10 * time.Millisecond)
+	s.secRunner.State.Lock()
+	req.NotNil(s.secRunner.State.Current)
+	ass.Same(sec1, s.secRunner.State.Current.Sec)
+	s.secRunner.State.Unlock()
+	_, err = s.handle("cancelSection", `{"sectionId": 1}`)
+	req.NoError(err)
+	time.Sleep(10 * time.Millisecond)
+	ass.False(sections[0].GetState(s.config.SectionInterface))
+
+	// the id of a deleted section is not given to a new one
+	_, err = s.handle("deleteSection", `{"sectionId": 2}`)
+	req.NoError(err)
+	res, err = s.handle("createSection", `{"data": {"name": "sec 3", "interfaceId": 1}}`)
+	req.NoError(err)
+	ass.Equal(3, res["data"].(datamodel.SectionStateJSON).ID)
+}
+
+func (s *HandlersSuite) TestSectionRunner() {
+	ass, req := s.Assert(), s.Require()
+	res, err := s.handle("pauseSectionRunner", `{"paused": true}`)
+	req.NoError(err)
+	ass.Equal("paused section runner", res["message"])
+	time.Sleep(10 * time.Millisecond)
+	res, _ = s.handle("getSectionRunner", `{}`)
+	ass.True(res["data"].(datamodel.SRStateJSON).Paused)
+
+	_, err = s.handle("runSection", `{"sectionId": 0, "duration": 60}`)
+	req.NoError(err)
+	_, err = s.handle("cancelSectionRunId", `{"runId": 0}`)
+	req.NoError(err)
+	_, err = s.handle("cancelAllSectionRuns", `{}`)
+	req.NoError(err)
+	_, err = s.handle("pauseSectionRunner", `{"paused": false}`)
+	req.NoError(err)
+
+	_, err = s.handle("pauseSectionRunner", `{}`)
+	ass.Error(err)
+	_, err = s.handle("cancelSectionRunId", `{}`)
+	ass.Error(err)
+}
+
+func (s *HandlersSuite) TestPrograms() {
+	ass, req := s.Assert(), s.Require()
+	res, err := s.handle("updateProgram", `{"programId": 0, "data": {"name": "renamed", "enabled": true}}`)
+	req.NoError(err)
+	ass.Equal("updated program 'renamed'", res["message"])
+	saved := s.saved()
+	req.Len(saved.Programs, 1)
+	ass.Equal("renamed", *saved.Programs[0].Name, "the updated program should be saved")
+
+	res, err = s.handle("getProgram", `{"programId": 0}`)
+	req.NoError(err)
+	prog := res["data"].(datamodel.ProgramStateJSON)
+	ass.Equal("renamed", *prog.Name)
+	ass.True(*prog.Enabled)
+	ass.False(prog.Running)
+
+	_, err = s.handle("runProgram", `{"programId": 0}`)
+	req.NoError(err)
+	time.Sleep(10 * time.Millisecond)
+	res, err = s.handle("getPrograms", `{}`)
+	req.NoError(err)
+	ass.True(res["data"].([]datamodel.ProgramStateJSON)[0].Running)
+	_, err = s.handle("cancelProgram", `{"programId": 0}`)
+	req.NoError(err)
+
+	_, err = s.handle("runProgram", `{"programId": 1}`)
+	ass.Error(err)
+	_, err = s.handle("updateProgram", `{"programId": 0, "data": {"sequence": [{"section": 5}]}}`)
+	ass.Error(err)
+}
+
+func (s *HandlersSuite) TestManagePrograms() {
+	ass, req := s.Assert(), s.Require()
+	events := logic.NewEventBus()
+	s.config.SetEventBus(events)
+	updates := events.Subscribe("test", 10, logic.DropNewest)
+	defer updates.Close()
+
+	res, err := s.handle("createProgram", `{"data": {"name": "new", "sequence": [{"section": 1, "duration": 60}]}}`)
+	req.NoError(err)
+	ass.Equal("created program 'new'", res["message"])
+	ass.Equal(1, res["data"].(datamodel.ProgramJSON).ID)
+	ass.Equal(logic.ProgramsUpdate{}, <-updates.C)
+	ass.Len(s.saved().Programs, 2, "the created program should be saved")
+
+	// the new program has been started
+	_, err = s.handle("runProgram", `{"programId": 1}`)
+	req.NoError(err)
+	time.Sleep(10 * time.Millisecond)
+	ass.True(s.config.Sections[1].GetState(s.config.SectionInterface))
+	_, err = s.handle("cancelProgram", `{"programId": 1}`)
+	req.NoError(err)
+
+	res, err = s.handle("duplicateProgram", `{"programId": 0}`)
+	req.NoError(err)
+	ass.Equal("duplicated program 'prog' as 'prog (copy)'", res["message"])
+	res, err = s.handle("duplicateProgram", `{"programId": 0, "name": "other"}`)
+	req.NoError(err)
+	ass.Equal(3, res["data"].(datamodel.ProgramJSON).ID)
+
+	res, err = s.handle("reorderProgram", `{"programId": 3, "position": 0}`)
+	req.NoError(err)
+	ass.Equal("moved program 'other' to position 0", res["message"])
+	names := func() (names []string, ids []int) {
+		for _, prog := range s.config.ProgramList() {
+			names, ids = append(names, prog.Name), append(ids, prog.ID)
+		}
+		return
+	}
+	// programs keep their ids when they are moved
+	programNames, ids := names()
+	ass.Equal([]string{"other", "prog", "new", "prog (copy)"}, programNames)
+	ass.Equal([]int{3, 0, 1, 2}, ids)
+	saved := s.saved()
+	req.Len(saved.Programs, 4)
+	ass.Equal("other", *saved.Programs[0].Name, "the order of the programs should be saved")
+
+	res, err = s.handle("deleteProgram", `{"programId": 0}`)
+	req.NoError(err)
+	ass.Equal("deleted program 'prog'", res["message"])
+	programNames, ids = names()
+	ass.Equal([]string{"other", "new", "prog (copy)"}, programNames)
+	ass.Equal([]int{3, 1, 2}, ids)
+
+	// a new program gets an id which has not been used
+	res, err = s.handle("createProgram", `{"data": {"name": "newer", "sequence": []}}`)
+	req.NoError(err)
+	ass.Equal(4, res["data"].(datamodel.ProgramJSON).ID)
+	_, err = s.handle("deleteProgram", `{"programId": 4}`)
+	req.NoError(err)
+	// even when it was the highest id
+	res, err = s.handle("createProgram", `{"data": {"name": "newest", "sequence": []}}`)
+	req.NoError(err)
+	ass.Equal(5, res["data"].(datamodel.ProgramJSON).ID)
+	_, err = s.handle("deleteProgram", `{"programId": 5}`)
+	req.NoError(err)
+
+	for request, data := range map[string]string{
+		"createProgram":    `{"data": {"sequence": []}}`,
+		"deleteProgram":    `{"programId": 0}`,
+		"reorderProgram":   `{"programId": 3, "position": 3}`,
+		"duplicateProgram": `{}`,
+	} {
+		_, err = s.handle(request, data)
+		ass.Error(err, request)
+	}
+	_, err = s.handle("createProgram", `{"data": {"name": "bad", "sequence": [{"section": 5}]}}`)
+	ass.Equal(util.ErrorCode(util.EC_InvalidData), err.(*util.Error).Code)
+	ass.Len(s.config.ProgramList(), 3)
+}
+
+func (s *HandlersSuite) TestHistory() {
+	ass, req := s.Assert(), s.Require()
+	_, err := s.handle("getHistory", `{"period": "day"}`)
+	ass.Error(err, "history is not enabled")
+
+	s.handlers.SetHistory(history.New(&memoryStore{}))
+	res, err := s.handle("getHistory", `{"period": "week", "count": 2}`)
+	req.NoError(err)
+	ass.Len(res["data"], 2)
+
+	for _, data := range []string{`{}`, `{"period": "year"}`, `{"period": "day", "count": 0}`} {
+		_, err = s.handle("getHistory", data)
+		ass.Error(err, data)
+	}
+}
+
+func (s *HandlersSuite) TestErrors() {
+	ass := s.Assert()
+	_, err := s.handle("unknown", `{}`)
+	ass.Equal(util.ErrorCode(util.EC_NotImplemented), err.(*util.Error).Code)
+
+	res, err := s.handle("runProgram", `{`)
+	uerr := res.SetResult(err)
+	ass.Equal(util.ErrorCode(util.EC_Parse), uerr.Code)
+	ass.Equal("error", res["result"])
+	ass.Equal("runProgram request", res["name"])
+	ass.Contains(res, "cause")
+	ass.Contains(res, "offset")
+
+	res, _ = s.handle("runProgram", `{"programId": 0}`)
+	ass.Nil(res.SetResult(nil))
+	ass.Equal("success", res["result"])
+}
+
+func (s *HandlersSuite) TestTokens() {
+	ass := s.Assert()
+	s.config.Tokens = []config.TokenJSON{{Token: "v"}, {Token: "o", Role: config.RoleOperator}}
+	res := make(Response)
+	ass.Error(s.handlers.Handle("getSections", "", nil, res), "requests need a token")
+	ass.Error(s.handlers.Handle("getSections", "x", nil, res), "requests need a valid token")
+	ass.Error(s.handlers.Handle("runProgram", "v", []byte(`{"programId": 0}`), res), "viewers can not run programs")
+	ass.False(s.config.Programs[0].Running())
+	ass.NoError(s.handlers.Handle("getSections", "v", nil, res))
+	ass.NoError(s.handlers.Handle("cancelProgram", "o", []byte(`{"programId": 0}`), res))
+	ass.Error(s.handlers.Handle("unknown", "o", nil, res), "unknown requests are not implemented")
+}
+
+func TestHandlers(t *testing.T) {
+	suite.Run(t, new(HandlersSuite))
+}
+
+func TestAuthorize(t *testing.T) {
+	ass := assert.New(t)
+	code := func(err error) util.ErrorCode {
+		if err == nil {
+			return 0
+		}
+		return err.(*util.Error).Code
+	}
+
+	// without tokens, everything is allowed
+	match, err := Authorize(nil, "deleteProgram", "")
+	ass.NoError(err)
+	ass.Nil(match)
+
+	tokens := []config.TokenJSON{
+		{Name: "display", Token: "v", Role: config.RoleViewer},
+		{Name: "phone", Token: "o", Role: config.RoleOperator},
+		{Name: "laptop", Token: "a", Role: config.RoleAdmin},
+	}
+	for _, c := range []struct {
+		request, token string
+		code           util.ErrorCode
+	}{
+		{"getSections", "v", 0},
+		{"runSection", "v", util.EC_NoPermission},
+		{"runSection", "o", 0},
+		{"pauseSectionRunner", "o", 0},
+		{"updateProgram", "o", util.EC_NoPermission},
+		{"deleteSection", "a", 0},
+		{"unknown", "o", util.EC_NoPermission},
+		{"getSections", "", util.EC_Unauthorized},
+		{"getSections", "x", util.EC_Unauthorized},
+	} {
+		_, err = Authorize(tokens, c.request, c.token)
+		ass.Equal(c.code, code(err), "%s with %q", c.request, c.token)
+	}
+	match, err = Authorize(tokens, "runProgram", "a")
+	ass.NoError(err)
+	ass.Equal("laptop", match.Name)
+	_, err = Authorize(tokens, "createProgram", "v")
+	ass.EqualError(err, "createProgram requests need the admin role, but the token has the viewer role")
+}
+
+type memoryStore struct {
+	entries []datamodel.RunRecordJSON
+}
+
+func (m *memoryStore) Append(entry datamodel.RunRecordJSON) error {
+	m.entries = append(m.entries, entry)
+	return nil
+}
+
+func (m *memoryStore) Entries(since time.Time) ([]datamodel.RunRecordJSON, error) {
+	return m.entries, nil
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+
+	"git.amikhalev.com/amikhalev/grinklers/config"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/Sirupsen/logrus"
+)
+
+var log = util.Logger.WithField("module", "api")
+
+// requiredRoles are the roles needed to make each type of request. Request types which are not listed need
+// config.RoleAdmin.
+var requiredRoles = map[string]config.Role{
+	"getSections":          config.RoleViewer,
+	"getSection":           config.RoleViewer,
+	"getPrograms":          config.RoleViewer,
+	"getProgram":           config.RoleViewer,
+	"getSectionRunner":     config.RoleViewer,
+	"getHistory":           config.RoleViewer,
+	"runProgram":           config.RoleOperator,
+	"cancelProgram":        config.RoleOperator,
+	"runSection":           config.RoleOperator,
+	"cancelSection":        config.RoleOperator,
+	"cancelSectionRunId":   config.RoleOperator,
+	"cancelAllSectionRuns": config.RoleOperator,
+	"pauseSectionRunner":   config.RoleOperator,
+}
+
+// RequiredRole gets the role needed to make a request of requestType
+func RequiredRole(requestType string) config.Role {
+	role, ok := requiredRoles[requestType]
+	if !ok {
+		return config.RoleAdmin
+	}
+	return role
+}
+
+// Authorize checks that token is one of tokens and that its role allows requests of requestType, returning the
+// matching token. If there are no tokens, every request is allowed and nil is returned.
+func Authorize(tokens []config.TokenJSON, requestType, token string) (match *config.TokenJSON, err error) {
+	if len(tokens) == 0 {
+		return
+	}
+	if token == "" {
+		return nil, util.NewError(util.EC_Unauthorized, "a token is required")
+	}
+	for i := range tokens {
+		// the comparison takes the same time wherever the tokens differ, so tokens can not be guessed from it
+		if subtle.ConstantTimeCompare([]byte(tokens[i].Token), []byte(token)) == 1 {
+			match = &tokens[i]
+		}
+	}
+	if match == nil {
+		return nil, util.NewError(util.EC_Unauthorized, "invalid token")
+	}
+	if required := RequiredRole(requestType); match.Role < required {
+		err = util.NewError(util.EC_NoPermission,
+			fmt.Sprintf("%s requests need the %s role, but the token has the %s role", requestType, required, match.Role))
+	}
+	return
+}
+
+// Authorize checks that requests of requestType can be made with token, using the configured tokens
+func (h *Handlers) Authorize(requestType, token string) (err error) {
+	match, err := Authorize(h.config.TokenList(), requestType, token)
+	if match != nil {
+		log.WithFields(logrus.Fields{"token": match.Name, "type": requestType}).Debug("authorized request")
+	}
+	return
+}
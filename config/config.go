@@ -1,84 +1,545 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"git.amikhalev.com/amikhalev/grinklers/http"
 
 	"git.amikhalev.com/amikhalev/grinklers/datamodel"
+	"git.amikhalev.com/amikhalev/grinklers/history"
 	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/persist"
+	"git.amikhalev.com/amikhalev/grinklers/remote"
+	"git.amikhalev.com/amikhalev/grinklers/storage"
 	"git.amikhalev.com/amikhalev/grinklers/util"
+	"git.amikhalev.com/amikhalev/grinklers/watchdog"
 	rpio "github.com/stianeikeland/go-rpio"
 )
 
 // ConfigData is the app state after being read from config
 type ConfigData struct {
-	Pins             []uint16
+	InterfaceConfig  SectionInterfaceJSON
 	SectionInterface logic.SectionInterface
-	Sections         []logic.Section
+	Sections         []*logic.Section
 	Programs         []*logic.Program
 	HTTPConfig       *http.Config
 	DeviceData       *http.DeviceData
+	MQTT             *MQTTJSON
+	REST             *RESTJSON
+	Tokens           []TokenJSON
+	MaxRunTime       time.Duration
+	Watchdog         *WatchdogJSON
+	Persist          *persist.Config
+	History          *history.Config
+	Storage          *storage.Config
+	// Store is where sections, programs and device data are saved, or nil if they are saved in the config file
+	Store storage.Store
+	// events, secRunner and wait are what programs which are added at runtime are set up with
+	events    *logic.EventBus
+	secRunner *logic.SectionRunner
+	wait      *sync.WaitGroup
+	// options override the config file when it is reloaded
+	options *Options
+	// nextSectionID and nextProgramID are the ids of the next section and program which are created, guarded by
+	// sectionsMutex and programsMutex. They only ever increase, so an id is never given to another section or
+	// program after it is deleted.
+	nextSectionID int
+	nextProgramID int
+}
+
+// SetEventBus makes all sections and programs publish their updates on events
+func (c *ConfigData) SetEventBus(events *logic.EventBus) {
+	c.events = events
+	for _, sec := range c.Sections {
+		sec.SetEventBus(events)
+	}
+	for _, prog := range c.Programs {
+		prog.SetEventBus(events)
+	}
+	if reporter, ok := c.SectionInterface.(logic.FaultReporter); ok {
+		// the fault of a section is part of its state
+		reporter.OnFaultChange(func() {
+			for _, sec := range c.SectionList() {
+				sec.OnUpdate(logic.SecUpdateState)
+			}
+		})
+	}
 }
 
 // ToJSON converts a ConfigData to a ConfigDataJSON
 func (c *ConfigData) ToJSON() (j ConfigDataJSON) {
 	j = ConfigDataJSON{}
-	j.SectionInterface = SectionInterfaceJSON{Pins: c.Pins}
-	j.Sections = c.Sections
-	j.Programs = datamodel.ProgramsToJSON(c.Programs)
+	j.Version = ConfigVersion
+	j.SectionInterface = c.InterfaceConfig
+	j.Sections = logic.Snapshots(c.SectionList())
+	j.Programs = datamodel.ProgramsToJSON(c.ProgramList())
+	j.NextSectionID, j.NextProgramID = c.nextIDs()
 	j.HTTPConfig = c.HTTPConfig
 	j.DeviceData = c.DeviceData
+	j.MQTT = c.MQTT
+	j.REST = c.REST
+	j.Tokens = c.TokenList()
+	j.MaxRunTime = c.MaxRunTime.Seconds()
+	j.Watchdog = c.Watchdog
+	j.Persist = c.Persist
+	j.History = c.History
+	j.Storage = c.Storage
+	return
+}
+
+// WatchdogJSON is the JSON configuration of the hardware watchdog
+type WatchdogJSON struct {
+	// Device is the path of the watchdog device. Defaults to watchdog.DefaultDevice
+	Device string `json:"device,omitempty"`
+	// Interval is how often to pet the watchdog in seconds. Defaults to 5
+	Interval float64 `json:"interval,omitempty"`
+	// StaleTimeout is how long in seconds the SectionRunner may go without a heartbeat before the
+	// watchdog is no longer petted. Defaults to 10
+	StaleTimeout float64 `json:"staleTimeout,omitempty"`
+}
+
+// ToWatchdog creates the Watchdog described by this configuration, which monitors heartbeat
+func (wj *WatchdogJSON) ToWatchdog(heartbeat watchdog.Heartbeat) *watchdog.Watchdog {
+	device, interval, stale := wj.Device, 5*time.Second, 10*time.Second
+	if device == "" {
+		device = watchdog.DefaultDevice
+	}
+	if wj.Interval > 0 {
+		interval = time.Duration(wj.Interval * float64(time.Second))
+	}
+	if wj.StaleTimeout > 0 {
+		stale = time.Duration(wj.StaleTimeout * float64(time.Second))
+	}
+	return watchdog.New(device, heartbeat, interval, stale)
+}
+
+// MQTTJSON is the configuration of an MQTT broker to connect to directly, without registering the device with
+// the sprinklers API
+type MQTTJSON struct {
+	// URL is the url of the broker, such as tcp://localhost:1883
+	URL      string `json:"url"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// DeviceID is used in the prefix of the topics, device/<DeviceID>. Defaults to "grinklers"
+	DeviceID string `json:"deviceId,omitempty"`
+	// ClientID is the MQTT client id. Defaults to the DeviceID
+	ClientID string `json:"clientId,omitempty"`
+	// HomeAssistant enables Home Assistant MQTT discovery if it is set
+	HomeAssistant *HomeAssistantJSON `json:"homeAssistant,omitempty"`
+	// V5 makes api requests be received over a second connection to the broker with MQTT 5, so that responses
+	// are published to the response topic of each request along with its correlation data. The broker must
+	// support MQTT 5.
+	V5 bool `json:"v5,omitempty"`
+	// TLS configures the certificates used to connect to the broker with an mqtts url
+	TLS *MQTTTLSJSON `json:"tls,omitempty"`
+}
+
+// Validate checks that the MQTT configuration is valid
+func (mj *MQTTJSON) Validate() (err error) {
+	if mj.URL == "" {
+		return util.NewNotSpecifiedError("mqtt url")
+	}
+	brokerURL, err := util.ParseBrokerURL(mj.URL)
+	if err != nil {
+		return
+	}
+	if mj.TLS != nil {
+		if brokerURL.Scheme != "ssl" {
+			return util.NewInvalidDataError("mqtt url", fmt.Errorf("tls requires an mqtts or ssl url"))
+		}
+		if err = mj.TLS.Validate(); err != nil {
+			return
+		}
+	}
+	if mj.HomeAssistant != nil {
+		if err = mj.HomeAssistant.Validate(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// MQTTTLSJSON is the TLS configuration of the connection to the broker. The files are reloaded when they change,
+// and used from the next time the broker is connected to.
+type MQTTTLSJSON struct {
+	// CAFile is a PEM bundle of the CAs the certificate of the broker is verified with. Defaults to the system CAs
+	CAFile string `json:"caFile,omitempty"`
+	// CertFile and KeyFile are the PEM client certificate and key to authenticate to the broker with
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// ServerName is the name the certificate of the broker is verified for. Defaults to the host of the url
+	ServerName string `json:"serverName,omitempty"`
+	// Pins are base64 SHA-256 hashes of public keys. If there are any, the certificate of the broker must have
+	// one of them.
+	Pins []string `json:"pins,omitempty"`
+}
+
+// Validate checks that the TLS configuration is valid
+func (tj *MQTTTLSJSON) Validate() (err error) {
+	if (tj.CertFile == "") != (tj.KeyFile == "") {
+		return util.NewInvalidDataError("mqtt tls", fmt.Errorf("certFile and keyFile must be set together"))
+	}
+	for _, pin := range tj.Pins {
+		if _, err = tj.decodePin(pin); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (tj *MQTTTLSJSON) decodePin(pin string) (hash []byte, err error) {
+	hash, err = base64.StdEncoding.DecodeString(pin)
+	if err == nil && len(hash) != sha256.Size {
+		err = fmt.Errorf("not a sha256 hash")
+	}
+	if err != nil {
+		err = util.NewInvalidDataError("mqtt tls pin", fmt.Errorf("%q: %v", pin, err))
+	}
+	return
+}
+
+// PinHashes gets the decoded Pins. The pins must be valid.
+func (tj *MQTTTLSJSON) PinHashes() (hashes [][]byte) {
+	for _, pin := range tj.Pins {
+		hash, _ := tj.decodePin(pin)
+		hashes = append(hashes, hash)
+	}
+	return
+}
+
+// HomeAssistantJSON is the configuration of Home Assistant MQTT discovery
+type HomeAssistantJSON struct {
+	// DiscoveryPrefix is the prefix of the discovery topics. Defaults to "homeassistant"
+	DiscoveryPrefix string `json:"discoveryPrefix,omitempty"`
+	// DefaultDuration is the duration in seconds sections are run for when turned on, until it is set from
+	// Home Assistant. Defaults to 10 minutes
+	DefaultDuration float64 `json:"defaultDuration,omitempty"`
+	// Token is the token commands from Home Assistant are made with if tokens are configured. Without it, they
+	// are rejected.
+	Token string `json:"token,omitempty"`
+}
+
+// Validate checks that the Home Assistant configuration is valid
+func (hj *HomeAssistantJSON) Validate() (err error) {
+	if strings.ContainsAny(hj.DiscoveryPrefix, "+#") {
+		return util.NewInvalidDataError("home assistant discovery prefix",
+			fmt.Errorf("%q contains a wildcard", hj.DiscoveryPrefix))
+	}
+	if hj.DefaultDuration < 0 {
+		return util.NewInvalidDataError("home assistant default duration",
+			fmt.Errorf("%v is negative", hj.DefaultDuration))
+	}
 	return
 }
 
+// Prefix gets the discovery prefix, or the default if it is not set
+func (hj *HomeAssistantJSON) Prefix() string {
+	if hj.DiscoveryPrefix == "" {
+		return "homeassistant"
+	}
+	return hj.DiscoveryPrefix
+}
+
+// Duration gets the default duration sections are run for, or 10 minutes if it is not set
+func (hj *HomeAssistantJSON) Duration() time.Duration {
+	if hj.DefaultDuration == 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(hj.DefaultDuration * float64(time.Second))
+}
+
+// ToConnectData gets the ConnectData used to connect to the broker
+func (mj *MQTTJSON) ToConnectData() *http.ConnectData {
+	deviceID, clientID := mj.DeviceID, mj.ClientID
+	if deviceID == "" {
+		deviceID = "grinklers"
+	}
+	if clientID == "" {
+		clientID = deviceID
+	}
+	return &http.ConnectData{
+		DeviceToken: mj.Password,
+		Username:    mj.Username,
+		DeviceConnectResult: &http.DeviceConnectResult{
+			MqttURL: mj.URL, DeviceID: deviceID, ClientID: clientID,
+		},
+	}
+}
+
+// RESTJSON is the configuration of the REST API server
+type RESTJSON struct {
+	// Address is the address to listen on, such as ":8080" or "127.0.0.1:8080"
+	Address string `json:"address"`
+}
+
+// Validate checks that the REST API configuration is valid
+func (rj *RESTJSON) Validate() (err error) {
+	if rj.Address == "" {
+		return util.NewNotSpecifiedError("rest address")
+	}
+	if _, _, err = net.SplitHostPort(rj.Address); err != nil {
+		err = fmt.Errorf("invalid rest address: %v", err)
+	}
+	return
+}
+
+// RpioPinJSON is the JSON representation of a logic.RpioPin. It is either just the pin number, or an
+// object which can override the polarity and idle mode set for the whole interface
+type RpioPinJSON struct {
+	Pin       uint16              `json:"pin"`
+	ActiveLow *bool               `json:"activeLow,omitempty"`
+	IdleMode  *logic.RpioIdleMode `json:"idleMode,omitempty"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler for RpioPinJSON
+func (pj *RpioPinJSON) UnmarshalJSON(b []byte) (err error) {
+	var pin uint16
+	if err = json.Unmarshal(b, &pin); err == nil {
+		*pj = RpioPinJSON{Pin: pin}
+		return
+	}
+	type rpioPinJSON RpioPinJSON // so UnmarshalJSON is not called recursively
+	var p rpioPinJSON
+	if err = json.Unmarshal(b, &p); err != nil {
+		return
+	}
+	*pj = RpioPinJSON(p)
+	return
+}
+
+// MarshalJSON implements json.Marshaler for RpioPinJSON
+func (pj RpioPinJSON) MarshalJSON() ([]byte, error) {
+	if pj.ActiveLow == nil && pj.IdleMode == nil {
+		return json.Marshal(pj.Pin)
+	}
+	type rpioPinJSON RpioPinJSON
+	return json.Marshal(rpioPinJSON(pj))
+}
+
+// SectionInterfaceJSON is the JSON configuration of the SectionInterface
 type SectionInterfaceJSON struct {
-	Pins []uint16 `json:"pins"`
+	// Type is the type of the SectionInterface. One of "rpio" (the default), "mock", "mqtt" or "composite"
+	Type string `json:"type,omitempty"`
+
+	Pins []RpioPinJSON `json:"pins,omitempty"`
+	// ActiveLow is the default polarity for all pins
+	ActiveLow bool `json:"activeLow,omitempty"`
+	// IdleMode is the default idle mode for all pins
+	IdleMode logic.RpioIdleMode `json:"idleMode,omitempty"`
+
+	// Remote is the configuration of a remote node controlled over mqtt
+	Remote *remote.Config `json:"remote,omitempty"`
+
+	// Backends are the named backends of a composite interface
+	Backends map[string]*SectionInterfaceJSON `json:"backends,omitempty"`
+	// Channels maps each section of a composite interface to a backend channel
+	Channels []logic.CompositeChannel `json:"channels,omitempty"`
 }
 
-func (ij *SectionInterfaceJSON) ToInterface() logic.SectionInterface {
-	rpi := os.Getenv("RPI") == "true" // TODO: base this off go-config
-	if rpi {
-		pins := make(logic.RpioPins, len(ij.Pins))
-		for i, pin := range ij.Pins {
-			pins[i] = (rpio.Pin)(pin)
+// ToRpioPins converts the pin configuration to RpioPins, applying the interface defaults to each pin
+func (ij *SectionInterfaceJSON) ToRpioPins() logic.RpioPins {
+	pins := make(logic.RpioPins, len(ij.Pins))
+	for i, pj := range ij.Pins {
+		pin := logic.RpioPin{Pin: (rpio.Pin)(pj.Pin), ActiveLow: ij.ActiveLow, IdleMode: ij.IdleMode}
+		if pj.ActiveLow != nil {
+			pin.ActiveLow = *pj.ActiveLow
+		}
+		if pj.IdleMode != nil {
+			pin.IdleMode = *pj.IdleMode
+		}
+		pins[i] = pin
+	}
+	return pins
+}
+
+// ToInterface creates the SectionInterface described by this configuration. An rpio interface only drives the
+// GPIO pins if options say so, otherwise it is mocked. options may be nil.
+func (ij *SectionInterfaceJSON) ToInterface(options *Options) (secInterface logic.SectionInterface, err error) {
+	switch ij.Type {
+	case "", "rpio":
+		if options.rpi() {
+			secInterface = logic.NewRpioSectionInterface(ij.ToRpioPins())
+		} else {
+			secInterface = logic.NewMockSectionInterface(len(ij.Pins))
+		}
+	case "mock":
+		secInterface = logic.NewMockSectionInterface(len(ij.Pins))
+	case "mqtt":
+		if ij.Remote == nil {
+			err = fmt.Errorf("no remote specified for mqtt section interface")
+			return
 		}
-		return logic.NewRpioSectionInterface(pins)
-	} else {
-		return logic.NewMockSectionInterface(len(ij.Pins))
+		secInterface = remote.NewMQTTSectionInterface(*ij.Remote)
+	case "composite":
+		backends := make(map[string]logic.SectionInterface, len(ij.Backends))
+		for name, backendJSON := range ij.Backends {
+			if backendJSON == nil {
+				err = fmt.Errorf("backend '%s' not specified", name)
+				return
+			}
+			backends[name], err = backendJSON.ToInterface(options)
+			if err != nil {
+				err = fmt.Errorf("invalid backend '%s': %v", name, err)
+				return
+			}
+		}
+		secInterface, err = logic.NewCompositeSectionInterface(backends, ij.Channels)
+	default:
+		err = fmt.Errorf("unknown section interface type '%s'", ij.Type)
 	}
+	return
 }
 
 // ConfigDataJSON is the JSON form of config data
 type ConfigDataJSON struct {
-	SectionInterface SectionInterfaceJSON
-	Sections         logic.Sections         `json:"sections"`
-	Programs         datamodel.ProgramsJSON `json:"programs"`
-	HTTPConfig       *http.Config
-	DeviceData       *http.DeviceData
+	// Version is the version of the config file format, which is used to migrate older config files
+	Version          int                    `json:"version"`
+	SectionInterface SectionInterfaceJSON   `json:"sectionInterface"`
+	Sections         logic.Sections         `json:"sections,omitempty"`
+	Programs         datamodel.ProgramsJSON `json:"programs,omitempty"`
+	// NextSectionID and NextProgramID are the ids of the next section and program which are created. If they are
+	// not higher than every id in Sections and Programs, the ids after the highest ones are used.
+	NextSectionID int              `json:"nextSectionId,omitempty"`
+	NextProgramID int              `json:"nextProgramId,omitempty"`
+	HTTPConfig    *http.Config     `json:"http,omitempty"`
+	DeviceData    *http.DeviceData `json:"deviceData,omitempty"`
+	// MQTT configures connecting directly to an MQTT broker, without registering the device with the
+	// sprinklers API. Either it or HTTPConfig must be specified.
+	MQTT *MQTTJSON `json:"mqtt,omitempty"`
+	// REST configures serving the API over HTTP on the local network
+	REST *RESTJSON `json:"rest,omitempty"`
+	// Tokens are the tokens api requests and commands must be made with, over MQTT and REST. If there are none,
+	// anyone who can reach the api can make any request.
+	Tokens []TokenJSON `json:"tokens,omitempty"`
+	// MaxRunTime is the maximum time in seconds any section may be on at once, or 0 for no limit
+	MaxRunTime float64       `json:"maxRunTime,omitempty"`
+	Watchdog   *WatchdogJSON `json:"watchdog,omitempty"`
+	// Persist configures saving the section runner state so it can be resumed after a restart
+	Persist *persist.Config `json:"persist,omitempty"`
+	// History configures recording every section run to a file. It is not used if Storage is configured, in
+	// which case runs are recorded to the Store
+	History *history.Config `json:"history,omitempty"`
+	// Storage configures a Store which sections, programs, device data and history are saved to instead of
+	// the config file. When it is first opened, the sections, programs and device data are imported into it.
+	Storage *storage.Config `json:"storage,omitempty"`
+}
+
+// interfaceConfig gets the configuration of the SectionInterface, with its type overridden by options
+func (j *ConfigDataJSON) interfaceConfig(options *Options) *SectionInterfaceJSON {
+	ij := j.SectionInterface
+	interfaceType := options.interfaceType()
+	if interfaceType == "" || interfaceType == ij.Type {
+		return &ij
+	}
+	ij.Type = interfaceType
+	if interfaceType != "mock" {
+		return &ij
+	}
+	// an interface which is not configured with pins needs enough mock pins for every section
+	count := 0
+	for _, sec := range j.Sections {
+		if int(sec.InterfaceID) >= count {
+			count = int(sec.InterfaceID) + 1
+		}
+	}
+	for len(ij.Pins) < count {
+		ij.Pins = append(ij.Pins, RpioPinJSON{})
+	}
+	return &ij
 }
 
-// ToConfigData converts a ConfigDataJSON to a ConfigData
-func (j *ConfigDataJSON) ToConfigData() (c ConfigData, err error) {
+// ToConfigData converts a ConfigDataJSON to a ConfigData, with the section interface overridden by options.
+// options may be nil.
+func (j *ConfigDataJSON) ToConfigData(options *Options) (c ConfigData, err error) {
 	c = ConfigData{}
-	c.Pins = j.SectionInterface.Pins
-	c.SectionInterface = j.SectionInterface.ToInterface()
-	c.Sections = j.Sections
+	c.options = options
+	c.InterfaceConfig = j.SectionInterface
+	c.SectionInterface, err = j.interfaceConfig(options).ToInterface(options)
+	if err != nil {
+		err = fmt.Errorf("invalid section interface: %v", err)
+		return
+	}
+	ids := make(map[int]bool)
+	for _, sec := range j.Sections {
+		if ids[sec.ID] {
+			err = fmt.Errorf("invalid sections json: duplicate section id %d", sec.ID)
+			return
+		}
+		ids[sec.ID] = true
+	}
+	c.Sections = j.Sections.Pointers()
 	c.Programs, err = j.Programs.ToPrograms(c.Sections)
 	if err != nil {
 		err = fmt.Errorf("invalid programs json: %v", err)
 		return
 	}
-	if j.HTTPConfig == nil {
-		err = fmt.Errorf("no HTTPConfig specified")
+	c.nextSectionID, c.nextProgramID = j.NextSectionID, j.NextProgramID
+	for _, sec := range c.Sections {
+		if sec.ID >= c.nextSectionID {
+			c.nextSectionID = sec.ID + 1
+		}
+	}
+	for _, prog := range c.Programs {
+		if prog.ID >= c.nextProgramID {
+			c.nextProgramID = prog.ID + 1
+		}
+	}
+	if j.MQTT != nil {
+		if err = j.MQTT.Validate(); err != nil {
+			err = fmt.Errorf("invalid mqtt config: %v", err)
+			return
+		}
+	} else if j.HTTPConfig == nil {
+		err = fmt.Errorf("no http or mqtt config specified")
 		return
 	}
 	c.HTTPConfig = j.HTTPConfig
+	c.MQTT = j.MQTT
+	if j.REST != nil {
+		if err = j.REST.Validate(); err != nil {
+			err = fmt.Errorf("invalid rest config: %v", err)
+			return
+		}
+	}
+	c.REST = j.REST
+	if err = validateTokens(j.Tokens); err != nil {
+		err = fmt.Errorf("invalid tokens: %v", err)
+		return
+	}
+	c.Tokens = j.Tokens
 	c.DeviceData = j.DeviceData
+	c.MaxRunTime = time.Duration(j.MaxRunTime * float64(time.Second))
+	c.Watchdog = j.Watchdog
+	if j.Persist != nil {
+		if err = j.Persist.Validate(); err != nil {
+			err = fmt.Errorf("invalid persist config: %v", err)
+			return
+		}
+	}
+	c.Persist = j.Persist
+	if j.History != nil {
+		if err = j.History.Validate(); err != nil {
+			err = fmt.Errorf("invalid history config: %v", err)
+			return
+		}
+	}
+	c.History = j.History
+	if j.Storage != nil {
+		if err = j.Storage.Validate(); err != nil {
+			err = fmt.Errorf("invalid storage config: %v", err)
+			return
+		}
+	}
+	c.Storage = j.Storage
 	return
 }
 
@@ -95,26 +556,146 @@ var log = util.Logger.WithField("module", "config")
 var configFile = findConfigFile()
 var configMutex = &sync.Mutex{}
 
-// LoadConfig loads a ConfigData from the config file
-func LoadConfig() (config ConfigData, err error) {
+// LoadConfig loads a ConfigData from the config file, with the section interface overridden by options. options
+// may be nil.
+func LoadConfig(options *Options) (config ConfigData, err error) {
 	configMutex.Lock()
 	defer configMutex.Unlock()
 
-	var j ConfigDataJSON
-
 	log.Debugf("loading config from %v", configFile)
-	file, err := ioutil.ReadFile(configFile)
+	contents, err := ioutil.ReadFile(configFile)
 	if err != nil {
 		err = fmt.Errorf("could not read config file: %v", err)
 		return
 	}
-	err = json.Unmarshal(file, &j)
+	j, err := parseConfig(contents)
+	if err != nil {
+		return
+	}
+
+	var store storage.Store
+	if j.Storage != nil {
+		if store, err = loadFromStore(&j); err != nil {
+			return
+		}
+	}
+	config, err = j.ToConfigData(options)
+	if err != nil {
+		if store != nil {
+			store.Close()
+		}
+		return
+	}
+	config.Store = store
+	lastContents = contents
+	return
+}
+
+// loadFromStore opens the Store configured in j and replaces the sections, programs and device data in j with
+// the ones in the Store. If the Store is empty, the ones in j are imported into it first.
+func loadFromStore(j *ConfigDataJSON) (store storage.Store, err error) {
+	store, err = j.Storage.Open()
+	if err != nil {
+		err = fmt.Errorf("could not open storage: %v", err)
+		return
+	}
+	defer func() {
+		if err != nil {
+			store.Close()
+			store = nil
+		}
+	}()
+	empty, err := store.Empty()
+	if err != nil {
+		err = fmt.Errorf("could not read storage: %v", err)
+		return
+	}
+	if empty {
+		log.Info("importing sections, programs and device data from config file into storage")
+		if err = store.Import(&storage.Data{
+			Sections: j.Sections, Programs: j.Programs, DeviceData: j.DeviceData,
+			NextSectionID: j.NextSectionID, NextProgramID: j.NextProgramID,
+		}); err != nil {
+			return
+		}
+	}
+	data, err := store.Load()
 	if err != nil {
-		err = fmt.Errorf("could not parse config file: %v", err)
+		err = fmt.Errorf("could not read storage: %v", err)
 		return
 	}
+	j.Sections, j.Programs, j.DeviceData = data.Sections, data.Programs, data.DeviceData
+	j.NextSectionID, j.NextProgramID = data.NextSectionID, data.NextProgramID
+	return
+}
+
+// SaveSection saves the data of sec to the Store if there is one, or otherwise writes the config file
+func SaveSection(configData *ConfigData, sec *logic.Section) error {
+	if configData.Store != nil {
+		return configData.Store.SaveSection(sec)
+	}
+	return WriteConfig(configData)
+}
+
+// SaveProgram saves the data of prog to the Store if there is one, or otherwise writes the config file
+func SaveProgram(configData *ConfigData, prog *logic.Program) error {
+	if configData.Store != nil {
+		data := datamodel.ProgramToJSON(prog)
+		return configData.Store.SaveProgram(&data)
+	}
+	return WriteConfig(configData)
+}
+
+// SaveSections saves all sections to the Store if there is one, or otherwise writes the config file. It is used
+// when sections are added or removed.
+func SaveSections(configData *ConfigData) error {
+	if configData.Store != nil {
+		return configData.Store.SaveSections(logic.Snapshots(configData.SectionList()))
+	}
+	return WriteConfig(configData)
+}
+
+// SavePrograms saves all programs to the Store if there is one, or otherwise writes the config file. It is used
+// when programs are added, removed or reordered.
+func SavePrograms(configData *ConfigData) error {
+	if configData.Store != nil {
+		return configData.Store.SavePrograms(datamodel.ProgramsToJSON(configData.ProgramList()))
+	}
+	return WriteConfig(configData)
+}
 
-	config, err = j.ToConfigData()
+// CheckConfig checks that the config file is valid, without opening the Store or initializing anything, and
+// returns it normalized to the latest version. The section interface is overridden by options, which may be nil.
+func CheckConfig(options *Options) (normalized []byte, err error) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	j, err := readConfigFile(configFile)
+	if err != nil {
+		return
+	}
+	configData, err := j.ToConfigData(options)
+	if err != nil {
+		return
+	}
+	data := configData.ToJSON()
+	return json.MarshalIndent(&data, "", "  ")
+}
+
+// ExportConfig writes configData to path as a config file which does not use a Store, with all of the
+// sections, programs and device data in it
+func ExportConfig(configData *ConfigData, path string) (err error) {
+	data := configData.ToJSON()
+	data.Storage = nil
+	bytes, err := json.MarshalIndent(&data, "", "  ")
+	if err != nil {
+		err = fmt.Errorf("could not marshal config: %v", err)
+		return
+	}
+	err = util.WriteFileAtomic(path, bytes, 0644)
+	if err != nil {
+		err = fmt.Errorf("could not write exported config: %v", err)
+	}
 	return
 }
 
@@ -128,16 +709,25 @@ func WriteConfig(configData *ConfigData) (err error) {
 	if err != nil {
 		err = fmt.Errorf("invalid config data: %v", err)
 	}
+	if configData.Store != nil {
+		// only the static configuration is kept in the config file
+		if err = configData.Store.SaveDeviceData(configData.DeviceData); err != nil {
+			err = fmt.Errorf("could not save device data: %v", err)
+			return
+		}
+		data.Sections, data.Programs, data.DeviceData = nil, nil, nil
+		data.NextSectionID, data.NextProgramID = 0, 0
+	}
 
 	bytes, err := json.MarshalIndent(&data, "", "  ")
 	if err != nil {
-		err = fmt.Errorf("could not parse config file: %v", err)
+		err = fmt.Errorf("could not marshal config: %v", err)
 		return
 	}
 
-	err = ioutil.WriteFile(configFile, bytes, 0)
+	err = writeConfigFile(bytes)
 	if err != nil {
-		err = fmt.Errorf("could not read config file: %v", err)
+		err = fmt.Errorf("could not write config file: %v", err)
 		return
 	}
 	return
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"git.amikhalev.com/amikhalev/grinklers/util"
+)
+
+// Backups is how many backups of the config file are kept. Every time the config file is written, the
+// previous one becomes the most recent backup.
+var Backups = 5
+
+// BackupPath gets the path of the nth most recent backup of the config file, starting at 1
+func BackupPath(n int) string {
+	return fmt.Sprintf("%s.%d", configFile, n)
+}
+
+// readConfigFile reads and parses the config file at path
+func readConfigFile(path string) (j ConfigDataJSON, err error) {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("could not read config file: %v", err)
+		return
+	}
+	return parseConfig(file)
+}
+
+// parseConfig parses the contents of a config file, migrating it to ConfigVersion if it is older
+func parseConfig(contents []byte) (j ConfigDataJSON, err error) {
+	contents, err = migrateConfig(contents)
+	if err == nil {
+		err = json.Unmarshal(contents, &j)
+	}
+	if err != nil {
+		err = fmt.Errorf("could not parse config file: %v", err)
+	}
+	return
+}
+
+// checkConfigFile checks that the config file at path can be loaded
+func checkConfigFile(path string) (err error) {
+	j, err := readConfigFile(path)
+	if err != nil {
+		return
+	}
+	_, err = j.ToConfigData(nil)
+	return
+}
+
+// pendingBackupPath gets the path the current config file is backed up to while it is being replaced
+func pendingBackupPath() string {
+	return configFile + ".backup"
+}
+
+// backupConfigFile backs up the current config file to pendingBackupPath, returning the path of the backup, or an
+// empty path if there is nothing to back up. The existing backups are left in place.
+func backupConfigFile() (path string, err error) {
+	if Backups < 1 {
+		return
+	}
+	info, err := os.Stat(configFile)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	path = pendingBackupPath()
+	os.Remove(path)
+	if linkErr := os.Link(configFile, path); linkErr == nil {
+		return
+	}
+	// hard links are not supported everywhere, so fall back to copying
+	data, err := ioutil.ReadFile(configFile)
+	if err == nil {
+		err = util.WriteFileAtomic(path, data, info.Mode().Perm())
+	}
+	if err != nil {
+		path = ""
+	}
+	return
+}
+
+// rotateBackups shifts every backup back by one, dropping the oldest, and makes the backup at path the most
+// recent backup
+func rotateBackups(path string) (err error) {
+	for n := Backups - 1; n >= 1; n-- {
+		if err = os.Rename(BackupPath(n), BackupPath(n+1)); err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+	return os.Rename(path, BackupPath(1))
+}
+
+// writeConfigFile atomically replaces the config file with data, keeping its permissions. data is checked to
+// be a valid config before the config file is replaced, and the previous config file is backed up. The backups
+// are only rotated once the config file has been replaced, so they are unchanged if it could not be. Nothing is
+// written if the config file already contains data, so that the backups are not replaced by identical copies.
+func writeConfigFile(data []byte) (err error) {
+	if current, err := ioutil.ReadFile(configFile); err == nil && bytes.Equal(current, data) {
+		lastContents = data
+		return nil
+	}
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(configFile); err == nil {
+		perm = info.Mode().Perm()
+	}
+	var backup string
+	err = util.WriteFileAtomicCheck(configFile, data, perm, func(tmpPath string) (err error) {
+		if err = checkConfigFile(tmpPath); err != nil {
+			return fmt.Errorf("refusing to write invalid config: %v", err)
+		}
+		if backup, err = backupConfigFile(); err != nil {
+			return fmt.Errorf("could not back up config file: %v", err)
+		}
+		return
+	})
+	if err != nil {
+		if backup != "" {
+			os.Remove(backup)
+		}
+		return
+	}
+	lastContents = data
+	if backup != "" {
+		if err := rotateBackups(backup); err != nil {
+			log.WithError(err).Warn("could not rotate config file backups")
+		}
+	}
+	return
+}
+
+// RollbackConfig replaces the config file with its nth most recent backup. The current config file becomes the
+// most recent backup, so a rollback can itself be rolled back.
+func RollbackConfig(n int) (err error) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	if n < 1 || n > Backups {
+		err = fmt.Errorf("backup must be between 1 and %d", Backups)
+		return
+	}
+	path := BackupPath(n)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("could not read backup: %v", err)
+		return
+	}
+	if err = checkConfigFile(path); err != nil {
+		err = fmt.Errorf("backup %d is invalid: %v", n, err)
+		return
+	}
+	if err = writeConfigFile(data); err != nil {
+		err = fmt.Errorf("could not write config file: %v", err)
+		return
+	}
+	log.WithField("backup", path).Info("rolled back config file")
+	return
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/stretchr/testify/suite"
+)
+
+const testConfig = `{"SectionInterface": {"type": "mock", "pins": [1, 2]}, "HTTPConfig": {}, ` +
+	`"sections": [{"name": "sec", "interfaceId": 0}]}`
+
+type ConfigFileSuite struct {
+	suite.Suite
+	dir            string
+	prevConfigFile string
+}
+
+func (s *ConfigFileSuite) SetupSuite() {
+	util.Logger.Out = ioutil.Discard
+	s.prevConfigFile = configFile
+}
+
+func (s *ConfigFileSuite) TearDownSuite() {
+	configFile = s.prevConfigFile
+}
+
+func (s *ConfigFileSuite) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "config")
+	s.Require().NoError(err)
+	configFile = filepath.Join(s.dir, "config.json")
+	s.Require().NoError(ioutil.WriteFile(configFile, []byte(testConfig), 0640))
+}
+
+func (s *ConfigFileSuite) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *ConfigFileSuite) readFile(path string) string {
+	data, err := ioutil.ReadFile(path)
+	s.Require().NoError(err)
+	return string(data)
+}
+
+func (s *ConfigFileSuite) TestWriteConfig() {
+	ass, req := s.Assert(), s.Require()
+	config, err := LoadConfig(nil)
+	req.NoError(err)
+
+	for i := 0; i < Backups+2; i++ {
+		config.Sections[0].Name = string(rune('a' + i))
+		req.NoError(WriteConfig(&config))
+	}
+	loaded, err := LoadConfig(nil)
+	req.NoError(err)
+	ass.Equal(string(rune('a'+Backups+1)), loaded.Sections[0].Name)
+
+	info, err := os.Stat(configFile)
+	req.NoError(err)
+	ass.Equal(os.FileMode(0640), info.Mode().Perm(), "permissions should be preserved")
+
+	// the previous versions are backed up, up to Backups of them
+	for n := 1; n <= Backups; n++ {
+		ass.Contains(s.readFile(BackupPath(n)), `"name": "`+string(rune('a'+Backups+1-n))+`"`)
+	}
+	_, err = os.Stat(BackupPath(Backups + 1))
+	ass.True(os.IsNotExist(err))
+	_, err = os.Stat(pendingBackupPath())
+	ass.True(os.IsNotExist(err), "the pending backup should become the most recent backup")
+}
+
+func (s *ConfigFileSuite) TestWriteConfig_Unchanged() {
+	ass, req := s.Assert(), s.Require()
+	config, err := LoadConfig(nil)
+	req.NoError(err)
+	config.Sections[0].Name = "changed"
+	req.NoError(WriteConfig(&config))
+	written := s.readFile(configFile)
+
+	// writing the same config again, such as on every start, does not replace the backups
+	for i := 0; i < Backups+1; i++ {
+		req.NoError(WriteConfig(&config))
+	}
+	ass.Equal(written, s.readFile(configFile))
+	ass.Equal(testConfig, s.readFile(BackupPath(1)), "the original config should still be backed up")
+	_, err = os.Stat(BackupPath(2))
+	ass.True(os.IsNotExist(err), "nothing else should be backed up")
+}
+
+func (s *ConfigFileSuite) TestWriteConfig_Invalid() {
+	ass, req := s.Assert(), s.Require()
+	config, err := LoadConfig(nil)
+	req.NoError(err)
+
+	// a config which can not be loaded again is not written
+	config.HTTPConfig = nil
+	ass.Error(WriteConfig(&config))
+	ass.Equal(testConfig, s.readFile(configFile))
+	_, err = os.Stat(BackupPath(1))
+	ass.True(os.IsNotExist(err), "nothing should be backed up")
+	_, err = os.Stat(pendingBackupPath())
+	ass.True(os.IsNotExist(err), "nothing should be backed up")
+}
+
+func (s *ConfigFileSuite) TestRollbackConfig() {
+	ass, req := s.Assert(), s.Require()
+	config, err := LoadConfig(nil)
+	req.NoError(err)
+	config.Sections[0].Name = "changed"
+	req.NoError(WriteConfig(&config))
+
+	req.NoError(RollbackConfig(1))
+	ass.Equal(testConfig, s.readFile(configFile))
+	ass.Contains(s.readFile(BackupPath(1)), "changed", "the rolled back config should be backed up")
+
+	ass.Error(RollbackConfig(0))
+	ass.Error(RollbackConfig(Backups + 1))
+	ass.Error(RollbackConfig(3), "backup does not exist")
+
+	req.NoError(ioutil.WriteFile(BackupPath(2), []byte("{"), 0644))
+	ass.Error(RollbackConfig(2), "backup is invalid")
+	ass.Equal(testConfig, s.readFile(configFile))
+}
+
+func TestConfigFile(t *testing.T) {
+	suite.Run(t, new(ConfigFileSuite))
+}
@@ -0,0 +1,124 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// rawConfig is a config file decoded without its schema, which is what migrations operate on
+type rawConfig map[string]interface{}
+
+// renameKey renames the key from to to, if it is present
+func (c rawConfig) renameKey(from, to string) {
+	if value, ok := c[from]; ok {
+		delete(c, from)
+		c[to] = value
+	}
+}
+
+// object gets the value of key as a rawConfig, or nil if it is missing or not an object
+func (c rawConfig) object(key string) rawConfig {
+	obj, _ := c[key].(map[string]interface{})
+	return obj
+}
+
+// migration upgrades a rawConfig from one version to the next
+type migration func(config rawConfig) error
+
+// migrations upgrade the config file step by step. migrations[i] upgrades a config from version i to i+1.
+var migrations = []migration{
+	migrateV1,
+	migrateV2,
+	migrateV3,
+}
+
+// ConfigVersion is the version of the config files written by this version of grinklers
+var ConfigVersion = len(migrations)
+
+// migrateV1 gives SectionInterface, HTTPConfig and DeviceData camel case keys like the rest of the config
+func migrateV1(config rawConfig) error {
+	config.renameKey("SectionInterface", "sectionInterface")
+	config.renameKey("HTTPConfig", "http")
+	config.renameKey("DeviceData", "deviceData")
+	if httpConfig := config.object("http"); httpConfig != nil {
+		httpConfig.renameKey("ApiURL", "apiUrl")
+		httpConfig.renameKey("DeviceRegistrationToken", "deviceRegistrationToken")
+	}
+	if deviceData := config.object("deviceData"); deviceData != nil {
+		deviceData.renameKey("DeviceID", "deviceId")
+		deviceData.renameKey("DeviceToken", "deviceToken")
+	}
+	return nil
+}
+
+// migrateV2 gives every section and program an id, which used to be its position in the list
+func migrateV2(config rawConfig) error {
+	for _, key := range []string{"sections", "programs"} {
+		list, _ := config[key].([]interface{})
+		for i, item := range list {
+			obj, ok := item.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s[%d] must be an object", key, i)
+			}
+			obj["id"] = i
+		}
+	}
+	return nil
+}
+
+// migrateV3 moves the tokens out of the mqtt config, since they are also used by the REST api
+func migrateV3(config rawConfig) error {
+	mqttConfig := config.object("mqtt")
+	if mqttConfig == nil {
+		return nil
+	}
+	if tokens, ok := mqttConfig["tokens"]; ok {
+		delete(mqttConfig, "tokens")
+		config["tokens"] = tokens
+	}
+	return nil
+}
+
+// migrateConfig upgrades the contents of a config file to ConfigVersion. If it is already at ConfigVersion,
+// contents is returned unchanged.
+func migrateConfig(contents []byte) (migrated []byte, err error) {
+	var config rawConfig
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	// numbers are kept as they are written instead of going through float64
+	decoder.UseNumber()
+	if err = decoder.Decode(&config); err != nil {
+		return
+	}
+	var version int64
+	if v, ok := config["version"]; ok {
+		number, ok := v.(json.Number)
+		if !ok {
+			err = fmt.Errorf("version must be a number")
+			return
+		}
+		if version, err = number.Int64(); err != nil {
+			err = fmt.Errorf("version must be an integer")
+			return
+		}
+	}
+	if version < 0 || version > int64(ConfigVersion) {
+		err = fmt.Errorf("unsupported config version %d, the latest supported version is %d", version, ConfigVersion)
+		return
+	}
+	if version == int64(ConfigVersion) {
+		migrated = contents
+		return
+	}
+	for v := version; v < int64(ConfigVersion); v++ {
+		if err = migrations[v](config); err != nil {
+			err = fmt.Errorf("could not migrate config from version %d to %d: %v", v, v+1, err)
+			return
+		}
+	}
+	config["version"] = ConfigVersion
+	log.WithFields(logrus.Fields{"from": version, "to": ConfigVersion}).Info("migrated config file")
+	return json.Marshal(config)
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"git.amikhalev.com/amikhalev/grinklers/http"
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/sched"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeRaw(t *testing.T, contents string) (config rawConfig) {
+	require.NoError(t, json.Unmarshal([]byte(contents), &config))
+	return
+}
+
+func TestMigrateV1(t *testing.T) {
+	ass := assert.New(t)
+	config := decodeRaw(t, `{"SectionInterface": {"type": "mock"}, `+
+		`"HTTPConfig": {"ApiURL": "http://api", "DeviceRegistrationToken": "reg"}, `+
+		`"DeviceData": {"DeviceID": "device", "DeviceToken": "token"}, "sections": []}`)
+	ass.NoError(migrateV1(config))
+	ass.Equal(decodeRaw(t, `{"sectionInterface": {"type": "mock"}, `+
+		`"http": {"apiUrl": "http://api", "deviceRegistrationToken": "reg"}, `+
+		`"deviceData": {"deviceId": "device", "deviceToken": "token"}, "sections": []}`), config)
+
+	config = decodeRaw(t, `{"HTTPConfig": {}, "DeviceData": null}`)
+	ass.NoError(migrateV1(config))
+	ass.Equal(decodeRaw(t, `{"http": {}, "deviceData": null}`), config)
+}
+
+func TestMigrateV2(t *testing.T) {
+	ass := assert.New(t)
+	config := decodeRaw(t, `{"sections": [{"name": "a"}, {"id": 5, "name": "b"}], "programs": [{"name": "p"}]}`)
+	ass.NoError(migrateV2(config))
+	migrated, err := json.Marshal(config)
+	ass.NoError(err)
+	ass.JSONEq(`{"sections": [{"id": 0, "name": "a"}, {"id": 1, "name": "b"}], `+
+		`"programs": [{"id": 0, "name": "p"}]}`, string(migrated))
+
+	config = decodeRaw(t, `{"http": {}}`)
+	ass.NoError(migrateV2(config))
+	ass.Equal(decodeRaw(t, `{"http": {}}`), config)
+
+	ass.EqualError(migrateV2(decodeRaw(t, `{"programs": [1]}`)), "programs[0] must be an object")
+}
+
+func TestMigrateV3(t *testing.T) {
+	ass := assert.New(t)
+	config := decodeRaw(t, `{"mqtt": {"url": "tcp://broker", "tokens": [{"token": "a", "role": "admin"}]}}`)
+	ass.NoError(migrateV3(config))
+	ass.Equal(decodeRaw(t, `{"mqtt": {"url": "tcp://broker"}, "tokens": [{"token": "a", "role": "admin"}]}`),
+		config)
+
+	config = decodeRaw(t, `{"http": {}}`)
+	ass.NoError(migrateV3(config))
+	ass.Equal(decodeRaw(t, `{"http": {}}`), config)
+}
+
+func TestConfigDataJSON_Tokens(t *testing.T) {
+	ass := assert.New(t)
+	j := ConfigDataJSON{SectionInterface: SectionInterfaceJSON{Type: "mock"}, HTTPConfig: &http.Config{}}
+	j.Tokens = []TokenJSON{{Token: "a"}, {Token: "b", Role: RoleAdmin}}
+	c, err := j.ToConfigData(nil)
+	ass.NoError(err)
+	ass.Equal(j.Tokens, c.Tokens)
+	ass.Equal(j.Tokens, c.ToJSON().Tokens)
+
+	j.Tokens = []TokenJSON{{Name: "empty"}}
+	_, err = j.ToConfigData(nil)
+	ass.Error(err)
+	j.Tokens = []TokenJSON{{Token: "a"}, {Token: "a"}}
+	_, err = j.ToConfigData(nil)
+	ass.Error(err)
+}
+
+func TestConfigDataJSON_NextIDs(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	j := ConfigDataJSON{SectionInterface: SectionInterfaceJSON{Type: "mock", Pins: []RpioPinJSON{{}}},
+		HTTPConfig: &http.Config{}}
+	j.Sections = logic.Sections{logic.NewSection(0, "a", 0), logic.NewSection(3, "b", 0)}
+	c, err := j.ToConfigData(nil)
+	req.NoError(err)
+	ass.Equal(4, c.ToJSON().NextSectionID, "the next id is after the highest one")
+	ass.Equal(0, c.ToJSON().NextProgramID)
+
+	j.NextSectionID, j.NextProgramID = 6, 2
+	c, err = j.ToConfigData(nil)
+	req.NoError(err)
+	c.SetEventBus(logic.NewEventBus())
+	id := 3
+	_, err = c.RemoveSection(&id, false)
+	req.NoError(err)
+	added, err := c.AddSection(logic.NewSection(0, "c", 0))
+	req.NoError(err)
+	ass.Equal(6, added.ID)
+	c.AddProgram(logic.NewProgram("p", nil, sched.Schedule{}, false))
+	ass.Equal(2, c.ProgramList()[0].ID)
+	ass.Equal(7, c.ToJSON().NextSectionID)
+	ass.Equal(3, c.ToJSON().NextProgramID)
+}
+
+func TestMigrateConfig(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	util.Logger.Out = ioutil.Discard
+	defer func(m []migration, version int) { migrations, ConfigVersion = m, version }(migrations, ConfigVersion)
+	var applied []int
+	migrations = nil
+	for i := 0; i < 3; i++ {
+		i := i
+		migrations = append(migrations, func(config rawConfig) error {
+			applied = append(applied, i)
+			config[fmt.Sprintf("v%d", i+1)] = true
+			return nil
+		})
+	}
+	ConfigVersion = len(migrations)
+
+	// migrations are applied in order, starting at the version of the config
+	migrated, err := migrateConfig([]byte(`{"version": 1, "maxRunTime": 1.5, "n": 12345678901234567890}`))
+	req.NoError(err)
+	ass.Equal([]int{1, 2}, applied)
+	ass.JSONEq(`{"version": 3, "maxRunTime": 1.5, "n": 12345678901234567890, "v2": true, "v3": true}`,
+		string(migrated))
+
+	// a config without a version is version 0
+	applied = nil
+	_, err = migrateConfig([]byte(`{}`))
+	req.NoError(err)
+	ass.Equal([]int{0, 1, 2}, applied)
+
+	// a config at the latest version is not changed
+	applied = nil
+	latest := []byte(`{"version": 3, "a": 1}`)
+	migrated, err = migrateConfig(latest)
+	req.NoError(err)
+	ass.Equal(latest, migrated)
+	ass.Empty(applied)
+
+	for _, contents := range []string{
+		`{"version": 4}`, `{"version": -1}`, `{"version": "1"}`, `{"version": 1.5}`, `[]`, `{`,
+	} {
+		_, err = migrateConfig([]byte(contents))
+		ass.Error(err, contents)
+	}
+
+	migrations[1] = func(config rawConfig) error { return fmt.Errorf("failed") }
+	_, err = migrateConfig([]byte(`{}`))
+	ass.EqualError(err, "could not migrate config from version 1 to 2: failed")
+}
+
+func TestParseConfig_Legacy(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	util.Logger.Out = ioutil.Discard
+	j, err := parseConfig([]byte(`{"SectionInterface": {"type": "mock", "pins": [1]}, ` +
+		`"HTTPConfig": {"ApiURL": "http://api"}, "DeviceData": {"DeviceID": "device", "DeviceToken": "token"}}`))
+	req.NoError(err)
+	ass.Equal(ConfigVersion, j.Version)
+	ass.Equal("mock", j.SectionInterface.Type)
+	req.NotNil(j.HTTPConfig)
+	ass.Equal("http://api", j.HTTPConfig.ApiURL)
+	req.NotNil(j.DeviceData)
+	ass.Equal("device", j.DeviceData.DeviceID)
+	ass.Equal("token", j.DeviceData.DeviceToken)
+}
+
+func (s *ConfigFileSuite) TestCheckConfig() {
+	ass, req := s.Assert(), s.Require()
+	normalized, err := CheckConfig(nil)
+	req.NoError(err)
+	ass.Equal(testConfig, s.readFile(configFile), "the config file should not be changed")
+	ass.JSONEq(`{"version": 3, "sectionInterface": {"type": "mock", "pins": [1, 2]}, `+
+		`"http": {"apiUrl": "", "deviceRegistrationToken": ""}, `+
+		`"sections": [{"id": 0, "name": "sec", "interfaceId": 0}], "nextSectionId": 1}`, string(normalized))
+
+	s.writeReloadConfig(`{"version": 1, "sectionInterface": {"type": "unknown"}, "http": {}}`)
+	_, err = CheckConfig(nil)
+	ass.Error(err)
+}
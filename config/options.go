@@ -0,0 +1,206 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/Sirupsen/logrus"
+)
+
+// Options are the settings of the server which are given on the command line or in the environment instead of
+// the config file. Command line flags take precedence over environment variables, which take precedence over
+// the config file.
+type Options struct {
+	// ConfigPath is the path of the config file
+	ConfigPath string
+	// InterfaceType overrides the type of the section interface in the config file. One of "rpio" or "mock"
+	InterfaceType string
+	// RPI makes a section interface of type rpio drive the GPIO pins. Otherwise it is mocked, unless InterfaceType
+	// is rpio, so a config file for a raspberry pi can be used on other machines
+	RPI bool
+	// APIURL overrides the url of the sprinklers API in the config file
+	APIURL string
+	// MQTTURL is the url of the MQTT broker to connect to, instead of the one given by the sprinklers API
+	MQTTURL string
+	// LogLevel is the minimum level of messages which are logged
+	LogLevel string
+	// LogFormat is the format messages are logged in. One of "text" or "json"
+	LogFormat string
+	// Offline runs without registering with the sprinklers API or connecting to an MQTT broker
+	Offline bool
+
+	flags  *flag.FlagSet
+	getenv func(string) string
+	errs   util.Errors
+}
+
+// option describes a single setting of Options
+type option struct {
+	flag, env, usage string
+	// configValue gets the value from the config file, or is nil if it is not in the config file
+	configValue func(j *ConfigDataJSON) string
+}
+
+var options = []option{
+	{"config", "CONFIG", "the path of the config `file`", nil},
+	{"interface", "INTERFACE", "override the section interface `type` in the config file (rpio or mock)",
+		func(j *ConfigDataJSON) string { return j.SectionInterface.Type }},
+	{"rpi", "RPI", "drive the GPIO pins of an rpio section interface instead of mocking them", nil},
+	{"api-url", "API_URL", "override the `url` of the sprinklers API in the config file",
+		func(j *ConfigDataJSON) string {
+			if j.HTTPConfig == nil {
+				return ""
+			}
+			return j.HTTPConfig.ApiURL
+		}},
+	{"mqtt-url", "MQTT_URL", "connect to the MQTT broker at `url` instead of the one given by the sprinklers API", nil},
+	{"log-level", "LOG_LEVEL", "the minimum `level` of messages to log", nil},
+	{"log-format", "LOG_FORMAT", "the `format` to log messages in (text or json)", nil},
+	{"offline", "OFFLINE", "run without registering with the sprinklers API or connecting to an MQTT broker", nil},
+}
+
+// NewOptions registers the Options as flags on flags. The defaults of the flags are taken from the environment
+// using getenv, so they are overridden by the flags once flags is parsed.
+func NewOptions(flags *flag.FlagSet, getenv func(string) string) *Options {
+	o := &Options{flags: flags, getenv: getenv}
+	env := func(name, def string) string {
+		if value := getenv(name); value != "" {
+			return value
+		}
+		return def
+	}
+	envBool := func(name string) (b bool) {
+		if value := getenv(name); value != "" {
+			var err error
+			if b, err = strconv.ParseBool(value); err != nil {
+				o.errs = append(o.errs, fmt.Errorf("invalid %s '%s': must be true or false", name, value))
+			}
+		}
+		return
+	}
+	dir, _ := os.Getwd()
+
+	stringOptions := map[string]struct {
+		value *string
+		def   string
+	}{
+		"config":     {&o.ConfigPath, env("CONFIG", filepath.Join(dir, "config.json"))},
+		"interface":  {&o.InterfaceType, getenv("INTERFACE")},
+		"api-url":    {&o.APIURL, getenv("API_URL")},
+		"mqtt-url":   {&o.MQTTURL, getenv("MQTT_URL")},
+		"log-level":  {&o.LogLevel, env("LOG_LEVEL", util.Logger.Level.String())},
+		"log-format": {&o.LogFormat, env("LOG_FORMAT", "text")},
+	}
+	boolOptions := map[string]*bool{
+		"rpi":     &o.RPI,
+		"offline": &o.Offline,
+	}
+	for _, opt := range options {
+		if s, ok := stringOptions[opt.flag]; ok {
+			flags.StringVar(s.value, opt.flag, s.def, opt.usage)
+		} else {
+			flags.BoolVar(boolOptions[opt.flag], opt.flag, envBool(opt.env), opt.usage)
+		}
+	}
+	return o
+}
+
+// Validate checks that all of the options are valid
+func (o *Options) Validate() (err error) {
+	errs := append(util.Errors(nil), o.errs...)
+	switch o.InterfaceType {
+	case "", "rpio", "mock":
+	default:
+		errs = append(errs, fmt.Errorf("invalid interface type '%s': must be rpio or mock", o.InterfaceType))
+	}
+	if _, err := logrus.ParseLevel(o.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("invalid log level: %v", err))
+	}
+	switch o.LogFormat {
+	case "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("invalid log format '%s': must be text or json", o.LogFormat))
+	}
+	return errs.ErrorOrNil()
+}
+
+// Apply validates the options and applies the ones which are not used directly by the server or passed to
+// LoadConfig: the config file path and logging
+func (o *Options) Apply() (err error) {
+	if err = o.Validate(); err != nil {
+		return
+	}
+	configMutex.Lock()
+	configFile = o.ConfigPath
+	configMutex.Unlock()
+
+	level, _ := logrus.ParseLevel(o.LogLevel)
+	util.Logger.SetLevel(level)
+	if o.LogFormat == "json" {
+		util.Logger.Formatter = &logrus.JSONFormatter{}
+	} else {
+		util.Logger.Formatter = &logrus.TextFormatter{}
+	}
+	return
+}
+
+// interfaceType gets the type which overrides the type of the section interface in the config file, or "" if it
+// is not overridden. o may be nil, in which case nothing is overridden.
+func (o *Options) interfaceType() string {
+	if o == nil {
+		return ""
+	}
+	return o.InterfaceType
+}
+
+// rpi gets whether an rpio section interface drives the GPIO pins, which it does if RPI is set or the interface
+// type is overridden to rpio. o may be nil, in which case the pins are mocked.
+func (o *Options) rpi() bool {
+	return o != nil && (o.RPI || o.InterfaceType == "rpio")
+}
+
+// Source gets where the value of the option with the flag name came from: "flag", "environment",
+// "config file" or "default"
+func (o *Options) Source(name string) (source string) {
+	source = "default"
+	o.flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			source = "flag"
+		}
+	})
+	if source != "default" {
+		return
+	}
+	for _, opt := range options {
+		if opt.flag != name {
+			continue
+		}
+		if o.getenv(opt.env) != "" {
+			return "environment"
+		}
+		if opt.configValue != nil {
+			if j, err := readConfigFile(o.ConfigPath); err == nil && opt.configValue(&j) != "" {
+				return "config file"
+			}
+		}
+	}
+	return
+}
+
+// PrintEffective prints the effective value of every option to w, along with where it came from
+func (o *Options) PrintEffective(w io.Writer) {
+	j, _ := readConfigFile(o.ConfigPath)
+	for _, opt := range options {
+		value := o.flags.Lookup(opt.flag).Value.String()
+		source := o.Source(opt.flag)
+		if source == "config file" {
+			value = opt.configValue(&j)
+		}
+		fmt.Fprintf(w, "  %-12s %-30q (%s, $%s)\n", opt.flag, value, source, opt.env)
+	}
+}
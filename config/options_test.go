@@ -0,0 +1,135 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestOptions(env map[string]string, args ...string) (*Options, error) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	options := NewOptions(flags, func(name string) string { return env[name] })
+	return options, flags.Parse(args)
+}
+
+func TestOptions(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+
+	// flags take precedence over the environment
+	options, err := newTestOptions(map[string]string{
+		"CONFIG": "env.json", "INTERFACE": "rpio", "API_URL": "http://env", "LOG_LEVEL": "debug", "OFFLINE": "true",
+		"RPI": "true",
+	}, "-interface", "mock", "-mqtt-url", "tcp://flag:1883", "-log-format", "json", "-offline=false")
+	req.NoError(err)
+	ass.NoError(options.Validate())
+	ass.Equal("env.json", options.ConfigPath)
+	ass.Equal("mock", options.InterfaceType)
+	ass.Equal("http://env", options.APIURL)
+	ass.Equal("tcp://flag:1883", options.MQTTURL)
+	ass.Equal("debug", options.LogLevel)
+	ass.Equal("json", options.LogFormat)
+	ass.False(options.Offline)
+	ass.True(options.RPI)
+	ass.Equal("flag", options.Source("interface"))
+	ass.Equal("environment", options.Source("config"))
+	ass.Equal("flag", options.Source("offline"))
+
+	// defaults are used if neither are given
+	options, err = newTestOptions(nil)
+	req.NoError(err)
+	ass.NoError(options.Validate())
+	dir, _ := os.Getwd()
+	ass.Equal(filepath.Join(dir, "config.json"), options.ConfigPath)
+	ass.Equal("", options.InterfaceType)
+	ass.Equal("text", options.LogFormat)
+	ass.Equal(util.Logger.Level.String(), options.LogLevel)
+	ass.False(options.Offline)
+	ass.False(options.RPI)
+	ass.Equal("default", options.Source("log-format"))
+}
+
+func TestOptions_Invalid(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	for _, env := range []map[string]string{
+		{"OFFLINE": "maybe"},
+		{"RPI": "yes"},
+		{"INTERFACE": "composite"},
+		{"LOG_LEVEL": "loud"},
+		{"LOG_FORMAT": "xml"},
+	} {
+		options, err := newTestOptions(env)
+		req.NoError(err)
+		ass.Error(options.Validate(), "%v", env)
+		ass.Error(options.Apply(), "%v", env)
+	}
+}
+
+func TestOptions_Apply(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	defer func(file string, level logrus.Level, formatter logrus.Formatter) {
+		configFile = file
+		util.Logger.Level, util.Logger.Formatter = level, formatter
+	}(configFile, util.Logger.Level, util.Logger.Formatter)
+	util.Logger.Out = ioutil.Discard
+
+	dir, err := ioutil.TempDir("", "options")
+	req.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	req.NoError(ioutil.WriteFile(path, []byte(`{"version": 1, "sectionInterface": {"type": "mqtt"}, `+
+		`"http": {"apiUrl": "http://file"}, "sections": [{"name": "a", "interfaceId": 0}, `+
+		`{"name": "b", "interfaceId": 2}]}`), 0644))
+
+	options, err := newTestOptions(map[string]string{"CONFIG": path, "INTERFACE": "mock"}, "-log-level", "warning")
+	req.NoError(err)
+	req.NoError(options.Apply())
+	ass.Equal(path, configFile)
+	ass.Equal(logrus.WarnLevel, util.Logger.Level)
+	ass.Equal("config file", options.Source("api-url"))
+	ass.Equal("environment", options.Source("interface"))
+
+	config, err := LoadConfig(options)
+	req.NoError(err)
+	ass.IsType(&logic.MockSectionInterface{}, config.SectionInterface, "interface type should be overridden")
+	ass.Equal(logic.SectionID(3), config.SectionInterface.Count(), "there should be a mock pin for every section")
+	ass.Equal("mqtt", config.InterfaceConfig.Type, "the override should not be written back to the config file")
+
+	var out bytes.Buffer
+	options.PrintEffective(&out)
+	ass.Contains(out.String(), `"http://file"`)
+	ass.Contains(out.String(), "config file, $API_URL")
+	ass.Contains(out.String(), `"warning"`)
+}
+
+func TestOptions_RPI(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	ij := SectionInterfaceJSON{Type: "rpio", Pins: []RpioPinJSON{{Pin: 4}}}
+
+	for _, test := range []struct {
+		options *Options
+		rpio    bool
+	}{
+		{nil, false},
+		{&Options{}, false},
+		{&Options{RPI: true}, true},
+		{&Options{InterfaceType: "rpio"}, true},
+	} {
+		secInterface, err := ij.ToInterface(test.options)
+		req.NoError(err)
+		if test.rpio {
+			ass.IsType(&logic.RpioSectionInterface{}, secInterface, "%+v", test.options)
+		} else {
+			ass.IsType(&logic.MockSectionInterface{}, secInterface, "%+v", test.options)
+		}
+	}
+}
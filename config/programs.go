@@ -0,0 +1,157 @@
+package config
+
+import (
+	"sync"
+
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+)
+
+// programsMutex guards Programs, which can be changed at runtime once the programs have been started
+var programsMutex = &sync.RWMutex{}
+
+// ProgramList gets a copy of the current programs. It is safe to use while programs are added, removed or
+// reordered.
+func (c *ConfigData) ProgramList() []*logic.Program {
+	programsMutex.RLock()
+	defer programsMutex.RUnlock()
+	return append([]*logic.Program(nil), c.Programs...)
+}
+
+// FindProgram gets the program with the ID progID
+func (c *ConfigData) FindProgram(progID *int) (prog *logic.Program, err error) {
+	programsMutex.RLock()
+	defer programsMutex.RUnlock()
+	_, prog, err = c.findProgram(progID)
+	return
+}
+
+// findProgram gets the position and program with the ID progID. programsMutex must be locked.
+func (c *ConfigData) findProgram(progID *int) (position int, prog *logic.Program, err error) {
+	if err = util.CheckNotNil(progID, "program ID"); err != nil {
+		return
+	}
+	for i, p := range c.Programs {
+		if p.ID == *progID {
+			return i, p, nil
+		}
+	}
+	err = util.NewNotFoundError("program ID", *progID)
+	return
+}
+
+// nextIDs gets the ids of the next section and program which are created
+func (c *ConfigData) nextIDs() (nextSectionID, nextProgramID int) {
+	sectionsMutex.RLock()
+	nextSectionID = c.nextSectionID
+	sectionsMutex.RUnlock()
+	programsMutex.RLock()
+	nextProgramID = c.nextProgramID
+	programsMutex.RUnlock()
+	return
+}
+
+// StartPrograms starts all programs running their sections on secRunner. Programs which are added later are
+// started the same way. Each program is added to wait until it has quit.
+func (c *ConfigData) StartPrograms(secRunner *logic.SectionRunner, wait *sync.WaitGroup) {
+	programsMutex.Lock()
+	defer programsMutex.Unlock()
+	c.secRunner, c.wait = secRunner, wait
+	for _, prog := range c.Programs {
+		prog.Start(secRunner, wait)
+	}
+}
+
+// QuitPrograms quits all programs started by StartPrograms, including ones which have been added since
+func (c *ConfigData) QuitPrograms() {
+	programsMutex.Lock()
+	programs := c.Programs
+	started := c.secRunner != nil
+	c.secRunner, c.wait = nil, nil
+	programsMutex.Unlock()
+	if !started {
+		return
+	}
+	for _, prog := range programs {
+		prog.Quit()
+	}
+}
+
+// AddProgram adds prog after all other programs with a new ID, which has never been used by another program, and
+// starts it if the programs have been started. A ProgramsUpdate is published.
+func (c *ConfigData) AddProgram(prog *logic.Program) {
+	c.addProgram(prog, true)
+}
+
+// addProgram adds prog after all other programs, giving it a new ID if newID is set. Otherwise it keeps its ID,
+// which must not be used by any other program. It is started if the programs have been started. A ProgramsUpdate
+// is published.
+func (c *ConfigData) addProgram(prog *logic.Program, newID bool) {
+	programsMutex.Lock()
+	prog.Lock()
+	if newID {
+		// the next id is also kept after the existing ones, for a ConfigData which was not created from JSON
+		for _, p := range c.Programs {
+			if p.ID >= c.nextProgramID {
+				c.nextProgramID = p.ID + 1
+			}
+		}
+		prog.ID = c.nextProgramID
+	}
+	if prog.ID >= c.nextProgramID {
+		c.nextProgramID = prog.ID + 1
+	}
+	prog.Unlock()
+	prog.SetEventBus(c.events)
+	// the slice is always copied, so one which was read without holding programsMutex never changes
+	c.Programs = append(c.Programs[:len(c.Programs):len(c.Programs)], prog)
+	if c.secRunner != nil {
+		prog.Start(c.secRunner, c.wait)
+	}
+	programsMutex.Unlock()
+	c.events.Publish(logic.ProgramsUpdate{})
+}
+
+// RemoveProgram removes the program with the ID progID and quits it if it was started. A ProgramsUpdate is
+// published.
+func (c *ConfigData) RemoveProgram(progID *int) (prog *logic.Program, err error) {
+	programsMutex.Lock()
+	i, prog, err := c.findProgram(progID)
+	if err != nil {
+		programsMutex.Unlock()
+		return
+	}
+	programs := make([]*logic.Program, 0, len(c.Programs)-1)
+	programs = append(programs, c.Programs[:i]...)
+	c.Programs = append(programs, c.Programs[i+1:]...)
+	started := c.secRunner != nil
+	programsMutex.Unlock()
+	if started {
+		prog.Quit()
+	}
+	c.events.Publish(logic.ProgramsUpdate{})
+	return
+}
+
+// MoveProgram moves the program with the ID progID to position in the list of programs. Its ID does not change. A
+// ProgramsUpdate is published.
+func (c *ConfigData) MoveProgram(progID *int, position *int) (prog *logic.Program, err error) {
+	programsMutex.Lock()
+	i, prog, err := c.findProgram(progID)
+	if err != nil {
+		programsMutex.Unlock()
+		return
+	}
+	if err = util.CheckRange(position, "position", len(c.Programs)); err != nil {
+		programsMutex.Unlock()
+		return
+	}
+	programs := make([]*logic.Program, 0, len(c.Programs))
+	programs = append(programs, c.Programs[:i]...)
+	programs = append(programs, c.Programs[i+1:]...)
+	programs = append(programs[:*position], append([]*logic.Program{prog}, programs[*position:]...)...)
+	c.Programs = programs
+	programsMutex.Unlock()
+	c.events.Publish(logic.ProgramsUpdate{})
+	return
+}
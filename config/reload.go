@@ -0,0 +1,269 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/datamodel"
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"github.com/Sirupsen/logrus"
+	"github.com/fsnotify/fsnotify"
+)
+
+// ReloadDelay is how long to wait after the config file changes before reloading it, so that a file which is
+// written in several steps is only reloaded once
+var ReloadDelay = 500 * time.Millisecond
+
+// lastContents are the contents of the config file when it was last loaded or written, so that it is not
+// reloaded when nothing changed
+var lastContents []byte
+
+// ReloadConfig reloads the config file into the live configData. Sections and programs are matched by their ids.
+// Changes to existing ones are applied in place, programs are refreshed so they are rescheduled, and sections and
+// programs are added and removed the same way as by requests, and the tokens are replaced. If the config file is
+// invalid, nothing is changed and an error is returned. Other changes are only applied after a restart. With a
+// Store, sections and programs are not reloaded, since they are loaded from the Store.
+func ReloadConfig(configData *ConfigData) (err error) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	contents, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		err = fmt.Errorf("could not read config file: %v", err)
+		return
+	}
+	if bytes.Equal(contents, lastContents) {
+		log.Debug("config file is unchanged")
+		return
+	}
+	j, err := parseConfig(contents)
+	if err != nil {
+		return
+	}
+	if err = applyConfig(configData, &j); err != nil {
+		return
+	}
+	lastContents = contents
+	log.Info("reloaded config file")
+	return
+}
+
+// applyConfig applies the changes in j to the live configData
+func applyConfig(configData *ConfigData, j *ConfigDataJSON) (err error) {
+	newConfig, err := j.ToConfigData(configData.options)
+	if err != nil {
+		err = fmt.Errorf("invalid config: %v", err)
+		return
+	}
+	current := configData.ToJSON()
+	var restart []string
+	for name, changed := range map[string]bool{
+		"sectionInterface": !reflect.DeepEqual(current.SectionInterface, j.SectionInterface),
+		"http":             !reflect.DeepEqual(current.HTTPConfig, j.HTTPConfig),
+		"mqtt":             !reflect.DeepEqual(current.MQTT, j.MQTT),
+		"rest":             !reflect.DeepEqual(current.REST, j.REST),
+		"maxRunTime":       current.MaxRunTime != j.MaxRunTime,
+		"watchdog":         !reflect.DeepEqual(current.Watchdog, j.Watchdog),
+		"persist":          !reflect.DeepEqual(current.Persist, j.Persist),
+		"history":          !reflect.DeepEqual(current.History, j.History),
+		"storage":          !reflect.DeepEqual(current.Storage, j.Storage),
+	} {
+		if changed {
+			restart = append(restart, name)
+		}
+	}
+	if len(restart) > 0 {
+		log.WithField("changed", restart).Warn("some config changes will only be applied after a restart")
+	}
+	if configData.Store == nil {
+		if err = checkSections(configData, newConfig.Sections); err != nil {
+			return
+		}
+		if err = checkPrograms(configData, newConfig.Sections, j.Programs); err != nil {
+			return
+		}
+	}
+	if !reflect.DeepEqual(current.Tokens, j.Tokens) {
+		configData.SetTokens(newConfig.Tokens)
+		log.WithField("count", len(newConfig.Tokens)).Info("updated tokens")
+	}
+	if configData.Store != nil {
+		log.Warn("sections and programs are loaded from storage, so they are not reloaded from the config file")
+		return
+	}
+
+	// everything has been checked, so nothing can fail from here on, as long as no request changes the sections
+	// or programs at the same time
+	ids := make(map[int]bool, len(newConfig.Sections))
+	for _, newSec := range newConfig.Sections {
+		ids[newSec.ID] = true
+		sec, err := configData.FindSection(&newSec.ID)
+		if err != nil {
+			if _, err := configData.addSection(*newSec, false); err != nil {
+				return err
+			}
+			log.WithField("section", newSec.Name).Info("added section")
+			continue
+		}
+		changed := sec.SetInterfaceID(newSec.InterfaceID)
+		if sec.SetData(newSec.Name, newSec.MaxRunTime) || changed {
+			log.WithField("section", newSec.Name).Info("updated section")
+		}
+	}
+
+	// programs are updated after sections are added, since they can use the new sections, and before sections are
+	// removed, so that they no longer use the removed sections
+	sections := configData.SectionList()
+	progIDs := make(map[int]bool, len(j.Programs))
+	for i := range j.Programs {
+		data := j.Programs[i]
+		progIDs[data.ID] = true
+		prog, err := configData.FindProgram(&data.ID)
+		if err != nil {
+			if prog, err = data.ToProgram(sections); err != nil {
+				return err
+			}
+			prog.ID = data.ID
+			configData.addProgram(prog, false)
+			log.WithField("program", *data.Name).Info("added program")
+			continue
+		}
+		if reflect.DeepEqual(datamodel.ProgramToJSON(prog), datamodel.ProgramToJSON(newConfig.Programs[i])) {
+			continue
+		}
+		// this refreshes the program and notifies its update chan
+		if err = data.Update(prog, sections); err != nil {
+			return err
+		}
+		log.WithField("program", *data.Name).Info("updated program")
+	}
+	for _, prog := range configData.ProgramList() {
+		if id := prog.ID; !progIDs[id] {
+			if _, err = configData.RemoveProgram(&id); err != nil {
+				return
+			}
+			log.WithField("program", prog.Name).Info("removed program")
+		}
+	}
+	for position := range j.Programs {
+		position := position
+		if configData.ProgramList()[position].ID != j.Programs[position].ID {
+			if _, err = configData.MoveProgram(&j.Programs[position].ID, &position); err != nil {
+				return
+			}
+		}
+	}
+	for _, sec := range configData.SectionList() {
+		if id := sec.ID; !ids[id] {
+			removed, err := configData.RemoveSection(&id, true)
+			if err != nil {
+				return err
+			}
+			log.WithField("section", removed.Name).Info("removed section")
+		}
+	}
+	return
+}
+
+// checkSections checks that the live sections of configData can be changed to newSections. The interface id of a
+// section can only be changed while it is off, like with an updateSection request.
+func checkSections(configData *ConfigData, newSections []*logic.Section) (err error) {
+	for _, newSec := range newSections {
+		if err = configData.CheckInterfaceID(newSec.InterfaceID); err != nil {
+			return fmt.Errorf("section '%s': %v", newSec.Name, err)
+		}
+		sec, err := configData.FindSection(&newSec.ID)
+		if err != nil {
+			// it is a new section
+			continue
+		}
+		current := sec.Snapshot()
+		if current.InterfaceID != newSec.InterfaceID && sec.GetState(configData.SectionInterface) {
+			return fmt.Errorf("section '%s' must be off to change its interfaceId", current.Name)
+		}
+	}
+	return nil
+}
+
+// checkPrograms checks that programs can be applied once the live sections of configData are changed to
+// newSections, by building them against the sections as they will be then
+func checkPrograms(configData *ConfigData, newSections []*logic.Section, programs []datamodel.ProgramJSON) (err error) {
+	sections := make([]*logic.Section, len(newSections))
+	for i, newSec := range newSections {
+		if sections[i], err = configData.FindSection(&newSec.ID); err != nil {
+			sections[i], err = newSec, nil
+		}
+	}
+	for i := range programs {
+		if _, err = programs[i].ToProgram(sections); err != nil {
+			return fmt.Errorf("program %d: %v", programs[i].ID, err)
+		}
+	}
+	return nil
+}
+
+// Watcher reloads the config file into a live ConfigData whenever it changes
+type Watcher struct {
+	configData *ConfigData
+	watcher    *fsnotify.Watcher
+	done       chan struct{}
+	log        *logrus.Entry
+}
+
+// NewWatcher creates a new Watcher which reloads the config file into configData
+func NewWatcher(configData *ConfigData) (w *Watcher, err error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		err = fmt.Errorf("could not watch config file: %v", err)
+		return
+	}
+	// the directory is watched, since editors and WriteConfig replace the file instead of writing to it
+	if err = watcher.Add(filepath.Dir(configFile)); err != nil {
+		watcher.Close()
+		err = fmt.Errorf("could not watch config file: %v", err)
+		return
+	}
+	w = &Watcher{configData, watcher, make(chan struct{}), log.WithField("file", configFile)}
+	return
+}
+
+// Start starts watching the config file in the background
+func (w *Watcher) Start() {
+	go w.run()
+}
+
+func (w *Watcher) run() {
+	defer close(w.done)
+	var reload <-chan time.Time
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == filepath.Clean(configFile) {
+				reload = time.After(ReloadDelay)
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.log.WithError(err).Warn("error watching config file")
+		case <-reload:
+			reload = nil
+			if err := ReloadConfig(w.configData); err != nil {
+				w.log.WithError(err).Error("error reloading config file, keeping the old config")
+			}
+		}
+	}
+}
+
+// Stop stops watching the config file
+func (w *Watcher) Stop() {
+	w.watcher.Close()
+	<-w.done
+}
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+)
+
+const testReloadConfig = `{"SectionInterface": {"type": "mock", "pins": [1, 2]}, "HTTPConfig": {}, ` +
+	`"sections": [{"name": "sec 0", "interfaceId": 0}, {"name": "sec 1", "interfaceId": 1}], ` +
+	`"programs": [{"name": "prog", "sequence": [{"section": 0, "duration": 60}], "enabled": false}]}`
+
+// startPrograms starts the programs of config, so that they can be refreshed
+func (s *ConfigFileSuite) startPrograms(config *ConfigData) (stop func()) {
+	secRunner := logic.NewSectionRunner(config.SectionInterface)
+	wait := sync.WaitGroup{}
+	secRunner.Start(&wait)
+	config.StartPrograms(secRunner, &wait)
+	return func() {
+		config.QuitPrograms()
+		secRunner.Quit()
+		wait.Wait()
+	}
+}
+
+func (s *ConfigFileSuite) writeReloadConfig(contents string) {
+	s.Require().NoError(ioutil.WriteFile(configFile, []byte(contents), 0640))
+}
+
+func (s *ConfigFileSuite) TestReloadConfig() {
+	ass, req := s.Assert(), s.Require()
+	s.writeReloadConfig(testReloadConfig)
+	config, err := LoadConfig(nil)
+	req.NoError(err)
+	req.NoError(config.SectionInterface.Initialize())
+	defer s.startPrograms(&config)()
+	sec0, prog := config.Sections[0], config.Programs[0]
+
+	// an unchanged file is not reloaded
+	req.NoError(ReloadConfig(&config))
+
+	s.writeReloadConfig(`{"SectionInterface": {"type": "mock", "pins": [1, 2]}, "HTTPConfig": {}, ` +
+		`"sections": [{"name": "renamed", "interfaceId": 0, "maxRunTime": 30}, {"name": "sec 1", "interfaceId": 1}], ` +
+		`"programs": [{"name": "prog", "sequence": [{"section": 1, "duration": 120}], "enabled": true}]}`)
+	req.NoError(ReloadConfig(&config))
+	ass.Same(sec0, config.Sections[0], "sections should be updated in place")
+	ass.Equal("renamed", config.Sections[0].Name)
+	ass.Equal(30.0, config.Sections[0].MaxRunTime)
+	ass.Equal("sec 1", config.Sections[1].Name)
+
+	ass.Same(prog, config.Programs[0], "programs should be updated in place")
+	prog.Lock()
+	ass.True(prog.Enabled)
+	ass.Len(prog.Sequence, 1)
+	ass.Same(config.Sections[1], prog.Sequence[0].Sec)
+	ass.Equal(2*time.Minute, prog.Sequence[0].Duration)
+	prog.Unlock()
+}
+
+func (s *ConfigFileSuite) TestReloadConfig_AddRemove() {
+	ass, req := s.Assert(), s.Require()
+	s.writeReloadConfig(testReloadConfig)
+	config, err := LoadConfig(nil)
+	req.NoError(err)
+	req.NoError(config.SectionInterface.Initialize())
+	defer s.startPrograms(&config)()
+	prog := config.Programs[0]
+
+	// section 0 is removed, section 3 and program 4 are added, and program 4 is moved before program 0
+	s.writeReloadConfig(`{"version": 2, "sectionInterface": {"type": "mock", "pins": [1, 2]}, "http": {}, ` +
+		`"sections": [{"id": 1, "name": "sec 1", "interfaceId": 1}, {"id": 3, "name": "sec 3", "interfaceId": 0}], ` +
+		`"programs": [{"id": 4, "name": "new", "sequence": [{"section": 3, "duration": 60}], "enabled": false}, ` +
+		`{"id": 0, "name": "prog", "sequence": [{"section": 1, "duration": 60}], "enabled": false}]}`)
+	req.NoError(ReloadConfig(&config))
+
+	sections := config.SectionList()
+	req.Len(sections, 2)
+	ass.Equal(1, sections[0].ID)
+	ass.Equal(3, sections[1].ID, "added sections should keep their id")
+	ass.Equal("sec 3", sections[1].Name)
+
+	programs := config.ProgramList()
+	req.Len(programs, 2)
+	ass.Equal(4, programs[0].ID, "added programs should keep their id")
+	ass.Equal(0, programs[1].ID)
+	ass.Same(prog, programs[1], "programs should be updated in place")
+	programs[0].Lock()
+	ass.Same(sections[1], programs[0].Sequence[0].Sec, "added programs should use the live sections")
+	programs[0].Unlock()
+	prog.Lock()
+	ass.Same(sections[0], prog.Sequence[0].Sec)
+	prog.Unlock()
+
+	// removing everything
+	s.writeReloadConfig(`{"version": 2, "sectionInterface": {"type": "mock", "pins": [1, 2]}, "http": {}, ` +
+		`"sections": [], "programs": []}`)
+	req.NoError(ReloadConfig(&config))
+	ass.Empty(config.SectionList())
+	ass.Empty(config.ProgramList())
+	ass.False(prog.Running())
+}
+
+func (s *ConfigFileSuite) TestReloadConfig_Tokens() {
+	ass, req := s.Assert(), s.Require()
+	s.writeReloadConfig(testReloadConfig)
+	config, err := LoadConfig(nil)
+	req.NoError(err)
+	ass.Empty(config.TokenList())
+
+	s.writeReloadConfig(`{"version": 2, "sectionInterface": {"type": "mock", "pins": [1, 2]}, "http": {}, ` +
+		`"sections": [{"id": 0, "name": "sec 0", "interfaceId": 0}, {"id": 1, "name": "sec 1", "interfaceId": 1}], ` +
+		`"tokens": [{"name": "new", "token": "abc", "role": "operator"}]}`)
+	req.NoError(ReloadConfig(&config))
+	ass.Equal([]TokenJSON{{"new", "abc", RoleOperator}}, config.TokenList(), "tokens should be applied on reload")
+
+	s.writeReloadConfig(`{"version": 2, "sectionInterface": {"type": "mock", "pins": [1, 2]}, "http": {}, ` +
+		`"sections": [{"id": 0, "name": "sec 0", "interfaceId": 0}, {"id": 1, "name": "sec 1", "interfaceId": 1}], ` +
+		`"tokens": [{"token": "abc"}, {"token": "abc"}]}`)
+	ass.Error(ReloadConfig(&config))
+	ass.Equal([]TokenJSON{{"new", "abc", RoleOperator}}, config.TokenList(), "invalid tokens should not be applied")
+}
+
+func (s *ConfigFileSuite) TestReloadConfig_Rejected() {
+	ass, req := s.Assert(), s.Require()
+	s.writeReloadConfig(testReloadConfig)
+	config, err := LoadConfig(nil)
+	req.NoError(err)
+	req.NoError(config.SectionInterface.Initialize())
+	defer s.startPrograms(&config)()
+	config.Sections[1].SetState(true, config.SectionInterface)
+
+	for _, contents := range []string{
+		`{`,
+		`{"SectionInterface": {"type": "mock", "pins": [1, 2]}, "HTTPConfig": {}, ` +
+			`"sections": [{"name": "renamed", "interfaceId": 0}, {"name": "sec 1", "interfaceId": 1}], ` +
+			`"programs": [{"name": "prog", "sequence": [{"section": 5, "duration": 60}]}]}`,
+		// the interface id of a section which is on can not be changed
+		`{"SectionInterface": {"type": "mock", "pins": [1, 2]}, "HTTPConfig": {}, ` +
+			`"sections": [{"name": "renamed", "interfaceId": 0}, {"name": "sec 1", "interfaceId": 0}], ` +
+			`"programs": [{"name": "prog", "sequence": [{"section": 0, "duration": 60}]}]}`,
+		// a new section must be on the section interface
+		`{"SectionInterface": {"type": "mock", "pins": [1, 2]}, "HTTPConfig": {}, ` +
+			`"sections": [{"name": "renamed", "interfaceId": 0}, {"name": "sec 1", "interfaceId": 1}, ` +
+			`{"name": "sec 2", "interfaceId": 2}], "programs": []}`,
+	} {
+		s.writeReloadConfig(contents)
+		ass.Error(ReloadConfig(&config), contents)
+		ass.Equal("sec 0", config.Sections[0].Name, "nothing should be changed by a rejected config")
+		ass.Len(config.Sections, 2)
+		ass.Len(config.Programs, 1)
+	}
+}
+
+func (s *ConfigFileSuite) TestWatcher() {
+	ass, req := s.Assert(), s.Require()
+	defer func(delay time.Duration) { ReloadDelay = delay }(ReloadDelay)
+	ReloadDelay = 10 * time.Millisecond
+
+	config, err := LoadConfig(nil)
+	req.NoError(err)
+	watcher, err := NewWatcher(&config)
+	req.NoError(err)
+	watcher.Start()
+	defer watcher.Stop()
+
+	configMutex.Lock()
+	config.Sections[0].Name = "changed"
+	configMutex.Unlock()
+	req.NoError(WriteConfig(&config))
+	s.writeReloadConfig(`{"SectionInterface": {"type": "mock", "pins": [1, 2]}, "HTTPConfig": {}, ` +
+		`"sections": [{"name": "edited", "interfaceId": 0}]}`)
+	ass.Eventually(func() bool {
+		configMutex.Lock()
+		defer configMutex.Unlock()
+		return config.Sections[0].Name == "edited"
+	}, time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+)
+
+// sectionsMutex guards Sections. Adding or removing sections replaces Sections with a new slice instead of
+// changing the old one, so a slice which has been read stays valid. The sections themselves are never copied, so a
+// section keeps its address for as long as it exists. Sections are looked up by their ID, which is not their
+// position.
+var sectionsMutex = &sync.RWMutex{}
+
+// SectionList gets the current sections. It is safe to use while sections are added or removed.
+func (c *ConfigData) SectionList() []*logic.Section {
+	sectionsMutex.RLock()
+	defer sectionsMutex.RUnlock()
+	return c.Sections
+}
+
+// FindSection gets the section with the ID secID
+func (c *ConfigData) FindSection(secID *int) (sec *logic.Section, err error) {
+	sectionsMutex.RLock()
+	defer sectionsMutex.RUnlock()
+	return c.findSection(secID)
+}
+
+// findSection gets the section with the ID secID. sectionsMutex must be locked.
+func (c *ConfigData) findSection(secID *int) (sec *logic.Section, err error) {
+	if err = util.CheckNotNil(secID, "section ID"); err != nil {
+		return
+	}
+	if sec = logic.FindSection(c.Sections, *secID); sec == nil {
+		err = util.NewNotFoundError("section ID", *secID)
+	}
+	return
+}
+
+// CheckInterfaceID checks that interfaceID is a section on the SectionInterface
+func (c *ConfigData) CheckInterfaceID(interfaceID logic.SectionID) (err error) {
+	if count := c.SectionInterface.Count(); interfaceID >= count {
+		err = util.NewError(util.EC_Range, fmt.Sprintf("interface id out of range: %d >= %d", interfaceID, count))
+	}
+	return
+}
+
+// AddSection adds sec after all other sections with a new ID, which has never been used by another section. A
+// SectionsUpdate is published.
+func (c *ConfigData) AddSection(sec logic.Section) (added *logic.Section, err error) {
+	return c.addSection(sec, true)
+}
+
+// addSection adds sec after all other sections, giving it a new ID if newID is set. Otherwise it keeps its ID,
+// which must not be used by any other section. A SectionsUpdate is published.
+func (c *ConfigData) addSection(sec logic.Section, newID bool) (added *logic.Section, err error) {
+	if err = c.CheckInterfaceID(sec.InterfaceID); err != nil {
+		return
+	}
+	sectionsMutex.Lock()
+	if newID {
+		// the next id is also kept after the existing ones, for a ConfigData which was not created from JSON
+		for _, other := range c.Sections {
+			if other.ID >= c.nextSectionID {
+				c.nextSectionID = other.ID + 1
+			}
+		}
+		sec.ID = c.nextSectionID
+	}
+	if sec.ID >= c.nextSectionID {
+		c.nextSectionID = sec.ID + 1
+	}
+	added = &sec
+	added.SetEventBus(c.events)
+	sections := make([]*logic.Section, len(c.Sections), len(c.Sections)+1)
+	copy(sections, c.Sections)
+	c.Sections = append(sections, added)
+	sectionsMutex.Unlock()
+	c.events.Publish(logic.SectionsUpdate{})
+	return
+}
+
+// RemoveSection removes the section with the ID secID, cancelling its runs. If any programs use the section, it is
+// only removed if removeFromPrograms is set, in which case it is removed from their sequences. A SectionsUpdate is
+// published.
+func (c *ConfigData) RemoveSection(secID *int, removeFromPrograms bool) (removed logic.Section, err error) {
+	sectionsMutex.Lock()
+	sec, err := c.findSection(secID)
+	if err != nil {
+		sectionsMutex.Unlock()
+		return
+	}
+	removed = sec.Snapshot()
+	var usedBy []string
+	for _, prog := range c.ProgramList() {
+		prog.Lock()
+		for _, item := range prog.Sequence {
+			if item.Sec == sec {
+				usedBy = append(usedBy, "'"+prog.Name+"'")
+				break
+			}
+		}
+		prog.Unlock()
+	}
+	if len(usedBy) > 0 && !removeFromPrograms {
+		sectionsMutex.Unlock()
+		err = util.NewError(util.EC_InvalidData, fmt.Sprintf("section '%s' is used by programs %s",
+			removed.Name, strings.Join(usedBy, ", ")))
+		return
+	}
+	sections := make([]*logic.Section, 0, len(c.Sections)-1)
+	for _, other := range c.Sections {
+		if other != sec {
+			sections = append(sections, other)
+		}
+	}
+	c.Sections = sections
+	sectionsMutex.Unlock()
+
+	for _, prog := range c.ProgramList() {
+		prog.Lock()
+		sequence := make(logic.ProgSequence, 0, len(prog.Sequence))
+		for _, item := range prog.Sequence {
+			if item.Sec != sec {
+				sequence = append(sequence, item)
+			}
+		}
+		changed := len(sequence) != len(prog.Sequence)
+		prog.Sequence = sequence
+		prog.Unlock()
+		if changed {
+			prog.OnUpdate(logic.ProgUpdateData)
+		}
+	}
+	// runs are cancelled after the section is removed, so no new runs of it can be started by requests
+	programsMutex.RLock()
+	secRunner := c.secRunner
+	programsMutex.RUnlock()
+	if secRunner != nil {
+		secRunner.CancelSection(sec)
+	}
+	c.events.Publish(logic.SectionsUpdate{})
+	return
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"git.amikhalev.com/amikhalev/grinklers/util"
+)
+
+// Role is what the holder of a token is allowed to do. Each role can do everything the roles before it can.
+type Role int
+
+const (
+	// RoleViewer can only make requests which get data
+	RoleViewer Role = iota
+	// RoleOperator can also run and cancel sections and programs and pause the section runner
+	RoleOperator
+	// RoleAdmin can also create, update and delete sections and programs
+	RoleAdmin
+)
+
+var roleNames = []string{"viewer", "operator", "admin"}
+
+func (r Role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+// MarshalJSON implements json.Marshaler
+func (r Role) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (r *Role) UnmarshalJSON(data []byte) (err error) {
+	var name string
+	if err = json.Unmarshal(data, &name); err != nil {
+		return
+	}
+	for i, roleName := range roleNames {
+		if name == roleName {
+			*r = Role(i)
+			return
+		}
+	}
+	return fmt.Errorf("invalid role %q, must be one of viewer, operator or admin", name)
+}
+
+// TokenJSON is a token which api requests can be made with
+type TokenJSON struct {
+	// Name identifies who the token belongs to in the logs
+	Name  string `json:"name,omitempty"`
+	Token string `json:"token"`
+	// Role is what requests made with the token are allowed to do. Defaults to viewer
+	Role Role `json:"role"`
+}
+
+// tokensMutex guards Tokens, which are replaced when the config file is reloaded
+var tokensMutex = &sync.RWMutex{}
+
+// TokenList gets the current tokens. The list is never modified, only replaced, so it can be used without holding
+// any lock.
+func (c *ConfigData) TokenList() []TokenJSON {
+	tokensMutex.RLock()
+	defer tokensMutex.RUnlock()
+	return c.Tokens
+}
+
+// SetTokens replaces the tokens api requests and commands must be made with
+func (c *ConfigData) SetTokens(tokens []TokenJSON) {
+	tokensMutex.Lock()
+	c.Tokens = tokens
+	tokensMutex.Unlock()
+}
+
+// validateTokens checks that every token is set and that none of them are the same
+func validateTokens(tokens []TokenJSON) (err error) {
+	seen := make(map[string]bool)
+	for i := range tokens {
+		token := tokens[i].Token
+		if token == "" {
+			return util.NewNotSpecifiedError(fmt.Sprintf("token %d", i))
+		}
+		if seen[token] {
+			return util.NewInvalidDataError(fmt.Sprintf("token %d", i), fmt.Errorf("duplicate token"))
+		}
+		seen[token] = true
+	}
+	return
+}
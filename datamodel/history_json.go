@@ -0,0 +1,44 @@
+package datamodel
+
+import (
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+)
+
+// RunRecordJSON is the JSON representation of a RunRecord
+type RunRecordJSON struct {
+	Section int `json:"section"`
+	// Program is the id of the program the run was part of, or nil if it was queued on its own
+	Program *int `json:"program,omitempty"`
+	// RequestedDuration is the duration in seconds the section was queued to run for
+	RequestedDuration float64 `json:"requestedDuration"`
+	// ActualDuration is the duration in seconds the section was actually on for
+	ActualDuration float64            `json:"actualDuration"`
+	StartTime      *time.Time         `json:"startTime,omitempty"`
+	EndTime        time.Time          `json:"endTime"`
+	Cancelled      bool               `json:"cancelled"`
+	CancelReason   logic.CancelReason `json:"cancelReason,omitempty"`
+	SkipReason     logic.SkipReason   `json:"skipReason,omitempty"`
+}
+
+// RunRecordToJSON returns the JSON representation of a RunRecord
+func RunRecordToJSON(rec *logic.RunRecord) (j RunRecordJSON) {
+	j = RunRecordJSON{
+		rec.Sec.ID, nil, rec.RequestedDuration.Seconds(), rec.ActualDuration.Seconds(),
+		rec.StartTime, rec.EndTime, rec.Cancelled(), rec.CancelReason, rec.SkipReason,
+	}
+	if rec.Prog != nil {
+		id := rec.Prog.ID
+		j.Program = &id
+	}
+	return
+}
+
+// Time gets the time the run is counted at, which is when it started, or when it was skipped if it never did
+func (j *RunRecordJSON) Time() time.Time {
+	if j.StartTime != nil {
+		return *j.StartTime
+	}
+	return j.EndTime
+}
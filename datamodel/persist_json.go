@@ -0,0 +1,79 @@
+package datamodel
+
+import (
+	"fmt"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+)
+
+// PersistedRunJSON is the JSON representation of a SectionRun which is persisted across restarts
+type PersistedRunJSON struct {
+	Section int `json:"section"`
+	// Program is the id of the program the run is part of, or nil if it was queued on its own
+	Program *int `json:"program,omitempty"`
+	// TotalDuration is the total duration of the run in seconds
+	TotalDuration float64 `json:"totalDuration"`
+	// Duration is the remaining duration of the run in seconds
+	Duration float64 `json:"duration"`
+}
+
+// PersistedStateJSON is the JSON representation of the SectionRunner state which is persisted across restarts
+type PersistedStateJSON struct {
+	// SavedAt is when the state was saved
+	SavedAt time.Time `json:"savedAt"`
+	Paused  bool      `json:"paused"`
+	// Runs are the current run followed by the queued runs
+	Runs []PersistedRunJSON `json:"runs"`
+}
+
+// SRStateToPersistedJSON returns the persisted JSON representation of a SRState at now. The SRState must be locked.
+func SRStateToPersistedJSON(s *logic.SRState, now time.Time) (j PersistedStateJSON) {
+	j = PersistedStateJSON{now, s.Paused, []PersistedRunJSON{}}
+	add := func(sr *logic.SectionRun) bool {
+		remaining := sr.Remaining(now)
+		if remaining <= 0 {
+			return true
+		}
+		run := PersistedRunJSON{sr.Sec.ID, nil, sr.TotalDuration.Seconds(), remaining.Seconds()}
+		if sr.Prog != nil {
+			id := sr.Prog.ID
+			run.Program = &id
+		}
+		j.Runs = append(j.Runs, run)
+		return true
+	}
+	if s.Current != nil {
+		add(s.Current)
+	}
+	s.Queue.ForEach(add)
+	return
+}
+
+// ToRestoredRuns converts the persisted runs to RestoredRuns, looking up their sections and programs by id
+func (j *PersistedStateJSON) ToRestoredRuns(sections []*logic.Section, programs []*logic.Program) (runs []logic.RestoredRun, err error) {
+	runs = make([]logic.RestoredRun, len(j.Runs))
+	for i := range j.Runs {
+		rj := &j.Runs[i]
+		sec := logic.FindSection(sections, rj.Section)
+		if sec == nil {
+			err = fmt.Errorf("invalid persisted run section id: %v", util.NewNotFoundError("section id", rj.Section))
+			return
+		}
+		run := logic.RestoredRun{
+			Sec:           sec,
+			TotalDuration: time.Duration(rj.TotalDuration * float64(time.Second)),
+			Duration:      time.Duration(rj.Duration * float64(time.Second)),
+		}
+		if rj.Program != nil {
+			if run.Prog = logic.FindProgram(programs, *rj.Program); run.Prog == nil {
+				err = fmt.Errorf("invalid persisted run program id: %v",
+					util.NewNotFoundError("program id", *rj.Program))
+				return
+			}
+		}
+		runs[i] = run
+	}
+	return
+}
@@ -11,19 +11,21 @@ import (
 
 // ProgItemJSON is the JSON representation of a ProgItem
 type ProgItemJSON struct {
+	// Section is the id of the section
 	Section int `json:"section"`
 	// Duration of the program item in seconds
 	Duration float64 `json:"duration"`
 }
 
 // ToProgItem converts a ProgItemJSON to a ProgItem
-func (data *ProgItemJSON) ToProgItem(sections []logic.Section) (pi *logic.ProgItem, err error) {
+func (data *ProgItemJSON) ToProgItem(sections []*logic.Section) (pi *logic.ProgItem, err error) {
 	dur := time.Duration(data.Duration * float64(time.Second))
-	if err = util.CheckRange(&data.Section, "section id", len(sections)); err != nil {
-		err = fmt.Errorf("invalid program item section id: %v", err)
+	sec := logic.FindSection(sections, data.Section)
+	if sec == nil {
+		err = fmt.Errorf("invalid program item section id: %v", util.NewNotFoundError("section id", data.Section))
 		return
 	}
-	pi = &logic.ProgItem{Sec: &sections[data.Section], Duration: dur}
+	pi = &logic.ProgItem{Sec: sec, Duration: dur}
 	return
 }
 
@@ -45,7 +47,7 @@ func ProgSequenceToJSON(seq logic.ProgSequence) (seqj ProgSequenceJSON) {
 }
 
 // ToSequence converts a ProgSequenceJSON to a ProgSequence
-func (seqj ProgSequenceJSON) ToSequence(sections []logic.Section) (seq logic.ProgSequence, err error) {
+func (seqj ProgSequenceJSON) ToSequence(sections []*logic.Section) (seq logic.ProgSequence, err error) {
 	seq = make(logic.ProgSequence, len(seqj))
 	var pi *logic.ProgItem
 	for i := range seqj {
@@ -75,7 +77,7 @@ func NewProgramJSON(name *string, sequence ProgSequenceJSON, sched *sched.Schedu
 }
 
 // ToProgram converts a ProgramJSON to a Program
-func (data *ProgramJSON) ToProgram(sections []logic.Section) (prog *logic.Program, err error) {
+func (data *ProgramJSON) ToProgram(sections []*logic.Section) (prog *logic.Program, err error) {
 	var (
 		sequence []logic.ProgItem
 		schedule = sched.Schedule{}
@@ -101,7 +103,17 @@ func (data *ProgramJSON) ToProgram(sections []logic.Section) (prog *logic.Progra
 
 // Update updates the data for this program based on the specified ProgramJSON, notifying
 // the runner of any changes.
-func (data *ProgramJSON) Update(prog *logic.Program, sections []logic.Section) (err error) {
+func (data *ProgramJSON) Update(prog *logic.Program, sections []*logic.Section) (err error) {
+	if err = data.update(prog, sections); err != nil {
+		return
+	}
+	// the program is unlocked first, since its runner locks it before it receives the refresh
+	prog.Refresh()
+	prog.OnUpdate(logic.ProgUpdateData)
+	return
+}
+
+func (data *ProgramJSON) update(prog *logic.Program, sections []*logic.Section) (err error) {
 	prog.Lock()
 	defer prog.Unlock()
 	if data.Name != nil {
@@ -120,8 +132,6 @@ func (data *ProgramJSON) Update(prog *logic.Program, sections []logic.Section) (
 	if data.Enabled != nil {
 		prog.Enabled = *data.Enabled
 	}
-	prog.Refresh()
-	prog.OnUpdate(logic.ProgUpdateData)
 	return
 }
 
@@ -133,18 +143,35 @@ func ProgramToJSON(prog *logic.Program) (data ProgramJSON) {
 	return ProgramJSON{prog.ID, &prog.Name, sequence, &prog.Sched, &prog.Enabled}
 }
 
+// ProgramStateJSON is the JSON representation of a Program along with whether it is currently running
+type ProgramStateJSON struct {
+	ProgramJSON
+	Running bool `json:"running"`
+}
+
+// ProgramToStateJSON locks and converts a Program to a ProgramStateJSON
+func ProgramToStateJSON(prog *logic.Program) ProgramStateJSON {
+	return ProgramStateJSON{ProgramToJSON(prog), prog.Running()}
+}
+
 // ProgramsJSON represents multiple ProgramJSONs in a JSON array
 type ProgramsJSON []ProgramJSON
 
-// ToPrograms converts this ProgramsJSON to Programs
-func (progs ProgramsJSON) ToPrograms(sections []logic.Section) (programs []*logic.Program, err error) {
+// ToPrograms converts this ProgramsJSON to Programs, keeping their ids, which must be unique
+func (progs ProgramsJSON) ToPrograms(sections []*logic.Section) (programs []*logic.Program, err error) {
 	var p *logic.Program
+	ids := make(map[int]bool)
 	for i := range progs {
+		if ids[progs[i].ID] {
+			err = fmt.Errorf("duplicate program id %d", progs[i].ID)
+			return
+		}
+		ids[progs[i].ID] = true
 		p, err = progs[i].ToProgram(sections)
 		if err != nil {
 			return
 		}
-		p.ID = i
+		p.ID = progs[i].ID
 		programs = append(programs, p)
 	}
 	return
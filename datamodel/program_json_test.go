@@ -30,7 +30,7 @@ func makeSchedule() Schedule {
 type ProgramSuite struct {
 	ass          *assert.Assertions
 	req          *require.Assertions
-	sections     []logic.Section
+	sections     []*logic.Section
 	secInterface *logic.MockSectionInterface
 	secRunner    *logic.SectionRunner
 	waitGroup    *sync.WaitGroup
@@ -45,9 +45,9 @@ func (s *ProgramSuite) SetupSuite() {
 
 	s.ass = assert.New(s.T())
 	s.req = require.New(s.T())
-	s.sections = []logic.Section{
-		logic.Section{ID: 0, Name: "mock 0", InterfaceID: 0},
-		logic.Section{ID: 1, Name: "mock 1", InterfaceID: 1},
+	s.sections = []*logic.Section{
+		{ID: 0, Name: "mock 0", InterfaceID: 0},
+		{ID: 1, Name: "mock 1", InterfaceID: 1},
 	}
 	s.waitGroup = &sync.WaitGroup{}
 	s.secInterface = logic.NewMockSectionInterface(2)
@@ -81,7 +81,7 @@ func (s *ProgramSuite) TestProgItem_JSON() {
 	pi, err := pij.ToProgItem(s.sections)
 	req.NoError(err)
 	ass.Equal(float64(1.0), pi.Duration.Minutes())
-	ass.Equal(&s.sections[1], pi.Sec)
+	ass.Equal(s.sections[1], pi.Sec)
 
 	pij.Duration = 60.0
 	pij.Section = 5 // out of range
@@ -120,8 +120,8 @@ func (s *ProgramSuite) TestProgram_JSON() {
 	req.NoError(err)
 	ass.Equal("test 1234", prog.Name)
 	ass.Equal(true, prog.Enabled)
-	ass.Equal(logic.ProgItem{Sec: &s.sections[0], Duration: 1*time.Hour + 2*time.Minute + 3*time.Second}, prog.Sequence[0])
-	ass.Equal(logic.ProgItem{Sec: &s.sections[1], Duration: 24 * time.Millisecond}, prog.Sequence[1])
+	ass.Equal(logic.ProgItem{Sec: s.sections[0], Duration: 1*time.Hour + 2*time.Minute + 3*time.Second}, prog.Sequence[0])
+	ass.Equal(logic.ProgItem{Sec: s.sections[1], Duration: 24 * time.Millisecond}, prog.Sequence[1])
 	ass.Equal(TimeOfDay{Hour: 1, Minute: 2, Second: 0, Millisecond: 0}, prog.Sched.Times[0])
 	ass.Contains(prog.Sched.Weekdays, time.Monday)
 	ass.Contains(prog.Sched.Weekdays, time.Wednesday)
@@ -158,9 +158,9 @@ func (s *ProgramSuite) TestPrograms_JSON() {
 
 	str := `[
 	{
-		"name": "p1", "sequence": []
+		"id": 3, "name": "p1", "sequence": []
 	}, {
-		"name": "p2", "sequence": [{"section": 0, "duration": 60.0}],
+		"id": 7, "name": "p2", "sequence": [{"section": 0, "duration": 60.0}],
 		"schedule": {},
 		"enabled": true
 	}
@@ -185,19 +185,25 @@ func (s *ProgramSuite) TestPrograms_JSON() {
 	req.NoError(err)
 
 	req.Len(ps, 2)
+	ass.Equal(3, ps[0].ID, "ids are kept")
+	ass.Equal(7, ps[1].ID)
 	ass.Equal("p1", ps[0].Name)
 	ass.Len(ps[0].Sequence, 0)
 	ass.Equal(false, ps[0].Enabled)
 
 	ass.Equal("p2", ps[1].Name)
 	req.Len(ps[1].Sequence, 1)
-	ass.Equal(&s.sections[0], ps[1].Sequence[0].Sec)
+	ass.Equal(s.sections[0], ps[1].Sequence[0].Sec)
 	ass.Equal("1m0s", ps[1].Sequence[0].Duration.String())
 	ass.Equal(true, ps[1].Enabled)
 
 	(psj[1].Sequence)[0].Section = 3
 	_, err = psj.ToPrograms(s.sections)
 	ass.Error(err)
+	(psj[1].Sequence)[0].Section = 0
+	psj[1].ID = 3
+	_, err = psj.ToPrograms(s.sections)
+	ass.Error(err, "program ids must be unique")
 
 	psj = ProgramsToJSON(ps)
 
@@ -217,7 +223,7 @@ func (s *ProgramSuite) TestProgram_Update() {
 	s.secInterface.SetupAllReturns()
 
 	prog := logic.NewProgram("test_update", []logic.ProgItem{
-		{Sec: &s.sections[0], Duration: 25 * time.Millisecond},
+		{Sec: s.sections[0], Duration: 25 * time.Millisecond},
 	}, makeSchedule(), false)
 
 	prog.Start(secRunner, nil)
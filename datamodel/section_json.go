@@ -0,0 +1,62 @@
+package datamodel
+
+import (
+	"fmt"
+
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+)
+
+// SectionStateJSON is the JSON representation of a Section along with whether it is currently on
+type SectionStateJSON struct {
+	*logic.Section
+	State bool `json:"state"`
+	// Fault is why the section can not currently be controlled, such as its remote node being offline
+	Fault string `json:"fault,omitempty"`
+}
+
+// SectionToStateJSON gets the SectionStateJSON of sec, which is controlled through secInterface
+func SectionToStateJSON(sec *logic.Section, secInterface logic.SectionInterface) SectionStateJSON {
+	data := sec.Snapshot()
+	j := SectionStateJSON{Section: &data, State: sec.GetState(secInterface)}
+	if fault := sec.GetFault(secInterface); fault != nil {
+		j.Fault = fault.Error()
+	}
+	return j
+}
+
+// SectionDataJSON is the JSON representation of the data of a Section which can be set by requests. Fields which
+// are nil are not changed.
+type SectionDataJSON struct {
+	Name        *string          `json:"name"`
+	InterfaceID *logic.SectionID `json:"interfaceId"`
+	// MaxRunTime is the maximum time in seconds the section may be on at once, or 0 for no limit
+	MaxRunTime *float64 `json:"maxRunTime"`
+}
+
+// Validate checks that the data which is set is valid
+func (data *SectionDataJSON) Validate() (err error) {
+	if data.MaxRunTime != nil && *data.MaxRunTime < 0 {
+		err = fmt.Errorf("maxRunTime must not be negative")
+	}
+	return
+}
+
+// ToSection converts a SectionDataJSON to a new Section, which requires the name and interface id
+func (data *SectionDataJSON) ToSection() (sec logic.Section, err error) {
+	if err = util.CheckNotNil(data.Name, "name"); err != nil {
+		return
+	}
+	if err = util.CheckNotNil(data.InterfaceID, "interfaceId"); err != nil {
+		return
+	}
+	if err = data.Validate(); err != nil {
+		return
+	}
+	// id will be assigned later
+	sec = logic.NewSection(0, *data.Name, *data.InterfaceID)
+	if data.MaxRunTime != nil {
+		sec.MaxRunTime = *data.MaxRunTime
+	}
+	return
+}
@@ -1,25 +1,36 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/url"
 	"strconv"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 var (
-	clientID = flag.String("cid", "grinklers_client", "The MQTT client ID to connect with")
+	clientID    = flag.String("cid", "grinklers_client", "The MQTT client ID to connect with")
+	requestType = flag.String("request", "", "Make an api request of this type, such as getSections, with MQTT 5 "+
+		"and print the response. The server must receive requests with MQTT 5")
+	requestData = flag.String("data", "{}", "The JSON data of the request made with -request")
+	apiToken    = flag.String("token", "", "The token to make requests with, if the server requires one")
 )
 
 var (
-	timeoutPeriod = 100 * time.Millisecond
-	timeoutError  = errors.New("the operation timed out")
+	timeoutPeriod  = 100 * time.Millisecond
+	requestTimeout = 5 * time.Second
+	timeoutError   = errors.New("the operation timed out")
 )
 
 type Section struct {
@@ -39,6 +50,11 @@ type GrinklersClient struct {
 	connected   bool
 	numSections int
 	sections    []Section
+	nextRequest int
+
+	// requests is the MQTT 5 connection requests are made with, and responses receives the responses to them
+	requests  *paho.Client
+	responses chan *paho.Publish
 }
 
 func NewGrinklersClient(mqttClient mqtt.Client, prefix string) *GrinklersClient {
@@ -48,8 +64,39 @@ func NewGrinklersClient(mqttClient mqtt.Client, prefix string) *GrinklersClient
 	return &GrinklersClient{
 		mqttClient, prefix,
 		chanConnected, chanNumSections, chanSections,
-		false, -1, nil,
+		false, -1, nil, 0,
+		nil, make(chan *paho.Publish, 1),
+	}
+}
+
+// ConnectRequests connects to the broker at mqttUrl with MQTT 5, which requests are made with
+func (c *GrinklersClient) ConnectRequests(mqttUrl *url.URL) (err error) {
+	var conn net.Conn
+	switch mqttUrl.Scheme {
+	case "ssl", "tls", "mqtts":
+		conn, err = tls.Dial("tcp", mqttUrl.Host, &tls.Config{})
+	default:
+		conn, err = net.Dial("tcp", mqttUrl.Host)
+	}
+	if err != nil {
+		return
 	}
+	c.requests = paho.NewClient(paho.ClientConfig{
+		Conn: packets.NewThreadSafeConn(conn),
+		OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+			func(received paho.PublishReceived) (bool, error) {
+				select {
+				case c.responses <- received.Packet:
+				default:
+				}
+				return true, nil
+			},
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err = c.requests.Connect(ctx, &paho.Connect{ClientID: *clientID + "-requests", KeepAlive: 30, CleanStart: true})
+	return
 }
 
 func (c *GrinklersClient) Connect() {
@@ -62,6 +109,9 @@ func (c *GrinklersClient) Connect() {
 
 func (c *GrinklersClient) Disconnect() {
 	c.mqttClient.Disconnect(250)
+	if c.requests != nil {
+		c.requests.Disconnect(&paho.Disconnect{})
+	}
 }
 
 func (c *GrinklersClient) subscribe() {
@@ -187,6 +237,61 @@ func (c *GrinklersClient) GetSections() ([]Section, error) {
 	return sections, nil
 }
 
+// Request makes an api request of requestType with data, and waits for the response. The response is published to
+// the response topic of the request, which is for this client only, and matched to the request by its correlation
+// data.
+func (c *GrinklersClient) Request(requestType string, data map[string]interface{}) (res map[string]interface{},
+	err error) {
+	c.nextRequest++
+	correlationData := []byte(strconv.Itoa(c.nextRequest))
+	responseTopic := fmt.Sprintf("%s/responses/%s", c.prefix, *clientID)
+	request := map[string]interface{}{}
+	for key, value := range data {
+		request[key] = value
+	}
+	request["type"] = requestType
+	request["rid"] = c.nextRequest
+	if *apiToken != "" {
+		request["token"] = *apiToken
+	}
+	reqBytes, err := json.Marshal(request)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if _, err = c.requests.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: responseTopic, QoS: 1}},
+	}); err != nil {
+		return
+	}
+	defer c.requests.Unsubscribe(context.Background(), &paho.Unsubscribe{Topics: []string{responseTopic}})
+	if _, err = c.requests.Publish(ctx, &paho.Publish{
+		Topic: c.prefix + "/requests", QoS: 1, Payload: reqBytes,
+		Properties: &paho.PublishProperties{ResponseTopic: responseTopic, CorrelationData: correlationData},
+	}); err != nil {
+		return
+	}
+	for {
+		select {
+		case response := <-c.responses:
+			if response.Properties == nil || !bytes.Equal(response.Properties.CorrelationData, correlationData) {
+				continue
+			}
+			if err = json.Unmarshal(response.Payload, &res); err != nil {
+				return nil, fmt.Errorf("invalid response received: %v", err)
+			}
+			if res["result"] == "error" {
+				err = fmt.Errorf("request failed: %v", res["message"])
+			}
+			return
+		case <-ctx.Done():
+			return nil, timeoutError
+		}
+	}
+}
+
 func createMqttOptions(mqttUrl *url.URL) *mqtt.ClientOptions {
 	opts := mqtt.NewClientOptions()
 
@@ -242,6 +347,25 @@ func main() {
 		entry.Fatalf("no grinklers server connected at prefix. exiting")
 	}
 
+	if *requestType != "" {
+		if err := client.ConnectRequests(mqttUrl); err != nil {
+			log.WithError(err).Fatal("error connecting to mqtt broker with mqtt 5")
+		}
+		var data map[string]interface{}
+		if err := json.Unmarshal([]byte(*requestData), &data); err != nil {
+			log.WithError(err).Fatal("invalid request data")
+		}
+		res, err := client.Request(*requestType, data)
+		if res != nil {
+			resBytes, _ := json.MarshalIndent(res, "", "  ")
+			fmt.Println(string(resBytes))
+		}
+		if err != nil {
+			log.WithError(err).Fatal("error making request")
+		}
+		return
+	}
+
 	log.Debug("requesting number of sections")
 	numSections, err := client.GetNumSections()
 	if err != nil {
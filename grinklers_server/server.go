@@ -1,15 +1,22 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"sync"
+	"syscall"
 
+	"git.amikhalev.com/amikhalev/grinklers/api"
+	"git.amikhalev.com/amikhalev/grinklers/history"
 	"git.amikhalev.com/amikhalev/grinklers/http"
 
 	c "git.amikhalev.com/amikhalev/grinklers/config"
 	l "git.amikhalev.com/amikhalev/grinklers/logic"
 	"git.amikhalev.com/amikhalev/grinklers/mqtt"
+	"git.amikhalev.com/amikhalev/grinklers/persist"
+	"git.amikhalev.com/amikhalev/grinklers/rest"
 	"git.amikhalev.com/amikhalev/grinklers/util"
 	log "github.com/Sirupsen/logrus"
 	"github.com/joho/godotenv"
@@ -18,86 +25,257 @@ import (
 var logger = util.Logger.WithField("module", "server")
 
 func main() {
-	util.InitLogLevel()
-	// channel which is notified on an interrupt signal
-	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, os.Interrupt, os.Kill)
-
+	// the environment is loaded first, since it supplies the defaults of the flags
 	godotenv.Load()
+	options := c.NewOptions(flag.CommandLine, os.Getenv)
+	exportPath := flag.String("export", "", "export the config, including the sections, programs and device data "+
+		"in storage, to a config file at this path and exit")
+	rollback := flag.Int("rollback", 0, "replace the config file with its `n`th most recent backup and exit")
+	checkConfig := flag.Bool("check-config", false, "check that the config file is valid, print it migrated to the "+
+		"latest version and exit")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(out, "\nEffective configuration (flags take precedence over the environment, "+
+			"which takes precedence over the config file):\n")
+		options.PrintEffective(out)
+	}
+	flag.Parse()
+
+	if err := options.Apply(); err != nil {
+		logger.WithError(err).Fatalf("invalid options")
+	}
+
+	if *rollback != 0 {
+		if err := c.RollbackConfig(*rollback); err != nil {
+			logger.WithError(err).Fatalf("error rolling back config")
+		}
+		return
+	}
+
+	if *checkConfig {
+		normalized, err := c.CheckConfig(options)
+		if err != nil {
+			logger.WithError(err).Fatalf("invalid config")
+		}
+		os.Stdout.Write(append(normalized, '\n'))
+		return
+	}
 
-	config, err := c.LoadConfig()
+	config, err := c.LoadConfig(options)
 	if err != nil {
 		logger.WithError(err).Fatalf("error loading config")
 	}
 
+	if *exportPath != "" {
+		err = c.ExportConfig(&config, *exportPath)
+		if config.Store != nil {
+			config.Store.Close()
+		}
+		if err != nil {
+			logger.WithError(err).Fatalf("error exporting config")
+		}
+		logger.WithField("path", *exportPath).Info("exported config")
+		return
+	}
+
 	err = config.SectionInterface.Initialize()
 	if err != nil {
 		logger.WithError(err).Fatalf("error initializing sections")
 	}
 
+	// from here on, all sections are turned off however the process exits
+	shutdown := l.NewShutdownCoordinator(config.SectionInterface)
+	shutdown.HandleSignals()
+	log.RegisterExitHandler(func() {
+		shutdown.Shutdown("fatal error")
+	})
+
+	l.AllOff(config.SectionInterface)
+
 	waitGroup := sync.WaitGroup{}
 
+	// updates to sections, programs and the section runner are published here for the mqtt api and event streams
+	events := l.NewEventBus()
+	config.SetEventBus(events)
+
 	secRunner := l.NewSectionRunner(config.SectionInterface)
+	secRunner.SetEventBus(events)
+	secRunner.SetMaxRunTime(config.MaxRunTime)
+	secRunner.SetPanicHandler(shutdown.HandlePanic)
+
+	var hist *history.History
+	if config.Store != nil {
+		hist = history.New(config.Store)
+		// registered first so it is closed last, after the section runner has recorded its last run
+		shutdown.OnShutdown(func() { config.Store.Close() })
+	} else if config.History != nil {
+		store, err := history.OpenFile(config.History.Path)
+		if err != nil {
+			logger.WithError(err).Error("error opening history, continuing without it")
+		} else {
+			hist = history.New(store)
+			shutdown.OnShutdown(func() { store.Close() })
+		}
+	}
+	if hist != nil {
+		secRunner.SetRunRecorder(hist)
+	}
+
+	var persister *persist.Persister
+	if config.Persist != nil {
+		err = persist.Restore(config.Persist, secRunner, config.Sections, config.Programs)
+		if err != nil {
+			logger.WithError(err).Error("error restoring persisted state, starting with an empty queue")
+		}
+		persister = persist.New(config.Persist.Path, &secRunner.State)
+		secRunner.SetStatePersister(persister)
+		persister.Start()
+	}
+
 	secRunner.Start(&waitGroup)
 
+	if config.Watchdog != nil {
+		wdog := config.Watchdog.ToWatchdog(secRunner)
+		err = wdog.Start()
+		if err != nil {
+			logger.WithError(err).Error("error starting watchdog, continuing without it")
+		} else {
+			shutdown.OnShutdown(func() { wdog.Stop() })
+		}
+	}
+
 	sections := config.Sections
 	programs := config.Programs
 
 	logger.Debug("initializing sections and programs")
 
-	stopAll := func() {
-		for i := range sections {
-			sections[i].SetState(false, config.SectionInterface)
-		}
-	}
-	stopAll()
-
-	for i := range programs {
-		programs[i].Start(secRunner, &waitGroup)
+	// programs added at runtime are also started and quit with these
+	config.StartPrograms(secRunner, &waitGroup)
+	shutdown.OnShutdown(func() {
+		config.QuitPrograms()
+		secRunner.Quit()
+		waitGroup.Wait()
+	})
+	if persister != nil {
+		// hooks run in reverse, so this stops persisting before programs are cancelled by quitting them
+		shutdown.OnShutdown(persister.Stop)
 	}
 
 	logger.WithFields(log.Fields{
 		"lenSections": len(sections), "lenPrograms": len(programs),
 	}).Info("initialized sections and programs")
 
-	// httpConfig := &http.Config{ApiURL: apiUrl, DeviceRegistrationToken: deviceRegToken}
-	httpConfig := config.HTTPConfig
-	httpApiClient := http.NewAPIClient(httpConfig)
-	if config.DeviceData == nil {
-		err = httpApiClient.Register()
-		if err != nil {
-			logger.WithError(err).Error("error registering device")
-		} else {
-			config.DeviceData = httpApiClient.Device
+	var connectData *http.ConnectData
+	switch {
+	case options.Offline:
+		logger.Info("running offline, not connecting to the sprinklers API or an mqtt broker")
+	case config.MQTT != nil:
+		logger.Info("running standalone, connecting directly to the mqtt broker")
+		connectData = config.MQTT.ToConnectData()
+		if options.MQTTURL != "" {
+			connectData.MqttURL = options.MQTTURL
 		}
+	default:
+		connectData = connectDevice(&config, options)
 	}
 
 	logger.Info("writing back config")
 	c.WriteConfig(&config)
 
-	httpApiClient.Device = config.DeviceData
-	connectData, err := httpApiClient.Connect()
-	if err != nil {
-		logger.WithError(err).Error("error connecting device")
+	mqttApi := mqtt.NewMQTTApi(&config, secRunner)
+	if hist != nil {
+		mqttApi.SetHistory(hist)
+	}
+	if !options.Offline {
+		if err = mqttApi.Start(connectData); err != nil {
+			logger.WithError(err).Error("error starting mqtt api, continuing without it")
+		}
 	}
+	shutdown.OnShutdown(mqttApi.Stop)
 
-	api := mqtt.NewMQTTApi(&config, secRunner)
-	api.Start(connectData)
+	if config.REST != nil {
+		handlers := api.NewHandlers(&config, secRunner)
+		if hist != nil {
+			handlers.SetHistory(hist)
+		}
+		stream := rest.NewStream(&config, secRunner, events)
+		restServer := rest.NewServer(config.REST.Address, handlers, stream)
+		if err = restServer.Start(); err != nil {
+			logger.WithError(err).Error("error starting rest api, continuing without it")
+		} else {
+			shutdown.OnShutdown(restServer.Stop)
+		}
+	}
 
-	updater := mqtt.NewMQTTUpdater(&config, secRunner)
+	updater := mqtt.NewMQTTUpdater(&config, events)
+	if hist != nil {
+		updater.SetHistory(hist)
+	}
+
+	updater.Start(mqttApi)
+	shutdown.OnShutdown(updater.Stop)
+
+	reloadConfig := func() {
+		if err := c.ReloadConfig(&config); err != nil {
+			logger.WithError(err).Error("error reloading config, keeping the old config")
+		}
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logger.Info("received SIGHUP, reloading config")
+			reloadConfig()
+		}
+	}()
+	watcher, err := c.NewWatcher(&config)
+	if err != nil {
+		logger.WithError(err).Warn("error watching config file, it will only be reloaded on SIGHUP")
+	} else {
+		watcher.Start()
+		shutdown.OnShutdown(watcher.Stop)
+	}
 
-	updater.Start(api)
+	<-shutdown.Done()
+	if shutdown.Panicked() {
+		os.Exit(1)
+	}
+}
 
-	<-sigc
+// connectDevice registers the device with the sprinklers API if it is not registered yet, and connects it to
+// get the mqtt broker to connect to. nil is returned if it can not be connected.
+func connectDevice(config *c.ConfigData, options *c.Options) (connectData *http.ConnectData) {
+	// a copy, so that an overridden url is not written back to the config file
+	httpConfig := *config.HTTPConfig
+	if options.APIURL != "" {
+		httpConfig.ApiURL = options.APIURL
+	}
+	httpApiClient := http.NewAPIClient(&httpConfig)
+	if config.DeviceData == nil {
+		err := httpApiClient.Register()
+		if err != nil {
+			logger.WithError(err).Error("error registering device")
+		} else {
+			config.DeviceData = httpApiClient.Device
+		}
+	}
 
-	logger.Info("cleaning up...")
-	updater.Stop()
-	api.Stop()
-	for i := range programs {
-		programs[i].Quit()
+	httpApiClient.Device = config.DeviceData
+	if options.MQTTURL != "" {
+		// connect straight to the broker, with the same credentials the sprinklers API would give
+		connectData = &http.ConnectData{DeviceConnectResult: &http.DeviceConnectResult{MqttURL: options.MQTTURL}}
+		if config.DeviceData != nil {
+			connectData.DeviceToken = config.DeviceData.DeviceToken
+			connectData.DeviceID = config.DeviceData.DeviceID
+			connectData.ClientID = config.DeviceData.DeviceID
+		}
+		return
+	}
+	connectData, err := httpApiClient.Connect()
+	if err != nil {
+		logger.WithError(err).Error("error connecting device")
 	}
-	secRunner.Quit()
-	waitGroup.Wait()
-	stopAll()
-	config.SectionInterface.Deinitialize()
+	return
 }
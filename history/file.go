@@ -0,0 +1,88 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/datamodel"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/Sirupsen/logrus"
+)
+
+// FileStore is an append-only Store which keeps records in a file as JSON lines
+type FileStore struct {
+	path string
+	file *os.File
+	mu   sync.Mutex
+	log  *logrus.Entry
+}
+
+// OpenFile opens the history file at path, creating it if it does not exist
+func OpenFile(path string) (s *FileStore, err error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		err = fmt.Errorf("could not open history file: %v", err)
+		return
+	}
+	s = &FileStore{
+		path, file, sync.Mutex{},
+		util.Logger.WithFields(logrus.Fields{"module": "history", "path": path}),
+	}
+	return
+}
+
+var _ Store = (*FileStore)(nil)
+
+// Append implements Store
+func (s *FileStore) Append(record datamodel.RunRecordJSON) (err error) {
+	data, err := json.Marshal(&record)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	_, err = s.file.Write(append(data, '\n'))
+	s.mu.Unlock()
+	if err != nil {
+		err = fmt.Errorf("could not write history file: %v", err)
+	}
+	return
+}
+
+// Entries implements Store. Lines which can not be parsed, such as one that was only partly written before a
+// crash, are skipped.
+func (s *FileStore) Entries(since time.Time) (entries []datamodel.RunRecordJSON, err error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		err = fmt.Errorf("could not read history file: %v", err)
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var entry datamodel.RunRecordJSON
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			s.log.WithError(err).WithField("line", line).Warn("skipping invalid history record")
+			continue
+		}
+		if !entry.Time().Before(since) {
+			entries = append(entries, entry)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		err = fmt.Errorf("could not read history file: %v", err)
+	}
+	return
+}
+
+// Close closes the file. Any records appended after it is closed are lost
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,123 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/datamodel"
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestStore(t *testing.T) (s *FileStore, cleanup func()) {
+	util.Logger.Out = ioutil.Discard
+	dir, err := ioutil.TempDir("", "history")
+	require.NoError(t, err)
+	s, err = OpenFile(filepath.Join(dir, "history.jsonl"))
+	require.NoError(t, err)
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	l, cleanup := openTestStore(t)
+	defer cleanup()
+
+	now := time.Now()
+	start := now.Add(-time.Hour)
+	progID := 1
+	req.NoError(l.Append(datamodel.RunRecordJSON{Section: 0, StartTime: &start, EndTime: now, ActualDuration: 60}))
+	req.NoError(l.Append(datamodel.RunRecordJSON{
+		Section: 1, Program: &progID, EndTime: now, Cancelled: true, SkipReason: logic.SkipCancelled,
+	}))
+
+	// a partially written record is skipped
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0)
+	req.NoError(err)
+	file.WriteString(`{"section": 2, "endT`)
+	file.Close()
+
+	entries, err := l.Entries(time.Time{})
+	req.NoError(err)
+	req.Len(entries, 2)
+	ass.Equal(0, entries[0].Section)
+	ass.Equal(60.0, entries[0].ActualDuration)
+	ass.True(start.Equal(*entries[0].StartTime))
+	ass.Equal(1, *entries[1].Program)
+	ass.Equal(logic.SkipCancelled, entries[1].SkipReason)
+
+	entries, err = l.Entries(now.Add(-time.Minute))
+	req.NoError(err)
+	req.Len(entries, 1, "entries are filtered by when they started")
+	ass.Equal(1, entries[0].Section)
+}
+
+func TestHistory_SectionRunner(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+	l := New(store)
+	onRecord := make(chan struct{}, 1)
+	l.OnRecord = onRecord
+
+	secInterface := logic.NewMockSectionInterface(2)
+	secInterface.Initialize()
+	secs := []logic.Section{logic.NewSection(0, "sec 0", 0), logic.NewSection(1, "sec 1", 1)}
+	sr := logic.NewSectionRunner(secInterface)
+	sr.SetRunRecorder(l)
+	sr.Start(nil)
+
+	start := time.Now()
+	_, done := sr.RunSectionAsync(&secs[0], 10*time.Millisecond)
+	sr.QueueSectionRun(&secs[1], time.Minute)
+	sr.QueueSectionRun(&secs[0], time.Minute)
+	ass.False(<-done)
+	firstDone := time.Since(start)
+	time.Sleep(10 * time.Millisecond)
+	sr.CancelAll()
+	var entries []datamodel.RunRecordJSON
+	ass.Eventually(func() bool {
+		var err error
+		entries, err = store.Entries(time.Time{})
+		return err == nil && len(entries) == 3
+	}, time.Second, time.Millisecond, "all runs should be recorded")
+	elapsed := time.Since(start)
+	sr.Quit()
+
+	select {
+	case <-onRecord:
+	default:
+		ass.Fail("OnRecord should be signalled")
+	}
+
+	req.Len(entries, 3)
+	ass.False(entries[0].Cancelled)
+	ass.Equal(0.01, entries[0].RequestedDuration)
+	// the actual durations depend on scheduling, so they are only bounded by how long the test took
+	ass.GreaterOrEqual(entries[0].ActualDuration, 0.01)
+	ass.LessOrEqual(entries[0].ActualDuration, firstDone.Seconds())
+	// queued runs are skipped before the current run is cancelled
+	ass.Equal(logic.SkipCancelled, entries[1].SkipReason)
+	ass.Equal(logic.CancelByUser, entries[1].CancelReason)
+	ass.Nil(entries[1].StartTime)
+	ass.Zero(entries[1].ActualDuration)
+	ass.True(entries[2].Cancelled)
+	ass.Equal(logic.CancelByUser, entries[2].CancelReason)
+	ass.Equal(60.0, entries[2].RequestedDuration)
+	ass.Greater(entries[2].ActualDuration, 0.0)
+	ass.LessOrEqual(entries[2].ActualDuration, elapsed.Seconds()-entries[0].ActualDuration)
+
+	totals, err := l.Totals(Day, 1, time.Now())
+	req.NoError(err)
+	req.Len(totals, 1)
+	ass.Equal(&SectionTotal{1, 0, 1, 0.01, entries[0].ActualDuration}, totals[0].Sections[0])
+	ass.Equal(&SectionTotal{1, 1, 0, 60, entries[2].ActualDuration}, totals[0].Sections[1])
+}
@@ -0,0 +1,77 @@
+// Package history keeps a log of every section run, and summarizes it into per-section totals.
+package history
+
+import (
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/datamodel"
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/Sirupsen/logrus"
+)
+
+// Config is the configuration of the run history
+type Config struct {
+	// Path is the file the history is appended to, with one JSON record per line
+	Path string `json:"path"`
+}
+
+// Validate checks that the configuration is valid
+func (c *Config) Validate() error {
+	if c.Path == "" {
+		return util.NewNotSpecifiedError("history path")
+	}
+	return nil
+}
+
+// Store is where run records are stored
+type Store interface {
+	// Append adds a record to the end of the history
+	Append(record datamodel.RunRecordJSON) error
+	// Entries gets all records counted at or after since, in the order they were appended
+	Entries(since time.Time) ([]datamodel.RunRecordJSON, error)
+}
+
+// History records every section run into a Store. It is a logic.RunRecorder.
+type History struct {
+	store Store
+	// OnRecord is signalled whenever a record is appended. Signals are dropped if one is already pending.
+	OnRecord chan<- struct{}
+	log      *logrus.Entry
+}
+
+// New creates a new History which records runs into store
+func New(store Store) *History {
+	return &History{store, nil, util.Logger.WithField("module", "history")}
+}
+
+// Store gets the Store runs are recorded into
+func (h *History) Store() Store {
+	return h.store
+}
+
+// RecordRun implements logic.RunRecorder
+func (h *History) RecordRun(record logic.RunRecord) {
+	if err := h.store.Append(datamodel.RunRecordToJSON(&record)); err != nil {
+		h.log.WithError(err).Error("error recording section run")
+		return
+	}
+	if h.OnRecord != nil {
+		select {
+		case h.OnRecord <- struct{}{}:
+		default:
+		}
+	}
+}
+
+var _ logic.RunRecorder = (*History)(nil)
+
+// Totals gets the per-section totals for the count periods up to and including the one containing now
+func (h *History) Totals(period Period, count int, now time.Time) (totals []Totals, err error) {
+	entries, err := h.store.Entries(period.Start(now, count-1))
+	if err != nil {
+		return
+	}
+	totals = Summarize(entries, period, count, now)
+	return
+}
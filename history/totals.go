@@ -0,0 +1,115 @@
+package history
+
+import (
+	"fmt"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/datamodel"
+)
+
+// Period is a calendar period history is summarized over
+type Period string
+
+const (
+	// Day is a calendar day, starting at midnight
+	Day Period = "day"
+	// Week is a calendar week, starting at midnight on monday
+	Week Period = "week"
+	// Month is a calendar month, starting at midnight on the first
+	Month Period = "month"
+)
+
+// Periods are all of the valid Periods
+var Periods = []Period{Day, Week, Month}
+
+// ParsePeriod parses a Period from its name
+func ParsePeriod(str string) (p Period, err error) {
+	for _, p = range Periods {
+		if string(p) == str {
+			return
+		}
+	}
+	err = fmt.Errorf("invalid period '%s'", str)
+	return
+}
+
+// Start gets the start of the period ago periods before the one containing t, in the location of t
+func (p Period) Start(t time.Time, ago int) time.Time {
+	year, month, day := t.Date()
+	switch p {
+	case Week:
+		weekday := (int(t.Weekday()) + 6) % 7 // days since monday
+		return time.Date(year, month, day-weekday-7*ago, 0, 0, 0, 0, t.Location())
+	case Month:
+		return time.Date(year, month-time.Month(ago), 1, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(year, month, day-ago, 0, 0, 0, 0, t.Location())
+	}
+}
+
+// SectionTotal is the total of all runs of a section in a period
+type SectionTotal struct {
+	// Runs is the number of runs which started
+	Runs int `json:"runs"`
+	// Cancelled is the number of runs which started, but were cancelled before they finished
+	Cancelled int `json:"cancelled"`
+	// Skipped is the number of runs which never started
+	Skipped int `json:"skipped"`
+	// RequestedDuration is the total duration in seconds of the runs which started
+	RequestedDuration float64 `json:"requestedDuration"`
+	// ActualDuration is the total duration in seconds the section was actually on for
+	ActualDuration float64 `json:"actualDuration"`
+}
+
+// Totals are the per-section totals of a single period
+type Totals struct {
+	Period Period    `json:"period"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	// Sections maps section ids to their totals. Sections without any runs are omitted
+	Sections map[int]*SectionTotal `json:"sections"`
+}
+
+func (t *Totals) add(entry *datamodel.RunRecordJSON) {
+	total := t.Sections[entry.Section]
+	if total == nil {
+		total = &SectionTotal{}
+		t.Sections[entry.Section] = total
+	}
+	if entry.SkipReason != "" {
+		total.Skipped++
+		return
+	}
+	total.Runs++
+	if entry.Cancelled {
+		total.Cancelled++
+	}
+	total.RequestedDuration += entry.RequestedDuration
+	total.ActualDuration += entry.ActualDuration
+}
+
+// Summarize computes the per-section totals of entries for the count periods up to and including the
+// one containing now, oldest first. Entries outside of those periods are ignored.
+func Summarize(entries []datamodel.RunRecordJSON, period Period, count int, now time.Time) (totals []Totals) {
+	if count < 1 {
+		return
+	}
+	totals = make([]Totals, count)
+	for i := range totals {
+		ago := count - 1 - i
+		totals[i] = Totals{
+			period, period.Start(now, ago), period.Start(now, ago-1), make(map[int]*SectionTotal),
+		}
+	}
+	for i := range entries {
+		entry := &entries[i]
+		t := entry.Time().In(now.Location())
+		for j := range totals {
+			if !t.Before(totals[j].Start) && t.Before(totals[j].End) {
+				totals[j].add(entry)
+				break
+			}
+		}
+	}
+	return
+}
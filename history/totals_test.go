@@ -0,0 +1,76 @@
+package history
+
+import (
+	"testing"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/datamodel"
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePeriod(t *testing.T) {
+	ass := assert.New(t)
+	for _, p := range Periods {
+		parsed, err := ParsePeriod(string(p))
+		ass.NoError(err)
+		ass.Equal(p, parsed)
+	}
+	_, err := ParsePeriod("year")
+	ass.Error(err)
+}
+
+func TestPeriod_Start(t *testing.T) {
+	ass := assert.New(t)
+	// a wednesday
+	now := time.Date(2017, time.March, 1, 15, 30, 0, 0, time.UTC)
+	date := func(month time.Month, day int) time.Time {
+		return time.Date(2017, month, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	ass.Equal(date(time.March, 1), Day.Start(now, 0))
+	ass.Equal(date(time.February, 28), Day.Start(now, 1))
+	ass.Equal(date(time.March, 2), Day.Start(now, -1))
+	ass.Equal(date(time.February, 27), Week.Start(now, 0))
+	ass.Equal(date(time.February, 20), Week.Start(now, 1))
+	ass.Equal(date(time.February, 27), Week.Start(date(time.March, 5), 0), "sunday is the end of the week")
+	ass.Equal(date(time.February, 27), Week.Start(date(time.February, 27), 0))
+	ass.Equal(date(time.March, 1), Month.Start(now, 0))
+	ass.Equal(date(time.January, 1), Month.Start(now, 2))
+	ass.Equal(time.Date(2016, time.December, 1, 0, 0, 0, 0, time.UTC), Month.Start(now, 3))
+}
+
+func TestSummarize(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	now := time.Date(2017, time.March, 1, 15, 30, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+	entries := []datamodel.RunRecordJSON{
+		{Section: 0, StartTime: at(-48 * time.Hour), RequestedDuration: 60, ActualDuration: 60},
+		{Section: 0, StartTime: at(-24 * time.Hour), RequestedDuration: 60, ActualDuration: 60},
+		{Section: 0, StartTime: at(-time.Hour), RequestedDuration: 60, ActualDuration: 60},
+		{Section: 0, StartTime: at(-time.Hour), RequestedDuration: 60, ActualDuration: 30, Cancelled: true,
+			CancelReason: logic.CancelByMaxRunTime},
+		{Section: 1, EndTime: *at(-time.Minute), RequestedDuration: 60, Cancelled: true,
+			SkipReason: logic.SkipDiscarded},
+	}
+
+	totals := Summarize(entries, Day, 2, now)
+	req.Len(totals, 2)
+	ass.Equal(Day, totals[0].Period)
+	ass.Equal(Day.Start(now, 1), totals[0].Start)
+	ass.Equal(Day.Start(now, 0), totals[0].End)
+	ass.Equal(map[int]*SectionTotal{0: {1, 0, 0, 60, 60}}, totals[0].Sections)
+	ass.Equal(map[int]*SectionTotal{0: {2, 1, 0, 120, 90}, 1: {0, 0, 1, 0, 0}}, totals[1].Sections)
+
+	totals = Summarize(entries, Month, 1, now)
+	req.Len(totals, 1)
+	ass.Equal(map[int]*SectionTotal{0: {2, 1, 0, 120, 90}, 1: {0, 0, 1, 0, 0}}, totals[0].Sections)
+	totals = Summarize(entries, Week, 1, now)
+	ass.Equal(4, totals[0].Sections[0].Runs)
+
+	ass.Empty(Summarize(entries, Day, 0, now))
+}
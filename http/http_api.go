@@ -53,17 +53,19 @@ func checkAPIError(err interface{}) *APIError {
 }
 
 type Config struct {
-	ApiURL                  string
-	DeviceRegistrationToken string
+	ApiURL                  string `json:"apiUrl"`
+	DeviceRegistrationToken string `json:"deviceRegistrationToken"`
 }
 
 type DeviceData struct {
-	DeviceID    string
-	DeviceToken string
+	DeviceID    string `json:"deviceId"`
+	DeviceToken string `json:"deviceToken"`
 }
 
 type ConnectData struct {
 	DeviceToken string
+	// Username is the username to authenticate to the MQTT broker with. The DeviceID is used if it is empty
+	Username string
 	*DeviceConnectResult
 }
 
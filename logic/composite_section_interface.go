@@ -0,0 +1,114 @@
+package logic
+
+import (
+	"fmt"
+	"sort"
+
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/Sirupsen/logrus"
+)
+
+// CompositeChannel is the channel on a backend of a CompositeSectionInterface that a section maps to
+type CompositeChannel struct {
+	// Backend is the name of the backend
+	Backend string `json:"backend"`
+	// Channel is the id of the section on the backend SectionInterface
+	Channel SectionID `json:"channel"`
+}
+
+// CompositeSectionInterface is a SectionInterface which spans multiple backend SectionInterfaces. Each
+// SectionID on the CompositeSectionInterface maps to a channel on one of the backends.
+type CompositeSectionInterface struct {
+	backends     map[string]SectionInterface
+	backendNames []string
+	channels     []CompositeChannel
+	log          *logrus.Entry
+}
+
+var _ SectionInterface = (*CompositeSectionInterface)(nil)
+var _ FaultReporter = (*CompositeSectionInterface)(nil)
+
+// NewCompositeSectionInterface creates a new CompositeSectionInterface with the specified backends, where
+// channels[i] is the backend channel for SectionID i. Returns an error if any channel is not valid for its backend.
+func NewCompositeSectionInterface(backends map[string]SectionInterface, channels []CompositeChannel) (*CompositeSectionInterface, error) {
+	backendNames := make([]string, 0, len(backends))
+	for name := range backends {
+		backendNames = append(backendNames, name)
+	}
+	sort.Strings(backendNames)
+	for i, ch := range channels {
+		backend, ok := backends[ch.Backend]
+		if !ok {
+			return nil, fmt.Errorf("section %d: no such backend '%s'", i, ch.Backend)
+		}
+		if ch.Channel >= backend.Count() {
+			return nil, fmt.Errorf("section %d: channel out of range for backend '%s': %d >= %d",
+				i, ch.Backend, ch.Channel, backend.Count())
+		}
+	}
+	return &CompositeSectionInterface{
+		backends, backendNames, channels,
+		util.Logger.WithField("section_interface", "composite"),
+	}, nil
+}
+
+func (c *CompositeSectionInterface) Name() string {
+	return "composite"
+}
+
+// Backend gets the backend with the specified name, or nil if there is none
+func (c *CompositeSectionInterface) Backend(name string) SectionInterface {
+	return c.backends[name]
+}
+
+func (c *CompositeSectionInterface) forEachBackend(f func(SectionInterface) error) error {
+	var errs util.Errors
+	for _, name := range c.backendNames {
+		if err := f(c.backends[name]); err != nil {
+			errs = append(errs, fmt.Errorf("backend '%s': %v", name, err))
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// Initialize initializes every backend. All backends are initialized even if some fail, and the errors are
+// aggregated.
+func (c *CompositeSectionInterface) Initialize() error {
+	c.log.WithField("backends", c.backendNames).Info("initializing backends")
+	return c.forEachBackend(SectionInterface.Initialize)
+}
+
+// Deinitialize deinitializes every backend. All backends are deinitialized even if some fail, and the errors are
+// aggregated.
+func (c *CompositeSectionInterface) Deinitialize() error {
+	return c.forEachBackend(SectionInterface.Deinitialize)
+}
+
+func (c *CompositeSectionInterface) Count() SectionID {
+	return (SectionID)(len(c.channels))
+}
+
+func (c *CompositeSectionInterface) Set(id SectionID, state bool) {
+	ch := c.channels[id]
+	c.backends[ch.Backend].Set(ch.Channel, state)
+}
+
+func (c *CompositeSectionInterface) Get(id SectionID) bool {
+	ch := c.channels[id]
+	return c.backends[ch.Backend].Get(ch.Channel)
+}
+
+// Fault gets the fault of the channel id maps to, if its backend detects faults
+func (c *CompositeSectionInterface) Fault(id SectionID) error {
+	ch := c.channels[id]
+	return SectionFault(c.backends[ch.Backend], ch.Channel)
+}
+
+// OnFaultChange sets handler on every backend which detects faults
+func (c *CompositeSectionInterface) OnFaultChange(handler func()) {
+	for _, name := range c.backendNames {
+		if reporter, ok := c.backends[name].(FaultReporter); ok {
+			reporter.OnFaultChange(handler)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package logic
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type failingSectionInterface struct {
+	*MockSectionInterface
+}
+
+func (f failingSectionInterface) Initialize() error {
+	f.MockSectionInterface.Initialize()
+	return fmt.Errorf("initialize failed")
+}
+
+func (f failingSectionInterface) Deinitialize() error {
+	f.MockSectionInterface.Deinitialize()
+	return fmt.Errorf("deinitialize failed")
+}
+
+func TestCompositeSectionInterface(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+
+	gpio := NewMockSectionInterface(2)
+	i2c := NewMockSectionInterface(3)
+	c, err := NewCompositeSectionInterface(map[string]SectionInterface{
+		"gpio": gpio, "i2c": i2c,
+	}, []CompositeChannel{
+		{"gpio", 1}, {"i2c", 2}, {"gpio", 0},
+	})
+	req.NoError(err)
+	req.NoError(c.Initialize())
+	ass.Equal((SectionID)(3), c.Count())
+	ass.Equal(gpio, c.Backend("gpio"))
+
+	c.Set(0, true)
+	ass.True(gpio.Get(1))
+	ass.True(c.Get(0))
+	ass.False(c.Get(2))
+
+	c.Set(1, true)
+	ass.True(i2c.Get(2))
+	ass.True(c.Get(1))
+
+	c.Set(0, false)
+	ass.False(gpio.Get(1))
+	ass.False(c.Get(0))
+
+	gpio.AssertNumberOfCalls(t, "Set", 2)
+	i2c.AssertNumberOfCalls(t, "Set", 1)
+
+	req.NoError(c.Deinitialize())
+	ass.False(c.Get(1))
+}
+
+func TestCompositeSectionInterface_Invalid(t *testing.T) {
+	ass := assert.New(t)
+	backends := map[string]SectionInterface{"gpio": NewMockSectionInterface(2)}
+
+	_, err := NewCompositeSectionInterface(backends, []CompositeChannel{{"i2c", 0}})
+	ass.Error(err)
+	_, err = NewCompositeSectionInterface(backends, []CompositeChannel{{"gpio", 2}})
+	ass.Error(err)
+}
+
+func TestCompositeSectionInterface_Errors(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+
+	ok := NewMockSectionInterface(1)
+	bad1 := failingSectionInterface{NewMockSectionInterface(1)}
+	bad2 := failingSectionInterface{NewMockSectionInterface(1)}
+	c, err := NewCompositeSectionInterface(map[string]SectionInterface{
+		"ok": ok, "bad1": bad1, "bad2": bad2,
+	}, []CompositeChannel{{"ok", 0}, {"bad1", 0}, {"bad2", 0}})
+	req.NoError(err)
+
+	ok.states[0] = true
+	err = c.Initialize()
+	req.Error(err)
+	ass.Equal("backend 'bad1': initialize failed; backend 'bad2': initialize failed", err.Error())
+	// the working backend should still have been initialized
+	ass.False(ok.Get(0))
+
+	err = c.Deinitialize()
+	req.Error(err)
+	ass.Len(err, 2)
+}
+
+type faultySectionInterface struct {
+	*MockSectionInterface
+	fault   error
+	handler func()
+}
+
+func (f *faultySectionInterface) Fault(SectionID) error {
+	return f.fault
+}
+
+func (f *faultySectionInterface) OnFaultChange(handler func()) {
+	f.handler = handler
+}
+
+func TestCompositeSectionInterface_Fault(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+
+	gpio := NewMockSectionInterface(1)
+	remote := &faultySectionInterface{NewMockSectionInterface(1), fmt.Errorf("offline"), nil}
+	c, err := NewCompositeSectionInterface(map[string]SectionInterface{
+		"gpio": gpio, "remote": remote,
+	}, []CompositeChannel{
+		{"gpio", 0}, {"remote", 0},
+	})
+	req.NoError(err)
+	ass.NoError(c.Fault(0))
+	ass.EqualError(c.Fault(1), "offline")
+	ass.NoError(SectionFault(gpio, 0), "interfaces which do not detect faults are never faulted")
+
+	changes := 0
+	c.OnFaultChange(func() { changes++ })
+	req.NotNil(remote.handler)
+	remote.fault = nil
+	remote.handler()
+	ass.Equal(1, changes)
+	ass.NoError(c.Fault(1))
+}
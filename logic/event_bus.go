@@ -0,0 +1,207 @@
+package logic
+
+import (
+	"sync"
+
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/Sirupsen/logrus"
+)
+
+// Event is an event published on an EventBus. It is a SecUpdate, SectionsUpdate, ProgUpdate, ProgramsUpdate or
+// SRUpdate.
+type Event interface {
+	// EventKey identifies what the event is about. Pending events with equal keys are coalesced by
+	// subscriptions with the Coalesce and CoalesceAll policies.
+	EventKey() interface{}
+}
+
+// EventKey implements Event. Updates of the same type to the same section have the same key.
+func (u SecUpdate) EventKey() interface{} {
+	return u
+}
+
+// EventKey implements Event. All SectionsUpdates have the same key.
+func (u SectionsUpdate) EventKey() interface{} {
+	return u
+}
+
+// EventKey implements Event. Updates of the same type to the same program have the same key.
+func (u ProgUpdate) EventKey() interface{} {
+	return u
+}
+
+// EventKey implements Event. All ProgramsUpdates have the same key.
+func (u ProgramsUpdate) EventKey() interface{} {
+	return u
+}
+
+// SRUpdate is an update to the state of a SectionRunner
+type SRUpdate struct {
+	State *SRState
+}
+
+// EventKey implements Event. All updates to the same SectionRunner have the same key.
+func (u SRUpdate) EventKey() interface{} {
+	return u
+}
+
+// OverflowPolicy is what a Subscription does with an event when its buffer is full
+type OverflowPolicy int
+
+const (
+	// DropOldest drops the oldest pending event to make room for the new one
+	DropOldest OverflowPolicy = iota
+	// DropNewest drops the new event
+	DropNewest
+	// Coalesce replaces a pending event with the same key with the new one, even if the buffer is not full.
+	// Otherwise the oldest pending event is dropped when the buffer is full. This suits consumers which only
+	// need the latest state of what an event refers to.
+	Coalesce
+	// CoalesceAll replaces a pending event with the same key with the new one like Coalesce, but never drops an
+	// event. The buffer grows past its size instead, which is bounded by the number of distinct keys. This suits
+	// consumers which must see the latest state of everything.
+	CoalesceAll
+)
+
+// Subscription receives the events published on an EventBus
+type Subscription struct {
+	// C receives the events. It is closed once the Subscription is closed.
+	C       <-chan Event
+	out     chan Event
+	bus     *EventBus
+	size    int
+	policy  OverflowPolicy
+	pending []Event
+	dropped int
+	notify  chan struct{}
+	done    chan struct{}
+	log     *logrus.Entry
+	sync.Mutex
+}
+
+// push adds event to the pending events without blocking, applying the overflow policy
+func (s *Subscription) push(event Event) {
+	s.Lock()
+	defer s.Unlock()
+	if s.policy == Coalesce || s.policy == CoalesceAll {
+		key := event.EventKey()
+		for i := range s.pending {
+			if s.pending[i].EventKey() == key {
+				s.pending[i] = event
+				return
+			}
+		}
+	}
+	if len(s.pending) >= s.size && s.policy != CoalesceAll {
+		s.dropped++
+		s.log.WithField("dropped", s.dropped).Debug("subscriber is behind, dropping event")
+		if s.policy == DropNewest {
+			return
+		}
+		s.pending = s.pending[1:]
+	}
+	s.pending = append(s.pending, event)
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes the oldest pending event
+func (s *Subscription) pop() (event Event, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.pending) == 0 {
+		return
+	}
+	event, s.pending[0] = s.pending[0], nil
+	s.pending = s.pending[1:]
+	return event, true
+}
+
+// run delivers pending events to C until the Subscription is closed
+func (s *Subscription) run() {
+	defer close(s.out)
+	for {
+		event, ok := s.pop()
+		if !ok {
+			select {
+			case <-s.notify:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		select {
+		case s.out <- event:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Dropped gets the number of events which have been dropped because the subscriber was behind
+func (s *Subscription) Dropped() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.dropped
+}
+
+// Close stops the Subscription from receiving events and closes C
+func (s *Subscription) Close() {
+	s.bus.unsubscribe(s)
+	close(s.done)
+}
+
+// EventBus publishes events to any number of subscribers without waiting for any of them
+type EventBus struct {
+	subscriptions []*Subscription
+	sync.Mutex
+}
+
+// NewEventBus creates a new EventBus without any subscribers
+func NewEventBus() *EventBus {
+	return &EventBus{nil, sync.Mutex{}}
+}
+
+// Subscribe subscribes to all events published on the bus. Up to size events are buffered for the subscriber,
+// after which events are dropped according to policy. name identifies the subscriber in logs.
+func (b *EventBus) Subscribe(name string, size int, policy OverflowPolicy) *Subscription {
+	if size < 1 {
+		size = 1
+	}
+	out := make(chan Event)
+	s := &Subscription{
+		out, out, b, size, policy, nil, 0, make(chan struct{}, 1), make(chan struct{}),
+		util.Logger.WithFields(logrus.Fields{"module": "eventBus", "subscriber": name}),
+		sync.Mutex{},
+	}
+	b.Lock()
+	b.subscriptions = append(b.subscriptions, s)
+	b.Unlock()
+	go s.run()
+	return s
+}
+
+func (b *EventBus) unsubscribe(s *Subscription) {
+	b.Lock()
+	defer b.Unlock()
+	for i := range b.subscriptions {
+		if b.subscriptions[i] == s {
+			b.subscriptions = append(b.subscriptions[:i], b.subscriptions[i+1:]...)
+			return
+		}
+	}
+}
+
+// Publish publishes event to all subscribers. It never blocks. Publishing on a nil EventBus does nothing.
+func (b *EventBus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	for _, s := range b.subscriptions {
+		s.push(event)
+	}
+}
@@ -0,0 +1,90 @@
+package logic
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receive receives the events from sub until none arrive for a short time
+func receive(sub *Subscription) (events []Event) {
+	for {
+		select {
+		case event := <-sub.C:
+			events = append(events, event)
+		case <-time.After(20 * time.Millisecond):
+			return
+		}
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	util.Logger.Out = ioutil.Discard
+	bus := NewEventBus()
+	sub1 := bus.Subscribe("sub1", 10, DropOldest)
+	sub2 := bus.Subscribe("sub2", 10, DropOldest)
+
+	secs := []Section{NewSection(0, "sec 0", 0), NewSection(1, "sec 1", 1)}
+	for i := range secs {
+		secs[i].SetEventBus(bus)
+	}
+	secInterface := NewMockSectionInterface(2)
+	secInterface.Initialize()
+	secs[0].SetData("renamed", 0)
+	secs[1].SetState(true, secInterface)
+
+	expected := []Event{
+		SecUpdate{&secs[0], SecUpdateData},
+		SecUpdate{&secs[1], SecUpdateState},
+	}
+	ass.Equal(expected, receive(sub1))
+	ass.Equal(expected, receive(sub2), "every subscriber gets every event")
+
+	sub1.Close()
+	_, ok := <-sub1.C
+	ass.False(ok, "C should be closed")
+	bus.Publish(SRUpdate{})
+	ass.Equal([]Event{SRUpdate{}}, receive(sub2))
+	sub2.Close()
+
+	var nilBus *EventBus
+	req.NotPanics(func() { nilBus.Publish(SRUpdate{}) })
+}
+
+func TestEventBus_Overflow(t *testing.T) {
+	ass := assert.New(t)
+	util.Logger.Out = ioutil.Discard
+	bus := NewEventBus()
+	secs := []Section{NewSection(0, "sec 0", 0), NewSection(1, "sec 1", 1), NewSection(2, "sec 2", 2)}
+	update := func(i int) Event { return SecUpdate{&secs[i], SecUpdateState} }
+
+	dropOldest := bus.Subscribe("dropOldest", 2, DropOldest)
+	dropNewest := bus.Subscribe("dropNewest", 2, DropNewest)
+	coalesce := bus.Subscribe("coalesce", 2, Coalesce)
+	coalesceAll := bus.Subscribe("coalesceAll", 2, CoalesceAll)
+	// one event is taken by each subscription while it waits to deliver it, so the rest are buffered
+	for _, i := range []int{0, 1, 2, 1, 0} {
+		bus.Publish(update(i))
+		time.Sleep(time.Millisecond)
+	}
+
+	ass.Equal([]Event{update(0), update(1), update(0)}, receive(dropOldest))
+	ass.Equal(2, dropOldest.Dropped())
+	ass.Equal([]Event{update(0), update(1), update(2)}, receive(dropNewest))
+	ass.Equal(2, dropNewest.Dropped())
+	// the second update to section 1 replaces the pending one, then the buffer is full when the second update to
+	// section 0 is published, so the oldest pending update is dropped
+	ass.Equal([]Event{update(0), update(2), update(0)}, receive(coalesce))
+	ass.Equal(1, coalesce.Dropped())
+	// nothing is dropped, so the update to section 2 is still received
+	ass.Equal([]Event{update(0), update(1), update(2), update(0)}, receive(coalesceAll))
+	ass.Equal(0, coalesceAll.Dropped())
+
+	ass.Equal(SRUpdate{}.EventKey(), SRUpdate{}.EventKey())
+	ass.NotEqual(update(0).EventKey(), update(1).EventKey())
+}
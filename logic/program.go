@@ -42,9 +42,14 @@ type ProgUpdate struct {
 	Type ProgUpdateType
 }
 
+// ProgramsUpdate is published when programs are added, removed or reordered, which can change the ID of any
+// program
+type ProgramsUpdate struct{}
+
 // Program represents a sprinklers program, which runs on a schedule and contains
 // a sequence of sections to run.
 type Program struct {
+	// ID is the unique id of the program, which does not change when programs are added, removed or reordered
 	ID         int
 	Name       string
 	Sequence   ProgSequence
@@ -52,7 +57,9 @@ type Program struct {
 	Enabled    bool
 	running    util.AtomicBool
 	runner     chan ProgRunnerMsg
-	updateChan chan<- ProgUpdate
+	events     *EventBus
+	resumedIDs []int32
+	resumed    []<-chan bool
 	log        *logrus.Entry
 	sync.Mutex // all fields should be accessed through this mutext
 }
@@ -62,36 +69,41 @@ func NewProgram(name string, sequence []ProgItem, schedule sched.Schedule, enabl
 	runner := make(chan ProgRunnerMsg)
 	return &Program{
 		0, name, sequence, schedule, enabled,
-		util.NewAtomicBool(false), runner, nil,
+		util.NewAtomicBool(false), runner, nil, nil, nil,
 		util.Logger.WithField("program", name),
 		sync.Mutex{},
 	}
 }
 
-func (prog *Program) SetUpdateChan(updateChan chan<- ProgUpdate) {
-	prog.updateChan = updateChan
+// FindProgram gets the program in programs with the ID id, or nil if there is none
+func FindProgram(programs []*Program, id int) *Program {
+	for _, prog := range programs {
+		prog.Lock()
+		found := prog.ID == id
+		prog.Unlock()
+		if found {
+			return prog
+		}
+	}
+	return nil
+}
+
+// SetEventBus sets the EventBus this Program publishes its ProgUpdates on
+func (prog *Program) SetEventBus(events *EventBus) {
+	prog.events = events
 }
 
 func (prog *Program) OnUpdate(t ProgUpdateType) {
-	if prog.updateChan != nil {
-		//prog.Debug("prog.onUpdate()")
-		prog.updateChan <- ProgUpdate{
-			Prog: prog, Type: t,
-		}
-	}
+	prog.events.Publish(ProgUpdate{
+		Prog: prog, Type: t,
+	})
 }
 
+// run runs the program until it finishes or cancel is closed. running must already be set.
 func (prog *Program) run(cancel <-chan int, secRunner *SectionRunner) {
-	if !prog.running.StoreIf(false, true) {
-		prog.log.Info("program was started when already running")
-		return
-	}
+	defer secRunner.recoverPanic("program run")
 	prog.log.Info("running program")
 	prog.OnUpdate(ProgUpdateRunning)
-	stop := func() {
-		prog.running.Store(false)
-		prog.OnUpdate(ProgUpdateRunning)
-	}
 	prog.Lock()
 	seq := prog.Sequence
 	prog.Unlock()
@@ -99,15 +111,34 @@ func (prog *Program) run(cancel <-chan int, secRunner *SectionRunner) {
 	runIds := make([]int32, seqLen)
 	secDoneChans := make([]<-chan bool, seqLen)
 	for i, item := range seq {
-		runIds[i], secDoneChans[i] = secRunner.RunSectionAsync(item.Sec, item.Duration)
+		runIds[i], secDoneChans[i] = secRunner.runSectionAsync(item.Sec, item.Duration, prog)
+	}
+	prog.waitForRuns(cancel, secRunner, runIds, secDoneChans)
+}
+
+// resume resumes a program run which was restored by SectionRunner.Restore. running must already be set.
+func (prog *Program) resume(cancel <-chan int, secRunner *SectionRunner, runIds []int32, secDoneChans []<-chan bool) {
+	defer secRunner.recoverPanic("program run")
+	prog.log.WithField("remainingRuns", len(runIds)).Info("resuming program")
+	prog.OnUpdate(ProgUpdateRunning)
+	prog.waitForRuns(cancel, secRunner, runIds, secDoneChans)
+}
+
+// waitForRuns waits for the section runs of a program run to finish, or cancels the rest of them if the
+// program run is cancelled
+func (prog *Program) waitForRuns(cancel <-chan int, secRunner *SectionRunner, runIds []int32, secDoneChans []<-chan bool) {
+	stop := func() {
+		prog.running.Store(false)
+		prog.OnUpdate(ProgUpdateRunning)
 	}
+	seqLen := len(runIds)
 	for i := 0; i < seqLen; i++ {
 		select {
 		case <-secDoneChans[i]:
 			continue
 		case <-cancel:
 			for j := seqLen - 1; j >= i; j-- {
-				secRunner.CancelID(runIds[j])
+				secRunner.CancelIDBy(runIds[j], CancelByProgram)
 			}
 			prog.log.Info("program run cancelled")
 			stop()
@@ -119,23 +150,41 @@ func (prog *Program) run(cancel <-chan int, secRunner *SectionRunner) {
 }
 
 func (prog *Program) start(secRunner *SectionRunner, wait *sync.WaitGroup) {
+	defer secRunner.recoverPanic("program runner")
 	var (
 		msg     ProgRunnerMsg
 		nextRun *time.Time
 		delay   <-chan time.Time
 	)
-	cancelRun := make(chan int)
+	// every run has its own cancel chan, which is closed to cancel it. This never blocks, even if the run
+	// has already finished.
+	var cancelRun chan int
 	run := func() {
+		if !prog.running.StoreIf(false, true) {
+			prog.log.Info("program was started when already running")
+			return
+		}
+		cancelRun = make(chan int)
 		go prog.run(cancelRun, secRunner)
 	}
 	cancel := func() {
-		if prog.Running() {
-			cancelRun <- 0
+		if cancelRun != nil {
+			close(cancelRun)
+			cancelRun = nil
 		}
 	}
 	if wait != nil {
 		defer wait.Done()
 	}
+	prog.Lock()
+	resumedIDs, resumed := prog.resumedIDs, prog.resumed
+	prog.resumedIDs, prog.resumed = nil, nil
+	prog.Unlock()
+	if len(resumedIDs) > 0 {
+		prog.running.Store(true)
+		cancelRun = make(chan int)
+		go prog.resume(cancelRun, secRunner, resumedIDs, resumed)
+	}
 	for {
 		prog.Lock()
 		if prog.Enabled {
@@ -174,6 +223,15 @@ func (prog *Program) start(secRunner *SectionRunner, wait *sync.WaitGroup) {
 	}
 }
 
+// addResumedRun adds a section run restored by SectionRunner.Restore to the program run which is resumed
+// when the Program is started
+func (prog *Program) addResumedRun(id int32, done <-chan bool) {
+	prog.Lock()
+	prog.resumedIDs = append(prog.resumedIDs, id)
+	prog.resumed = append(prog.resumed, done)
+	prog.Unlock()
+}
+
 // Start starts the background goroutine which runs the program at the appropriate
 // schedule
 func (prog *Program) Start(secRunner *SectionRunner, wait *sync.WaitGroup) {
@@ -68,13 +68,15 @@ func (s *ProgramSuite) TearDownTest() {
 func (s *ProgramSuite) TestProgram_Run() {
 	ass, secRunner := s.ass, s.secRunner
 
-	onUpdate := make(chan ProgUpdate, 10)
+	events := NewEventBus()
+	sub := events.Subscribe("test", 10, DropNewest)
+	defer sub.Close()
 
 	prog := NewProgram("test_run", []ProgItem{
 		{&s.sections[0], 10 * time.Millisecond},
 		{&s.sections[1], 10 * time.Millisecond},
 	}, Schedule{}, false)
-	prog.SetUpdateChan(onUpdate)
+	prog.SetEventBus(events)
 	prog.Start(secRunner, s.waitGroup)
 
 	s.secInterface.On("Set", (SectionID)(0), true).Return().
@@ -90,12 +92,12 @@ func (s *ProgramSuite) TestProgram_Run() {
 
 	prog.Run()
 
-	p := <-onUpdate
+	p := (<-sub.C).(ProgUpdate)
 	ass.Equal(&prog, &p.Prog)
 	ass.Equal(ProgUpdateRunning, p.Type)
 	ass.Equal(true, prog.Running())
 
-	p = <-onUpdate
+	p = (<-sub.C).(ProgUpdate)
 	ass.Equal(&prog, &p.Prog)
 	ass.Equal(ProgUpdateRunning, p.Type)
 	ass.Equal(false, prog.Running())
@@ -8,7 +8,78 @@ import (
 	"github.com/stianeikeland/go-rpio"
 )
 
-type RpioPins []rpio.Pin
+// RpioIdleMode is what is done with a pin when the section it controls is off
+type RpioIdleMode int
+
+const (
+	// RpioIdleDrive means the pin stays an output and is driven to its inactive level
+	RpioIdleDrive RpioIdleMode = iota
+	// RpioIdleInput means the pin is switched to an input, leaving it floating
+	RpioIdleInput
+)
+
+var rpioIdleModeNames = map[RpioIdleMode]string{
+	RpioIdleDrive: "drive",
+	RpioIdleInput: "input",
+}
+
+func (m RpioIdleMode) String() string {
+	if name, ok := rpioIdleModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("RpioIdleMode(%d)", int(m))
+}
+
+// MarshalText implements encoding.TextMarshaler for RpioIdleMode
+func (m RpioIdleMode) MarshalText() ([]byte, error) {
+	if _, ok := rpioIdleModeNames[m]; !ok {
+		return nil, fmt.Errorf("invalid rpio idle mode: %d", int(m))
+	}
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler for RpioIdleMode
+func (m *RpioIdleMode) UnmarshalText(text []byte) error {
+	for mode, name := range rpioIdleModeNames {
+		if name == string(text) {
+			*m = mode
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid rpio idle mode: '%s'", string(text))
+}
+
+// RpioPin is a gpio pin which controls a section, along with how it should be driven
+type RpioPin struct {
+	Pin rpio.Pin
+	// ActiveLow is true if the section is on when the pin is low (as on most relay boards)
+	ActiveLow bool
+	// IdleMode is what is done with the pin when the section is off
+	IdleMode RpioIdleMode
+}
+
+func (p *RpioPin) level(state bool) rpio.State {
+	if state != p.ActiveLow {
+		return rpio.High
+	}
+	return rpio.Low
+}
+
+func (p *RpioPin) set(state bool) {
+	if !state && p.IdleMode == RpioIdleInput {
+		p.Pin.Input()
+		return
+	}
+	// write the level before switching to output so the pin never glitches to the wrong level
+	p.Pin.Write(p.level(state))
+	p.Pin.Output()
+}
+
+func (p *RpioPin) get() bool {
+	return p.Pin.Read() == p.level(true)
+}
+
+type RpioPins []RpioPin
 
 // RpioSectionInterface is a section interface which uses raspberry pi gpio pins to control sections
 type RpioSectionInterface struct {
@@ -34,6 +105,10 @@ func (i *RpioSectionInterface) Initialize() (err error) {
 	err = rpio.Open()
 	if err != nil {
 		err = fmt.Errorf("error opening rpio: %v", err)
+		return
+	}
+	for id := range i.pins {
+		i.pins[id].set(false)
 	}
 	return
 }
@@ -48,17 +123,10 @@ func (i *RpioSectionInterface) Count() SectionID {
 
 func (i *RpioSectionInterface) Set(id SectionID, state bool) {
 	i.log.WithField("state", state).Debug("setting section state")
-	pin := i.pins[id]
-	if state {
-		pin.Output()
-		pin.High()
-	} else {
-		pin.Low()
-		pin.Input()
-	}
+	i.pins[id].set(state)
 }
 
+// Get gets the logical state of the section, taking into account whether the pin is active low
 func (i *RpioSectionInterface) Get(id SectionID) bool {
-	pin := i.pins[id]
-	return pin.Read() == rpio.High
+	return i.pins[id].get()
 }
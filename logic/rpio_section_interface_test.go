@@ -0,0 +1,41 @@
+package logic
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stianeikeland/go-rpio"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRpioPin_Level(t *testing.T) {
+	ass := assert.New(t)
+
+	activeHigh := RpioPin{Pin: 1}
+	ass.Equal(rpio.High, activeHigh.level(true))
+	ass.Equal(rpio.Low, activeHigh.level(false))
+
+	activeLow := RpioPin{Pin: 2, ActiveLow: true}
+	ass.Equal(rpio.Low, activeLow.level(true))
+	ass.Equal(rpio.High, activeLow.level(false))
+}
+
+func TestRpioIdleMode_JSON(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+
+	var modes []RpioIdleMode
+	err := json.Unmarshal([]byte(`["drive", "input"]`), &modes)
+	req.NoError(err)
+	ass.Equal([]RpioIdleMode{RpioIdleDrive, RpioIdleInput}, modes)
+
+	bytes, err := json.Marshal(modes)
+	req.NoError(err)
+	ass.Equal(`["drive","input"]`, string(bytes))
+
+	var mode RpioIdleMode
+	ass.Error(json.Unmarshal([]byte(`"float"`), &mode))
+	_, err = json.Marshal(RpioIdleMode(5))
+	ass.Error(err)
+	ass.Equal("RpioIdleMode(5)", RpioIdleMode(5).String())
+}
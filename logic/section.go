@@ -1,6 +1,9 @@
 package logic
 
-import "encoding/json"
+import (
+	"sync"
+	"time"
+)
 
 // SecUpdateType is the type of a SecUpdate
 type SecUpdateType int
@@ -18,42 +21,115 @@ type SecUpdate struct {
 	Type SecUpdateType
 }
 
+// SectionsUpdate is published when sections are added or removed, which can change the ID of any section
+type SectionsUpdate struct{}
+
 // Section is an interface for sprinklers sections which can be turned on and off
 type Section struct {
-	// ID is the id of the section in the sections array
+	// ID is the unique id of the section, which does not change when sections are added, removed or reordered
 	ID int `json:"id"`
 	// Name is the human readable name of the section
 	Name string `json:"name"`
 	// InterfaceID is the id of the section used on the SectionInterface
 	InterfaceID SectionID `json:"interfaceId"`
+	// MaxRunTime is the maximum time in seconds the section may be on at once, or 0 for no limit
+	MaxRunTime float64 `json:"maxRunTime,omitempty"`
 
-	updateChan chan<- SecUpdate
+	events *EventBus
 }
 
+// sectionDataMutex guards the Name, InterfaceID and MaxRunTime of every Section, which can be changed at runtime
+// by requests or by reloading the config. Sections are copied by Snapshot, so the lock is not part of Section.
+// Other goroutines read them through Snapshot or the methods of Section.
+var sectionDataMutex = &sync.RWMutex{}
+
 func NewSection(id int, name string, interfaceId SectionID) Section {
-	return Section{id, name, interfaceId, nil}
+	return Section{id, name, interfaceId, 0, nil}
+}
+
+// Snapshot gets a copy of sec, which can be read while sec is changed
+func (sec *Section) Snapshot() Section {
+	sectionDataMutex.RLock()
+	defer sectionDataMutex.RUnlock()
+	return *sec
+}
+
+// Snapshots gets copies of sections, which can be read while they are changed
+func Snapshots(sections []*Section) []Section {
+	snapshots := make([]Section, len(sections))
+	for i := range sections {
+		snapshots[i] = sections[i].Snapshot()
+	}
+	return snapshots
 }
 
-// SetUpdateChan sets the update handler chan for this Section
-func (sec *Section) SetUpdateChan(updateChan chan<- SecUpdate) {
-	sec.updateChan = updateChan
+func (sec *Section) interfaceID() SectionID {
+	sectionDataMutex.RLock()
+	defer sectionDataMutex.RUnlock()
+	return sec.InterfaceID
+}
+
+// MaxRunDuration gets the maximum time the section may be on at once, or 0 if there is no limit
+func (sec *Section) MaxRunDuration() time.Duration {
+	sectionDataMutex.RLock()
+	defer sectionDataMutex.RUnlock()
+	return time.Duration(sec.MaxRunTime * float64(time.Second))
+}
+
+// SetEventBus sets the EventBus this Section publishes its SecUpdates on
+func (sec *Section) SetEventBus(events *EventBus) {
+	sec.events = events
+}
+
+// OnUpdate publishes a SecUpdate of type t for sec
+func (sec *Section) OnUpdate(t SecUpdateType) {
+	sec.update(t)
 }
 
 func (sec *Section) update(t SecUpdateType) {
-	if sec.updateChan != nil {
-		sec.updateChan <- SecUpdate{
-			Sec: sec, Type: t,
-		}
+	sec.events.Publish(SecUpdate{
+		Sec: sec, Type: t,
+	})
+}
+
+// SetData sets the name and max run time of sec, publishing an update if either changed
+func (sec *Section) SetData(name string, maxRunTime float64) (changed bool) {
+	sectionDataMutex.Lock()
+	changed = sec.Name != name || sec.MaxRunTime != maxRunTime
+	sec.Name = name
+	sec.MaxRunTime = maxRunTime
+	sectionDataMutex.Unlock()
+	if changed {
+		sec.update(SecUpdateData)
 	}
+	return
+}
+
+// SetInterfaceID sets the id of sec on the SectionInterface, publishing an update if it changed. The section should
+// be off, since it is not turned off on the old interface id.
+func (sec *Section) SetInterfaceID(interfaceID SectionID) (changed bool) {
+	sectionDataMutex.Lock()
+	changed = sec.InterfaceID != interfaceID
+	sec.InterfaceID = interfaceID
+	sectionDataMutex.Unlock()
+	if changed {
+		sec.update(SecUpdateData)
+	}
+	return
 }
 
 func (sec *Section) SetState(state bool, secInterface SectionInterface) {
-	secInterface.Set(sec.InterfaceID, state)
+	secInterface.Set(sec.interfaceID(), state)
 	sec.update(SecUpdateState)
 }
 
 func (sec *Section) GetState(secInterface SectionInterface) (state bool) {
-	return secInterface.Get(sec.InterfaceID)
+	return secInterface.Get(sec.interfaceID())
+}
+
+// GetFault gets why sec can not currently be controlled through secInterface, or nil if it can
+func (sec *Section) GetFault(secInterface SectionInterface) error {
+	return SectionFault(secInterface, sec.interfaceID())
 }
 
 // SetState(on bool)
@@ -64,17 +140,23 @@ func (sec *Section) GetState(secInterface SectionInterface) (state bool) {
 // Sections represents a list of Sections as stored in JSON
 type Sections []Section
 
-func (secs *Sections) UnmarshalJSON(b []byte) (err error) {
-	var s []Section
-	err = json.Unmarshal(b, &s)
-	if err != nil {
-		return
+// Pointers gets pointers to copies of sections. Sections which are in use are kept by pointer, so that each one
+// stays at the same address when other sections are added or removed.
+func (sections Sections) Pointers() []*Section {
+	pointers := make([]*Section, len(sections))
+	for i := range sections {
+		sec := sections[i]
+		pointers[i] = &sec
 	}
-	for i := range s {
-		s[i].ID = i
-	}
-	*secs = s
-	return
+	return pointers
 }
 
-// var _ json.Unmarshaler = (*RpioSections)(nil)
+// FindSection gets the section in sections with the ID id, or nil if there is none
+func FindSection(sections []*Section, id int) *Section {
+	for _, sec := range sections {
+		if sec.ID == id {
+			return sec
+		}
+	}
+	return nil
+}
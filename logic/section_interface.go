@@ -15,3 +15,21 @@ type SectionInterface interface {
 	Set(sectionNum SectionID, state bool)
 	Get(sectionNum SectionID) (state bool)
 }
+
+// FaultReporter is implemented by SectionInterfaces which can detect that they are unable to control sections,
+// such as when a remote node is offline
+type FaultReporter interface {
+	// Fault returns why sectionNum can not currently be controlled, or nil if it can
+	Fault(sectionNum SectionID) error
+	// OnFaultChange sets a function which is called whenever the fault of any section may have changed
+	OnFaultChange(handler func())
+}
+
+// SectionFault gets why sectionNum on secInterface can not currently be controlled, or nil if it can or
+// secInterface does not detect faults
+func SectionFault(secInterface SectionInterface, sectionNum SectionID) error {
+	if reporter, ok := secInterface.(FaultReporter); ok {
+		return reporter.Fault(sectionNum)
+	}
+	return nil
+}
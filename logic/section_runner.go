@@ -13,6 +13,9 @@ import (
 
 const srIDAll = -1
 
+// HeartbeatInterval is how often the SectionRunner goroutine updates its heartbeat when it is idle
+const HeartbeatInterval = 1 * time.Second
+
 // SectionRun is a single run of a section for a duration that is either queued, or currently running
 type SectionRun struct {
 	// RunID is a sequential unique identifier of SectionRuns
@@ -34,21 +37,48 @@ type SectionRun struct {
 	PauseTime *time.Time
 	// UnpauseTime is the time the section was unpaused, if it was paused and then unpaused. Otherwise, nil
 	UnpauseTime *time.Time
+	// Prog is the Program which queued this run as part of running its sequence, or nil if it was queued on its own
+	Prog *Program
+
+	// onTime is how long the section has been on for during this run, not counting since onSince
+	onTime time.Duration
+	// onSince is when the section was last turned on, or zero if it is currently off
+	onSince time.Time
 }
 
 // NewSectionRun creates a new SectionRun
 func NewSectionRun(runID int32, sec *Section, duration time.Duration, doneChan chan<- bool) SectionRun {
 	return SectionRun{
 		runID, sec, duration, duration, doneChan,
-		nil, nil, nil,
+		nil, nil, nil, nil, 0, time.Time{},
+	}
+}
+
+// Remaining gets how much longer the section has to run for at now
+func (sr *SectionRun) Remaining(now time.Time) time.Duration {
+	if sr.StartTime == nil || sr.PauseTime != nil {
+		return sr.Duration
+	}
+	since := *sr.StartTime
+	if sr.UnpauseTime != nil {
+		since = *sr.UnpauseTime
+	}
+	return sr.Duration - now.Sub(since)
+}
+
+// ranFor gets how long the section has actually been on for during this run at now
+func (sr *SectionRun) ranFor(now time.Time) time.Duration {
+	if sr.onSince.IsZero() {
+		return sr.onTime
 	}
+	return sr.onTime + now.Sub(sr.onSince)
 }
 
 func (sr *SectionRun) String() string {
 	if sr == nil {
 		return "nil"
 	}
-	return fmt.Sprintf("{'%s' for %v}", sr.Sec.Name, sr.Duration)
+	return fmt.Sprintf("{'%s' for %v}", sr.Sec.Snapshot().Name, sr.Duration)
 }
 
 // SRQueue is a queue for SectionRuns. It is implemented as a circular buffer that doubles in length when it fills up
@@ -204,18 +234,94 @@ func (s *SRState) String() string {
 	return fmt.Sprintf("{Current: %v, Queue: %v, Paused: %t}", s.Current, s.Queue, s.Paused)
 }
 
+// CancelReason describes who or what cancelled a SectionRun
+type CancelReason string
+
+const (
+	// CancelByUser means the run was cancelled by a user request
+	CancelByUser CancelReason = "user"
+	// CancelByProgram means the run was cancelled because the program run it was part of was cancelled
+	CancelByProgram CancelReason = "program"
+	// CancelByMaxRunTime means the section was turned off because it reached its max run time
+	CancelByMaxRunTime CancelReason = "maxRunTime"
+	// CancelByShutdown means the run was interrupted because the SectionRunner was stopped
+	CancelByShutdown CancelReason = "shutdown"
+)
+
+// SkipReason describes why a SectionRun never started
+type SkipReason string
+
+const (
+	// SkipCancelled means the run was cancelled while it was still queued
+	SkipCancelled SkipReason = "cancelled"
+	// SkipDiscarded means the run was persisted before a restart, but was not resumed
+	SkipDiscarded SkipReason = "discarded"
+)
+
+// RunRecord is a record of a SectionRun which has finished, was cancelled, or was skipped
+type RunRecord struct {
+	Sec  *Section
+	Prog *Program
+	// RequestedDuration is the total duration the section was queued to run for
+	RequestedDuration time.Duration
+	// ActualDuration is how long the section was actually on for
+	ActualDuration time.Duration
+	// StartTime is when the run started, or nil if it was skipped
+	StartTime *time.Time
+	EndTime   time.Time
+	// CancelReason is why the run was cancelled, or "" if it finished normally
+	CancelReason CancelReason
+	// SkipReason is why the run never started, or "" if it started
+	SkipReason SkipReason
+}
+
+// Cancelled checks if the run was cancelled (or skipped) instead of finishing normally
+func (rec *RunRecord) Cancelled() bool {
+	return rec.CancelReason != "" || rec.SkipReason != ""
+}
+
+// RunRecorder records the history of SectionRuns
+type RunRecorder interface {
+	// RecordRun is called with a record of every SectionRun once it is done
+	RecordRun(record RunRecord)
+}
+
+type sectionCancel struct {
+	sec    *Section
+	reason CancelReason
+}
+
+type idCancel struct {
+	id     int32
+	reason CancelReason
+}
+
 // SectionRunner runs a queue of sections
 type SectionRunner struct {
 	secInterface  SectionInterface
 	run           chan SectionRun
-	cancelSec     chan *Section
-	cancelID      chan int32
+	cancelSec     chan sectionCancel
+	cancelID      chan idCancel
 	paused        chan bool
 	quit          chan struct{}
+	quitOnce      sync.Once
 	nextID        int32
 	State         SRState
-	OnUpdateState chan<- *SRState
-	log           *logrus.Entry
+	events        *EventBus
+	maxRunTime    time.Duration
+	lastHeartbeat int64
+	panicHandler  PanicHandler
+	persister     StatePersister
+	recorder      RunRecorder
+	// records are the RunRecords waiting to be passed to the recorder once the state is unlocked
+	records []RunRecord
+	log     *logrus.Entry
+}
+
+// StatePersister is notified whenever the state of a SectionRunner changes, so that it can be persisted
+type StatePersister interface {
+	// PersistState is called after state changes. It must not block, and must lock state before reading it
+	PersistState(state *SRState)
 }
 
 // NewSectionRunner creates a new SectionRunner without starting it
@@ -223,27 +329,108 @@ func NewSectionRunner(secInterface SectionInterface) *SectionRunner {
 	return &SectionRunner{
 		secInterface,
 		make(chan SectionRun, 2),
-		make(chan *Section, 2),
-		make(chan int32, 2),
+		make(chan sectionCancel, 2),
+		make(chan idCancel, 2),
 		make(chan bool, 2),
 		make(chan struct{}),
+		sync.Once{},
 		0,
 		NewSRState(),
 		nil,
+		0,
+		time.Now().UnixNano(),
+		nil,
+		nil,
+		nil,
+		nil,
 		util.Logger.WithField("module", "SectionRunner"),
 	}
 }
 
+// SetMaxRunTime sets the maximum time that any section may be on at once, or 0 for no limit. Sections
+// are turned off after this long (or after their own MaxRunTime, if it is less) no matter how long they
+// were queued to run for. This must be called before the SectionRunner is started.
+func (r *SectionRunner) SetMaxRunTime(maxRunTime time.Duration) {
+	r.maxRunTime = maxRunTime
+}
+
+// maxRunTimeFor gets the maximum time sec may be on at once, or 0 if there is no limit
+func (r *SectionRunner) maxRunTimeFor(sec *Section) time.Duration {
+	max := sec.MaxRunDuration()
+	if r.maxRunTime > 0 && (max <= 0 || r.maxRunTime < max) {
+		max = r.maxRunTime
+	}
+	return max
+}
+
+// SetPanicHandler sets the handler which is called if the background goroutines of the SectionRunner, or of
+// any Program started with it, panic. If there is no handler the panic is not recovered. This must be called
+// before the SectionRunner or any Programs are started.
+func (r *SectionRunner) SetPanicHandler(handler PanicHandler) {
+	r.panicHandler = handler
+}
+
+// recoverPanic must be deferred by background goroutines. It passes any panic on to the panic handler
+func (r *SectionRunner) recoverPanic(component string) {
+	if r.panicHandler == nil {
+		return
+	}
+	if v := recover(); v != nil {
+		r.panicHandler(component, v)
+	}
+}
+
+func (r *SectionRunner) heartbeat() {
+	atomic.StoreInt64(&r.lastHeartbeat, time.Now().UnixNano())
+}
+
+// LastHeartbeat gets the last time the background goroutine of the SectionRunner was known to be alive
+func (r *SectionRunner) LastHeartbeat() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&r.lastHeartbeat))
+}
+
 func (r *SectionRunner) start(wait *sync.WaitGroup) {
-	r.stateUpdate()
+	defer r.recoverPanic("section runner")
 	state := &r.State
 	endUpdate := func() {
+		records := r.records
+		r.records = nil
 		r.State.Unlock()
+		r.flushRecords(records)
 		r.stateUpdate()
 	}
 	var (
 		delay <-chan time.Time
+		// safety fires when the current section has been on for its max run time
+		safety <-chan time.Time
 	)
+	heartbeat := time.NewTicker(HeartbeatInterval)
+	defer heartbeat.Stop()
+	turnOn := func() {
+		// the time the section was on before being paused counts towards its max run time
+		if max := r.maxRunTimeFor(state.Current.Sec); max > 0 {
+			remaining := max - state.Current.onTime
+			if remaining <= 0 {
+				// it is not turned on again, and is finished as soon as possible
+				expired := make(chan time.Time, 1)
+				expired <- time.Now()
+				safety = expired
+				delay = nil
+				return
+			}
+			safety = time.After(remaining)
+		}
+		state.Current.Sec.SetState(true, r.secInterface)
+		state.Current.onSince = time.Now()
+		delay = time.After(state.Current.Duration)
+	}
+	turnOff := func() {
+		state.Current.Sec.SetState(false, r.secInterface)
+		state.Current.onTime = state.Current.ranFor(time.Now())
+		state.Current.onSince = time.Time{}
+		delay = nil
+		safety = nil
+	}
 	runItem := func() {
 		if state.Current == nil {
 			return
@@ -255,13 +442,14 @@ func (r *SectionRunner) start(wait *sync.WaitGroup) {
 			delay = nil
 			state.Current.PauseTime = &startTime
 		} else {
-			state.Current.Sec.SetState(true, r.secInterface)
-			delay = time.After(state.Current.Duration)
+			turnOn()
 		}
 	}
-	finishRun := func(cancelled bool) {
-		state.Current.Sec.SetState(false, r.secInterface)
-		delay = nil
+	// finishRun finishes the current run, which was cancelled unless reason is ""
+	finishRun := func(reason CancelReason) {
+		cancelled := reason != ""
+		turnOff()
+		r.record(state.Current, reason, "")
 		if state.Current.Done != nil {
 			state.Current.Done <- cancelled
 		}
@@ -274,12 +462,38 @@ func (r *SectionRunner) start(wait *sync.WaitGroup) {
 		r.log.WithField("state", state).Infof("%s running section", verb)
 		state.Current = state.Queue.Pop()
 	}
+	// skipRuns finishes runs that were removed from the queue before they started
+	skipRuns := func(runs []*SectionRun, reason CancelReason) {
+		for _, secRun := range runs {
+			r.record(secRun, reason, SkipCancelled)
+			if secRun.Done != nil {
+				secRun.Done <- true
+			}
+		}
+	}
 	if wait != nil {
 		defer wait.Done()
 	}
+	state.Lock()
+	if state.Current == nil && !state.Paused {
+		// start running anything that was restored before the SectionRunner was started
+		state.Current = state.Queue.Pop()
+		runItem()
+	}
+	endUpdate()
 	for {
+		r.heartbeat()
 		select {
+		case <-heartbeat.C:
 		case <-r.quit:
+			state.Lock()
+			if state.Current != nil && state.Current.StartTime != nil {
+				r.record(state.Current, CancelByShutdown, "")
+			}
+			records := r.records
+			r.records = nil
+			state.Unlock()
+			r.flushRecords(records)
 			r.log.Debug("quiting section runner")
 			return
 		case item := <-r.run:
@@ -292,45 +506,36 @@ func (r *SectionRunner) start(wait *sync.WaitGroup) {
 				r.log.WithField("state", state).Debug("queued section run")
 			}
 			endUpdate()
-		case sec := <-r.cancelSec:
+		case cancel := <-r.cancelSec:
+			sec := cancel.sec
 			state.Lock()
-			fromQueue := state.Queue.RemoveWithSection(sec)
-			for _, secRun := range fromQueue {
-				if secRun.Done != nil {
-					secRun.Done <- true
-				}
-			}
+			skipRuns(state.Queue.RemoveWithSection(sec), cancel.reason)
 			if state.Current != nil && state.Current.Sec == sec {
-				finishRun(true)
+				finishRun(cancel.reason)
 				runItem()
 			}
 			r.log.WithFields(logrus.Fields{
-				"state": state, "sec": sec.Name,
+				"state": state, "sec": sec.Snapshot().Name, "reason": cancel.reason,
 			}).Debug("cancelled section runs with section")
 			endUpdate()
-		case id := <-r.cancelID:
+		case cancel := <-r.cancelID:
+			id := cancel.id
 			state.Lock()
 			if id == srIDAll {
-				fromQueue := state.Queue.RemoveAll()
-				for _, secRun := range fromQueue {
-					if secRun.Done != nil {
-						secRun.Done <- true
-					}
-				}
+				skipRuns(state.Queue.RemoveAll(), cancel.reason)
 				if state.Current != nil {
-					finishRun(true)
+					finishRun(cancel.reason)
 					runItem()
 				}
 				r.log.WithFields(logrus.Fields{
 					"state": state,
 				}).Debug("cancelled all section runs")
 			} else {
-				fromQueue := state.Queue.RemoveByID(id)
-				if fromQueue != nil && fromQueue.Done != nil {
-					fromQueue.Done <- true
+				if fromQueue := state.Queue.RemoveByID(id); fromQueue != nil {
+					skipRuns([]*SectionRun{fromQueue}, cancel.reason)
 				}
 				if state.Current != nil && state.Current.RunID == id {
-					finishRun(true)
+					finishRun(cancel.reason)
 					runItem()
 				}
 				r.log.WithFields(logrus.Fields{
@@ -353,10 +558,9 @@ func (r *SectionRunner) start(wait *sync.WaitGroup) {
 					} else {
 						alreadyRunFor = now.Sub(*state.Current.StartTime)
 					}
-					state.Current.Sec.SetState(false, r.secInterface)
+					turnOff()
 					state.Current.PauseTime = &now
 					state.Current.Duration = state.Current.Duration - alreadyRunFor
-					delay = nil // so it never receives
 				}
 				state.Paused = true
 				r.log.WithFields(logrus.Fields{
@@ -370,10 +574,9 @@ func (r *SectionRunner) start(wait *sync.WaitGroup) {
 						"remaining": state.Current.Duration,
 						"run":       state.Current,
 					}).Debug("resuming paused section")
-					delay = time.After(state.Current.Duration)
 					state.Current.PauseTime = nil
 					state.Current.UnpauseTime = &now
-					state.Current.Sec.SetState(true, r.secInterface)
+					turnOn()
 				} else {
 					state.Current = state.Queue.Pop()
 					runItem()
@@ -383,17 +586,62 @@ func (r *SectionRunner) start(wait *sync.WaitGroup) {
 			endUpdate()
 		case <-delay:
 			state.Lock()
-			finishRun(false)
+			finishRun("")
+			runItem()
+			endUpdate()
+		case <-safety:
+			state.Lock()
+			r.log.WithFields(logrus.Fields{
+				"state": state, "maxRunTime": r.maxRunTimeFor(state.Current.Sec),
+			}).Warn("section reached its max run time, turning it off")
+			finishRun(CancelByMaxRunTime)
 			runItem()
 			endUpdate()
 		}
 	}
 }
 
+// SetRunRecorder sets the RunRecorder which records every SectionRun once it is done. This must be called before
+// the SectionRunner is started.
+func (r *SectionRunner) SetRunRecorder(recorder RunRecorder) {
+	r.recorder = recorder
+}
+
+// record adds a RunRecord for run to be passed to the recorder. The state must be locked
+func (r *SectionRunner) record(run *SectionRun, cancelReason CancelReason, skipReason SkipReason) {
+	if r.recorder == nil {
+		return
+	}
+	now := time.Now()
+	r.records = append(r.records, RunRecord{
+		run.Sec, run.Prog, run.TotalDuration, run.ranFor(now), run.StartTime, now, cancelReason, skipReason,
+	})
+}
+
+// flushRecords passes the pending RunRecords to the recorder. The state must not be locked
+func (r *SectionRunner) flushRecords(records []RunRecord) {
+	for _, rec := range records {
+		r.recorder.RecordRun(rec)
+	}
+}
+
+// SetEventBus sets the EventBus SRUpdates are published on. This must be called before the SectionRunner is
+// started.
+func (r *SectionRunner) SetEventBus(events *EventBus) {
+	r.events = events
+}
+
+// SetStatePersister sets the StatePersister which is notified of state changes. This must be called before the
+// SectionRunner is started.
+func (r *SectionRunner) SetStatePersister(persister StatePersister) {
+	r.persister = persister
+}
+
 func (r *SectionRunner) stateUpdate() {
-	if r.OnUpdateState != nil {
-		r.OnUpdateState <- &r.State
+	if r.persister != nil {
+		r.persister.PersistState(&r.State)
 	}
+	r.events.Publish(SRUpdate{&r.State})
 }
 
 // Start starts the background goroutine of a SectionRunner
@@ -404,15 +652,60 @@ func (r *SectionRunner) Start(wait *sync.WaitGroup) {
 	go r.start(wait)
 }
 
-// Quit tells the background goroutine to stop
+// Quit tells the background goroutine to stop. It does not wait for it to stop, so it can be called from the
+// background goroutine itself, such as when it panics, and can be called any number of times.
 func (r *SectionRunner) Quit() {
-	r.quit <- struct{}{}
+	r.quitOnce.Do(func() { close(r.quit) })
 }
 
 func (r *SectionRunner) getNextID() int32 {
 	return atomic.AddInt32(&r.nextID, 1) - 1
 }
 
+// RestoredRun is a SectionRun which was persisted before a restart and should be queued again
+type RestoredRun struct {
+	Sec *Section
+	// TotalDuration is the total duration the section was originally queued to run for
+	TotalDuration time.Duration
+	// Duration is the remaining duration the section should run for
+	Duration time.Duration
+	// Prog is the Program the run was part of, or nil if it was queued on its own
+	Prog *Program
+}
+
+// Restore queues runs which were persisted before a restart, in order, and restores whether the SectionRunner
+// was paused. Runs that were part of a program run are resumed as part of that program run once the Program is
+// started. This must be called before the SectionRunner and any Programs are started.
+func (r *SectionRunner) Restore(runs []RestoredRun, paused bool) {
+	state := &r.State
+	state.Lock()
+	defer state.Unlock()
+	for _, run := range runs {
+		item := NewSectionRun(r.getNextID(), run.Sec, run.Duration, nil)
+		item.TotalDuration = run.TotalDuration
+		if run.Prog != nil {
+			doneChan := make(chan bool, 1)
+			item.Done = doneChan
+			item.Prog = run.Prog
+			run.Prog.addResumedRun(item.RunID, doneChan)
+		}
+		state.Queue.Push(&item)
+	}
+	state.Paused = paused
+	r.log.WithField("state", state).Info("restored section runner state")
+}
+
+// Skip records runs which were never started because of reason, without running them
+func (r *SectionRunner) Skip(runs []RestoredRun, reason SkipReason) {
+	if r.recorder == nil {
+		return
+	}
+	now := time.Now()
+	for _, run := range runs {
+		r.recorder.RecordRun(RunRecord{run.Sec, run.Prog, run.TotalDuration, 0, nil, now, "", reason})
+	}
+}
+
 // QueueSectionRun queues the specified Section to run for dur
 func (r *SectionRunner) QueueSectionRun(sec *Section, dur time.Duration) (id int32) {
 	id = r.getNextID()
@@ -422,9 +715,15 @@ func (r *SectionRunner) QueueSectionRun(sec *Section, dur time.Duration) (id int
 
 // RunSectionAsync runs the section and returns a chan which recieves when the section is finished running
 func (r *SectionRunner) RunSectionAsync(sec *Section, dur time.Duration) (id int32, done <-chan bool) {
+	return r.runSectionAsync(sec, dur, nil)
+}
+
+func (r *SectionRunner) runSectionAsync(sec *Section, dur time.Duration, prog *Program) (id int32, done <-chan bool) {
 	id = r.getNextID()
 	doneChan := make(chan bool, 1)
-	r.run <- NewSectionRun(id, sec, dur, doneChan)
+	item := NewSectionRun(id, sec, dur, doneChan)
+	item.Prog = prog
+	r.run <- item
 	done = doneChan
 	return
 }
@@ -435,19 +734,34 @@ func (r *SectionRunner) RunSection(sec *Section, dur time.Duration) {
 	<-done
 }
 
-// CancelSection cancels all runs for the specified Section
+// CancelSection cancels all runs for the specified Section at the request of a user
 func (r *SectionRunner) CancelSection(sec *Section) {
-	r.cancelSec <- sec
+	r.CancelSectionBy(sec, CancelByUser)
 }
 
-// CancelID cancels the section run with the specified id
+// CancelSectionBy cancels all runs for the specified Section because of reason
+func (r *SectionRunner) CancelSectionBy(sec *Section, reason CancelReason) {
+	r.cancelSec <- sectionCancel{sec, reason}
+}
+
+// CancelID cancels the section run with the specified id at the request of a user
 func (r *SectionRunner) CancelID(id int32) {
-	r.cancelID <- id
+	r.CancelIDBy(id, CancelByUser)
+}
+
+// CancelIDBy cancels the section run with the specified id because of reason
+func (r *SectionRunner) CancelIDBy(id int32, reason CancelReason) {
+	r.cancelID <- idCancel{id, reason}
 }
 
-// CancelAll cancels all section runs
+// CancelAll cancels all section runs at the request of a user
 func (r *SectionRunner) CancelAll() {
-	r.cancelID <- srIDAll
+	r.CancelAllBy(CancelByUser)
+}
+
+// CancelAllBy cancels all section runs because of reason
+func (r *SectionRunner) CancelAllBy(reason CancelReason) {
+	r.cancelID <- idCancel{srIDAll, reason}
 }
 
 // Pause pauses the currently running section run (if any) and stops processing the section run queue
@@ -5,9 +5,11 @@ import (
 	"testing"
 	"time"
 
+	"git.amikhalev.com/amikhalev/grinklers/sched"
 	"git.amikhalev.com/amikhalev/grinklers/util"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -447,6 +449,209 @@ func (s *SectionRunnerSuite) TestPause() {
 	s.secInterface.AssertAllCalled(s.T())
 }
 
+func (s *SectionRunnerSuite) TestHeartbeat() {
+	s.ass.WithinDuration(time.Now(), s.sr.LastHeartbeat(), 10*time.Millisecond)
+}
+
 func TestSectionRunner(t *testing.T) {
 	suite.Run(t, new(SectionRunnerSuite))
 }
+
+// waitForState waits until cond is true of the state of sr, which publishes its updates to updates. It fails the
+// test if that takes more than a second.
+func waitForState(t *testing.T, sr *SectionRunner, updates *Subscription, cond func(state *SRState) bool) bool {
+	timeout := time.After(time.Second)
+	for {
+		sr.State.Lock()
+		ok := cond(&sr.State)
+		sr.State.Unlock()
+		if ok {
+			return true
+		}
+		select {
+		case <-updates.C:
+		case <-timeout:
+			return assert.Fail(t, "timed out waiting for the section runner state")
+		}
+	}
+}
+
+// running gets a condition which is true once sec is the current run and is on
+func running(sec *Section) func(state *SRState) bool {
+	return func(state *SRState) bool {
+		return state.Current != nil && state.Current.Sec == sec && !state.Current.onSince.IsZero()
+	}
+}
+
+func TestSectionRunner_MaxRunTime(t *testing.T) {
+	ass := assert.New(t)
+	util.Logger.Out = ioutil.Discard
+	secInterface := NewMockSectionInterface(2)
+	secInterface.Initialize()
+	secs := []Section{NewSection(0, "mock 1", 0), NewSection(1, "mock 2", 1)}
+	secs[1].MaxRunTime = 0.02
+
+	events := NewEventBus()
+	updates := events.Subscribe("test", 1, Coalesce)
+	defer updates.Close()
+	sr := NewSectionRunner(secInterface)
+	sr.SetEventBus(events)
+	sr.SetMaxRunTime(40 * time.Millisecond)
+	ass.Equal(40*time.Millisecond, sr.maxRunTimeFor(&secs[0]))
+	ass.Equal(20*time.Millisecond, sr.maxRunTimeFor(&secs[1]))
+	sr.Start(nil)
+	defer sr.Quit()
+
+	// waitCancelled waits for a run of an hour to be cancelled, returning how long it took
+	waitCancelled := func(done <-chan bool) time.Duration {
+		start := time.Now()
+		select {
+		case cancelled := <-done:
+			ass.True(cancelled, "run should be cancelled after max run time")
+		case <-time.After(time.Second):
+			ass.Fail("section should have been turned off after its max run time")
+		}
+		return time.Since(start)
+	}
+
+	// the section max run time applies when it is less than the global one
+	_, done := sr.RunSectionAsync(&secs[1], time.Hour)
+	ass.GreaterOrEqual(int64(waitCancelled(done)), int64(20*time.Millisecond))
+	secInterface.AssertNotRunning(t, &secs[1])
+
+	// the global max run time applies otherwise
+	_, done = sr.RunSectionAsync(&secs[0], time.Hour)
+	ass.GreaterOrEqual(int64(waitCancelled(done)), int64(40*time.Millisecond))
+	secInterface.AssertNotRunning(t, &secs[0])
+
+	// runs shorter than the max run time are not affected
+	_, done = sr.RunSectionAsync(&secs[0], 10*time.Millisecond)
+	ass.False(<-done)
+
+	sr.State.Lock()
+	ass.Nil(sr.State.Current)
+	sr.State.Unlock()
+}
+
+func TestSectionRunner_MaxRunTimePaused(t *testing.T) {
+	ass := assert.New(t)
+	util.Logger.Out = ioutil.Discard
+	secInterface := NewMockSectionInterface(1)
+	secInterface.Initialize()
+	sec := NewSection(0, "mock 1", 0)
+
+	events := NewEventBus()
+	updates := events.Subscribe("test", 1, Coalesce)
+	defer updates.Close()
+	sr := NewSectionRunner(secInterface)
+	sr.SetEventBus(events)
+	max := 200 * time.Millisecond
+	sr.SetMaxRunTime(max)
+	sr.Start(nil)
+	defer sr.Quit()
+
+	_, done := sr.RunSectionAsync(&sec, time.Hour)
+	waitForState(t, sr, updates, running(&sec))
+	time.Sleep(150 * time.Millisecond)
+	sr.Pause()
+	waitForState(t, sr, updates, func(state *SRState) bool { return state.Paused })
+	secInterface.AssertNotRunning(t, &sec)
+
+	// pausing does not reset the max run time, so only the rest of it is left after unpausing
+	sr.Unpause()
+	unpaused := time.Now()
+	select {
+	case cancelled := <-done:
+		ass.True(cancelled, "run should be cancelled after max run time")
+		ass.True(time.Since(unpaused) < max-50*time.Millisecond,
+			"the time the section was on before pausing should count towards its max run time")
+	case <-time.After(time.Second):
+		ass.Fail("section should have been turned off after its max run time")
+	}
+	secInterface.AssertNotRunning(t, &sec)
+}
+
+func TestSectionRunner_Restore(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	util.Logger.Out = ioutil.Discard
+	secInterface := NewMockSectionInterface(2)
+	secInterface.Initialize()
+	secs := []Section{NewSection(0, "mock 1", 0), NewSection(1, "mock 2", 1)}
+	prog := NewProgram("restored", []ProgItem{{&secs[1], time.Minute}}, sched.Schedule{}, false)
+
+	events := NewEventBus()
+	updates := events.Subscribe("test", 1, Coalesce)
+	defer updates.Close()
+	sr := NewSectionRunner(secInterface)
+	sr.SetEventBus(events)
+	sr.Restore([]RestoredRun{
+		{&secs[0], time.Minute, 100 * time.Millisecond, nil},
+		{&secs[1], time.Minute, 100 * time.Millisecond, prog},
+	}, false)
+	sr.State.Lock()
+	ass.Nil(sr.State.Current)
+	ass.Equal(2, sr.State.Queue.Len())
+	sr.State.Unlock()
+
+	prog.Start(sr, nil)
+	defer prog.Quit()
+	sr.Start(nil)
+	defer sr.Quit()
+
+	// the restored runs start as soon as the SectionRunner is started
+	req.True(waitForState(t, sr, updates, running(&secs[0])))
+	secInterface.AssertRunning(t, &secs[0])
+	ass.Eventually(prog.Running, time.Second, time.Millisecond, "program run should be resumed")
+	sr.State.Lock()
+	req.NotNil(sr.State.Current)
+	ass.Equal(time.Minute, sr.State.Current.TotalDuration)
+	ass.Nil(sr.State.Current.Prog)
+	sr.State.Unlock()
+
+	req.True(waitForState(t, sr, updates, running(&secs[1])))
+	secInterface.AssertRunning(t, &secs[1])
+	sr.State.Lock()
+	req.NotNil(sr.State.Current)
+	ass.Equal(prog, sr.State.Current.Prog)
+	sr.State.Unlock()
+
+	req.True(waitForState(t, sr, updates, func(state *SRState) bool { return state.Current == nil }))
+	secInterface.AssertNotRunning(t, &secs[1])
+	ass.Eventually(func() bool { return !prog.Running() }, time.Second, time.Millisecond,
+		"program run should finish after its restored runs")
+}
+
+func TestSectionRunner_RestorePaused(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	util.Logger.Out = ioutil.Discard
+	secInterface := NewMockSectionInterface(1)
+	secInterface.Initialize()
+	sec := NewSection(0, "mock 1", 0)
+
+	events := NewEventBus()
+	updates := events.Subscribe("test", 1, Coalesce)
+	defer updates.Close()
+	sr := NewSectionRunner(secInterface)
+	sr.SetEventBus(events)
+	sr.Restore([]RestoredRun{{&sec, time.Minute, 20 * time.Millisecond, nil}}, true)
+	sr.Start(nil)
+	defer sr.Quit()
+
+	// nothing runs until the SectionRunner is unpaused
+	req.True(waitForState(t, sr, updates, func(state *SRState) bool { return state.Paused }))
+	secInterface.AssertNotRunning(t, &sec)
+	sr.State.Lock()
+	ass.Nil(sr.State.Current)
+	ass.Equal(1, sr.State.Queue.Len())
+	sr.State.Unlock()
+
+	sr.Unpause()
+	req.True(waitForState(t, sr, updates, running(&sec)))
+	secInterface.AssertRunning(t, &sec)
+	req.True(waitForState(t, sr, updates, func(state *SRState) bool { return state.Current == nil }))
+	secInterface.AssertNotRunning(t, &sec)
+	sr.State.Lock()
+	ass.False(sr.State.Paused)
+	ass.Zero(sr.State.Queue.Len())
+	sr.State.Unlock()
+}
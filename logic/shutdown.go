@@ -0,0 +1,170 @@
+package logic
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sync"
+	"syscall"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/Sirupsen/logrus"
+)
+
+// ShutdownHookTimeout is the maximum time a single shutdown hook may take before it is abandoned
+var ShutdownHookTimeout = 5 * time.Second
+
+// PanicHandler is called when a background goroutine panics, with the name of the component which panicked
+// and the value it panicked with
+type PanicHandler func(component string, value interface{})
+
+// AllOff turns off every section of secInterface, continuing even if turning off some of them panics
+func AllOff(secInterface SectionInterface) (err error) {
+	var errs util.Errors
+	for id := SectionID(0); id < secInterface.Count(); id++ {
+		func() {
+			defer func() {
+				if v := recover(); v != nil {
+					errs = append(errs, fmt.Errorf("panic turning off section %d: %v", id, v))
+				}
+			}()
+			secInterface.Set(id, false)
+		}()
+	}
+	return errs.ErrorOrNil()
+}
+
+// ShutdownCoordinator makes sure all sections are turned off and the SectionInterface is deinitialized
+// whenever the process exits, whether because of a signal, a fatal error or a panic in a background goroutine.
+type ShutdownCoordinator struct {
+	secInterface SectionInterface
+	hooks        []func()
+	started      bool
+	panicked     bool
+	reason       string
+	done         chan struct{}
+	mu           sync.Mutex
+	log          *logrus.Entry
+}
+
+// NewShutdownCoordinator creates a new ShutdownCoordinator which turns off all sections of secInterface
+func NewShutdownCoordinator(secInterface SectionInterface) *ShutdownCoordinator {
+	return &ShutdownCoordinator{
+		secInterface: secInterface,
+		done:         make(chan struct{}),
+		log:          util.Logger.WithField("module", "shutdown"),
+	}
+}
+
+// OnShutdown registers a hook which is called on shutdown, before the SectionInterface is deinitialized.
+// Hooks are called in the reverse order they were registered in, and each is abandoned if it takes
+// longer than ShutdownHookTimeout.
+func (c *ShutdownCoordinator) OnShutdown(hook func()) {
+	c.mu.Lock()
+	c.hooks = append(c.hooks, hook)
+	c.mu.Unlock()
+}
+
+// Shutdown turns off all sections, runs the shutdown hooks, and deinitializes the SectionInterface. Only the
+// first call has any effect, and any other calls wait for it to complete.
+func (c *ShutdownCoordinator) Shutdown(reason string) {
+	c.mu.Lock()
+	if c.started {
+		c.mu.Unlock()
+		<-c.done
+		return
+	}
+	c.started = true
+	c.reason = reason
+	hooks := c.hooks
+	c.mu.Unlock()
+	defer close(c.done)
+
+	c.log.WithField("reason", reason).Info("shutting down")
+	// turn everything off first so nothing is left on if a hook hangs
+	c.allOff()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		c.runHook(hooks[i])
+	}
+	// and again in case something was turned on again before the hooks stopped it
+	c.allOff()
+	if err := c.secInterface.Deinitialize(); err != nil {
+		c.log.WithError(err).Error("error deinitializing section interface")
+	}
+	c.log.Info("shutdown complete")
+}
+
+func (c *ShutdownCoordinator) allOff() {
+	if err := AllOff(c.secInterface); err != nil {
+		c.log.WithError(err).Error("error turning off all sections")
+	}
+}
+
+func (c *ShutdownCoordinator) runHook(hook func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			if v := recover(); v != nil {
+				c.log.WithField("panic", v).Error("shutdown hook panicked")
+			}
+		}()
+		hook()
+	}()
+	select {
+	case <-done:
+	case <-time.After(ShutdownHookTimeout):
+		c.log.WithField("timeout", ShutdownHookTimeout).Error("shutdown hook timed out")
+	}
+}
+
+// HandlePanic logs a panic that was recovered in a background goroutine and shuts down. It is a PanicHandler.
+func (c *ShutdownCoordinator) HandlePanic(component string, value interface{}) {
+	c.mu.Lock()
+	c.panicked = true
+	c.mu.Unlock()
+	c.log.WithFields(logrus.Fields{
+		"component": component, "panic": value, "stack": string(debug.Stack()),
+	}).Error("recovered panic in background goroutine")
+	c.Shutdown(fmt.Sprintf("panic in %s: %v", component, value))
+}
+
+var _ PanicHandler = (*ShutdownCoordinator)(nil).HandlePanic
+
+// HandleSignals shuts down when SIGINT or SIGTERM is received. If another signal is received while
+// shutting down, all sections are turned off and the process exits immediately.
+func (c *ShutdownCoordinator) HandleSignals() {
+	sigc := make(chan os.Signal, 2)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigc
+		go func() {
+			sig := <-sigc
+			c.log.WithField("signal", sig).Warn("received second signal, exiting immediately")
+			c.allOff()
+			os.Exit(1)
+		}()
+		c.Shutdown(fmt.Sprintf("received signal %v", sig))
+	}()
+}
+
+// Done returns a chan which is closed once shutdown is complete
+func (c *ShutdownCoordinator) Done() <-chan struct{} {
+	return c.done
+}
+
+// Reason gets the reason passed to Shutdown, or "" if it has not been called
+func (c *ShutdownCoordinator) Reason() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reason
+}
+
+// Panicked returns true if shutdown happened because of a panic
+func (c *ShutdownCoordinator) Panicked() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.panicked
+}
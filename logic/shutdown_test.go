@@ -0,0 +1,217 @@
+package logic
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/sched"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// deinitCountingInterface counts how many times Deinitialize is called
+type deinitCountingInterface struct {
+	*MockSectionInterface
+	deinits int
+}
+
+func (d *deinitCountingInterface) Deinitialize() error {
+	d.deinits++
+	return nil
+}
+
+func newShutdownTestInterface(len int) *deinitCountingInterface {
+	util.Logger.Out = ioutil.Discard
+	secInterface := &deinitCountingInterface{NewMockSectionInterface(len), 0}
+	secInterface.Initialize()
+	return secInterface
+}
+
+func TestAllOff(t *testing.T) {
+	ass := assert.New(t)
+	secInterface := NewMockSectionInterface(3)
+	secInterface.Initialize()
+	secInterface.Set(0, true)
+	secInterface.Set(2, true)
+
+	ass.NoError(AllOff(secInterface))
+	for id := SectionID(0); id < 3; id++ {
+		ass.False(secInterface.Get(id))
+	}
+
+	// a panic turning off one section does not stop the others from being turned off
+	secInterface.Set(0, true)
+	secInterface.Set(2, true)
+	secInterface.ExpectedCalls = nil
+	secInterface.On("Set", SectionID(0), false).Return()
+	secInterface.On("Set", SectionID(2), false).Return()
+	err := AllOff(secInterface)
+	ass.Error(err)
+	ass.False(secInterface.Get(0))
+	ass.False(secInterface.Get(2))
+}
+
+func TestShutdownCoordinator(t *testing.T) {
+	ass := assert.New(t)
+	secInterface := newShutdownTestInterface(2)
+	shutdown := NewShutdownCoordinator(secInterface)
+
+	var calls []string
+	shutdown.OnShutdown(func() {
+		calls = append(calls, "first")
+	})
+	shutdown.OnShutdown(func() {
+		// sections are turned off before the hooks are called
+		ass.False(secInterface.Get(1))
+		// and again after, in case a hook turns one on
+		secInterface.Set(0, true)
+		calls = append(calls, "second")
+	})
+	shutdown.OnShutdown(func() {
+		panic("hooks can panic")
+	})
+
+	secInterface.Set(1, true)
+	select {
+	case <-shutdown.Done():
+		ass.Fail("should not be done before shutdown")
+	default:
+	}
+	ass.Equal("", shutdown.Reason())
+
+	shutdown.Shutdown("test")
+	<-shutdown.Done()
+	ass.Equal([]string{"second", "first"}, calls, "hooks should be called in reverse order")
+	ass.False(secInterface.Get(0))
+	ass.False(secInterface.Get(1))
+	ass.Equal(1, secInterface.deinits)
+	ass.Equal("test", shutdown.Reason())
+	ass.False(shutdown.Panicked())
+
+	// only the first shutdown has an effect
+	shutdown.Shutdown("again")
+	ass.Len(calls, 2)
+	ass.Equal(1, secInterface.deinits)
+	ass.Equal("test", shutdown.Reason())
+}
+
+func TestShutdownCoordinator_Concurrent(t *testing.T) {
+	secInterface := newShutdownTestInterface(1)
+	shutdown := NewShutdownCoordinator(secInterface)
+	hookDone := make(chan struct{})
+	shutdown.OnShutdown(func() {
+		time.Sleep(20 * time.Millisecond)
+		close(hookDone)
+	})
+
+	wait := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			shutdown.Shutdown("concurrent")
+			select {
+			case <-hookDone:
+			default:
+				assert.Fail(t, "Shutdown should not return until shutdown is complete")
+			}
+		}()
+	}
+	wait.Wait()
+	assert.Equal(t, 1, secInterface.deinits)
+}
+
+func TestShutdownCoordinator_HookTimeout(t *testing.T) {
+	ass := assert.New(t)
+	defer func(timeout time.Duration) { ShutdownHookTimeout = timeout }(ShutdownHookTimeout)
+	ShutdownHookTimeout = 10 * time.Millisecond
+
+	secInterface := newShutdownTestInterface(1)
+	shutdown := NewShutdownCoordinator(secInterface)
+	shutdown.OnShutdown(func() {
+		select {}
+	})
+	secInterface.Set(0, true)
+
+	start := time.Now()
+	shutdown.Shutdown("test")
+	ass.WithinDuration(start.Add(10*time.Millisecond), time.Now(), 10*time.Millisecond)
+	ass.False(secInterface.Get(0))
+	ass.Equal(1, secInterface.deinits)
+}
+
+func TestShutdownCoordinator_SectionRunnerPanic(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+
+	secInterface := newShutdownTestInterface(2)
+	// turning a section on panics, since it is not an expected call
+	secInterface.ExpectedCalls = nil
+	secInterface.On("Set", SectionID(0), false).Return()
+	secInterface.On("Set", SectionID(1), false).Return()
+	secInterface.states[1] = true
+
+	shutdown := NewShutdownCoordinator(secInterface)
+	sr := NewSectionRunner(secInterface)
+	sr.SetPanicHandler(shutdown.HandlePanic)
+	// the hooks run on the goroutine which panicked, so quitting must not wait for the section runner
+	wait := sync.WaitGroup{}
+	quit := make(chan struct{})
+	shutdown.OnShutdown(func() {
+		sr.Quit()
+		wait.Wait()
+		close(quit)
+	})
+	sr.Start(&wait)
+
+	sec := NewSection(0, "mock 0", 0)
+	sr.QueueSectionRun(&sec, time.Minute)
+
+	select {
+	case <-shutdown.Done():
+	case <-time.After(ShutdownHookTimeout / 2):
+		req.FailNow("panic in section runner should cause shutdown without waiting for the hook timeout")
+	}
+	select {
+	case <-quit:
+	default:
+		ass.Fail("the section runner should be quit")
+	}
+	ass.True(shutdown.Panicked())
+	ass.Contains(shutdown.Reason(), "section runner")
+	ass.False(secInterface.Get(0))
+	ass.False(secInterface.Get(1))
+	ass.Equal(1, secInterface.deinits)
+	secInterface.AssertCalled(t, "Set", SectionID(1), false)
+
+	// quitting again does nothing
+	sr.Quit()
+}
+
+func TestShutdownCoordinator_ProgramPanic(t *testing.T) {
+	ass := assert.New(t)
+	secInterface := newShutdownTestInterface(1)
+	sr := NewSectionRunner(secInterface)
+	panics := make(chan string, 1)
+	sr.SetPanicHandler(func(component string, value interface{}) {
+		panics <- component
+	})
+
+	// program runs call secRunner.RunSectionAsync, which panics on a closed chan
+	close(sr.run)
+	prog := NewProgram("test_panic", []ProgItem{{Duration: time.Millisecond}}, sched.Schedule{}, false)
+	prog.Start(sr, nil)
+	prog.Run()
+
+	select {
+	case component := <-panics:
+		ass.Equal("program run", component)
+	case <-time.After(100 * time.Millisecond):
+		ass.Fail("panic in program run should be recovered")
+	}
+	prog.Quit()
+	secInterface.AssertNotCalled(t, "Set", mock.Anything, true)
+}
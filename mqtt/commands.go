@@ -0,0 +1,168 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"git.amikhalev.com/amikhalev/grinklers/api"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// command maps a command topic to an api request. The result of the request is published to the command topic
+// with /response appended.
+type command struct {
+	// path is the topic after the prefix split into levels. A level in braces is a parameter, which is put in the
+	// request data under its name.
+	path    []string
+	request string
+	// payloadField is the field of the request data the payload is put in as JSON, or "" if it is ignored
+	payloadField string
+	// fixed is data which is always put in the request
+	fixed map[string]interface{}
+}
+
+func newCommand(path, request, payloadField string) command {
+	return command{strings.Split(path, "/"), request, payloadField, nil}
+}
+
+// withFixed returns a copy of c which always puts fixed in the request
+func (c command) withFixed(fixed map[string]interface{}) command {
+	c.fixed = fixed
+	return c
+}
+
+// filter gets the topic filter which matches the command topic under prefix
+func (c *command) filter(prefix string) string {
+	levels := make([]string, len(c.path))
+	for i, level := range c.path {
+		if strings.HasPrefix(level, "{") {
+			level = "+"
+		}
+		levels[i] = level
+	}
+	return prefix + "/" + strings.Join(levels, "/")
+}
+
+// match checks if levels match the path of the command, returning the parameters if they do
+func (c *command) match(levels []string) (params map[string]interface{}, ok bool) {
+	if len(levels) != len(c.path) {
+		return
+	}
+	params = make(map[string]interface{})
+	for i, level := range c.path {
+		if strings.HasPrefix(level, "{") && strings.HasSuffix(level, "}") {
+			n, err := strconv.ParseInt(levels[i], 10, 64)
+			if err != nil {
+				return nil, false
+			}
+			params[level[1:len(level)-1]] = n
+		} else if level != levels[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+var commands = []command{
+	newCommand("sections/{sectionId}/run", "runSection", "duration"),
+	newCommand("sections/{sectionId}/cancel", "cancelSection", ""),
+	newCommand("sections/create", "createSection", "data"),
+	newCommand("sections/{sectionId}/update", "updateSection", "data"),
+	newCommand("sections/{sectionId}/delete", "deleteSection", "removeFromPrograms"),
+	newCommand("programs/{programId}/run", "runProgram", ""),
+	newCommand("programs/{programId}/cancel", "cancelProgram", ""),
+	newCommand("programs/{programId}/update", "updateProgram", "data"),
+	newCommand("programs/create", "createProgram", "data"),
+	newCommand("programs/{programId}/delete", "deleteProgram", ""),
+	newCommand("programs/{programId}/reorder", "reorderProgram", "position"),
+	newCommand("programs/{programId}/duplicate", "duplicateProgram", "name"),
+	newCommand("section_runner/pause", "pauseSectionRunner", "").
+		withFixed(map[string]interface{}{"paused": true}),
+	newCommand("section_runner/unpause", "pauseSectionRunner", "").
+		withFixed(map[string]interface{}{"paused": false}),
+	newCommand("section_runner/cancel_all", "cancelAllSectionRuns", ""),
+	newCommand("section_runner/runs/{runId}/cancel", "cancelSectionRunId", ""),
+}
+
+// commandData builds the data of the api request for cmd from the parameters in the topic and the payload
+func commandData(cmd *command, params map[string]interface{}, payload []byte) (data []byte, err error) {
+	payload = bytes.TrimSpace(payload)
+	if cmd.payloadField != "" && len(payload) > 0 {
+		if !json.Valid(payload) {
+			return nil, util.NewParseError(cmd.payloadField, fmt.Errorf("invalid json: %q", payload))
+		}
+		params[cmd.payloadField] = json.RawMessage(payload)
+	}
+	for name, value := range cmd.fixed {
+		params[name] = value
+	}
+	return json.Marshal(params)
+}
+
+// commandEnvelope is the payload of a command if tokens are configured
+type commandEnvelope struct {
+	Token   string          `json:"token"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// handleCommand handles a message on a command topic, returning the response. If tokens are configured, the
+// payload must be a commandEnvelope.
+func (a *MQTTApi) handleCommand(topic string, payload []byte) (res api.Response, err error) {
+	res = make(api.Response)
+	levels := strings.Split(strings.TrimPrefix(topic, a.prefix+"/"), "/")
+	for i := range commands {
+		cmd := &commands[i]
+		params, ok := cmd.match(levels)
+		if !ok {
+			continue
+		}
+		res["type"] = cmd.request
+		var token string
+		if len(a.config.TokenList()) > 0 {
+			var envelope commandEnvelope
+			if json.Unmarshal(payload, &envelope) != nil {
+				err = util.NewError(util.EC_Unauthorized,
+					"commands must be a json object with a token and payload when tokens are configured")
+				return
+			}
+			token, payload = envelope.Token, envelope.Payload
+		}
+		var data []byte
+		if data, err = commandData(cmd, params, payload); err != nil {
+			return
+		}
+		err = a.handlers.Handle(cmd.request, token, data, res)
+		return
+	}
+	err = util.NewError(util.EC_NotImplemented, fmt.Sprintf("invalid command topic: %s", topic))
+	return
+}
+
+// subscribeCommands subscribes to the command topics. Retained commands are ignored, so that they are not run
+// again every time the broker is reconnected to.
+func (a *MQTTApi) subscribeCommands() {
+	filters := make(map[string]byte)
+	for i := range commands {
+		filters[commands[i].filter(a.prefix)] = 2
+	}
+	a.client.SubscribeMultiple(filters, func(client mqtt.Client, message mqtt.Message) {
+		if message.Retained() {
+			a.logger.WithField("topic", message.Topic()).Warn("ignoring retained command")
+			return
+		}
+		res, err := a.handleCommand(message.Topic(), message.Payload())
+		if uerr := res.SetResult(err); uerr != nil {
+			a.logger.WithError(uerr).WithField("topic", message.Topic()).Info("error processing command")
+		}
+		resBytes, err := json.Marshal(&res)
+		if err != nil {
+			a.logger.WithError(err).Error("error marshaling response")
+			return
+		}
+		client.Publish(message.Topic()+"/response", 2, false, resBytes)
+	})
+}
@@ -0,0 +1,114 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/config"
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/mqtt/mqtttest"
+	"git.amikhalev.com/amikhalev/grinklers/sched"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMQTTApi_Commands(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	broker := mqtttest.NewBroker()
+	req.NoError(broker.Start())
+	defer broker.Close()
+
+	_, configData := newTestAPI()
+	configData.Programs = []*logic.Program{
+		logic.NewProgram("prog", []logic.ProgItem{{Sec: configData.Sections[0], Duration: time.Minute}},
+			sched.Schedule{}, false),
+	}
+	var wait sync.WaitGroup
+	secRunner := logic.NewSectionRunner(configData.SectionInterface)
+	secRunner.Start(&wait)
+	configData.StartPrograms(secRunner, &wait)
+	defer func() {
+		configData.QuitPrograms()
+		secRunner.Quit()
+		wait.Wait()
+	}()
+	// retained commands are not run when subscribing
+	broker.Publish("device/cmd/sections/0/run", []byte("30"), true)
+	api := NewMQTTApi(configData, secRunner)
+	req.NoError(api.Start((&config.MQTTJSON{URL: broker.URL(), DeviceID: "cmd"}).ToConnectData()))
+	defer api.Stop()
+	ass.Eventually(func() bool {
+		msg, _ := broker.Retained("device/cmd/connected")
+		return string(msg.Payload) == "true"
+	}, time.Second, 5*time.Millisecond)
+
+	time.Sleep(20 * time.Millisecond)
+	ass.False(configData.Sections[0].GetState(configData.SectionInterface))
+
+	responses := broker.Watch("device/cmd/#")
+	// command publishes payload to the command topic, returning its response
+	command := func(topic, payload string) (res map[string]interface{}) {
+		broker.Publish("device/cmd/"+topic, []byte(payload), false)
+		timeout := time.After(time.Second)
+		for {
+			select {
+			case msg := <-responses:
+				if msg.Topic == "device/cmd/"+topic+"/response" {
+					req.NoError(json.Unmarshal(msg.Payload, &res))
+					return
+				}
+			case <-timeout:
+				req.Fail("no response to " + topic)
+			}
+		}
+	}
+
+	res := command("sections/1/run", "30")
+	ass.Equal("success", res["result"])
+	ass.Equal("runSection", res["type"])
+	ass.Equal("running section 'sec 1' for 30s", res["message"])
+	ass.Eventually(func() bool {
+		return configData.Sections[1].GetState(configData.SectionInterface)
+	}, time.Second, 5*time.Millisecond)
+	ass.Equal("success", command("sections/1/cancel", "")["result"])
+
+	ass.Equal("paused section runner", command("section_runner/pause", "")["message"])
+	ass.Equal("unpaused section runner", command("section_runner/unpause", "")["message"])
+	ass.Equal("success", command("section_runner/runs/5/cancel", "")["result"])
+	ass.Equal("success", command("section_runner/cancel_all", "")["result"])
+
+	res = command("programs/0/update", `{"name": "renamed"}`)
+	ass.Equal("updated program 'renamed'", res["message"])
+	ass.Equal("running program 'renamed'", command("programs/0/run", "")["message"])
+	ass.Equal("cancelled program 'renamed'", command("programs/0/cancel", "")["message"])
+
+	res = command("programs/create", `{"name": "created", "sequence": [{"section": 1, "duration": 30}]}`)
+	ass.Equal("created program 'created'", res["message"])
+	res = command("programs/0/duplicate", `"copied"`)
+	ass.Equal("duplicated program 'renamed' as 'copied'", res["message"])
+	res = command("programs/2/reorder", "0")
+	ass.Equal("moved program 'copied' to position 0", res["message"])
+	res = command("programs/0/delete", "")
+	ass.Equal("deleted program 'renamed'", res["message"])
+	ass.Equal("running program 'created'", command("programs/1/run", "")["message"])
+	ass.Len(configData.ProgramList(), 2)
+
+	res = command("sections/create", `{"name": "sec 2", "interfaceId": 0}`)
+	ass.Equal("created section 'sec 2'", res["message"])
+	res = command("sections/2/update", `{"name": "renamed"}`)
+	ass.Equal("updated section 'renamed'", res["message"])
+	res = command("sections/0/delete", "")
+	ass.Equal(float64(util.EC_InvalidData), res["code"], "section 0 is used by programs")
+	res = command("sections/0/delete", "true")
+	ass.Equal("deleted section 'sec 0'", res["message"])
+	ass.Len(configData.SectionList(), 2)
+
+	res = command("programs/3/run", "")
+	ass.Equal("error", res["result"])
+	ass.Equal(float64(util.EC_Range), res["code"])
+	res = command("sections/0/run", "soon")
+	ass.Equal(float64(util.EC_Parse), res["code"])
+}
@@ -0,0 +1,297 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/api"
+	"git.amikhalev.com/amikhalev/grinklers/config"
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"github.com/Sirupsen/logrus"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// maxSectionMinutes is the maximum duration which can be set for running a section from Home Assistant
+const maxSectionMinutes = 24 * 60
+
+var invalidNodeIDChars = regexp.MustCompile("[^a-zA-Z0-9_-]")
+
+// entity is the discovery config of a Home Assistant entity
+type entity map[string]interface{}
+
+// homeAssistant publishes Home Assistant MQTT discovery configs for the sections, programs and section runner,
+// and handles the commands from those entities by making requests to the api handlers. All methods do nothing
+// on a nil homeAssistant, which is used when discovery is disabled.
+type homeAssistant struct {
+	api      *MQTTApi
+	config   *config.HomeAssistantJSON
+	deviceID string
+	nodeID   string
+	// durations are the durations sections are run for when they are turned on, by section id
+	durations map[int]time.Duration
+	// sectionIDs and programIDs are the ids of the sections and programs which configs have been published for
+	sectionIDs map[int]bool
+	programIDs map[int]bool
+	log        *logrus.Entry
+	sync.Mutex
+}
+
+func newHomeAssistant(a *MQTTApi, haConfig *config.HomeAssistantJSON, deviceID string) *homeAssistant {
+	nodeID := "grinklers_" + invalidNodeIDChars.ReplaceAllString(deviceID, "_")
+	return &homeAssistant{
+		a, haConfig, deviceID, nodeID, make(map[int]time.Duration), make(map[int]bool), make(map[int]bool),
+		a.logger.WithField("nodeId", nodeID), sync.Mutex{},
+	}
+}
+
+// commandTopic gets the topic the commands for path are received on
+func (h *homeAssistant) commandTopic(path string) string {
+	return fmt.Sprintf("%s/homeassistant/%s", h.api.prefix, path)
+}
+
+func (h *homeAssistant) configTopic(component, objectID string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/config", h.config.Prefix(), component, h.nodeID, objectID)
+}
+
+// publishConfig publishes the discovery config of an entity, with the fields common to all entities filled in
+func (h *homeAssistant) publishConfig(component, objectID string, e entity) (err error) {
+	e["unique_id"] = h.nodeID + "_" + objectID
+	e["availability_topic"] = h.api.prefix + "/connected"
+	e["payload_available"] = "true"
+	e["payload_not_available"] = "false"
+	e["device"] = entity{
+		"identifiers":  []string{h.nodeID},
+		"name":         "Grinklers " + h.deviceID,
+		"manufacturer": "grinklers",
+		"model":        "grinklers",
+	}
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("error marshalling home assistant %s config: %v", component, err)
+	}
+	h.api.publish(h.configTopic(component, objectID), bytes)
+	return
+}
+
+// clearConfig removes an entity from Home Assistant
+func (h *homeAssistant) clearConfig(component, objectID string) {
+	h.api.publish(h.configTopic(component, objectID), []byte{})
+}
+
+func (h *homeAssistant) duration(secID int) time.Duration {
+	if duration, ok := h.durations[secID]; ok {
+		return duration
+	}
+	return h.config.Duration()
+}
+
+// updateSection publishes the configs of the switch and duration number for a section
+func (h *homeAssistant) updateSection(sec *logic.Section) (err error) {
+	if h == nil {
+		return
+	}
+	name := sec.Snapshot().Name
+	objectID := fmt.Sprintf("section_%d", sec.ID)
+	err = h.publishConfig("switch", objectID, entity{
+		"name":          name,
+		"icon":          "mdi:sprinkler",
+		"state_topic":   fmt.Sprintf("%s/sections/%d/state", h.api.prefix, sec.ID),
+		"state_on":      "true",
+		"state_off":     "false",
+		"command_topic": h.commandTopic(fmt.Sprintf("sections/%d/set", sec.ID)),
+		"payload_on":    "ON",
+		"payload_off":   "OFF",
+	})
+	if err != nil {
+		return
+	}
+	durationTopic := h.commandTopic(fmt.Sprintf("sections/%d/duration", sec.ID))
+	err = h.publishConfig("number", objectID+"_duration", entity{
+		"name":                name + " duration",
+		"icon":                "mdi:timer-outline",
+		"state_topic":         durationTopic,
+		"command_topic":       durationTopic + "/set",
+		"min":                 1,
+		"max":                 maxSectionMinutes,
+		"step":                1,
+		"mode":                "box",
+		"unit_of_measurement": "min",
+		// so that the durations are restored when reconnecting
+		"retain": true,
+	})
+	if err != nil {
+		return
+	}
+	h.Lock()
+	duration := h.duration(sec.ID)
+	h.Unlock()
+	h.api.publish(durationTopic, []byte(strconv.FormatFloat(duration.Minutes(), 'f', -1, 64)))
+	return
+}
+
+// updateSections publishes the configs for all sections, removing the entities of sections which no longer exist
+func (h *homeAssistant) updateSections(sections []*logic.Section) (err error) {
+	if h == nil {
+		return
+	}
+	for _, sec := range sections {
+		if err = h.updateSection(sec); err != nil {
+			return
+		}
+	}
+	ids := make(map[int]bool, len(sections))
+	for _, sec := range sections {
+		ids[sec.ID] = true
+	}
+	h.Lock()
+	defer h.Unlock()
+	for id := range h.sectionIDs {
+		if !ids[id] {
+			h.clearConfig("switch", fmt.Sprintf("section_%d", id))
+			h.clearConfig("number", fmt.Sprintf("section_%d_duration", id))
+		}
+	}
+	h.sectionIDs = ids
+	return
+}
+
+// updateProgram publishes the configs of the run button and running sensor for a program
+func (h *homeAssistant) updateProgram(prog *logic.Program) (err error) {
+	if h == nil {
+		return
+	}
+	prog.Lock()
+	id, name := prog.ID, prog.Name
+	prog.Unlock()
+	objectID := fmt.Sprintf("program_%d", id)
+	err = h.publishConfig("button", objectID+"_run", entity{
+		"name":          "Run " + name,
+		"icon":          "mdi:play",
+		"command_topic": h.commandTopic(fmt.Sprintf("programs/%d/run", id)),
+		"payload_press": "PRESS",
+	})
+	if err != nil {
+		return
+	}
+	return h.publishConfig("binary_sensor", objectID+"_running", entity{
+		"name":         name + " running",
+		"device_class": "running",
+		"state_topic":  fmt.Sprintf("%s/programs/%d/running", h.api.prefix, id),
+		"payload_on":   "true",
+		"payload_off":  "false",
+	})
+}
+
+// updatePrograms publishes the configs for all programs, removing the entities of programs which no longer exist
+func (h *homeAssistant) updatePrograms(programs []*logic.Program) (err error) {
+	if h == nil {
+		return
+	}
+	ids := make(map[int]bool, len(programs))
+	for _, prog := range programs {
+		if err = h.updateProgram(prog); err != nil {
+			return
+		}
+		prog.Lock()
+		ids[prog.ID] = true
+		prog.Unlock()
+	}
+	h.Lock()
+	defer h.Unlock()
+	for id := range h.programIDs {
+		if !ids[id] {
+			h.clearConfig("button", fmt.Sprintf("program_%d_run", id))
+			h.clearConfig("binary_sensor", fmt.Sprintf("program_%d_running", id))
+		}
+	}
+	h.programIDs = ids
+	return
+}
+
+// updateSectionRunner publishes the config of the switch which pauses the section runner
+func (h *homeAssistant) updateSectionRunner() (err error) {
+	if h == nil {
+		return
+	}
+	return h.publishConfig("switch", "section_runner_paused", entity{
+		"name":           "Section runner paused",
+		"icon":           "mdi:pause",
+		"state_topic":    h.api.prefix + "/section_runner",
+		"value_template": "{{ 'ON' if value_json.paused else 'OFF' }}",
+		"command_topic":  h.commandTopic("section_runner/paused/set"),
+		"payload_on":     "ON",
+		"payload_off":    "OFF",
+	})
+}
+
+// subscribe subscribes to the command topics of all entities
+func (h *homeAssistant) subscribe() {
+	if h == nil {
+		return
+	}
+	h.api.client.Subscribe(h.commandTopic("#"), 1, func(client mqtt.Client, message mqtt.Message) {
+		path := strings.TrimPrefix(message.Topic(), h.commandTopic(""))
+		if err := h.handleCommand(path, string(message.Payload())); err != nil {
+			h.log.WithError(err).WithField("topic", message.Topic()).Info("error processing home assistant command")
+		}
+	})
+}
+
+// request makes a request to the api handlers with the configured token
+func (h *homeAssistant) request(requestType string, data entity) (err error) {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	res := make(api.Response)
+	err = h.api.handlers.Handle(requestType, h.config.Token, bytes, res)
+	if err == nil {
+		h.log.Info(res["message"])
+	}
+	return
+}
+
+// handleCommand handles the command payload for the command topic with path
+func (h *homeAssistant) handleCommand(path, payload string) (err error) {
+	parts := strings.Split(path, "/")
+	var id int
+	if len(parts) > 1 && (parts[0] == "sections" || parts[0] == "programs") {
+		if id, err = strconv.Atoi(parts[1]); err != nil {
+			return fmt.Errorf("invalid id: %v", err)
+		}
+	}
+	switch {
+	case len(parts) == 3 && parts[0] == "sections" && parts[2] == "set":
+		if payload == "OFF" {
+			return h.request("cancelSection", entity{"sectionId": id})
+		}
+		h.Lock()
+		duration := h.duration(id)
+		h.Unlock()
+		return h.request("runSection", entity{"sectionId": id, "duration": duration.Seconds()})
+	case len(parts) == 4 && parts[0] == "sections" && parts[2] == "duration" && parts[3] == "set":
+		minutes, err := strconv.ParseFloat(payload, 64)
+		if err != nil || minutes <= 0 || minutes > maxSectionMinutes {
+			return fmt.Errorf("invalid duration: %q", payload)
+		}
+		h.Lock()
+		h.durations[id] = time.Duration(minutes * float64(time.Minute))
+		h.Unlock()
+		h.api.publish(h.commandTopic(fmt.Sprintf("sections/%d/duration", id)), []byte(payload))
+		return nil
+	case len(parts) == 3 && parts[0] == "programs" && parts[2] == "run":
+		return h.request("runProgram", entity{"programId": id})
+	case path == "section_runner/paused/set":
+		return h.request("pauseSectionRunner", entity{"paused": payload == "ON"})
+	case len(parts) == 3 && parts[0] == "sections" && parts[2] == "duration":
+		// the state of a duration, published by the api
+		return nil
+	default:
+		return fmt.Errorf("unknown command topic")
+	}
+}
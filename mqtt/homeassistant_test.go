@@ -0,0 +1,115 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/config"
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/mqtt/mqtttest"
+	"git.amikhalev.com/amikhalev/grinklers/sched"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHomeAssistant(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	broker := mqtttest.NewBroker()
+	req.NoError(broker.Start())
+	defer broker.Close()
+
+	_, configData := newTestAPI()
+	configData.Programs = []*logic.Program{
+		logic.NewProgram("prog", []logic.ProgItem{{Sec: configData.Sections[0], Duration: time.Minute}},
+			sched.Schedule{}, false),
+	}
+	configData.MQTT = &config.MQTTJSON{
+		URL: broker.URL(), DeviceID: "yard",
+		HomeAssistant: &config.HomeAssistantJSON{DiscoveryPrefix: "ha", DefaultDuration: 120},
+	}
+	req.NoError(configData.MQTT.Validate())
+	var wait sync.WaitGroup
+	secRunner := logic.NewSectionRunner(configData.SectionInterface)
+	secRunner.Start(&wait)
+	configData.Programs[0].Start(secRunner, &wait)
+	defer func() {
+		configData.Programs[0].Quit()
+		secRunner.Quit()
+		wait.Wait()
+	}()
+	api := NewMQTTApi(configData, secRunner)
+	req.NoError(api.Start(configData.MQTT.ToConnectData()))
+	defer api.Stop()
+
+	retainedConfig := func(topic string) (e entity) {
+		ass.Eventually(func() bool {
+			_, ok := broker.Retained(topic)
+			return ok
+		}, time.Second, 5*time.Millisecond, topic)
+		msg, _ := broker.Retained(topic)
+		req.NoError(json.Unmarshal(msg.Payload, &e))
+		return
+	}
+	sw := retainedConfig("ha/switch/grinklers_yard/section_1/config")
+	ass.Equal("sec 1", sw["name"])
+	ass.Equal("grinklers_yard_section_1", sw["unique_id"])
+	ass.Equal("device/yard/sections/1/state", sw["state_topic"])
+	ass.Equal("device/yard/connected", sw["availability_topic"])
+	ass.Equal("grinklers_yard", sw["device"].(map[string]interface{})["identifiers"].([]interface{})[0])
+	number := retainedConfig("ha/number/grinklers_yard/section_1_duration/config")
+	ass.Equal(true, number["retain"])
+	msg, _ := broker.Retained("device/yard/homeassistant/sections/1/duration")
+	ass.Equal("2", string(msg.Payload))
+	button := retainedConfig("ha/button/grinklers_yard/program_0_run/config")
+	ass.Equal("Run prog", button["name"])
+	sensor := retainedConfig("ha/binary_sensor/grinklers_yard/program_0_running/config")
+	ass.Equal("device/yard/programs/0/running", sensor["state_topic"])
+	pause := retainedConfig("ha/switch/grinklers_yard/section_runner_paused/config")
+	ass.Equal("device/yard/section_runner", pause["state_topic"])
+
+	// commands are handled by the api
+	broker.Publish("device/yard/homeassistant/sections/1/duration/set", []byte("5"), true)
+	ass.Eventually(func() bool {
+		msg, _ := broker.Retained("device/yard/homeassistant/sections/1/duration")
+		return string(msg.Payload) == "5"
+	}, time.Second, 5*time.Millisecond, "the duration should be updated")
+	broker.Publish("device/yard/homeassistant/sections/1/set", []byte("ON"), false)
+	ass.Eventually(func() bool {
+		secRunner.State.Lock()
+		defer secRunner.State.Unlock()
+		return secRunner.State.Current != nil && secRunner.State.Current.TotalDuration == 5*time.Minute
+	}, time.Second, 5*time.Millisecond, "the section should run for the set duration")
+	broker.Publish("device/yard/homeassistant/sections/1/set", []byte("OFF"), false)
+	ass.Eventually(func() bool {
+		return !configData.Sections[1].GetState(configData.SectionInterface)
+	}, time.Second, 5*time.Millisecond, "the section should be turned off")
+
+	broker.Publish("device/yard/homeassistant/section_runner/paused/set", []byte("ON"), false)
+	ass.Eventually(func() bool {
+		secRunner.State.Lock()
+		defer secRunner.State.Unlock()
+		return secRunner.State.Paused
+	}, time.Second, 5*time.Millisecond, "the section runner should be paused")
+	broker.Publish("device/yard/homeassistant/programs/0/run", []byte("PRESS"), false)
+	ass.Eventually(configData.Programs[0].Running, time.Second, 5*time.Millisecond, "the program should run")
+
+	// entities of removed programs are cleared
+	req.NoError(api.UpdatePrograms(nil))
+	ass.Eventually(func() bool {
+		msg, ok := broker.Retained("ha/button/grinklers_yard/program_0_run/config")
+		return !ok || len(msg.Payload) == 0
+	}, time.Second, 5*time.Millisecond)
+
+	// with tokens, commands are made with the token of the home assistant config
+	configData.Tokens = []config.TokenJSON{{Token: "ha", Role: config.RoleOperator}}
+	err := api.homeAssistant.handleCommand("section_runner/paused/set", "OFF")
+	ass.Equal(util.ErrorCode(util.EC_Unauthorized), err.(*util.Error).Code)
+	configData.MQTT.HomeAssistant.Token = "ha"
+	ass.NoError(api.homeAssistant.handleCommand("section_runner/paused/set", "OFF"))
+
+	ass.Error((&config.HomeAssistantJSON{DiscoveryPrefix: "ha/#"}).Validate())
+	ass.Error((&config.HomeAssistantJSON{DefaultDuration: -1}).Validate())
+}
@@ -3,12 +3,16 @@ package mqtt
 import (
 	"encoding/json"
 	"fmt"
-	"net/url"
+	"math/rand"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"git.amikhalev.com/amikhalev/grinklers/api"
 	"git.amikhalev.com/amikhalev/grinklers/config"
 	"git.amikhalev.com/amikhalev/grinklers/datamodel"
+	"git.amikhalev.com/amikhalev/grinklers/history"
 	"git.amikhalev.com/amikhalev/grinklers/http"
 	"git.amikhalev.com/amikhalev/grinklers/logic"
 	"git.amikhalev.com/amikhalev/grinklers/util"
@@ -16,101 +20,262 @@ import (
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
-const CONNECT_RETRY_TIMEOUT = 10 * time.Second
 const MQTT_TIMEOUT = 10 * time.Second
 
-type responseData map[string]interface{}
-type requestHandler func(message mqtt.Message, rData responseData) (err error)
+// ReconnectDelay is about how long to wait before connecting to the broker again after a connection attempt
+// fails or the connection is lost. It doubles after every failed attempt, up to MaxReconnectDelay.
+var ReconnectDelay = time.Second
+
+// MaxReconnectDelay is the longest time to wait before connecting to the broker again
+var MaxReconnectDelay = 2 * time.Minute
+
+// reconnectDelay gets how long to wait before the connection attempt after attempt failed ones. It is randomized
+// between half of the delay and the full delay, so that many clients do not reconnect at the same time.
+func reconnectDelay(attempt int) time.Duration {
+	delay := MaxReconnectDelay
+	if attempt < 32 && ReconnectDelay<<uint(attempt) < MaxReconnectDelay {
+		delay = ReconnectDelay << uint(attempt)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// waitToken waits at most timeout for token to complete. Token.WaitTimeout is not used, since it holds a lock
+// which keeps the token from failing until it times out.
+func waitToken(token mqtt.Token, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		token.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// HealthJSON is the health of the connection to the broker, which is published to <prefix>/connection
+type HealthJSON struct {
+	// LastConnected is when the broker was last connected to
+	LastConnected time.Time `json:"lastConnected"`
+	// Reconnects is how many times the broker has been connected to again after the first time
+	Reconnects int `json:"reconnects"`
+	// Queued is how many messages were waiting to be published when the broker was connected to, and Dropped is
+	// how many were dropped since they did not fit in the outbox
+	Queued  int `json:"queued"`
+	Dropped int `json:"dropped"`
+}
 
 // MQTTApi encapsulates all functionality exposed over MQTT
 type MQTTApi struct {
 	config    *config.ConfigData
 	secRunner *logic.SectionRunner
-	client    mqtt.Client
-	prefix    string
-	logger    *logrus.Entry
+	history   *history.History
+	handlers  *api.Handlers
+	// homeAssistant is nil unless Home Assistant discovery is enabled
+	homeAssistant *homeAssistant
+	// requestsV5 is nil unless api requests are received with MQTT 5
+	requestsV5 *requestsV5
+	// tls is nil unless TLS is configured
+	tls    *tlsFiles
+	client mqtt.Client
+	prefix string
+	stop   chan struct{}
+	// stopOnce makes Stop only close stop the first time it is called
+	stopOnce sync.Once
+	// lost receives when the connection to the broker is lost
+	lost   chan error
+	outbox *outbox
+	// connects is how many times the broker has been connected to
+	connects int
+	// sectionIDs and programIDs are the ids of the sections and programs which topics have been published for
+	sectionIDs map[int]bool
+	programIDs map[int]bool
+	logger     *logrus.Entry
+	sync.Mutex
 }
 
 // NewMQTTApi creates a new MQTTApi that uses the specified data
 func NewMQTTApi(config *config.ConfigData, secRunner *logic.SectionRunner) *MQTTApi {
 	return &MQTTApi{
-		config, secRunner,
-		nil, "",
-		util.Logger.WithField("module", "MQTTApi"),
+		config, secRunner, nil, api.NewHandlers(config, secRunner), nil, nil, nil,
+		nil, "", make(chan struct{}), sync.Once{}, make(chan error, 1), newOutbox(OutboxSize), 0,
+		make(map[int]bool), make(map[int]bool),
+		util.Logger.WithField("module", "MQTTApi"), sync.Mutex{},
 	}
 }
 
-func (a *MQTTApi) createMQTTOpts(connectData *http.ConnectData) (opts *mqtt.ClientOptions) {
-	brokerURI, err := url.Parse(connectData.MqttURL)
+func (a *MQTTApi) createMQTTOpts(connectData *http.ConnectData) (opts *mqtt.ClientOptions, err error) {
+	brokerURI, err := util.ParseBrokerURL(connectData.MqttURL)
 	if err != nil {
-		err = fmt.Errorf("error parsing MQTT_BROKER: %v", err)
+		err = fmt.Errorf("invalid mqtt url: %v", err)
 		return
 	}
-	if brokerURI.Scheme == "mqtt" { // translate scheme to compatible
-		brokerURI.Scheme = "tcp"
-	} else if brokerURI.Scheme == "mqtts" {
-		brokerURI.Scheme = "ssl"
-	} else if brokerURI.Scheme == "" {
-		brokerURI.Scheme = "tcp"
-	}
 	a.prefix = "device/" + connectData.DeviceID
 	a.logger.Debugf("broker prefix: '%s'", a.prefix)
 
+	username := brokerUsername(connectData)
 	opts = mqtt.NewClientOptions()
 	opts.AddBroker(brokerURI.String())
-	opts.SetUsername(connectData.DeviceID)
+	opts.SetUsername(username)
 	opts.SetPassword(connectData.DeviceToken)
 	a.logger.WithFields(logrus.Fields{
-		"username": connectData.DeviceID,
+		"username": username,
 	}).Debug("authenticating to mqtt server")
 	opts.SetClientID(connectData.ClientID)
 	opts.SetCleanSession(false)
+	// reconnecting is done by run, with backoff and resubscribing
+	opts.SetAutoReconnect(false)
+	if a.config.MQTT != nil && a.config.MQTT.TLS != nil {
+		if a.tls, err = newTLSFiles(a.config.MQTT.TLS, a.logger); err != nil {
+			return
+		}
+		if werr := a.tls.watch(); werr != nil {
+			a.logger.WithError(werr).Warn("mqtt tls files will not be reloaded when they change")
+		}
+		opts.SetTLSConfig(a.tls.tlsConfig())
+	}
 	return
 }
 
-// Start connects to the MQTT broker and listens to the API topics
+// brokerUsername gets the username to authenticate to the broker with, which is the device id by default
+func brokerUsername(connectData *http.ConnectData) string {
+	if connectData.Username == "" {
+		return connectData.DeviceID
+	}
+	return connectData.Username
+}
+
+// Start connects to the MQTT broker in the background and listens to the API topics. If there is no broker to
+// connect to, an error is returned and the MQTTApi does nothing until it is stopped.
 func (a *MQTTApi) Start(connectData *http.ConnectData) (err error) {
-	opts := a.createMQTTOpts(connectData)
+	if connectData == nil {
+		err = fmt.Errorf("no mqtt broker to connect to")
+		return
+	}
+	opts, err := a.createMQTTOpts(connectData)
+	if err != nil {
+		return
+	}
+	if a.config.MQTT != nil && a.config.MQTT.HomeAssistant != nil {
+		a.homeAssistant = newHomeAssistant(a, a.config.MQTT.HomeAssistant, connectData.DeviceID)
+	}
+	if a.config.MQTT != nil && a.config.MQTT.V5 {
+		if a.requestsV5, err = newRequestsV5(a, connectData); err != nil {
+			return
+		}
+	}
 	opts.SetWill(a.prefix+"/connected", "false", 1, true)
 	opts.SetOnConnectHandler(func(client mqtt.Client) {
 		a.logger.Info("connected to mqtt broker")
-		a.updateConnected(true)
-		a.UpdateAll()
+		a.onConnect()
 	})
 	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
-		a.logger.WithError(err).Warn("lost connection to mqtt broker")
+		select {
+		case a.lost <- err:
+		default:
+		}
 	})
 	a.client = mqtt.NewClient(opts)
 
-	go func() {
-		for {
-			if token := a.client.Connect(); token.WaitTimeout(MQTT_TIMEOUT) && token.Error() != nil {
-				a.logger.WithError(token.Error()).
-					Errorf("error connecting to mqtt broker. will retry in %v", CONNECT_RETRY_TIMEOUT)
-				time.Sleep(CONNECT_RETRY_TIMEOUT)
-			} else {
-				break
+	go a.run()
+
+	return
+}
+
+// run connects to the broker until the MQTTApi is stopped, waiting longer after each failed attempt
+func (a *MQTTApi) run() {
+	attempt := 0
+	for {
+		token := a.client.Connect()
+		var err error
+		if !waitToken(token, MQTT_TIMEOUT) {
+			err = fmt.Errorf("timed out")
+		} else {
+			err = token.Error()
+		}
+		if err == nil {
+			// the connection attempts start over once the connection is lost
+			attempt = 0
+			select {
+			case <-a.stop:
+				return
+			case err = <-a.lost:
+				a.logger.WithError(err).Warn("lost connection to mqtt broker")
 			}
+		} else {
+			a.logger.WithError(err).Error("error connecting to mqtt broker")
 		}
+		delay := reconnectDelay(attempt)
+		attempt++
+		a.logger.Infof("connecting to mqtt broker again in %v", delay)
+		select {
+		case <-a.stop:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
 
-		a.subscribe()
-	}()
-
-	return
+// onConnect subscribes to the api topics and publishes everything each time the broker is connected to, since
+// the subscriptions and messages may have been lost while it was not connected
+func (a *MQTTApi) onConnect() {
+	a.subscribe()
+	a.updateConnected(true)
+	messages := a.outbox.take()
+	for _, msg := range messages {
+		a.publish(msg.topic, msg.payload)
+	}
+	if err := a.UpdateAll(); err != nil {
+		a.logger.WithError(err).Error("error updating mqtt topics")
+	}
+	a.Lock()
+	a.connects++
+	health := HealthJSON{time.Now(), a.connects - 1, len(messages), 0}
+	a.Unlock()
+	_, health.Dropped = a.outbox.stats()
+	bytes, err := json.Marshal(&health)
+	if err != nil {
+		a.logger.WithError(err).Error("error marshalling connection health")
+		return
+	}
+	a.publish(a.prefix+"/connection", bytes)
 }
 
-// Stop disconnects from the broker
+// Stop disconnects from the broker. Calling it again does nothing.
 func (a *MQTTApi) Stop() {
+	stopped := true
+	a.stopOnce.Do(func() {
+		stopped = false
+		close(a.stop)
+	})
+	if stopped {
+		return
+	}
+	a.requestsV5.stop()
+	if a.tls != nil {
+		a.tls.close()
+	}
+	if a.client == nil {
+		return
+	}
 	if a.client.IsConnected() {
 		a.logger.Info("disconnecting from mqtt broker")
 		a.updateConnected(false)
 		a.client.Disconnect(250)
 	} else {
-		a.logger.Warn("was never connected to broker")
+		a.logger.Warn("was not connected to broker")
 	}
 }
 
-// Client gets the MQTT client used by the MQTTApi
+// SetHistory sets the History which is summarized on the history topics and queried by getHistory requests
+func (a *MQTTApi) SetHistory(hist *history.History) {
+	a.history = hist
+	a.handlers.SetHistory(hist)
+}
+
+// Client gets the MQTT client used by the MQTTApi, or nil if it was not started
 func (a *MQTTApi) Client() mqtt.Client {
 	return a.client
 }
@@ -120,54 +285,89 @@ func (a *MQTTApi) Prefix() string {
 	return a.prefix
 }
 
+// publish publishes a retained message to topic. Nothing is published if there is no broker to publish to. If
+// the message can not be published, it is kept in the outbox until the broker is connected to again.
+func (a *MQTTApi) publish(topic string, payload interface{}) {
+	if a.client == nil {
+		return
+	}
+	seq := a.outbox.publishing(topic)
+	if !a.client.IsConnected() {
+		a.outbox.failed(topic, seq, payload)
+		return
+	}
+	token := a.client.Publish(topic, 1, true, payload)
+	go func() {
+		if !waitToken(token, MQTT_TIMEOUT) || token.Error() != nil {
+			a.outbox.failed(topic, seq, payload)
+		}
+	}()
+}
+
 func (a *MQTTApi) updateConnected(connected bool) (err error) {
 	str := strconv.FormatBool(connected)
 	token := a.client.Publish(a.prefix+"/connected", 1, true, str)
-	if token.WaitTimeout(MQTT_TIMEOUT); token.Error() != nil {
-		return token.Error()
+	if !waitToken(token, MQTT_TIMEOUT) {
+		return fmt.Errorf("timed out publishing connected")
 	}
-	return
+	return token.Error()
 }
 
 // UpdateAll updates all mqtt data
 func (a *MQTTApi) UpdateAll() (err error) {
-	err = a.UpdatePrograms(a.config.Programs)
+	err = a.UpdatePrograms(a.config.ProgramList())
 	if err != nil {
 		return
 	}
-	err = a.UpdateSections(a.config.Sections)
+	err = a.UpdateSections(a.config.SectionList())
 	if err != nil {
 		return
 	}
 	err = a.UpdateSectionRunner(&a.secRunner.State)
+	if err != nil {
+		return
+	}
+	err = a.UpdateHistory()
+	if err != nil {
+		return
+	}
+	err = a.homeAssistant.updateSectionRunner()
 	return
 }
 
 // UpdateSectionData updates the topic for the specified section
 func (a *MQTTApi) UpdateSectionData(sec *logic.Section) (err error) {
-	bytes, err := json.Marshal(sec)
+	data := sec.Snapshot()
+	bytes, err := json.Marshal(&data)
 	if err != nil {
 		err = fmt.Errorf("error marshalling section: %v", err)
 		return
 	}
-	a.client.Publish(fmt.Sprintf("%s/sections/%d", a.prefix, sec.ID), 1, true, bytes)
+	a.publish(fmt.Sprintf("%s/sections/%d", a.prefix, sec.ID), bytes)
+	err = a.homeAssistant.updateSection(sec)
 	return
 }
 
-// UpdateSectionState updates the topic for the current state of the section
+// UpdateSectionState updates the topics for the current state and fault of the section
 func (a *MQTTApi) UpdateSectionState(sec *logic.Section) (err error) {
 	bytes := []byte(strconv.FormatBool(sec.GetState(a.config.SectionInterface)))
-	a.client.Publish(fmt.Sprintf("%s/sections/%d/state", a.prefix, sec.ID), 1, true, bytes)
+	a.publish(fmt.Sprintf("%s/sections/%d/state", a.prefix, sec.ID), bytes)
+	// the fault topic is cleared when the section is not faulted
+	fault := []byte{}
+	if secFault := sec.GetFault(a.config.SectionInterface); secFault != nil {
+		fault = []byte(secFault.Error())
+	}
+	a.publish(fmt.Sprintf("%s/sections/%d/fault", a.prefix, sec.ID), fault)
 	return
 }
 
-// UpdateSections updates the topics for all the specified sections
-func (a *MQTTApi) UpdateSections(sections []logic.Section) (err error) {
+// UpdateSections updates the topics for all the specified sections, clearing the topics of sections which no
+// longer exist
+func (a *MQTTApi) UpdateSections(sections []*logic.Section) (err error) {
 	lenSections := len(sections)
 	bytes := []byte(strconv.Itoa(lenSections))
-	a.client.Publish(a.prefix+"/sections", 1, true, bytes)
-	for i := range sections {
-		sec := &sections[i]
+	a.publish(a.prefix+"/sections", bytes)
+	for _, sec := range sections {
 		err = a.UpdateSectionData(sec)
 		if err != nil {
 			return
@@ -177,12 +377,27 @@ func (a *MQTTApi) UpdateSections(sections []logic.Section) (err error) {
 			return
 		}
 	}
+	ids := make(map[int]bool, lenSections)
+	for _, sec := range sections {
+		ids[sec.ID] = true
+	}
+	a.Lock()
+	for id := range a.sectionIDs {
+		if !ids[id] {
+			a.publish(fmt.Sprintf("%s/sections/%d", a.prefix, id), []byte{})
+			a.publish(fmt.Sprintf("%s/sections/%d/state", a.prefix, id), []byte{})
+			a.publish(fmt.Sprintf("%s/sections/%d/fault", a.prefix, id), []byte{})
+		}
+	}
+	a.sectionIDs = ids
+	a.Unlock()
 	//logger.Debug("updated sections", "bytes", string(bytes))
+	err = a.homeAssistant.updateSections(sections)
 	return
 }
 
 // UpdateProgramData updates the topic for the data about the specified Program
-func (a *MQTTApi) UpdateProgramData(index int, prog *logic.Program) (err error) {
+func (a *MQTTApi) UpdateProgramData(prog *logic.Program) (err error) {
 	data := datamodel.ProgramToJSON(prog)
 	if err != nil {
 		err = fmt.Errorf("error converting programs to json: %v", err)
@@ -193,34 +408,52 @@ func (a *MQTTApi) UpdateProgramData(index int, prog *logic.Program) (err error)
 		err = fmt.Errorf("error marshalling program: %v", err)
 		return
 	}
-	a.client.Publish(fmt.Sprintf("%s/programs/%d", a.prefix, index), 1, true, bytes)
+	a.publish(fmt.Sprintf("%s/programs/%d", a.prefix, data.ID), bytes)
+	err = a.homeAssistant.updateProgram(prog)
 	return
 }
 
 // UpdateProgramRunning updates the topic for the current running state of the Program
-func (a *MQTTApi) UpdateProgramRunning(index int, prog *logic.Program) (err error) {
+func (a *MQTTApi) UpdateProgramRunning(prog *logic.Program) (err error) {
 	bytes := []byte(strconv.FormatBool(prog.Running()))
-	a.client.Publish(fmt.Sprintf("%s/programs/%d/running", a.prefix, index), 1, true, bytes)
+	prog.Lock()
+	id := prog.ID
+	prog.Unlock()
+	a.publish(fmt.Sprintf("%s/programs/%d/running", a.prefix, id), bytes)
 	return
 }
 
-// UpdatePrograms updates the topics for all the specified Programs
+// UpdatePrograms updates the topics for all the specified Programs, clearing the topics of programs which no
+// longer exist
 func (a *MQTTApi) UpdatePrograms(programs []*logic.Program) (err error) {
 	lenPrograms := len(programs)
 	bytes := []byte(strconv.Itoa(lenPrograms))
-	a.client.Publish(a.prefix+"/programs", 1, true, bytes)
-	for i := range programs {
-		prog := programs[i]
-		err = a.UpdateProgramData(i, prog)
+	a.publish(a.prefix+"/programs", bytes)
+	ids := make(map[int]bool, lenPrograms)
+	for _, prog := range programs {
+		err = a.UpdateProgramData(prog)
 		if err != nil {
 			return
 		}
-		err = a.UpdateProgramRunning(i, prog)
+		err = a.UpdateProgramRunning(prog)
 		if err != nil {
 			return
 		}
+		prog.Lock()
+		ids[prog.ID] = true
+		prog.Unlock()
+	}
+	a.Lock()
+	for id := range a.programIDs {
+		if !ids[id] {
+			a.publish(fmt.Sprintf("%s/programs/%d", a.prefix, id), []byte{})
+			a.publish(fmt.Sprintf("%s/programs/%d/running", a.prefix, id), []byte{})
+		}
 	}
+	a.programIDs = ids
+	a.Unlock()
 	//logger.Debug("updated programs", "bytes", string(bytes))
+	err = a.homeAssistant.updatePrograms(programs)
 	return
 }
 
@@ -236,272 +469,100 @@ func (a *MQTTApi) UpdateSectionRunner(state *logic.SRState) (err error) {
 	if err != nil {
 		return
 	}
-	a.client.Publish(fmt.Sprintf("%s/section_runner", a.prefix), 1, true, bytes)
+	a.publish(fmt.Sprintf("%s/section_runner", a.prefix), bytes)
 	return
 }
 
-func (a *MQTTApi) subscribe() {
-	reqPath := a.prefix + "/requests"
-	resPath := a.prefix + "/responses"
-	a.logger.WithField("path", reqPath).Debug("registering request handler")
-	a.client.Subscribe(reqPath, 2, func(client mqtt.Client, message mqtt.Message) {
-		var (
-			data struct {
-				Rid  int    `json:"rid"`
-				Type string `json:"type"`
-			}
-			rData = make(responseData)
-			err   error
-		)
-
-		defer func() {
-			var (
-				merr *util.Error
-				ok   bool
-			)
-			if err != nil {
-				if merr, ok = err.(*util.Error); !ok {
-					merr = util.NewInternalError(err)
-				}
-			}
-			if merr != nil {
-				a.logger.WithError(merr).Info("error processing request")
-				rData["result"] = "error"
-				rData["code"] = merr.Code
-				rData["message"] = merr.Error()
-				if merr.Name != "" {
-					rData["name"] = merr.Name
-				}
-				if merr.Cause != nil {
-					rData["cause"] = merr.Cause.Error()
-					if e, ok := merr.Cause.(*json.SyntaxError); ok {
-						rData["offset"] = e.Offset
-					}
-				}
-			} else {
-				rData["result"] = "success"
-			}
-			resBytes, err := json.Marshal(&rData)
-			if err != nil {
-				a.logger.WithError(err).Error("error marshaling response")
-				return
-			}
-			client.Publish(resPath, 2, false, resBytes)
-		}()
-
-		err = json.Unmarshal(message.Payload(), &data)
+// UpdateHistory updates the topics with the history totals of the current day, week and month
+func (a *MQTTApi) UpdateHistory() (err error) {
+	if a.history == nil {
+		return
+	}
+	now := time.Now()
+	for _, period := range history.Periods {
+		var totals []history.Totals
+		totals, err = a.history.Totals(period, 1, now)
 		if err != nil {
-			err = fmt.Errorf("could not parse api request: %v", err)
 			return
 		}
-
-		rData["rid"] = data.Rid
-		rData["type"] = data.Type
-
-		var handler requestHandler
-		switch data.Type {
-		case "runProgram":
-			handler = a.runProgram
-		case "cancelProgram":
-			handler = a.cancelProgram
-		case "updateProgram":
-			handler = a.updateProgram
-		case "runSection":
-			handler = a.runSection
-		case "cancelSection":
-			handler = a.cancelSection
-		case "cancelSectionRunId":
-			handler = a.cancelSectionRunID
-		case "cancelAllSectionRuns":
-			handler = a.cancelAllSectionRuns
-		case "pauseSectionRunner":
-			handler = a.pauseSectionRunner
-		}
-
-		if handler != nil {
-			err = handler(message, rData)
-		} else {
-			err = util.NewError(util.EC_NotImplemented, fmt.Sprintf("invalid api request type: %s", data.Type))
+		var bytes []byte
+		bytes, err = json.Marshal(&totals[0])
+		if err != nil {
+			return
 		}
-	})
-}
-
-func parseDuration(durStr *string) (duration *time.Duration, err error) {
-	if durStr == nil {
-		err = util.NewNotSpecifiedError("duration")
-		return
-	}
-	dur, err := time.ParseDuration(*durStr)
-	duration = &dur
-	if err != nil {
-		err = util.NewParseError("duration", err)
-	}
-	return
-}
-
-func (a *MQTTApi) getProgram(progID *int) (program *logic.Program, err error) {
-	err = util.CheckRange(progID, "program ID", len(a.config.Programs))
-	if err != nil {
-		return
-	}
-	program = a.config.Programs[*progID]
-	return
-}
-
-func (a *MQTTApi) getSection(secID *int) (section *logic.Section, err error) {
-	err = util.CheckRange(secID, "section ID", len(a.config.Sections))
-	if err != nil {
-		return
+		a.publish(fmt.Sprintf("%s/history/%s", a.prefix, period), bytes)
 	}
-	section = &a.config.Sections[*secID]
 	return
 }
 
-func (a *MQTTApi) runProgram(message mqtt.Message, rData responseData) (err error) {
-	var data struct {
-		ProgramID *int
-	}
-	err = json.Unmarshal(message.Payload(), &data)
-	if err != nil {
-		err = util.NewParseError("runProgram request", err)
-		return
-	}
-	program, err := a.getProgram(data.ProgramID)
-	if err != nil {
-		return
-	}
-	program.Run()
-	rData["message"] = fmt.Sprintf("running program '%s'", program.Name)
-	return
-}
-
-func (a *MQTTApi) cancelProgram(message mqtt.Message, rData responseData) (err error) {
-	var data struct {
-		ProgramID *int
-	}
-	err = json.Unmarshal(message.Payload(), &data)
-	if err != nil {
-		err = util.NewParseError("cancelProgram request", err)
-		return
-	}
-	program, err := a.getProgram(data.ProgramID)
-	if err != nil {
-		return
-	}
-	program.Cancel()
-	rData["message"] = fmt.Sprintf("cancelled program '%s'", program.Name)
-	return
-}
-
-func (a *MQTTApi) updateProgram(message mqtt.Message, rData responseData) (err error) {
-	var data struct {
-		ProgramID *int
-		Data      datamodel.ProgramJSON
-	}
-	err = json.Unmarshal(message.Payload(), &data)
-	if err != nil {
-		err = util.NewParseError("updateProgram request", err)
-		return
-	}
-	program, err := a.getProgram(data.ProgramID)
-	if err != nil {
-		return
-	}
-	err = data.Data.Update(program, a.config.Sections)
-	if err != nil {
-		err = util.NewInvalidDataError("program update", err)
-		return
+// responseTopic gets the topic the response to a request with the requested response topic is published to.
+// Response topics must be under <prefix>/responses/, so that requests can not be used to publish elsewhere.
+func (a *MQTTApi) responseTopic(requested string) (topic string, err error) {
+	resPath := a.prefix + "/responses"
+	if requested == "" {
+		return resPath, nil
 	}
-	programJSON := datamodel.ProgramToJSON(program)
-	if err != nil {
-		return
+	if !strings.HasPrefix(requested, resPath+"/") || strings.ContainsAny(requested, "+#") {
+		return resPath, util.NewError(util.EC_BadRequest,
+			fmt.Sprintf("response topic must be under %s/ and not contain wildcards", resPath))
 	}
-	rData["message"] = fmt.Sprintf("updated program '%s'", program.Name)
-	rData["data"] = programJSON
-	return
+	return requested, nil
 }
 
-func (a *MQTTApi) runSection(message mqtt.Message, rData responseData) (err error) {
-	var data struct {
-		SectionID *int
-		Duration  float64
-	}
-	err = json.Unmarshal(message.Payload(), &data)
-	if err != nil {
-		err = util.NewParseError("runSection request", err)
-		return
-	}
-	sec, err := a.getSection(data.SectionID)
-	if err != nil {
-		return
-	}
-	duration := time.Duration(data.Duration * float64(time.Second))
-	id := a.secRunner.QueueSectionRun(sec, duration)
-	rData["message"] = fmt.Sprintf("running section '%s' for %v", sec.Name, duration)
-	rData["runId"] = id
-	return
-}
+// handleRequest handles the api request payload, returning the response and the topic to publish it to.
+// responseTopic is the response topic requested with the MQTT 5 property, or "" if there is none, in which case
+// the response is published to <prefix>/responses and matched by the rid of the request.
+func (a *MQTTApi) handleRequest(payload []byte, responseTopic string) (resPath string, resBytes []byte) {
+	var (
+		data struct {
+			Rid  int    `json:"rid"`
+			Type string `json:"type"`
+			// Token is needed if tokens are configured
+			Token string `json:"token"`
+		}
+		res = make(api.Response)
+		err error
+	)
+	resPath = a.prefix + "/responses"
+
+	defer func() {
+		if uerr := res.SetResult(err); uerr != nil {
+			a.logger.WithError(uerr).Info("error processing request")
+		}
+		resBytes, err = json.Marshal(&res)
+		if err != nil {
+			a.logger.WithError(err).Error("error marshaling response")
+			resBytes = nil
+		}
+	}()
 
-func (a *MQTTApi) cancelSection(message mqtt.Message, rData responseData) (err error) {
-	var data struct {
-		SectionID *int
-	}
-	err = json.Unmarshal(message.Payload(), &data)
+	err = json.Unmarshal(payload, &data)
 	if err != nil {
-		err = util.NewParseError("cancelSection request", err)
+		err = fmt.Errorf("could not parse api request: %v", err)
 		return
 	}
-	sec, err := a.getSection(data.SectionID)
-	if err != nil {
-		return
-	}
-	a.secRunner.CancelSection(sec)
-	rData["message"] = fmt.Sprintf("cancelled section '%s'", sec.Name)
-	return
-}
 
-func (a *MQTTApi) cancelSectionRunID(message mqtt.Message, rData responseData) (err error) {
-	var data struct {
-		RunID *int32
-	}
-	err = json.Unmarshal(message.Payload(), &data)
-	if err != nil || data.RunID == nil {
-		err = util.NewParseError("cancelSectionRunId request", err)
+	res["rid"] = data.Rid
+	res["type"] = data.Type
+	if resPath, err = a.responseTopic(responseTopic); err != nil {
 		return
 	}
-	a.secRunner.CancelID(*data.RunID)
-	rData["message"] = fmt.Sprintf("cancelled section run with id %v", data.RunID)
-	return
-}
 
-func (a *MQTTApi) cancelAllSectionRuns(message mqtt.Message, rData responseData) (err error) {
-	var data struct{}
-	err = json.Unmarshal(message.Payload(), &data)
-	if err != nil {
-		err = util.NewParseError("cancelAllSectionRuns request", err)
-		return
-	}
-	a.secRunner.CancelAll()
-	rData["message"] = "cancelled all section runs"
+	err = a.handlers.Handle(data.Type, data.Token, payload, res)
 	return
 }
 
-func (a *MQTTApi) pauseSectionRunner(message mqtt.Message, rData responseData) (err error) {
-	var data struct {
-		Paused *bool
-	}
-	err = json.Unmarshal(message.Payload(), &data)
-	if err != nil || data.Paused == nil {
-		err = util.NewParseError("parse pauseSectionRunner request", err)
-		return
-	}
-	rData["paused"] = data.Paused
-	if *data.Paused {
-		a.secRunner.Pause()
-		rData["message"] = "paused section runner"
-	} else {
-		a.secRunner.Unpause()
-		rData["message"] = "unpaused section runner"
+func (a *MQTTApi) subscribe() {
+	// with MQTT 5, requests are received by requestsV5 instead
+	if a.requestsV5 == nil {
+		reqPath := a.prefix + "/requests"
+		a.logger.WithField("path", reqPath).Debug("registering request handler")
+		a.client.Subscribe(reqPath, 2, func(client mqtt.Client, message mqtt.Message) {
+			if resPath, resBytes := a.handleRequest(message.Payload(), ""); resBytes != nil {
+				client.Publish(resPath, 2, false, resBytes)
+			}
+		})
 	}
-	return
+	a.subscribeCommands()
+	a.homeAssistant.subscribe()
 }
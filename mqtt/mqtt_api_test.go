@@ -0,0 +1,366 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/config"
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/mqtt/mqtttest"
+	"git.amikhalev.com/amikhalev/grinklers/sched"
+	"git.amikhalev.com/amikhalev/grinklers/storage"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAPI() (*MQTTApi, *config.ConfigData) {
+	util.Logger.Out = ioutil.Discard
+	secInterface := logic.NewMockSectionInterface(2)
+	secInterface.Initialize()
+	// changes made by requests are saved in memory instead of to the config file
+	store, err := storage.OpenSQLite(":memory:")
+	if err != nil {
+		panic(err)
+	}
+	configData := &config.ConfigData{
+		SectionInterface: secInterface,
+		Sections:         logic.Sections{logic.NewSection(0, "sec 0", 0), logic.NewSection(1, "sec 1", 1)}.Pointers(),
+		Store:            store,
+	}
+	return NewMQTTApi(configData, logic.NewSectionRunner(secInterface)), configData
+}
+
+func TestMQTTApi_Standalone(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	broker := mqtttest.NewBroker()
+	broker.Authenticate = func(creds mqtttest.Credentials) bool {
+		return creds.Username == "user" && creds.Password == "pass" && creds.ClientID == "lan"
+	}
+	req.NoError(broker.Start())
+	defer broker.Close()
+
+	api, _ := newTestAPI()
+	mqttConfig := &config.MQTTJSON{URL: broker.URL(), Username: "user", Password: "pass", DeviceID: "lan"}
+	req.NoError(api.Start(mqttConfig.ToConnectData()))
+	ass.Equal("device/lan", api.Prefix())
+
+	ass.Eventually(func() bool {
+		msg, ok := broker.Retained("device/lan/connected")
+		return ok && string(msg.Payload) == "true"
+	}, time.Second, 5*time.Millisecond, "should connect with the configured credentials")
+	// the state is published after the connected state
+	ass.Eventually(func() bool {
+		msg, ok := broker.Retained("device/lan/sections")
+		return ok && string(msg.Payload) == "2"
+	}, time.Second, 5*time.Millisecond)
+
+	api.Stop()
+	msg, _ := broker.Retained("device/lan/connected")
+	ass.Equal("false", string(msg.Payload))
+
+	// stopping again does nothing
+	ass.NotPanics(api.Stop)
+}
+
+func TestMQTTApi_NoBroker(t *testing.T) {
+	ass := assert.New(t)
+	api, configData := newTestAPI()
+
+	// nothing is connected to, and updating does nothing
+	ass.Error(api.Start(nil))
+	ass.Nil(api.Client())
+	ass.NoError(api.UpdateAll())
+	ass.NoError(api.UpdateSectionData(configData.Sections[0]))
+	api.Stop()
+	ass.NotPanics(api.Stop)
+
+	// a broker which can not be connected to is retried until the api is stopped
+	broker := mqtttest.NewBroker()
+	ass.NoError(broker.Start())
+	url := broker.URL()
+	broker.Close()
+	api, _ = newTestAPI()
+	ass.NoError(api.Start((&config.MQTTJSON{URL: url}).ToConnectData()))
+	ass.NoError(api.UpdateAll())
+	done := make(chan struct{})
+	go func() {
+		api.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		ass.Fail("stopping should not wait for the broker")
+	}
+
+	ass.Error((&config.MQTTJSON{}).Validate())
+	ass.Error((&config.MQTTJSON{URL: "tcp://bad url:%"}).Validate())
+	ass.NoError((&config.MQTTJSON{URL: url}).Validate())
+}
+
+func TestMQTTApi_Tokens(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	broker := mqtttest.NewBroker()
+	req.NoError(broker.Start())
+	defer broker.Close()
+
+	var tokens []config.TokenJSON
+	req.NoError(json.Unmarshal([]byte(`[{"token": "a", "role": "operator"}, {"token": "b"}]`), &tokens))
+	ass.Equal([]config.TokenJSON{{Token: "a", Role: config.RoleOperator}, {Token: "b", Role: config.RoleViewer}},
+		tokens)
+	ass.Error(json.Unmarshal([]byte(`[{"token": "a", "role": "owner"}]`), &tokens))
+	bytes, err := json.Marshal(config.TokenJSON{Token: "a", Role: config.RoleAdmin})
+	req.NoError(err)
+	ass.JSONEq(`{"token": "a", "role": "admin"}`, string(bytes))
+
+	api, configData := newTestAPI()
+	configData.MQTT = &config.MQTTJSON{URL: broker.URL(), DeviceID: "auth"}
+	configData.Tokens = []config.TokenJSON{
+		{Name: "viewer", Token: "view"}, {Name: "operator", Token: "op", Role: config.RoleOperator},
+	}
+	req.NoError(api.Start(configData.MQTT.ToConnectData()))
+	defer api.Stop()
+	ass.Eventually(func() bool {
+		msg, _ := broker.Retained("device/auth/connected")
+		return string(msg.Payload) == "true"
+	}, time.Second, 5*time.Millisecond)
+
+	responses := broker.Watch("device/auth/#")
+	// publish publishes payload to topic, returning the response published to responseTopic
+	publish := func(topic, responseTopic, payload string) (res map[string]interface{}) {
+		broker.Publish("device/auth/"+topic, []byte(payload), false)
+		timeout := time.After(time.Second)
+		for {
+			select {
+			case msg := <-responses:
+				if msg.Topic == "device/auth/"+responseTopic {
+					req.NoError(json.Unmarshal(msg.Payload, &res))
+					return
+				}
+			case <-timeout:
+				req.Fail("no response")
+				return
+			}
+		}
+	}
+	request := func(payload string) map[string]interface{} {
+		return publish("requests", "responses", payload)
+	}
+
+	res := request(`{"type": "getSections"}`)
+	ass.Equal(float64(util.EC_Unauthorized), res["code"])
+	res = request(`{"type": "getSections", "token": "wrong"}`)
+	ass.Equal(float64(util.EC_Unauthorized), res["code"])
+	res = request(`{"type": "getSections", "token": "view"}`)
+	ass.Equal("success", res["result"])
+	res = request(`{"type": "runSection", "token": "view", "sectionId": 0, "duration": 1}`)
+	ass.Equal(float64(util.EC_NoPermission), res["code"])
+
+	// commands carry their token along with their payload
+	res = publish("sections/0/cancel", "sections/0/cancel/response", "")
+	ass.Equal(float64(util.EC_Unauthorized), res["code"])
+	res = publish("section_runner/pause", "section_runner/pause/response", `{"token": "view"}`)
+	ass.Equal(float64(util.EC_NoPermission), res["code"])
+	res = publish("programs/create", "programs/create/response",
+		`{"token": "op", "payload": {"name": "p", "sequence": []}}`)
+	ass.Equal(float64(util.EC_NoPermission), res["code"])
+	res = publish("sections/0/cancel", "sections/0/cancel/response", `{"token": "op"}`)
+	ass.Equal("success", res["result"])
+	res = publish("section_runner/runs/3/cancel", "section_runner/runs/3/cancel/response",
+		`{"token": "op", "payload": null}`)
+	ass.Equal("success", res["result"])
+}
+
+func TestMQTTApi_Reconnect(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	defer func(delay, max time.Duration) { ReconnectDelay, MaxReconnectDelay = delay, max }(
+		ReconnectDelay, MaxReconnectDelay)
+	ReconnectDelay, MaxReconnectDelay = 10*time.Millisecond, 50*time.Millisecond
+	broker := mqtttest.NewBroker()
+	var allowed int32 = 1
+	broker.Authenticate = func(mqtttest.Credentials) bool { return atomic.LoadInt32(&allowed) == 1 }
+	req.NoError(broker.Start())
+	defer broker.Close()
+
+	api, configData := newTestAPI()
+	req.NoError(api.Start((&config.MQTTJSON{URL: broker.URL(), DeviceID: "re"}).ToConnectData()))
+	defer api.Stop()
+	health := func() (h HealthJSON) {
+		msg, ok := broker.Retained("device/re/connection")
+		if ok {
+			req.NoError(json.Unmarshal(msg.Payload, &h))
+		}
+		return
+	}
+	ass.Eventually(func() bool { return !health().LastConnected.IsZero() }, time.Second, 5*time.Millisecond)
+	ass.Equal(0, health().Reconnects)
+
+	// while the broker refuses connections, messages are kept in the outbox
+	atomic.StoreInt32(&allowed, 0)
+	broker.DisconnectAll()
+	ass.Eventually(func() bool { return !api.Client().IsConnected() }, time.Second, 5*time.Millisecond)
+	configData.Sections[0].Name = "renamed"
+	req.NoError(api.UpdateSectionData(configData.Sections[0]))
+	queued, _ := api.outbox.stats()
+	ass.Equal(1, queued)
+	time.Sleep(100 * time.Millisecond)
+
+	atomic.StoreInt32(&allowed, 1)
+	ass.Eventually(func() bool { return health().Reconnects == 1 }, time.Second, 5*time.Millisecond)
+	ass.Equal(1, health().Queued)
+	msg, _ := broker.Retained("device/re/sections/0")
+	ass.Contains(string(msg.Payload), "renamed")
+	msg, _ = broker.Retained("device/re/connected")
+	ass.Equal("true", string(msg.Payload))
+
+	// the api topics are subscribed to again
+	responses := broker.Watch("device/re/responses")
+	broker.Publish("device/re/requests", []byte(`{"type": "getSections", "rid": 3}`), false)
+	select {
+	case msg := <-responses:
+		ass.Contains(string(msg.Payload), `"rid":3`)
+	case <-time.After(time.Second):
+		ass.Fail("no response after reconnecting")
+	}
+}
+
+// faultySectionInterface is a MockSectionInterface which reports fault for every section
+type faultySectionInterface struct {
+	*logic.MockSectionInterface
+	fault error
+}
+
+func (f *faultySectionInterface) Fault(logic.SectionID) error { return f.fault }
+func (f *faultySectionInterface) OnFaultChange(func())        {}
+
+func TestMQTTApi_SectionFault(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	broker := mqtttest.NewBroker()
+	req.NoError(broker.Start())
+	defer broker.Close()
+
+	api, configData := newTestAPI()
+	secInterface := &faultySectionInterface{configData.SectionInterface.(*logic.MockSectionInterface), nil}
+	configData.SectionInterface = secInterface
+	req.NoError(api.Start((&config.MQTTJSON{URL: broker.URL(), DeviceID: "fault"}).ToConnectData()))
+	defer api.Stop()
+	ass.Eventually(func() bool {
+		_, ok := broker.Retained("device/fault/sections/0/state")
+		return ok
+	}, time.Second, 5*time.Millisecond)
+	_, ok := broker.Retained("device/fault/sections/0/fault")
+	ass.False(ok, "there should be no fault")
+
+	secInterface.fault = fmt.Errorf("remote node is offline")
+	req.NoError(api.UpdateSectionState(configData.Sections[0]))
+	ass.Eventually(func() bool {
+		msg, _ := broker.Retained("device/fault/sections/0/fault")
+		return string(msg.Payload) == "remote node is offline"
+	}, time.Second, 5*time.Millisecond)
+
+	secInterface.fault = nil
+	req.NoError(api.UpdateSectionState(configData.Sections[0]))
+	ass.Eventually(func() bool {
+		_, ok := broker.Retained("device/fault/sections/0/fault")
+		return !ok
+	}, time.Second, 5*time.Millisecond, "the fault should be cleared")
+}
+
+func TestMQTTApi_V5(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	broker := mqtttest.NewBroker()
+	req.NoError(broker.Start())
+	defer broker.Close()
+
+	api, configData := newTestAPI()
+	configData.MQTT = &config.MQTTJSON{URL: broker.URL(), DeviceID: "res", V5: true}
+	req.NoError(api.Start(configData.MQTT.ToConnectData()))
+	defer api.Stop()
+	ass.Eventually(func() bool {
+		return broker.ClientCount() == 2 && broker.Subscribers("device/res/requests") == 1
+	}, time.Second, 5*time.Millisecond, "requests should only be received over the mqtt 5 connection")
+
+	responses := broker.Watch("device/res/responses/#")
+	// request makes a request, returning the response
+	request := func(msg mqtttest.Message) (res mqtttest.Message) {
+		msg.Topic = "device/res/requests"
+		broker.PublishMessage(msg)
+		select {
+		case res = <-responses:
+		case <-time.After(time.Second):
+			req.Fail("no response")
+		}
+		select {
+		case extra := <-responses:
+			ass.Fail("only one response should be published", extra.Topic)
+		case <-time.After(20 * time.Millisecond):
+		}
+		return
+	}
+	decode := func(msg mqtttest.Message) (res map[string]interface{}) {
+		req.NoError(json.Unmarshal(msg.Payload, &res))
+		return
+	}
+
+	msg := request(mqtttest.Message{Payload: []byte(`{"type": "getSections"}`),
+		ResponseTopic: "device/res/responses/client1", CorrelationData: []byte{1, 2, 3}})
+	ass.Equal("device/res/responses/client1", msg.Topic)
+	ass.Equal([]byte{1, 2, 3}, msg.CorrelationData)
+	ass.Equal("success", decode(msg)["result"])
+
+	// without a response topic, responses are matched by rid
+	msg = request(mqtttest.Message{Payload: []byte(`{"type": "getSections", "rid": 7}`)})
+	ass.Equal("device/res/responses", msg.Topic)
+	ass.Nil(msg.CorrelationData)
+	ass.Equal(7.0, decode(msg)["rid"])
+
+	for _, responseTopic := range []string{"somewhere/else", "device/res/responses/#", "device/res/responsesx"} {
+		msg = request(mqtttest.Message{Payload: []byte(`{"type": "getSections", "rid": 8}`),
+			ResponseTopic: responseTopic, CorrelationData: []byte("abc")})
+		ass.Equal("device/res/responses", msg.Topic, responseTopic)
+		ass.Equal([]byte("abc"), msg.CorrelationData, responseTopic)
+		ass.Equal("error", decode(msg)["result"], responseTopic)
+	}
+
+	api.Stop()
+	ass.Eventually(func() bool { return broker.ClientCount() == 0 }, time.Second, 5*time.Millisecond,
+		"both connections should be closed")
+}
+
+func TestMQTTApi_RemovedPrograms(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	broker := mqtttest.NewBroker()
+	req.NoError(broker.Start())
+	defer broker.Close()
+
+	api, configData := newTestAPI()
+	programs := []*logic.Program{
+		logic.NewProgram("first", nil, sched.Schedule{}, false),
+		logic.NewProgram("second", nil, sched.Schedule{}, false),
+	}
+	programs[1].ID = 5
+	configData.Programs = programs
+	req.NoError(api.Start((&config.MQTTJSON{URL: broker.URL(), DeviceID: "rm"}).ToConnectData()))
+	defer api.Stop()
+	retained := func(topic string) bool {
+		_, ok := broker.Retained("device/rm/" + topic)
+		return ok
+	}
+	ass.Eventually(func() bool {
+		return retained("programs/0") && retained("programs/0/running") && retained("programs/5")
+	}, time.Second, 5*time.Millisecond)
+
+	// the topics are by program id, so removing the first program does not move the others
+	configData.Programs = programs[1:]
+	req.NoError(api.UpdatePrograms(configData.ProgramList()))
+	ass.Eventually(func() bool {
+		msg, _ := broker.Retained("device/rm/programs")
+		return string(msg.Payload) == "1" && !retained("programs/0") && !retained("programs/0/running")
+	}, time.Second, 5*time.Millisecond, "the topics of the removed program should be cleared")
+	ass.True(retained("programs/5"))
+}
@@ -2,50 +2,50 @@ package mqtt
 
 import (
 	"git.amikhalev.com/amikhalev/grinklers/config"
+	"git.amikhalev.com/amikhalev/grinklers/history"
 	"git.amikhalev.com/amikhalev/grinklers/logic"
 	"git.amikhalev.com/amikhalev/grinklers/util"
 	"github.com/Sirupsen/logrus"
 )
 
+// updaterBuffer is the number of updates which are expected to be pending for the MQTTUpdater at once. Updates are
+// never dropped, since a topic would be left stale.
+const updaterBuffer = 32
+
 // MQTTUpdater updates MQTT topics with the current state of the application
 type MQTTUpdater struct {
-	config                *config.ConfigData
-	onSectionUpdate       chan logic.SecUpdate
-	onProgramUpdate       chan logic.ProgUpdate
-	onSectionRunnerUpdate chan *logic.SRState
-	stop                  chan int
-	api                   *MQTTApi
-	logger                *logrus.Entry
+	config          *config.ConfigData
+	events          *logic.Subscription
+	onHistoryUpdate chan struct{}
+	stop            chan int
+	api             *MQTTApi
+	logger          *logrus.Entry
 }
 
-// NewMQTTUpdater creates a new MQTTUpdater which uses the specified state
-func NewMQTTUpdater(config *config.ConfigData, sectionRunner *logic.SectionRunner) *MQTTUpdater {
-	onSectionUpdate := make(chan logic.SecUpdate, 10)
-	onProgramUpdate := make(chan logic.ProgUpdate, 10)
-	onSectionRunnerUpdate := make(chan *logic.SRState, 10)
+// NewMQTTUpdater creates a new MQTTUpdater which updates topics for the updates published on events
+func NewMQTTUpdater(config *config.ConfigData, events *logic.EventBus) *MQTTUpdater {
+	onHistoryUpdate := make(chan struct{}, 1)
 	stop := make(chan int)
-	for i := range config.Sections {
-		config.Sections[i].SetUpdateChan(onSectionUpdate)
-	}
-	for i := range config.Programs {
-		config.Programs[i].SetUpdateChan(onProgramUpdate)
-	}
-	sectionRunner.OnUpdateState = onSectionRunnerUpdate
 	return &MQTTUpdater{
 		config,
-		onSectionUpdate, onProgramUpdate, onSectionRunnerUpdate, stop, nil,
+		events.Subscribe("MQTTUpdater", updaterBuffer, logic.CoalesceAll), onHistoryUpdate, stop, nil,
 		util.Logger.WithField("module", "MQTTUpdater"),
 	}
 }
 
+// SetHistory makes the updater update the history topics whenever a run is recorded in hist
+func (u *MQTTUpdater) SetHistory(hist *history.History) {
+	hist.OnRecord = u.onHistoryUpdate
+}
+
 // UpdateSections updates the topics for all sections
 func (u *MQTTUpdater) UpdateSections() {
-	u.api.UpdateSections(u.config.Sections)
+	u.api.UpdateSections(u.config.SectionList())
 }
 
 // UpdatePrograms updates topics for all programs
 func (u *MQTTUpdater) UpdatePrograms() {
-	u.api.UpdatePrograms(u.config.Programs)
+	u.api.UpdatePrograms(u.config.ProgramList())
 }
 
 func (u *MQTTUpdater) run() {
@@ -58,63 +58,91 @@ func (u *MQTTUpdater) run() {
 		case <-u.stop:
 			u.logger.Debug("stopping updater")
 			return
-		case secUpdate := <-u.onSectionUpdate:
-			//logger.Debug("sec update")
-
-			var err error
-			switch secUpdate.Type {
-			case logic.SecUpdateData:
-				err = u.api.UpdateSectionData(secUpdate.Sec)
-				if err == nil {
-					err = config.WriteConfig(u.config)
-				}
-			case logic.SecUpdateState:
-				err = u.api.UpdateSectionState(secUpdate.Sec)
-			default:
+		case event := <-u.events.C:
+			switch update := event.(type) {
+			case logic.SecUpdate:
+				u.updateSection(update)
+			case logic.SectionsUpdate:
+				u.updateSections()
+			case logic.ProgUpdate:
+				u.updateProgram(update)
+			case logic.ProgramsUpdate:
+				u.updatePrograms()
+			case logic.SRUpdate:
+				u.updateSectionRunner(update.State)
 			}
+		case <-u.onHistoryUpdate:
+			err := u.api.UpdateHistory()
 			if err != nil {
-				u.logger.WithError(err).Error("error updating sections")
-			}
-		case progUpdate := <-u.onProgramUpdate:
-			//logger.Debug("prog update")
-			util.ExhaustChan(u.onProgramUpdate)
-
-			index := -1
-			for i := range u.config.Programs {
-				if u.config.Programs[i] == progUpdate.Prog {
-					index = i
-				}
-			}
-			if index == -1 {
-				u.logger.Panicf("invalid program update recieved: %v", progUpdate.Prog)
+				u.logger.WithError(err).Error("error updating history")
 			}
+		}
+	}
+}
 
-			var err error
-			switch progUpdate.Type {
-			case logic.ProgUpdateData:
-				err = u.api.UpdateProgramData(index, progUpdate.Prog)
-				if err == nil {
-					err = config.WriteConfig(u.config)
-				}
-			case logic.ProgUpdateRunning:
-				err = u.api.UpdateProgramRunning(index, progUpdate.Prog)
-			default:
-			}
-			if err != nil {
-				u.logger.WithError(err).Error("error updating sections")
-			}
-		case srState := <-u.onSectionRunnerUpdate:
-			util.ExhaustChan(u.onSectionRunnerUpdate)
-			srState.Lock()
-			u.logger.WithField("srState", srState).Debugf("section runner update")
-			srState.Unlock()
+func (u *MQTTUpdater) updateSection(secUpdate logic.SecUpdate) {
+	var err error
+	switch secUpdate.Type {
+	case logic.SecUpdateData:
+		err = u.api.UpdateSectionData(secUpdate.Sec)
+	case logic.SecUpdateState:
+		err = u.api.UpdateSectionState(secUpdate.Sec)
+	default:
+	}
+	if err != nil {
+		u.logger.WithError(err).Error("error updating sections")
+	}
+}
 
-			err := u.api.UpdateSectionRunner(srState)
-			if err != nil {
-				u.logger.WithError(err).Error("error updating section runner state")
-			}
+// updateSections updates the topics for all sections after sections are added or removed
+func (u *MQTTUpdater) updateSections() {
+	if err := u.api.UpdateSections(u.config.SectionList()); err != nil {
+		u.logger.WithError(err).Error("error updating sections")
+	}
+}
+
+func (u *MQTTUpdater) updateProgram(progUpdate logic.ProgUpdate) {
+	found := false
+	for _, prog := range u.config.ProgramList() {
+		if prog == progUpdate.Prog {
+			found = true
 		}
 	}
+	if !found {
+		// the program has been removed since the update was published
+		u.logger.WithField("program", progUpdate.Prog.Name).Debug("ignoring update to removed program")
+		return
+	}
+
+	var err error
+	switch progUpdate.Type {
+	case logic.ProgUpdateData:
+		err = u.api.UpdateProgramData(progUpdate.Prog)
+	case logic.ProgUpdateRunning:
+		err = u.api.UpdateProgramRunning(progUpdate.Prog)
+	default:
+	}
+	if err != nil {
+		u.logger.WithError(err).Error("error updating programs")
+	}
+}
+
+// updatePrograms updates the topics for all programs after programs are added, removed or reordered
+func (u *MQTTUpdater) updatePrograms() {
+	if err := u.api.UpdatePrograms(u.config.ProgramList()); err != nil {
+		u.logger.WithError(err).Error("error updating programs")
+	}
+}
+
+func (u *MQTTUpdater) updateSectionRunner(srState *logic.SRState) {
+	srState.Lock()
+	u.logger.WithField("srState", srState).Debugf("section runner update")
+	srState.Unlock()
+
+	err := u.api.UpdateSectionRunner(srState)
+	if err != nil {
+		u.logger.WithError(err).Error("error updating section runner state")
+	}
 }
 
 // Start starts the MQTTUpdater to listen and update topics
@@ -126,4 +154,5 @@ func (u *MQTTUpdater) Start(api *MQTTApi) {
 // Stop stops the updater from updating topics
 func (u *MQTTUpdater) Stop() {
 	u.stop <- 0
+	u.events.Close()
 }
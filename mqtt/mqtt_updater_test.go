@@ -0,0 +1,40 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/config"
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/mqtt/mqtttest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMQTTUpdater(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	broker := mqtttest.NewBroker()
+	req.NoError(broker.Start())
+	defer broker.Close()
+
+	api, configData := newTestAPI()
+	events := logic.NewEventBus()
+	configData.SetEventBus(events)
+	updater := NewMQTTUpdater(configData, events)
+	// another subscriber does not interfere with the updater
+	other := events.Subscribe("other", 1, logic.DropNewest)
+	defer other.Close()
+
+	mqttConfig := &config.MQTTJSON{URL: broker.URL(), DeviceID: "updater"}
+	req.NoError(api.Start(mqttConfig.ToConnectData()))
+	defer api.Stop()
+	updater.Start(api)
+	defer updater.Stop()
+
+	configData.Sections[1].SetState(true, configData.SectionInterface)
+	ass.Eventually(func() bool {
+		msg, ok := broker.Retained("device/updater/sections/1/state")
+		return ok && string(msg.Payload) == "true"
+	}, time.Second, 5*time.Millisecond, "the section state should be updated")
+	ass.Equal(logic.SecUpdate{Sec: configData.Sections[1], Type: logic.SecUpdateState}, <-other.C)
+}
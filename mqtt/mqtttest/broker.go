@@ -0,0 +1,607 @@
+// Package mqtttest provides a minimal in-process MQTT broker for use in tests.
+//
+// The Broker implements enough of MQTT 3.1.1 to be used by the paho client: connecting (with wills and
+// credentials), publishing at any QoS, subscribing with wildcards, retained messages and pings. All
+// subscriptions are granted at QoS 0, so messages are always delivered to subscribers at QoS 0. Clients may
+// also connect with MQTT 5, in which case the response topic and correlation data properties of messages are
+// passed on to them. Other properties are ignored.
+package mqtttest
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	pktConnect     = 1
+	pktConnack     = 2
+	pktPublish     = 3
+	pktPuback      = 4
+	pktPubrec      = 5
+	pktPubrel      = 6
+	pktPubcomp     = 7
+	pktSubscribe   = 8
+	pktSuback      = 9
+	pktUnsubscribe = 10
+	pktUnsuback    = 11
+	pktPingreq     = 12
+	pktPingresp    = 13
+	pktDisconnect  = 14
+)
+
+// Message is a message that was published to the Broker
+type Message struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+	// ResponseTopic and CorrelationData are the MQTT 5 properties of the message, which are only delivered to
+	// clients connected with MQTT 5
+	ResponseTopic   string
+	CorrelationData []byte
+}
+
+// Credentials are a username and password that a client connected with
+type Credentials struct {
+	ClientID string
+	Username string
+	Password string
+}
+
+// Broker is a minimal in-process MQTT broker
+type Broker struct {
+	// Authenticate is called for every connecting client, if it is set. If it returns false, the client
+	// is refused with a "not authorized" CONNACK.
+	Authenticate func(creds Credentials) bool
+
+	listener net.Listener
+	scheme   string
+	clients  map[*brokerClient]struct{}
+	retained map[string]Message
+	watchers []*watcher
+	wait     sync.WaitGroup
+	mu       sync.Mutex
+}
+
+type watcher struct {
+	filter string
+	ch     chan Message
+}
+
+// NewBroker creates a new Broker which is not yet listening
+func NewBroker() *Broker {
+	return &Broker{
+		clients:  make(map[*brokerClient]struct{}),
+		retained: make(map[string]Message),
+	}
+}
+
+// Start starts the Broker listening on a random local tcp port
+func (b *Broker) Start() error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	b.serve(listener, "tcp")
+	return nil
+}
+
+// StartTLS starts the Broker listening with TLS on a random local tcp port
+func (b *Broker) StartTLS(config *tls.Config) error {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		return err
+	}
+	b.serve(listener, "ssl")
+	return nil
+}
+
+func (b *Broker) serve(listener net.Listener, scheme string) {
+	b.listener = listener
+	b.scheme = scheme
+	b.wait.Add(1)
+	go func() {
+		defer b.wait.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b.wait.Add(1)
+			go func() {
+				defer b.wait.Done()
+				b.handle(conn)
+			}()
+		}
+	}()
+}
+
+// URL gets the URL that clients can connect to the Broker with
+func (b *Broker) URL() string {
+	return fmt.Sprintf("%s://%s", b.scheme, b.listener.Addr().String())
+}
+
+// Close stops the Broker and disconnects all clients
+func (b *Broker) Close() {
+	b.listener.Close()
+	b.DisconnectAll()
+	b.wait.Wait()
+	b.mu.Lock()
+	for _, w := range b.watchers {
+		close(w.ch)
+	}
+	b.watchers = nil
+	b.mu.Unlock()
+}
+
+// DisconnectAll abruptly closes the connections of all connected clients, as if the network had failed.
+// Their wills are published.
+func (b *Broker) DisconnectAll() {
+	b.mu.Lock()
+	clients := make([]*brokerClient, 0, len(b.clients))
+	for c := range b.clients {
+		clients = append(clients, c)
+	}
+	b.mu.Unlock()
+	for _, c := range clients {
+		c.conn.Close()
+	}
+}
+
+// ClientCount gets the number of currently connected clients
+func (b *Broker) ClientCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.clients)
+}
+
+// Subscribers gets the number of connected clients which are subscribed to topic
+func (b *Broker) Subscribers(topic string) (count int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		if c.subscribed(topic) {
+			count++
+		}
+	}
+	return
+}
+
+// Watch returns a chan which receives every message published to a topic matching filter,
+// including currently retained messages. The chan is closed when the Broker is closed.
+func (b *Broker) Watch(filter string) <-chan Message {
+	w := &watcher{filter, make(chan Message, 100)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.watchers = append(b.watchers, w)
+	for topic, msg := range b.retained {
+		if MatchTopic(filter, topic) {
+			w.ch <- msg
+		}
+	}
+	return w.ch
+}
+
+// Retained gets the currently retained message for a topic
+func (b *Broker) Retained(topic string) (msg Message, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msg, ok = b.retained[topic]
+	return
+}
+
+// Publish publishes a message from the broker itself to all subscribers
+func (b *Broker) Publish(topic string, payload []byte, retain bool) {
+	b.publish(Message{Topic: topic, Payload: payload, Retain: retain})
+}
+
+// PublishMessage publishes msg from the broker itself to all subscribers, along with its properties
+func (b *Broker) PublishMessage(msg Message) {
+	b.publish(msg)
+}
+
+func (b *Broker) publish(msg Message) {
+	b.mu.Lock()
+	if msg.Retain {
+		if len(msg.Payload) == 0 {
+			delete(b.retained, msg.Topic)
+		} else {
+			b.retained[msg.Topic] = msg
+		}
+	}
+	var targets []*brokerClient
+	for c := range b.clients {
+		if c.subscribed(msg.Topic) {
+			targets = append(targets, c)
+		}
+	}
+	for _, w := range b.watchers {
+		if MatchTopic(w.filter, msg.Topic) {
+			select {
+			case w.ch <- msg:
+			default:
+			}
+		}
+	}
+	b.mu.Unlock()
+	// retain is only set on messages delivered because of a new subscription
+	msg.Retain = false
+	for _, c := range targets {
+		c.deliver(msg)
+	}
+}
+
+// MatchTopic checks if topic matches the MQTT topic filter (which may contain + and # wildcards)
+func MatchTopic(filter, topic string) bool {
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+type brokerClient struct {
+	broker *Broker
+	conn   net.Conn
+	// version is the protocol level the client connected with, 4 for MQTT 3.1.1 or 5 for MQTT 5
+	version byte
+	filters map[string]struct{}
+	will    *Message
+	writeMu sync.Mutex
+}
+
+func (c *brokerClient) subscribed(topic string) bool {
+	for filter := range c.filters {
+		if MatchTopic(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *brokerClient) write(pktType byte, flags byte, body []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	header := appendVarint([]byte{pktType<<4 | flags}, len(body))
+	if _, err := c.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(body)
+	return err
+}
+
+func (c *brokerClient) deliver(msg Message) {
+	var flags byte
+	if msg.Retain {
+		flags |= 0x01
+	}
+	body := appendString(nil, msg.Topic)
+	if c.version == 5 {
+		body = appendProperties(body, msg)
+	}
+	body = append(body, msg.Payload...)
+	c.write(pktPublish, flags, body)
+}
+
+const (
+	propResponseTopic   = 0x08
+	propCorrelationData = 0x09
+)
+
+// appendProperties appends the MQTT 5 properties of msg
+func appendProperties(b []byte, msg Message) []byte {
+	var props []byte
+	if msg.ResponseTopic != "" {
+		props = append(props, propResponseTopic)
+		props = appendString(props, msg.ResponseTopic)
+	}
+	if msg.CorrelationData != nil {
+		props = append(props, propCorrelationData)
+		props = appendString(props, string(msg.CorrelationData))
+	}
+	b = appendVarint(b, len(props))
+	return append(b, props...)
+}
+
+func appendVarint(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func appendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func appendID(b []byte, id uint16) []byte {
+	return append(b, byte(id>>8), byte(id))
+}
+
+var errMalformed = errors.New("malformed packet")
+
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil || len(r.data) < n {
+		r.err = errMalformed
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) byte() byte {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *reader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *reader) string() string {
+	return string(r.bytes(int(r.uint16())))
+}
+
+func (r *reader) varint() (n int) {
+	for multiplier := 1; multiplier <= 128*128*128; multiplier *= 128 {
+		digit := r.byte()
+		n += int(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			return
+		}
+	}
+	r.err = errMalformed
+	return
+}
+
+// properties reads MQTT 5 properties, keeping the ones of msg. msg may be nil if the properties are skipped.
+func (r *reader) properties(msg *Message) {
+	props := &reader{data: r.bytes(r.varint())}
+	for len(props.data) > 0 && props.err == nil {
+		switch id := props.byte(); id {
+		case 0x01, 0x17, 0x19, 0x24, 0x25, 0x28, 0x29, 0x2a: // byte
+			props.byte()
+		case 0x13, 0x21, 0x22, 0x23: // two byte integer
+			props.uint16()
+		case 0x02, 0x11, 0x18, 0x27: // four byte integer
+			props.bytes(4)
+		case 0x0b: // variable byte integer
+			props.varint()
+		case 0x03, 0x12, 0x15, 0x16, 0x1a, 0x1c, 0x1f: // string or binary data
+			props.string()
+		case propResponseTopic:
+			topic := props.string()
+			if msg != nil {
+				msg.ResponseTopic = topic
+			}
+		case propCorrelationData:
+			data := props.bytes(int(props.uint16()))
+			if msg != nil {
+				msg.CorrelationData = append([]byte{}, data...)
+			}
+		case 0x26: // user property, a string pair
+			props.string()
+			props.string()
+		default:
+			props.err = errMalformed
+		}
+	}
+	if props.err != nil {
+		r.err = props.err
+	}
+}
+
+func readPacket(br *bufio.Reader) (pktType byte, flags byte, body []byte, err error) {
+	first, err := br.ReadByte()
+	if err != nil {
+		return
+	}
+	pktType, flags = first>>4, first&0x0f
+	length, multiplier := 0, 1
+	for {
+		var digit byte
+		if digit, err = br.ReadByte(); err != nil {
+			return
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	body = make([]byte, length)
+	_, err = io.ReadFull(br, body)
+	return
+}
+
+func (b *Broker) handle(conn net.Conn) {
+	defer conn.Close()
+	c := &brokerClient{broker: b, conn: conn, filters: make(map[string]struct{})}
+	br := bufio.NewReader(conn)
+
+	pktType, _, body, err := readPacket(br)
+	if err != nil || pktType != pktConnect {
+		return
+	}
+	r := &reader{data: body}
+	r.string() // protocol name
+	c.version = r.byte()
+	connectFlags := r.byte()
+	r.uint16() // keep alive
+	if c.version == 5 {
+		r.properties(nil)
+	}
+	creds := Credentials{ClientID: r.string()}
+	if connectFlags&0x04 != 0 {
+		c.will = &Message{}
+		if c.version == 5 {
+			r.properties(c.will)
+		}
+		c.will.Topic, c.will.Retain = r.string(), connectFlags&0x20 != 0
+		c.will.Payload = r.bytes(int(r.uint16()))
+	}
+	if connectFlags&0x80 != 0 {
+		creds.Username = r.string()
+	}
+	if connectFlags&0x40 != 0 {
+		creds.Password = r.string()
+	}
+	if r.err != nil {
+		return
+	}
+	if b.Authenticate != nil && !b.Authenticate(creds) {
+		if c.version == 5 {
+			// not authorized, with no properties
+			c.write(pktConnack, 0, []byte{0, 0x87, 0})
+		} else {
+			c.write(pktConnack, 0, []byte{0, 5})
+		}
+		return
+	}
+	b.mu.Lock()
+	b.clients[c] = struct{}{}
+	b.mu.Unlock()
+	if c.version == 5 {
+		c.write(pktConnack, 0, []byte{0, 0, 0})
+	} else {
+		c.write(pktConnack, 0, []byte{0, 0})
+	}
+
+	cleanDisconnect := false
+	defer func() {
+		b.mu.Lock()
+		delete(b.clients, c)
+		b.mu.Unlock()
+		if !cleanDisconnect && c.will != nil {
+			b.publish(*c.will)
+		}
+	}()
+
+	for {
+		pktType, flags, body, err := readPacket(br)
+		if err != nil {
+			return
+		}
+		r := &reader{data: body}
+		switch pktType {
+		case pktPublish:
+			qos := (flags >> 1) & 0x03
+			msg := Message{Topic: r.string(), Retain: flags&0x01 != 0}
+			var id uint16
+			if qos > 0 {
+				id = r.uint16()
+			}
+			if c.version == 5 {
+				r.properties(&msg)
+			}
+			if r.err != nil {
+				return
+			}
+			msg.Payload = r.data
+			switch qos {
+			case 1:
+				c.write(pktPuback, 0, appendID(nil, id))
+			case 2:
+				c.write(pktPubrec, 0, appendID(nil, id))
+			}
+			b.publish(msg)
+		case pktPubrel:
+			c.write(pktPubcomp, 0, appendID(nil, r.uint16()))
+		case pktSubscribe:
+			id := r.uint16()
+			if c.version == 5 {
+				r.properties(nil)
+			}
+			var filters []string
+			for len(r.data) > 0 && r.err == nil {
+				filters = append(filters, r.string())
+				r.byte() // requested qos
+			}
+			if r.err != nil {
+				return
+			}
+			b.mu.Lock()
+			for _, filter := range filters {
+				c.filters[filter] = struct{}{}
+			}
+			var retained []Message
+			for topic, msg := range b.retained {
+				for _, filter := range filters {
+					if MatchTopic(filter, topic) {
+						retained = append(retained, msg)
+						break
+					}
+				}
+			}
+			b.mu.Unlock()
+			// every subscription is granted at qos 0
+			suback := appendID(nil, id)
+			if c.version == 5 {
+				suback = append(suback, 0)
+			}
+			c.write(pktSuback, 0, append(suback, make([]byte, len(filters))...))
+			for _, msg := range retained {
+				c.deliver(msg)
+			}
+		case pktUnsubscribe:
+			id := r.uint16()
+			if c.version == 5 {
+				r.properties(nil)
+			}
+			count := 0
+			b.mu.Lock()
+			for len(r.data) > 0 && r.err == nil {
+				delete(c.filters, r.string())
+				count++
+			}
+			b.mu.Unlock()
+			unsuback := appendID(nil, id)
+			if c.version == 5 {
+				// no properties, and a success reason code for every filter
+				unsuback = append(append(unsuback, 0), make([]byte, count)...)
+			}
+			c.write(pktUnsuback, 0, unsuback)
+		case pktPingreq:
+			c.write(pktPingresp, 0, nil)
+		case pktDisconnect:
+			cleanDisconnect = true
+			return
+		}
+	}
+}
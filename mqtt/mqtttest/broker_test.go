@@ -0,0 +1,19 @@
+package mqtttest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchTopic(t *testing.T) {
+	ass := assert.New(t)
+	ass.True(MatchTopic("a/b/c", "a/b/c"))
+	ass.False(MatchTopic("a/b/c", "a/b"))
+	ass.False(MatchTopic("a/b", "a/b/c"))
+	ass.True(MatchTopic("a/+/c", "a/b/c"))
+	ass.False(MatchTopic("a/+/c", "a/b/d"))
+	ass.True(MatchTopic("a/#", "a/b/c"))
+	ass.True(MatchTopic("#", "a"))
+	ass.True(MatchTopic("a/+", "a/"))
+}
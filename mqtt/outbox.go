@@ -0,0 +1,91 @@
+package mqtt
+
+import (
+	"sync"
+)
+
+// OutboxSize is the number of topics the outbox of an MQTTApi keeps messages for while the broker can not be
+// published to
+var OutboxSize = 1000
+
+// outboxMessage is a retained message in an outbox
+type outboxMessage struct {
+	topic   string
+	payload interface{}
+}
+
+// outbox keeps the retained messages which could not be published, so they can be published when the broker is
+// connected to again. Only the latest message for each topic is kept, since it replaces the others. When it is
+// full, the oldest messages are dropped.
+type outbox struct {
+	size int
+	// seqs are the sequence numbers of the latest messages published to each topic
+	seqs    map[string]uint64
+	queued  map[string]interface{}
+	order   []string
+	dropped int
+	sync.Mutex
+}
+
+func newOutbox(size int) *outbox {
+	return &outbox{size, make(map[string]uint64), make(map[string]interface{}), nil, 0, sync.Mutex{}}
+}
+
+// publishing records that a message is being published to topic, replacing any queued message for it. It
+// returns the sequence number to pass to failed if publishing fails.
+func (o *outbox) publishing(topic string) (seq uint64) {
+	o.Lock()
+	defer o.Unlock()
+	o.seqs[topic]++
+	if _, ok := o.queued[topic]; ok {
+		delete(o.queued, topic)
+		o.removeFromOrder(topic)
+	}
+	return o.seqs[topic]
+}
+
+// failed queues payload for topic, unless a newer message has been published to topic since
+func (o *outbox) failed(topic string, seq uint64, payload interface{}) {
+	o.Lock()
+	defer o.Unlock()
+	if o.seqs[topic] != seq {
+		return
+	}
+	if _, ok := o.queued[topic]; !ok {
+		if len(o.order) >= o.size {
+			delete(o.queued, o.order[0])
+			o.order = o.order[1:]
+			o.dropped++
+		}
+		o.order = append(o.order, topic)
+	}
+	o.queued[topic] = payload
+}
+
+func (o *outbox) removeFromOrder(topic string) {
+	for i, t := range o.order {
+		if t == topic {
+			o.order = append(o.order[:i:i], o.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// take removes all queued messages, returning them from oldest to newest
+func (o *outbox) take() (messages []outboxMessage) {
+	o.Lock()
+	defer o.Unlock()
+	for _, topic := range o.order {
+		messages = append(messages, outboxMessage{topic, o.queued[topic]})
+	}
+	o.queued = make(map[string]interface{})
+	o.order = nil
+	return
+}
+
+// stats gets the number of queued messages and the number of messages which have been dropped because it was full
+func (o *outbox) stats() (queued, dropped int) {
+	o.Lock()
+	defer o.Unlock()
+	return len(o.order), o.dropped
+}
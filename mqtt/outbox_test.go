@@ -0,0 +1,59 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutbox(t *testing.T) {
+	ass := assert.New(t)
+	o := newOutbox(2)
+
+	seq := o.publishing("a")
+	o.failed("a", seq, "a1")
+	// only the latest message for a topic is kept
+	seq = o.publishing("a")
+	o.failed("a", seq, "a2")
+	// a failure of a message which has been replaced is ignored
+	stale := o.publishing("b")
+	seq = o.publishing("b")
+	o.failed("b", seq, "b2")
+	o.failed("b", stale, "b1")
+	ass.Equal([]outboxMessage{{"a", "a2"}, {"b", "b2"}}, o.take())
+	ass.Empty(o.take())
+
+	// publishing a topic again removes its queued message
+	seq = o.publishing("a")
+	o.failed("a", seq, "a3")
+	o.publishing("a")
+	queued, dropped := o.stats()
+	ass.Equal(0, queued)
+	ass.Equal(0, dropped)
+
+	// the oldest messages are dropped when it is full
+	for _, topic := range []string{"a", "b", "c"} {
+		o.failed(topic, o.publishing(topic), topic)
+	}
+	queued, dropped = o.stats()
+	ass.Equal(2, queued)
+	ass.Equal(1, dropped)
+	ass.Equal([]outboxMessage{{"b", "b"}, {"c", "c"}}, o.take())
+}
+
+func TestReconnectDelay(t *testing.T) {
+	ass := assert.New(t)
+	defer func(delay, max time.Duration) { ReconnectDelay, MaxReconnectDelay = delay, max }(
+		ReconnectDelay, MaxReconnectDelay)
+	ReconnectDelay, MaxReconnectDelay = time.Second, time.Minute
+	for attempt, expected := range []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second, time.Minute,
+	} {
+		for i := 0; i < 20; i++ {
+			delay := reconnectDelay(attempt)
+			ass.True(delay >= expected/2 && delay <= expected, "attempt %d: %v", attempt, delay)
+		}
+	}
+	ass.True(reconnectDelay(100) <= time.Minute)
+}
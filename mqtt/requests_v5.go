@@ -0,0 +1,125 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/http"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/Sirupsen/logrus"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// requestsV5 receives api requests on <prefix>/requests over a connection to the broker with MQTT 5, which the
+// client used for everything else does not support. The response to each request is published to the response
+// topic of the request, along with its correlation data. Requests without a response topic are answered on
+// <prefix>/responses like over MQTT 3.
+type requestsV5 struct {
+	api    *MQTTApi
+	conn   *autopaho.ConnectionManager
+	cancel context.CancelFunc
+	logger *logrus.Entry
+}
+
+// newRequestsV5 starts connecting to the broker of connectData in the background, with the client id of
+// connectData followed by "-requests". It keeps reconnecting until it is stopped.
+func newRequestsV5(a *MQTTApi, connectData *http.ConnectData) (r *requestsV5, err error) {
+	brokerURI, err := util.ParseBrokerURL(connectData.MqttURL)
+	if err != nil {
+		err = fmt.Errorf("invalid mqtt url: %v", err)
+		return
+	}
+	r = &requestsV5{api: a, logger: a.logger.WithField("protocol", "mqtt5")}
+	cfg := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{brokerURI},
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: true,
+		ReconnectBackoff: func(attempt int) time.Duration {
+			// the delay of attempt 0 is before the first attempt, which is made right away
+			if attempt == 0 {
+				return 0
+			}
+			return reconnectDelay(attempt - 1)
+		},
+		ConnectTimeout:  MQTT_TIMEOUT,
+		ConnectUsername: brokerUsername(connectData),
+		ConnectPassword: []byte(connectData.DeviceToken),
+		OnConnectionUp:  r.onConnectionUp,
+		OnConnectError: func(err error) {
+			r.logger.WithError(err).Error("error connecting to mqtt broker")
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:          connectData.ClientID + "-requests",
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){r.onPublishReceived},
+		},
+	}
+	if a.tls != nil {
+		cfg.TlsCfg = a.tls.tlsConfig()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if r.conn, err = autopaho.NewConnection(ctx, cfg); err != nil {
+		cancel()
+		err = fmt.Errorf("could not connect to mqtt broker with mqtt 5: %v", err)
+		return
+	}
+	r.cancel = cancel
+	return
+}
+
+// onConnectionUp subscribes to the requests every time the broker is connected to, since the session is not kept
+func (r *requestsV5) onConnectionUp(conn *autopaho.ConnectionManager, _ *paho.Connack) {
+	reqPath := r.api.prefix + "/requests"
+	r.logger.WithField("path", reqPath).Info("connected to mqtt broker, registering request handler")
+	// OnConnectionUp must not block, so the subscription is waited for in the background
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), MQTT_TIMEOUT)
+		defer cancel()
+		if _, err := conn.Subscribe(ctx, &paho.Subscribe{
+			Subscriptions: []paho.SubscribeOptions{{Topic: reqPath, QoS: 2}},
+		}); err != nil {
+			r.logger.WithError(err).Error("error subscribing to requests")
+		}
+	}()
+}
+
+func (r *requestsV5) onPublishReceived(received paho.PublishReceived) (bool, error) {
+	var responseTopic string
+	var correlationData []byte
+	if props := received.Packet.Properties; props != nil {
+		responseTopic, correlationData = props.ResponseTopic, props.CorrelationData
+	}
+	resPath, resBytes := r.api.handleRequest(received.Packet.Payload, responseTopic)
+	if resBytes == nil {
+		return true, nil
+	}
+	response := &paho.Publish{
+		Topic: resPath, QoS: 2, Payload: resBytes,
+		Properties: &paho.PublishProperties{CorrelationData: correlationData},
+	}
+	// publishing waits for the broker to acknowledge it, which should not hold up receiving other requests
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), MQTT_TIMEOUT)
+		defer cancel()
+		if _, err := r.conn.Publish(ctx, response); err != nil {
+			r.logger.WithError(err).WithField("topic", resPath).Error("error publishing response")
+		}
+	}()
+	return true, nil
+}
+
+// stop disconnects from the broker. It does nothing on a nil requestsV5, which is used when requests are received
+// with MQTT 3.
+func (r *requestsV5) stop() {
+	if r == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), MQTT_TIMEOUT)
+	defer cancel()
+	if err := r.conn.Disconnect(ctx); err != nil {
+		r.logger.WithError(err).Debug("error disconnecting from mqtt broker")
+	}
+	r.cancel()
+}
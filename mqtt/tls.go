@@ -0,0 +1,187 @@
+package mqtt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/config"
+	"github.com/Sirupsen/logrus"
+	"github.com/fsnotify/fsnotify"
+)
+
+// tlsFiles loads the CA bundle and client certificate of a TLS configuration, and reloads them when the files
+// change. The tls.Config it creates always uses the files which were loaded last, so changed files are used
+// from the next time the broker is connected to.
+type tlsFiles struct {
+	config  *config.MQTTTLSJSON
+	pins    [][]byte
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+	log     *logrus.Entry
+	// roots are the CAs from CAFile, or nil to use the system CAs
+	roots *x509.CertPool
+	// cert is the client certificate, or nil if there is none
+	cert *tls.Certificate
+	sync.Mutex
+}
+
+// newTLSFiles loads the files of tlsConfig, returning an error if they are invalid
+func newTLSFiles(tlsConfig *config.MQTTTLSJSON, log *logrus.Entry) (f *tlsFiles, err error) {
+	f = &tlsFiles{
+		config: tlsConfig, pins: tlsConfig.PinHashes(), done: make(chan struct{}), log: log,
+	}
+	if err = f.load(); err != nil {
+		f = nil
+	}
+	return
+}
+
+// load reads the files. If any of them are invalid, the files which were loaded before are kept.
+func (f *tlsFiles) load() (err error) {
+	var roots *x509.CertPool
+	if f.config.CAFile != "" {
+		pem, err := ioutil.ReadFile(f.config.CAFile)
+		if err != nil {
+			return fmt.Errorf("could not read mqtt ca file: %v", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in mqtt ca file %s", f.config.CAFile)
+		}
+	}
+	var cert *tls.Certificate
+	if f.config.CertFile != "" {
+		keyPair, err := tls.LoadX509KeyPair(f.config.CertFile, f.config.KeyFile)
+		if err != nil {
+			return fmt.Errorf("could not load mqtt client certificate: %v", err)
+		}
+		cert = &keyPair
+	}
+	f.Lock()
+	f.roots, f.cert = roots, cert
+	f.Unlock()
+	return
+}
+
+// files gets the paths of the files which are loaded
+func (f *tlsFiles) files() (files []string) {
+	for _, file := range []string{f.config.CAFile, f.config.CertFile, f.config.KeyFile} {
+		if file != "" {
+			files = append(files, filepath.Clean(file))
+		}
+	}
+	return
+}
+
+// watch starts reloading the files in the background whenever they change
+func (f *tlsFiles) watch() (err error) {
+	if f.watcher, err = fsnotify.NewWatcher(); err != nil {
+		return fmt.Errorf("could not watch mqtt tls files: %v", err)
+	}
+	// the directories are watched, since certificates are usually renewed by replacing the files
+	for _, file := range f.files() {
+		if err = f.watcher.Add(filepath.Dir(file)); err != nil {
+			f.watcher.Close()
+			return fmt.Errorf("could not watch mqtt tls files: %v", err)
+		}
+	}
+	go f.run()
+	return
+}
+
+func (f *tlsFiles) run() {
+	defer close(f.done)
+	files := f.files()
+	var reload <-chan time.Time
+	for {
+		select {
+		case event, ok := <-f.watcher.Events:
+			if !ok {
+				return
+			}
+			for _, file := range files {
+				if filepath.Clean(event.Name) == file {
+					reload = time.After(config.ReloadDelay)
+				}
+			}
+		case err, ok := <-f.watcher.Errors:
+			if !ok {
+				return
+			}
+			f.log.WithError(err).Warn("error watching mqtt tls files")
+		case <-reload:
+			reload = nil
+			if err := f.load(); err != nil {
+				f.log.WithError(err).Error("error reloading mqtt tls files, keeping the old files")
+			} else {
+				f.log.Info("reloaded mqtt tls files, they are used from the next connection")
+			}
+		}
+	}
+}
+
+// close stops watching the files
+func (f *tlsFiles) close() {
+	if f.watcher == nil {
+		return
+	}
+	f.watcher.Close()
+	<-f.done
+}
+
+// tlsConfig creates a tls.Config which uses the files which were loaded last
+func (f *tlsFiles) tlsConfig() *tls.Config {
+	return &tls.Config{
+		ServerName: f.config.ServerName,
+		// the certificate is verified by verifyConnection instead, so that the CAs can be reloaded
+		InsecureSkipVerify:   true,
+		VerifyConnection:     f.verifyConnection,
+		GetClientCertificate: f.clientCertificate,
+	}
+}
+
+// verifyConnection verifies the certificate of the broker against the CAs and pins
+func (f *tlsFiles) verifyConnection(state tls.ConnectionState) (err error) {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("the broker did not send a certificate")
+	}
+	f.Lock()
+	roots := f.roots
+	f.Unlock()
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	leaf := state.PeerCertificates[0]
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName: state.ServerName, Roots: roots, Intermediates: intermediates,
+	})
+	if err != nil || len(f.pins) == 0 {
+		return
+	}
+	hash := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	for _, pin := range f.pins {
+		if bytes.Equal(pin, hash[:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the public key of the broker does not match any pin")
+}
+
+// clientCertificate gets the client certificate to send to the broker
+func (f *tlsFiles) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.cert == nil {
+		// no certificate is sent
+		return &tls.Certificate{}, nil
+	}
+	return f.cert, nil
+}
@@ -0,0 +1,188 @@
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/config"
+	"git.amikhalev.com/amikhalev/grinklers/mqtt/mqtttest"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA issues certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(req *require.Assertions) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	req.NoError(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test ca"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	req.NoError(err)
+	cert, err := x509.ParseCertificate(der)
+	req.NoError(err)
+	return &testCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue issues a certificate for a server on 127.0.0.1 or for a client, returning it and its key as PEM
+func (ca *testCA) issue(req *require.Assertions, server bool) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	req.NoError(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()), Subject: pkix.Name{CommonName: "test"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	req.NoError(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	req.NoError(err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// pin gets the pin of the public key of certPEM
+func pin(req *require.Assertions, certPEM []byte) string {
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	req.NoError(err)
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func TestMQTTApi_TLS(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	util.Logger.Out = ioutil.Discard
+	defer func(delay time.Duration) { config.ReloadDelay = delay }(config.ReloadDelay)
+	config.ReloadDelay = 10 * time.Millisecond
+	dir, err := ioutil.TempDir("", "mqtt_tls")
+	req.NoError(err)
+	defer os.RemoveAll(dir)
+	write := func(name string, contents []byte) string {
+		path := filepath.Join(dir, name)
+		req.NoError(ioutil.WriteFile(path, contents, 0600))
+		return path
+	}
+
+	// the broker only accepts clients with a certificate from the ca
+	ca := newTestCA(req)
+	serverCert, serverKey := ca.issue(req, true)
+	serverPair, err := tls.X509KeyPair(serverCert, serverKey)
+	req.NoError(err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	broker := mqtttest.NewBroker()
+	req.NoError(broker.StartTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverPair}, ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert,
+	}))
+	defer broker.Close()
+
+	clientCert, clientKey := ca.issue(req, false)
+	tlsConfig := &config.MQTTTLSJSON{
+		CAFile: write("ca.pem", ca.pem), CertFile: write("client.pem", clientCert),
+		KeyFile: write("client.key", clientKey), Pins: []string{pin(req, serverCert)},
+	}
+	url := strings.Replace(broker.URL(), "ssl://", "mqtts://", 1)
+	mqttConfig := &config.MQTTJSON{URL: url, DeviceID: "tls", TLS: tlsConfig}
+	req.NoError(mqttConfig.Validate())
+	api, configData := newTestAPI()
+	configData.MQTT = mqttConfig
+	req.NoError(api.Start(mqttConfig.ToConnectData()))
+	defer api.Stop()
+	ass.Eventually(func() bool {
+		msg, _ := broker.Retained("device/tls/connected")
+		return string(msg.Payload) == "true"
+	}, time.Second, 5*time.Millisecond, "should connect with the client certificate")
+
+	// dial connects to the broker with the tls config of files
+	addr := strings.TrimPrefix(broker.URL(), "ssl://")
+	dial := func(files *tlsFiles) error {
+		conn, err := tls.Dial("tcp", addr, files.tlsConfig())
+		if err == nil {
+			// the handshake with the client certificate finishes when reading
+			conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			_, err = conn.Read(make([]byte, 1))
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				err = nil
+			}
+			conn.Close()
+		}
+		return err
+	}
+	files, err := newTLSFiles(tlsConfig, api.logger)
+	req.NoError(err)
+	ass.NoError(dial(files))
+
+	// the certificate of the broker must be from the ca and match a pin
+	other := newTestCA(req)
+	wrongCA := *tlsConfig
+	wrongCA.CAFile = write("other.pem", other.pem)
+	files, err = newTLSFiles(&wrongCA, api.logger)
+	req.NoError(err)
+	ass.Error(dial(files))
+	wrongPin := *tlsConfig
+	wrongPin.Pins = []string{pin(req, clientCert)}
+	files, err = newTLSFiles(&wrongPin, api.logger)
+	req.NoError(err)
+	ass.EqualError(dial(files), "the public key of the broker does not match any pin")
+	noCert := *tlsConfig
+	noCert.CertFile, noCert.KeyFile = "", ""
+	files, err = newTLSFiles(&noCert, api.logger)
+	req.NoError(err)
+	ass.Error(dial(files), "the broker requires a client certificate")
+
+	// the files are reloaded when they change, and invalid files are ignored
+	renewedCert, renewedKey := ca.issue(req, false)
+	write("client.key", renewedKey)
+	write("client.pem", renewedCert)
+	block, _ := pem.Decode(renewedCert)
+	current := func() []byte {
+		cert, _ := api.tls.clientCertificate(nil)
+		return cert.Certificate[0]
+	}
+	ass.Eventually(func() bool {
+		return string(current()) == string(block.Bytes)
+	}, time.Second, 5*time.Millisecond, "the renewed certificate should be loaded")
+	write("client.pem", []byte("invalid"))
+	time.Sleep(50 * time.Millisecond)
+	ass.Equal(block.Bytes, current())
+	ass.NoError(dial(api.tls))
+
+	_, err = newTLSFiles(&config.MQTTTLSJSON{CAFile: filepath.Join(dir, "missing.pem")}, api.logger)
+	ass.Error(err)
+	_, err = newTLSFiles(&config.MQTTTLSJSON{CAFile: filepath.Join(dir, "client.key")}, api.logger)
+	ass.Error(err)
+
+	ass.Error((&config.MQTTJSON{URL: "tcp://localhost", TLS: &config.MQTTTLSJSON{}}).Validate())
+	ass.Error((&config.MQTTTLSJSON{CertFile: "client.pem"}).Validate())
+	ass.Error((&config.MQTTTLSJSON{Pins: []string{"abc"}}).Validate())
+	ass.NoError((&config.MQTTTLSJSON{Pins: []string{pin(req, serverCert)}}).Validate())
+}
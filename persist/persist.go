@@ -0,0 +1,213 @@
+// Package persist saves the state of the SectionRunner to disk, so that queued section runs and running
+// programs can be resumed after a restart.
+package persist
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/datamodel"
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/Sirupsen/logrus"
+)
+
+// ResumePolicy decides what happens to persisted state on startup
+type ResumePolicy string
+
+const (
+	// ResumeAlways always resumes the persisted state
+	ResumeAlways ResumePolicy = "resume"
+	// ResumeNever always discards the persisted state
+	ResumeNever ResumePolicy = "discard"
+	// ResumeIfShort resumes the persisted state only if it was saved less than the max outage ago
+	ResumeIfShort ResumePolicy = "short"
+)
+
+// DefaultMaxOutage is the default max outage for ResumeIfShort
+const DefaultMaxOutage = 15 * time.Minute
+
+// SaveInterval is how often the state is saved while a section is running, in addition to whenever it
+// changes. This bounds how far off the remaining duration of the current run and the outage time can be
+// after a crash.
+var SaveInterval = 30 * time.Second
+
+// Config is the configuration of state persistence
+type Config struct {
+	// Path is the file the state is saved to
+	Path string `json:"path"`
+	// Policy is the ResumePolicy used on startup. Defaults to ResumeIfShort
+	Policy ResumePolicy `json:"policy,omitempty"`
+	// MaxOutage is the longest outage in seconds after which the state is resumed with ResumeIfShort.
+	// Defaults to DefaultMaxOutage
+	MaxOutage float64 `json:"maxOutage,omitempty"`
+}
+
+// MaxOutageDuration gets the max outage for ResumeIfShort
+func (c *Config) MaxOutageDuration() time.Duration {
+	if c.MaxOutage <= 0 {
+		return DefaultMaxOutage
+	}
+	return time.Duration(c.MaxOutage * float64(time.Second))
+}
+
+// Validate checks that the configuration is valid
+func (c *Config) Validate() (err error) {
+	if c.Path == "" {
+		return util.NewNotSpecifiedError("persist path")
+	}
+	switch c.Policy {
+	case "", ResumeAlways, ResumeNever, ResumeIfShort:
+	default:
+		err = fmt.Errorf("unknown resume policy '%s'", c.Policy)
+	}
+	return
+}
+
+var log = util.Logger.WithField("module", "persist")
+
+// Load reads persisted state from path. If there is no persisted state, it returns nil
+func Load(path string) (state *datamodel.PersistedStateJSON, err error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil {
+		err = fmt.Errorf("could not read persisted state: %v", err)
+		return
+	}
+	state = &datamodel.PersistedStateJSON{}
+	if err = json.Unmarshal(data, state); err != nil {
+		state = nil
+		err = util.NewParseError("persisted state", err)
+	}
+	return
+}
+
+// Restore loads the persisted state for config and, if allowed by its policy, restores it into secRunner.
+// This must be called before secRunner and any of programs are started.
+func Restore(config *Config, secRunner *logic.SectionRunner, sections []*logic.Section, programs []*logic.Program) (err error) {
+	state, err := Load(config.Path)
+	if err != nil || state == nil {
+		return
+	}
+	runs, err := state.ToRestoredRuns(sections, programs)
+	if err != nil {
+		err = util.NewInvalidDataError("persisted state", err)
+		return
+	}
+	outage := time.Since(state.SavedAt)
+	logger := log.WithFields(logrus.Fields{
+		"policy": config.Policy, "outage": outage, "runs": len(runs),
+	})
+	switch config.Policy {
+	case ResumeAlways:
+	case ResumeNever:
+		logger.Info("discarding persisted state")
+		secRunner.Skip(runs, logic.SkipDiscarded)
+		return
+	default:
+		if max := config.MaxOutageDuration(); outage > max {
+			logger.WithField("maxOutage", max).Info("outage was too long, discarding persisted state")
+			secRunner.Skip(runs, logic.SkipDiscarded)
+			return
+		}
+	}
+	logger.Info("resuming persisted state")
+	secRunner.Restore(runs, state.Paused)
+	return
+}
+
+// Persister saves the state of a SectionRunner to a file whenever it changes, and regularly while a section is
+// running. It is a logic.StatePersister.
+type Persister struct {
+	path    string
+	state   *logic.SRState
+	changed chan struct{}
+	quit    chan struct{}
+	done    chan struct{}
+	log     *logrus.Entry
+}
+
+// New creates a new Persister which saves state to path
+func New(path string, state *logic.SRState) *Persister {
+	return &Persister{
+		path, state,
+		make(chan struct{}, 1), make(chan struct{}), make(chan struct{}),
+		log.WithField("path", path),
+	}
+}
+
+// PersistState implements logic.StatePersister
+func (p *Persister) PersistState(state *logic.SRState) {
+	select {
+	case p.changed <- struct{}{}:
+	default: // a save is already pending
+	}
+}
+
+var _ logic.StatePersister = (*Persister)(nil)
+
+// Save saves the state immediately
+func (p *Persister) Save() (err error) {
+	p.state.Lock()
+	j := datamodel.SRStateToPersistedJSON(p.state, time.Now())
+	p.state.Unlock()
+	data, err := json.Marshal(&j)
+	if err != nil {
+		return
+	}
+	err = util.WriteFileAtomic(p.path, data, 0644)
+	if err != nil {
+		err = fmt.Errorf("could not write persisted state: %v", err)
+	}
+	return
+}
+
+func (p *Persister) save() {
+	if err := p.Save(); err != nil {
+		p.log.WithError(err).Error("error persisting state")
+	}
+}
+
+// running checks if a section is currently running, in which case the state needs to be saved regularly
+func (p *Persister) running() bool {
+	p.state.Lock()
+	defer p.state.Unlock()
+	return p.state.Current != nil && !p.state.Paused
+}
+
+func (p *Persister) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(SaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-p.changed:
+			p.save()
+		case <-ticker.C:
+			if p.running() {
+				p.save()
+			}
+		}
+	}
+}
+
+// Start starts saving the state in the background
+func (p *Persister) Start() {
+	go p.run()
+}
+
+// Stop stops saving the state in the background and saves it one last time. Any changes to the state after
+// Stop are not persisted, so that shutting down does not discard the state.
+func (p *Persister) Stop() {
+	close(p.quit)
+	<-p.done
+	p.save()
+	p.log.Debug("stopped persister")
+}
@@ -0,0 +1,194 @@
+package persist
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/datamodel"
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/sched"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type PersistSuite struct {
+	suite.Suite
+	dir      string
+	path     string
+	secs     []*logic.Section
+	programs []*logic.Program
+}
+
+func (s *PersistSuite) SetupSuite() {
+	util.Logger.Out = ioutil.Discard
+}
+
+func (s *PersistSuite) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "persist")
+	s.Require().NoError(err)
+	s.path = filepath.Join(s.dir, "state.json")
+	s.secs = logic.Sections{logic.NewSection(0, "sec 0", 0), logic.NewSection(1, "sec 1", 1)}.Pointers()
+	prog := logic.NewProgram("prog", []logic.ProgItem{
+		{Sec: s.secs[0], Duration: time.Hour}, {Sec: s.secs[1], Duration: time.Hour},
+	}, sched.Schedule{}, false)
+	s.programs = []*logic.Program{prog}
+}
+
+func (s *PersistSuite) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *PersistSuite) newSectionRunner() (*logic.SectionRunner, *logic.MockSectionInterface) {
+	secInterface := logic.NewMockSectionInterface(2)
+	secInterface.Initialize()
+	return logic.NewSectionRunner(secInterface), secInterface
+}
+
+func (s *PersistSuite) writeState(state datamodel.PersistedStateJSON) {
+	data, err := json.Marshal(&state)
+	s.Require().NoError(err)
+	s.Require().NoError(ioutil.WriteFile(s.path, data, 0644))
+}
+
+func (s *PersistSuite) TestPersister() {
+	ass, req := s.Assert(), s.Require()
+	sr, _ := s.newSectionRunner()
+	persister := New(s.path, &sr.State)
+	sr.SetStatePersister(persister)
+	persister.Start()
+	sr.Start(nil)
+	prog := s.programs[0]
+	prog.Start(sr, nil)
+
+	sr.QueueSectionRun(s.secs[1], time.Minute)
+	prog.Run()
+	time.Sleep(20 * time.Millisecond)
+	persister.Stop()
+	// changes after the persister is stopped are not saved
+	prog.Quit()
+	sr.Quit()
+
+	state, err := Load(s.path)
+	req.NoError(err)
+	req.NotNil(state)
+	ass.WithinDuration(time.Now(), state.SavedAt, time.Second)
+	ass.False(state.Paused)
+	req.Len(state.Runs, 3)
+	ass.Equal(1, state.Runs[0].Section)
+	ass.Nil(state.Runs[0].Program)
+	ass.Equal(60.0, state.Runs[0].TotalDuration)
+	ass.True(state.Runs[0].Duration < 60, "current run should have its remaining duration")
+	ass.True(state.Runs[0].Duration > 59)
+	for i, secID := range []int{0, 1} {
+		run := state.Runs[i+1]
+		ass.Equal(secID, run.Section)
+		if ass.NotNil(run.Program) {
+			ass.Equal(0, *run.Program)
+		}
+		ass.Equal(3600.0, run.Duration)
+	}
+}
+
+func (s *PersistSuite) TestRestore() {
+	ass, req := s.Assert(), s.Require()
+	progID := 0
+	s.writeState(datamodel.PersistedStateJSON{
+		SavedAt: time.Now().Add(-time.Minute),
+		Runs: []datamodel.PersistedRunJSON{
+			{Section: 1, TotalDuration: 60, Duration: 30},
+			{Section: 0, Program: &progID, TotalDuration: 3600, Duration: 3600},
+		},
+	})
+	sr, secInterface := s.newSectionRunner()
+	req.NoError(Restore(&Config{Path: s.path}, sr, s.secs, s.programs))
+
+	prog := s.programs[0]
+	prog.Start(sr, nil)
+	defer prog.Quit()
+	sr.Start(nil)
+	defer sr.Quit()
+	time.Sleep(10 * time.Millisecond)
+
+	secInterface.AssertRunning(s.T(), s.secs[1])
+	ass.True(prog.Running())
+	sr.State.Lock()
+	ass.Equal(30*time.Second, sr.State.Current.Duration)
+	ass.Equal(time.Minute, sr.State.Current.TotalDuration)
+	ass.Equal(1, sr.State.Queue.Len())
+	sr.State.Unlock()
+
+	// cancelling the resumed program run cancels its restored runs
+	prog.Cancel()
+	time.Sleep(10 * time.Millisecond)
+	ass.False(prog.Running())
+	sr.State.Lock()
+	ass.Equal(0, sr.State.Queue.Len())
+	sr.State.Unlock()
+}
+
+func (s *PersistSuite) TestRestorePolicy() {
+	ass, req := s.Assert(), s.Require()
+	s.writeState(datamodel.PersistedStateJSON{
+		SavedAt: time.Now().Add(-time.Hour),
+		Paused:  true,
+		Runs:    []datamodel.PersistedRunJSON{{Section: 0, TotalDuration: 60, Duration: 60}},
+	})
+	restored := func(config Config) bool {
+		sr, _ := s.newSectionRunner()
+		req.NoError(Restore(&config, sr, s.secs, s.programs))
+		sr.State.Lock()
+		defer sr.State.Unlock()
+		return sr.State.Queue.Len() == 1 && sr.State.Paused
+	}
+	ass.True(restored(Config{Path: s.path, Policy: ResumeAlways}))
+	ass.False(restored(Config{Path: s.path, Policy: ResumeNever}))
+	ass.False(restored(Config{Path: s.path, Policy: ResumeIfShort}), "outage is longer than the default max")
+	ass.False(restored(Config{Path: s.path}), "ResumeIfShort should be the default")
+	ass.True(restored(Config{Path: s.path, Policy: ResumeIfShort, MaxOutage: 2 * 3600}))
+}
+
+func (s *PersistSuite) TestRestoreErrors() {
+	ass := s.Assert()
+	sr, _ := s.newSectionRunner()
+
+	// no persisted state is not an error
+	ass.NoError(Restore(&Config{Path: s.path}, sr, s.secs, s.programs))
+
+	s.Require().NoError(ioutil.WriteFile(s.path, []byte("{"), 0644))
+	ass.Error(Restore(&Config{Path: s.path}, sr, s.secs, s.programs))
+
+	progID := 1
+	s.writeState(datamodel.PersistedStateJSON{
+		SavedAt: time.Now(),
+		Runs:    []datamodel.PersistedRunJSON{{Section: 0, Program: &progID, Duration: 60}},
+	})
+	ass.Error(Restore(&Config{Path: s.path}, sr, s.secs, s.programs))
+	s.writeState(datamodel.PersistedStateJSON{
+		SavedAt: time.Now(),
+		Runs:    []datamodel.PersistedRunJSON{{Section: 2, Duration: 60}},
+	})
+	ass.Error(Restore(&Config{Path: s.path}, sr, s.secs, s.programs))
+	sr.State.Lock()
+	ass.Equal(0, sr.State.Queue.Len(), "nothing should be restored from invalid state")
+	sr.State.Unlock()
+}
+
+func TestPersistSuite(t *testing.T) {
+	suite.Run(t, new(PersistSuite))
+}
+
+func TestConfig(t *testing.T) {
+	ass := assert.New(t)
+	ass.Error((&Config{}).Validate())
+	ass.Error((&Config{Path: "state.json", Policy: "sometimes"}).Validate())
+	ass.NoError((&Config{Path: "state.json"}).Validate())
+	ass.NoError((&Config{Path: "state.json", Policy: ResumeNever}).Validate())
+	ass.Equal(DefaultMaxOutage, (&Config{}).MaxOutageDuration())
+	ass.Equal(time.Minute, (&Config{MaxOutage: 60}).MaxOutageDuration())
+}
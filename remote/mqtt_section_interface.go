@@ -0,0 +1,323 @@
+// Package remote contains SectionInterfaces which control sections on remote nodes over the network
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/Sirupsen/logrus"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// DefaultAckTimeout is how long to wait for a remote node to acknowledge a command if no AckTimeout is configured
+const DefaultAckTimeout = 2 * time.Second
+
+// ConnectTimeout is how long each attempt to connect to the broker may take
+var ConnectTimeout = 10 * time.Second
+
+// ConnectRetryInterval is how long to wait before trying again when the broker could not be connected to
+var ConnectRetryInterval = 10 * time.Second
+
+// Config is the configuration of a remote node controlled over MQTT
+type Config struct {
+	// BrokerURL is the url of the MQTT broker the remote node is connected to
+	BrokerURL string `json:"brokerUrl"`
+	Username  string `json:"username,omitempty"`
+	Password  string `json:"password,omitempty"`
+	ClientID  string `json:"clientId,omitempty"`
+	// Topic is the topic prefix of the remote node
+	Topic string `json:"topic"`
+	// Count is the number of outputs on the remote node
+	Count logic.SectionID `json:"count"`
+	// AckTimeout is how long to wait for the remote node to acknowledge a command, in seconds
+	AckTimeout float64 `json:"ackTimeout,omitempty"`
+}
+
+func (c *Config) ackTimeout() time.Duration {
+	if c.AckTimeout <= 0 {
+		return DefaultAckTimeout
+	}
+	return time.Duration(c.AckTimeout * float64(time.Second))
+}
+
+// CommandJSON is the payload of a command sent to a remote node on <topic>/set. The node must reply with
+// the same payload on <topic>/ack, with State set to the state the output was actually set to.
+type CommandJSON struct {
+	Seq     uint32          `json:"seq"`
+	Channel logic.SectionID `json:"channel"`
+	State   bool            `json:"state"`
+}
+
+// MQTTSectionInterface is a SectionInterface which drives the outputs of a remote node by publishing
+// commands over MQTT.
+//
+// The remote node is expected to:
+//   - publish its availability as a retained "true" or "false" on <topic>/online, using a will to publish
+//     "false" if it disconnects
+//   - subscribe to <topic>/set and acknowledge every CommandJSON on <topic>/ack
+//   - optionally report the state of each output as a retained "true" or "false" on <topic>/state/<channel>
+//
+// A node which is offline, whose broker can not be reached, or which does not acknowledge a command within the
+// ack timeout, is considered faulted (see Fault). Sections are never turned on while the node is offline.
+type MQTTSectionInterface struct {
+	config  Config
+	client  mqtt.Client
+	states  []bool
+	online  bool
+	fault   error
+	seq     uint32
+	pending map[uint32]chan<- bool
+	// stop is closed to stop trying to connect, and connectDone is closed once it stopped
+	stop        chan struct{}
+	connectDone chan struct{}
+	// onFaultChange is called after fault changes
+	onFaultChange func()
+	log           *logrus.Entry
+	sync.Mutex
+}
+
+var _ logic.SectionInterface = (*MQTTSectionInterface)(nil)
+var _ logic.FaultReporter = (*MQTTSectionInterface)(nil)
+
+// NewMQTTSectionInterface creates a new MQTTSectionInterface for the remote node with the specified config.
+// It does not connect until it is initialized.
+func NewMQTTSectionInterface(config Config) *MQTTSectionInterface {
+	return &MQTTSectionInterface{
+		config: config,
+		states: make([]bool, config.Count),
+		// the node is faulted until it reports that it is online
+		fault:   fmt.Errorf("remote node has not come online"),
+		pending: make(map[uint32]chan<- bool),
+		log: util.Logger.WithFields(logrus.Fields{
+			"section_interface": "mqtt", "topic": config.Topic,
+		}),
+	}
+}
+
+func (i *MQTTSectionInterface) Name() string {
+	return "mqtt"
+}
+
+// Initialize starts connecting to the broker in the background, retrying until it can be reached. It does not
+// wait for the connection or for the remote node to come online, so an unreachable node is only a fault and does
+// not stop other sections from being used. An error is only returned if the config is invalid.
+func (i *MQTTSectionInterface) Initialize() (err error) {
+	brokerURL, err := util.ParseBrokerURL(i.config.BrokerURL)
+	if err != nil {
+		return
+	}
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(brokerURL.String())
+	opts.SetUsername(i.config.Username)
+	opts.SetPassword(i.config.Password)
+	opts.SetClientID(i.config.ClientID)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectTimeout(ConnectTimeout)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		i.log.Info("connected to remote node broker")
+		i.subscribe()
+	})
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		i.log.WithError(err).Warn("lost connection to remote node broker")
+		i.setOnline(false)
+		i.setFault(fmt.Errorf("lost connection to remote node broker: %v", err))
+	})
+	i.client = mqtt.NewClient(opts)
+	i.setFault(fmt.Errorf("not connected to remote node broker"))
+	i.log.WithField("broker", brokerURL.String()).Info("connecting to remote node broker")
+	i.stop, i.connectDone = make(chan struct{}), make(chan struct{})
+	go i.connect()
+	return
+}
+
+// connect tries to connect to the broker until it succeeds or the interface is deinitialized. Once connected,
+// the client reconnects by itself.
+func (i *MQTTSectionInterface) connect() {
+	defer close(i.connectDone)
+	for {
+		token := i.client.Connect()
+		var err error
+		if !token.WaitTimeout(ConnectTimeout) {
+			err = fmt.Errorf("timed out")
+		} else if err = token.Error(); err == nil {
+			return
+		}
+		i.log.WithError(err).Warn("could not connect to remote node broker, retrying")
+		i.setFault(fmt.Errorf("could not connect to remote node broker: %v", err))
+		select {
+		case <-i.stop:
+			return
+		case <-time.After(ConnectRetryInterval):
+		}
+	}
+}
+
+// Deinitialize stops connecting to and disconnects from the broker
+func (i *MQTTSectionInterface) Deinitialize() error {
+	if i.stop != nil {
+		close(i.stop)
+		<-i.connectDone
+		i.stop = nil
+	}
+	if i.client != nil {
+		i.client.Disconnect(250)
+	}
+	i.setOnline(false)
+	return nil
+}
+
+func (i *MQTTSectionInterface) subscribe() {
+	i.Lock()
+	online := i.online
+	i.Unlock()
+	if !online {
+		i.setFault(fmt.Errorf("remote node has not come online"))
+	}
+	topic := i.config.Topic
+	i.client.Subscribe(topic+"/online", 1, func(client mqtt.Client, message mqtt.Message) {
+		online, err := strconv.ParseBool(string(message.Payload()))
+		if err != nil {
+			i.log.WithError(err).Warn("invalid online message from remote node")
+			return
+		}
+		i.setOnline(online)
+	})
+	i.client.Subscribe(topic+"/ack", 1, func(client mqtt.Client, message mqtt.Message) {
+		var ack CommandJSON
+		if err := json.Unmarshal(message.Payload(), &ack); err != nil {
+			i.log.WithError(err).Warn("invalid ack from remote node")
+			return
+		}
+		i.Lock()
+		ackChan, ok := i.pending[ack.Seq]
+		i.Unlock()
+		if ok {
+			// a command can be acknowledged more than once, such as when the ack is redelivered after
+			// reconnecting, and only the first one is waited for
+			select {
+			case ackChan <- ack.State:
+			default:
+			}
+		}
+	})
+	i.client.Subscribe(topic+"/state/+", 1, func(client mqtt.Client, message mqtt.Message) {
+		channel, err := strconv.ParseUint(strings.TrimPrefix(message.Topic(), topic+"/state/"), 10, 16)
+		state, err2 := strconv.ParseBool(string(message.Payload()))
+		if err != nil || err2 != nil || channel >= uint64(len(i.states)) {
+			i.log.WithField("topic", message.Topic()).Warn("invalid state report from remote node")
+			return
+		}
+		i.Lock()
+		i.states[channel] = state
+		i.Unlock()
+	})
+}
+
+func (i *MQTTSectionInterface) setOnline(online bool) {
+	i.Lock()
+	if i.online == online {
+		i.Unlock()
+		return
+	}
+	i.online = online
+	var fault error
+	if online {
+		i.log.Info("remote node is online")
+	} else {
+		i.log.Error("remote node is offline")
+		fault = fmt.Errorf("remote node is offline")
+	}
+	i.Unlock()
+	i.setFault(fault)
+}
+
+// setFault sets the fault of the node, calling the fault change handler if it changed
+func (i *MQTTSectionInterface) setFault(fault error) {
+	i.Lock()
+	changed := (i.fault == nil) != (fault == nil) || (fault != nil && fault.Error() != i.fault.Error())
+	i.fault = fault
+	handler := i.onFaultChange
+	i.Unlock()
+	if changed && handler != nil {
+		handler()
+	}
+}
+
+// Fault returns why the remote node is currently considered faulted, or nil if it is healthy. A fault applies
+// to every channel of the node.
+func (i *MQTTSectionInterface) Fault(logic.SectionID) error {
+	i.Lock()
+	defer i.Unlock()
+	return i.fault
+}
+
+// OnFaultChange sets a function which is called whenever the remote node becomes faulted or healthy, or its
+// fault changes
+func (i *MQTTSectionInterface) OnFaultChange(handler func()) {
+	i.Lock()
+	i.onFaultChange = handler
+	i.Unlock()
+}
+
+func (i *MQTTSectionInterface) Count() logic.SectionID {
+	return (logic.SectionID)(len(i.states))
+}
+
+// Set sends a command to the remote node and waits for it to be acknowledged (for at most the ack timeout)
+func (i *MQTTSectionInterface) Set(id logic.SectionID, state bool) {
+	log := i.log.WithFields(logrus.Fields{"channel": id, "state": state})
+	i.Lock()
+	online := i.online
+	if !online && state {
+		i.Unlock()
+		log.Error("not turning on section because remote node is offline")
+		return
+	}
+	i.seq++
+	cmd := CommandJSON{i.seq, id, state}
+	ack := make(chan bool, 1)
+	i.pending[cmd.Seq] = ack
+	i.Unlock()
+	defer func() {
+		i.Lock()
+		delete(i.pending, cmd.Seq)
+		i.Unlock()
+	}()
+
+	log.Debug("sending command to remote node")
+	bytes, _ := json.Marshal(&cmd)
+	i.client.Publish(i.config.Topic+"/set", 1, false, bytes)
+	if !online {
+		// still try to turn it off in case the node is actually there, but don't wait for an ack
+		return
+	}
+	select {
+	case ackState := <-ack:
+		i.Lock()
+		i.states[id] = ackState
+		i.Unlock()
+		var fault error
+		if ackState != state {
+			fault = fmt.Errorf("remote node set channel %d to %t instead of %t", id, ackState, state)
+			log.Error(fault)
+		}
+		i.setFault(fault)
+	case <-time.After(i.config.ackTimeout()):
+		fault := fmt.Errorf("remote node did not acknowledge command within %v", i.config.ackTimeout())
+		log.Error(fault)
+		i.setFault(fault)
+	}
+}
+
+// Get gets the last state reported by the remote node
+func (i *MQTTSectionInterface) Get(id logic.SectionID) bool {
+	i.Lock()
+	defer i.Unlock()
+	return i.states[id]
+}
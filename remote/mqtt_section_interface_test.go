@@ -0,0 +1,210 @@
+package remote
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/mqtt/mqtttest"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type MQTTSectionInterfaceSuite struct {
+	suite.Suite
+	ass          *assert.Assertions
+	req          *require.Assertions
+	broker       *mqtttest.Broker
+	secInterface *MQTTSectionInterface
+	commands     <-chan mqtttest.Message
+}
+
+func (s *MQTTSectionInterfaceSuite) SetupTest() {
+	util.Logger.Out = ioutil.Discard
+	s.ass, s.req = assert.New(s.T()), require.New(s.T())
+	s.broker = mqtttest.NewBroker()
+	s.req.NoError(s.broker.Start())
+	s.commands = s.broker.Watch("node/set")
+	s.secInterface = NewMQTTSectionInterface(Config{
+		BrokerURL: s.broker.URL(), ClientID: "grinklers",
+		Topic: "node", Count: 2, AckTimeout: 0.05,
+	})
+	s.req.NoError(s.secInterface.Initialize())
+	s.req.Eventually(func() bool { return s.broker.Subscribers("node/online") == 1 },
+		time.Second, 5*time.Millisecond, "should subscribe once connected")
+}
+
+func (s *MQTTSectionInterfaceSuite) TearDownTest() {
+	s.secInterface.Deinitialize()
+	s.broker.Close()
+}
+
+func (s *MQTTSectionInterfaceSuite) setOnline(online bool) {
+	payload := "false"
+	if online {
+		payload = "true"
+	}
+	s.broker.Publish("node/online", []byte(payload), true)
+	time.Sleep(10 * time.Millisecond)
+}
+
+// ackNext acknowledges the next command sent to the node with the specified state
+func (s *MQTTSectionInterfaceSuite) ackNext(state func(cmd CommandJSON) bool) {
+	go func() {
+		msg, ok := <-s.commands
+		if !ok {
+			return
+		}
+		var cmd CommandJSON
+		if json.Unmarshal(msg.Payload, &cmd) != nil {
+			return
+		}
+		cmd.State = state(cmd)
+		bytes, _ := json.Marshal(&cmd)
+		s.broker.Publish("node/ack", bytes, false)
+	}()
+}
+
+func (s *MQTTSectionInterfaceSuite) TestSet() {
+	ass := s.ass
+	ass.Error(s.secInterface.Fault(0), "should be faulted before node comes online")
+	s.setOnline(true)
+	ass.NoError(s.secInterface.Fault(0))
+	ass.Equal(2, int(s.secInterface.Count()))
+
+	s.ackNext(func(cmd CommandJSON) bool {
+		ass.Equal(1, int(cmd.Channel))
+		ass.True(cmd.State)
+		return cmd.State
+	})
+	s.secInterface.Set(1, true)
+	ass.True(s.secInterface.Get(1))
+	ass.False(s.secInterface.Get(0))
+	ass.NoError(s.secInterface.Fault(0))
+
+	s.ackNext(func(cmd CommandJSON) bool { return cmd.State })
+	s.secInterface.Set(1, false)
+	ass.False(s.secInterface.Get(1))
+	ass.NoError(s.secInterface.Fault(0))
+}
+
+func (s *MQTTSectionInterfaceSuite) TestStateReport() {
+	s.setOnline(true)
+	s.broker.Publish("node/state/0", []byte("true"), true)
+	time.Sleep(10 * time.Millisecond)
+	s.ass.True(s.secInterface.Get(0))
+	s.broker.Publish("node/state/0", []byte("false"), true)
+	time.Sleep(10 * time.Millisecond)
+	s.ass.False(s.secInterface.Get(0))
+}
+
+func (s *MQTTSectionInterfaceSuite) TestNoAck() {
+	s.setOnline(true)
+	start := time.Now()
+	s.secInterface.Set(0, true)
+	s.ass.True(time.Since(start) >= 50*time.Millisecond, "Set should wait for the ack timeout")
+	s.ass.Error(s.secInterface.Fault(0))
+	s.ass.False(s.secInterface.Get(0))
+	<-s.commands
+
+	// a successful command clears the fault
+	s.ackNext(func(cmd CommandJSON) bool { return cmd.State })
+	s.secInterface.Set(0, true)
+	s.ass.NoError(s.secInterface.Fault(0))
+	s.ass.True(s.secInterface.Get(0))
+}
+
+func (s *MQTTSectionInterfaceSuite) TestWrongAck() {
+	s.setOnline(true)
+	s.ackNext(func(cmd CommandJSON) bool { return false })
+	s.secInterface.Set(0, true)
+	s.ass.Error(s.secInterface.Fault(0))
+	s.ass.False(s.secInterface.Get(0))
+}
+
+func (s *MQTTSectionInterfaceSuite) TestOffline() {
+	s.setOnline(true)
+	s.setOnline(false)
+	s.ass.Error(s.secInterface.Fault(0))
+
+	s.secInterface.Set(0, true)
+	select {
+	case <-s.commands:
+		s.Fail("should not send on command to offline node")
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.ass.False(s.secInterface.Get(0))
+
+	// off commands are still sent
+	s.secInterface.Set(0, false)
+	select {
+	case <-s.commands:
+	case <-time.After(20 * time.Millisecond):
+		s.Fail("should send off command to offline node")
+	}
+}
+
+func (s *MQTTSectionInterfaceSuite) TestBrokerDisconnect() {
+	s.setOnline(true)
+	s.broker.Close()
+	for i := 0; i < 50 && s.secInterface.Fault(0) == nil; i++ {
+		time.Sleep(2 * time.Millisecond)
+	}
+	s.ass.Error(s.secInterface.Fault(0))
+}
+
+func (s *MQTTSectionInterfaceSuite) TestDuplicateAck() {
+	s.setOnline(true)
+	go func() {
+		msg := <-s.commands
+		for i := 0; i < 3; i++ {
+			s.broker.Publish("node/ack", msg.Payload, false)
+		}
+	}()
+	s.secInterface.Set(0, false)
+	s.ass.NoError(s.secInterface.Fault(0))
+
+	// the duplicate acks must not stop messages from being handled
+	s.broker.Publish("node/state/1", []byte("true"), true)
+	s.ass.Eventually(func() bool { return s.secInterface.Get(1) }, time.Second, 5*time.Millisecond)
+}
+
+func (s *MQTTSectionInterfaceSuite) TestFaultChange() {
+	changes := make(chan error, 10)
+	s.secInterface.OnFaultChange(func() { changes <- s.secInterface.Fault(0) })
+	s.setOnline(true)
+	s.ass.NoError(<-changes)
+	s.setOnline(false)
+	s.ass.EqualError(<-changes, "remote node is offline")
+	s.setOnline(false)
+	select {
+	case <-changes:
+		s.Fail("should not be called when the fault does not change")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestMQTTSectionInterface(t *testing.T) {
+	suite.Run(t, new(MQTTSectionInterfaceSuite))
+}
+
+func TestMQTTSectionInterface_NoBroker(t *testing.T) {
+	util.Logger.Out = ioutil.Discard
+	broker := mqtttest.NewBroker()
+	require.NoError(t, broker.Start())
+	brokerURL := broker.URL()
+	broker.Close()
+	secInterface := NewMQTTSectionInterface(Config{
+		BrokerURL: brokerURL, Topic: "node", Count: 1,
+	})
+	defer func(timeout, interval time.Duration) {
+		ConnectTimeout, ConnectRetryInterval = timeout, interval
+	}(ConnectTimeout, ConnectRetryInterval)
+	ConnectTimeout, ConnectRetryInterval = 100*time.Millisecond, 20*time.Millisecond
+	require.NoError(t, secInterface.Initialize(), "an unreachable broker should not fail initializing")
+	defer secInterface.Deinitialize()
+	assert.Error(t, secInterface.Fault(0), "an unreachable broker should be a fault")
+}
@@ -0,0 +1,309 @@
+// Package rest serves the grinklers API as a REST/JSON API over HTTP
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/api"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/Sirupsen/logrus"
+)
+
+// MaxBodySize is the maximum size of a request body
+const MaxBodySize = 1 << 20
+
+// route maps requests with a method and path to an api request
+type route struct {
+	method string
+	// path is the path split into segments. A segment in braces is a parameter, which is put in the request
+	// data under its name.
+	path    []string
+	request string
+	// fixed is data which is always put in the request
+	fixed map[string]interface{}
+	// bodyField is the field of the request data the body is put in, or "" if the body is the request data
+	bodyField string
+}
+
+func newRoute(method, path, request string) route {
+	return route{method, strings.Split(strings.Trim(path, "/"), "/"), request, nil, ""}
+}
+
+// withFixed returns a copy of r which always puts fixed in the request
+func (r route) withFixed(fixed map[string]interface{}) route {
+	r.fixed = fixed
+	return r
+}
+
+// withBodyField returns a copy of r which puts the body in the request under bodyField
+func (r route) withBodyField(bodyField string) route {
+	r.bodyField = bodyField
+	return r
+}
+
+// match checks if segments match the path of the route, returning the path parameters if they do
+func (r *route) match(segments []string) (params map[string]string, ok bool) {
+	if len(segments) != len(r.path) {
+		return
+	}
+	params = make(map[string]string)
+	for i, segment := range r.path {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			params[segment[1:len(segment)-1]] = segments[i]
+		} else if segment != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+var routes = []route{
+	newRoute("GET", "/api/sections", "getSections"),
+	newRoute("POST", "/api/sections", "createSection").withBodyField("data"),
+	newRoute("GET", "/api/sections/{sectionId}", "getSection"),
+	newRoute("PUT", "/api/sections/{sectionId}", "updateSection").withBodyField("data"),
+	newRoute("DELETE", "/api/sections/{sectionId}", "deleteSection"),
+	newRoute("POST", "/api/sections/{sectionId}/run", "runSection"),
+	newRoute("POST", "/api/sections/{sectionId}/cancel", "cancelSection"),
+	newRoute("GET", "/api/programs", "getPrograms"),
+	newRoute("POST", "/api/programs", "createProgram").withBodyField("data"),
+	newRoute("GET", "/api/programs/{programId}", "getProgram"),
+	newRoute("PUT", "/api/programs/{programId}", "updateProgram").withBodyField("data"),
+	newRoute("DELETE", "/api/programs/{programId}", "deleteProgram"),
+	newRoute("POST", "/api/programs/{programId}/reorder", "reorderProgram"),
+	newRoute("POST", "/api/programs/{programId}/duplicate", "duplicateProgram"),
+	newRoute("POST", "/api/programs/{programId}/run", "runProgram"),
+	newRoute("POST", "/api/programs/{programId}/cancel", "cancelProgram"),
+	newRoute("GET", "/api/section_runner", "getSectionRunner"),
+	newRoute("POST", "/api/section_runner/pause", "pauseSectionRunner").
+		withFixed(map[string]interface{}{"paused": true}),
+	newRoute("POST", "/api/section_runner/unpause", "pauseSectionRunner").
+		withFixed(map[string]interface{}{"paused": false}),
+	newRoute("POST", "/api/section_runner/cancel_all", "cancelAllSectionRuns"),
+	newRoute("POST", "/api/section_runner/runs/{runId}/cancel", "cancelSectionRunId"),
+	newRoute("GET", "/api/history/{period}", "getHistory"),
+	// any request can also be made the same way as over MQTT, with the request type in the path
+	newRoute("POST", "/api/requests/{type}", ""),
+}
+
+// StatusCode gets the HTTP status code for a util.Error code
+func StatusCode(code util.ErrorCode) int {
+	switch code {
+	case util.EC_BadRequest, util.EC_NotSpecified, util.EC_Parse, util.EC_Range, util.EC_InvalidData:
+		return http.StatusBadRequest
+	case util.EC_BadToken, util.EC_Unauthorized:
+		return http.StatusUnauthorized
+	case util.EC_NoPermission:
+		return http.StatusForbidden
+	case util.EC_NotImplemented:
+		return http.StatusNotImplemented
+	case util.EC_Timeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Server serves the api Handlers over HTTP
+type Server struct {
+	address  string
+	handlers *api.Handlers
+	stream   *Stream
+	server   *http.Server
+	listener net.Listener
+	done     chan struct{}
+	log      *logrus.Entry
+}
+
+// NewServer creates a new Server which serves handlers on address, along with the events in stream at
+// /api/events if it is not nil
+func NewServer(address string, handlers *api.Handlers, stream *Stream) *Server {
+	s := &Server{
+		address, handlers, stream, nil, nil, make(chan struct{}),
+		util.Logger.WithFields(logrus.Fields{"module": "rest", "address": address}),
+	}
+	// there is no write timeout, since event streams stay open
+	s.server = &http.Server{Handler: s, ReadTimeout: 30 * time.Second}
+	return s
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	res := make(api.Response)
+	var (
+		status int
+		err    error
+	)
+	if s.stream != nil && r.Method == "GET" && strings.Trim(r.URL.Path, "/") == "api/events" {
+		// the events have the same data as the get requests
+		if err = s.handlers.Authorize("getSections", bearerToken(r)); err == nil {
+			s.stream.serveEvents(w, r, s.done)
+			return
+		}
+	} else {
+		status, err = s.handle(r, res)
+	}
+	if uerr := res.SetResult(err); uerr != nil {
+		if status == 0 {
+			status = StatusCode(uerr.Code)
+		}
+		s.log.WithError(uerr).WithFields(logrus.Fields{"method": r.Method, "path": r.URL.Path}).
+			Info("error processing request")
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	resBytes, err := json.Marshal(&res)
+	if err != nil {
+		s.log.WithError(err).Error("error marshaling response")
+		http.Error(w, "error marshaling response", http.StatusInternalServerError)
+		return
+	}
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resBytes)
+}
+
+// handle handles the request r, returning the status code if it is not the one for err
+func (s *Server) handle(r *http.Request, res api.Response) (status int, err error) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var (
+		matched *route
+		params  map[string]string
+		found   bool
+	)
+	for i := range routes {
+		if p, ok := routes[i].match(segments); ok {
+			found = true
+			if routes[i].method == r.Method {
+				matched, params = &routes[i], p
+				break
+			}
+		}
+	}
+	if matched == nil {
+		if found {
+			return http.StatusMethodNotAllowed, util.NewError(util.EC_BadRequest,
+				fmt.Sprintf("method %s not allowed for %s", r.Method, r.URL.Path))
+		}
+		return http.StatusNotFound, util.NewError(util.EC_BadRequest, fmt.Sprintf("%s not found", r.URL.Path))
+	}
+
+	requestType := matched.request
+	if requestType == "" {
+		requestType = params["type"]
+		delete(params, "type")
+	}
+	data, err := requestData(matched, r, params)
+	if err != nil {
+		return
+	}
+	err = s.handlers.Handle(requestType, bearerToken(r), data, res)
+	if uerr, ok := err.(*util.Error); ok && uerr.Code == util.EC_Range && uerr.Name != "" && len(params) > 0 {
+		// an id in the path which does not exist
+		status = http.StatusNotFound
+	}
+	return
+}
+
+// bearerToken gets the token from the "Authorization: Bearer <token>" header of r, or "" if there is none
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(prefix):])
+}
+
+// requestData builds the data of the api request from the body, query and path parameters of r
+func requestData(rt *route, r *http.Request, params map[string]string) (data []byte, err error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxBodySize+1))
+	if err != nil {
+		err = util.NewParseError("request body", err)
+		return
+	}
+	if len(body) > MaxBodySize {
+		err = util.NewError(util.EC_BadRequest, "request body too large")
+		return
+	}
+	fields := make(map[string]interface{})
+	if len(bytes.TrimSpace(body)) > 0 {
+		if rt.bodyField != "" {
+			if !json.Valid(body) {
+				err = util.NewParseError("request body", fmt.Errorf("invalid json"))
+				return
+			}
+			fields[rt.bodyField] = json.RawMessage(body)
+		} else if err = json.Unmarshal(body, &fields); err != nil {
+			err = util.NewParseError("request body", err)
+			return
+		}
+	}
+	for name, values := range r.URL.Query() {
+		fields[name] = paramValue(values[0])
+	}
+	for name, value := range params {
+		fields[name] = paramValue(value)
+	}
+	for name, value := range rt.fixed {
+		fields[name] = value
+	}
+	return json.Marshal(fields)
+}
+
+// paramValue gets the value of a path or query parameter, which is a number if it can be parsed as one, or a bool
+// if it is true or false
+func paramValue(param string) interface{} {
+	if param == "true" || param == "false" {
+		return param == "true"
+	}
+	if n, err := strconv.ParseInt(param, 10, 64); err == nil {
+		return n
+	}
+	return param
+}
+
+// Start starts listening and serving in the background
+func (s *Server) Start() (err error) {
+	s.listener, err = net.Listen("tcp", s.address)
+	if err != nil {
+		err = fmt.Errorf("could not listen on %s: %v", s.address, err)
+		return
+	}
+	s.log.WithField("address", s.listener.Addr()).Info("started rest api server")
+	go func() {
+		if err := s.server.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+			s.log.WithError(err).Error("error serving rest api")
+		}
+	}()
+	return
+}
+
+// Addr gets the address the Server is listening on, once it is started
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Stop stops the Server, closing event streams and waiting a few seconds for requests in progress to finish
+func (s *Server) Stop() {
+	close(s.done)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		s.log.WithError(err).Warn("error stopping rest api server")
+	}
+}
@@ -0,0 +1,257 @@
+package rest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/api"
+	"git.amikhalev.com/amikhalev/grinklers/config"
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/sched"
+	"git.amikhalev.com/amikhalev/grinklers/storage"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type RESTSuite struct {
+	suite.Suite
+	config    *config.ConfigData
+	secRunner *logic.SectionRunner
+	server    *Server
+	events    *logic.EventBus
+	wait      sync.WaitGroup
+}
+
+func (s *RESTSuite) SetupTest() {
+	util.Logger.Out = ioutil.Discard
+	secInterface := logic.NewMockSectionInterface(2)
+	secInterface.Initialize()
+	sections := logic.Sections{logic.NewSection(0, "sec 0", 0), logic.NewSection(1, "sec 1", 1)}.Pointers()
+	// changes made by requests are saved in memory instead of to the config file
+	store, err := storage.OpenSQLite(":memory:")
+	s.Require().NoError(err)
+	s.config = &config.ConfigData{SectionInterface: secInterface, Sections: sections, Store: store}
+	s.config.Programs = []*logic.Program{logic.NewProgram("prog", []logic.ProgItem{
+		{Sec: s.config.Sections[0], Duration: time.Minute},
+	}, sched.Schedule{}, false)}
+	s.events = logic.NewEventBus()
+	s.config.SetEventBus(s.events)
+	s.secRunner = logic.NewSectionRunner(secInterface)
+	s.secRunner.SetEventBus(s.events)
+	s.secRunner.Start(&s.wait)
+	s.config.StartPrograms(s.secRunner, &s.wait)
+	s.server = NewServer(":0", api.NewHandlers(s.config, s.secRunner), NewStream(s.config, s.secRunner, s.events))
+}
+
+func (s *RESTSuite) TearDownTest() {
+	s.config.QuitPrograms()
+	s.secRunner.Quit()
+	s.wait.Wait()
+	s.config.Store.Close()
+}
+
+// request makes a request to the server, returning the status and the decoded response
+func (s *RESTSuite) request(method, path, body string) (status int, res map[string]interface{}) {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	s.server.ServeHTTP(w, r)
+	s.Equal("application/json", w.Header().Get("Content-Type"))
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &res), w.Body.String())
+	return w.Code, res
+}
+
+func (s *RESTSuite) TestSections() {
+	ass := s.Assert()
+	status, res := s.request("POST", "/api/sections/1/run", `{"duration": 60}`)
+	ass.Equal(http.StatusOK, status)
+	ass.Equal("success", res["result"])
+	ass.Equal(0.0, res["runId"])
+	time.Sleep(10 * time.Millisecond)
+
+	status, res = s.request("GET", "/api/sections/1", "")
+	ass.Equal(http.StatusOK, status)
+	ass.Equal(map[string]interface{}{"id": 1.0, "name": "sec 1", "interfaceId": 1.0, "state": true}, res["data"])
+
+	status, res = s.request("GET", "/api/section_runner", "")
+	ass.Equal(http.StatusOK, status)
+	ass.Equal(1.0, res["data"].(map[string]interface{})["current"].(map[string]interface{})["section"])
+
+	status, _ = s.request("POST", "/api/section_runner/runs/0/cancel", "")
+	ass.Equal(http.StatusOK, status)
+
+	status, res = s.request("GET", "/api/sections", "")
+	ass.Equal(http.StatusOK, status)
+	ass.Len(res["data"], 2)
+
+	status, res = s.request("GET", "/api/sections/5", "")
+	ass.Equal(http.StatusNotFound, status)
+	ass.Equal(float64(util.EC_Range), res["code"])
+}
+
+func (s *RESTSuite) TestPrograms() {
+	ass := s.Assert()
+	status, res := s.request("PUT", "/api/programs/0", `{"name": "renamed"}`)
+	ass.Equal(http.StatusOK, status)
+	ass.Equal("renamed", res["data"].(map[string]interface{})["name"])
+
+	status, _ = s.request("POST", "/api/programs/0/run", "")
+	ass.Equal(http.StatusOK, status)
+	time.Sleep(10 * time.Millisecond)
+	status, res = s.request("GET", "/api/programs", "")
+	ass.Equal(http.StatusOK, status)
+	ass.Equal(true, res["data"].([]interface{})[0].(map[string]interface{})["running"])
+	status, _ = s.request("POST", "/api/programs/0/cancel", "")
+	ass.Equal(http.StatusOK, status)
+
+	status, _ = s.request("PUT", "/api/programs/0", `{"name": `)
+	ass.Equal(http.StatusBadRequest, status)
+	status, _ = s.request("PUT", "/api/programs/0", `{"sequence": [{"section": 5}]}`)
+	ass.Equal(http.StatusBadRequest, status)
+}
+
+func (s *RESTSuite) TestManageSections() {
+	ass := s.Assert()
+	status, res := s.request("POST", "/api/sections", `{"name": "sec 2", "interfaceId": 1}`)
+	ass.Equal(http.StatusOK, status)
+	ass.Equal(2.0, res["data"].(map[string]interface{})["id"])
+
+	status, res = s.request("PUT", "/api/sections/2", `{"name": "renamed"}`)
+	ass.Equal(http.StatusOK, status)
+	ass.Equal("renamed", res["data"].(map[string]interface{})["name"])
+	status, _ = s.request("POST", "/api/sections", `{"name": "sec 3", "interfaceId": 9}`)
+	ass.Equal(http.StatusBadRequest, status)
+
+	status, _ = s.request("DELETE", "/api/sections/0", "")
+	ass.Equal(http.StatusBadRequest, status, "section 0 is used by a program")
+	status, _ = s.request("DELETE", "/api/sections/0?removeFromPrograms=true", "")
+	ass.Equal(http.StatusOK, status)
+	status, res = s.request("GET", "/api/sections", "")
+	ass.Equal(http.StatusOK, status)
+	ass.Len(res["data"], 2)
+}
+
+func (s *RESTSuite) TestManagePrograms() {
+	ass := s.Assert()
+	status, res := s.request("POST", "/api/programs", `{"name": "created", "sequence": []}`)
+	ass.Equal(http.StatusOK, status)
+	ass.Equal(1.0, res["data"].(map[string]interface{})["id"])
+
+	status, res = s.request("POST", "/api/programs/0/duplicate", `{"name": "copied"}`)
+	ass.Equal(http.StatusOK, status)
+	ass.Equal(2.0, res["data"].(map[string]interface{})["id"])
+
+	status, res = s.request("POST", "/api/programs/2/reorder", `{"position": 1}`)
+	ass.Equal(http.StatusOK, status)
+	ass.Equal("moved program 'copied' to position 1", res["message"])
+
+	status, _ = s.request("DELETE", "/api/programs/0", "")
+	ass.Equal(http.StatusOK, status)
+	status, res = s.request("GET", "/api/programs", "")
+	ass.Equal(http.StatusOK, status)
+	programs := res["data"].([]interface{})
+	s.Require().Len(programs, 2)
+	ass.Equal("copied", programs[0].(map[string]interface{})["name"])
+	ass.Equal(2.0, programs[0].(map[string]interface{})["id"])
+
+	status, _ = s.request("DELETE", "/api/programs/0", "")
+	ass.Equal(http.StatusNotFound, status)
+}
+
+func (s *RESTSuite) TestSectionRunner() {
+	ass := s.Assert()
+	status, res := s.request("POST", "/api/section_runner/pause", "")
+	ass.Equal(http.StatusOK, status)
+	ass.Equal(true, res["paused"])
+	status, res = s.request("POST", "/api/section_runner/unpause", "")
+	ass.Equal(http.StatusOK, status)
+	ass.Equal(false, res["paused"])
+	status, _ = s.request("POST", "/api/section_runner/cancel_all", "")
+	ass.Equal(http.StatusOK, status)
+}
+
+func (s *RESTSuite) TestRequests() {
+	ass := s.Assert()
+	// requests can be made with the same data as over MQTT
+	status, res := s.request("POST", "/api/requests/runSection", `{"sectionId": 0, "duration": 1}`)
+	ass.Equal(http.StatusOK, status)
+	ass.Equal("running section 'sec 0' for 1s", res["message"])
+
+	status, res = s.request("POST", "/api/requests/unknown", "")
+	ass.Equal(http.StatusNotImplemented, status)
+	ass.Equal(float64(util.EC_NotImplemented), res["code"])
+
+	status, res = s.request("POST", "/api/requests/runSection", `{"sectionId": `)
+	ass.Equal(http.StatusBadRequest, status)
+	ass.Equal(float64(util.EC_Parse), res["code"])
+
+	status, _ = s.request("GET", "/api/history/day", "")
+	ass.Equal(http.StatusNotImplemented, status, "history is not enabled")
+
+	status, _ = s.request("DELETE", "/api/sections", "")
+	ass.Equal(http.StatusMethodNotAllowed, status)
+	status, _ = s.request("GET", "/api/nothing", "")
+	ass.Equal(http.StatusNotFound, status)
+}
+
+func (s *RESTSuite) TestTokens() {
+	ass := s.Assert()
+	s.config.Tokens = []config.TokenJSON{{Token: "v"}, {Token: "o", Role: config.RoleOperator}}
+	request := func(method, path, authorization string) (status int, w *httptest.ResponseRecorder) {
+		r := httptest.NewRequest(method, path, nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w = httptest.NewRecorder()
+		s.server.ServeHTTP(w, r)
+		return w.Code, w
+	}
+
+	status, w := request("GET", "/api/sections", "")
+	ass.Equal(http.StatusUnauthorized, status)
+	ass.Equal("Bearer", w.Header().Get("WWW-Authenticate"))
+	status, _ = request("GET", "/api/sections", "Bearer x")
+	ass.Equal(http.StatusUnauthorized, status)
+	status, _ = request("GET", "/api/sections", "Basic v")
+	ass.Equal(http.StatusUnauthorized, status, "only bearer tokens are accepted")
+	status, _ = request("GET", "/api/sections", "Bearer v")
+	ass.Equal(http.StatusOK, status)
+	status, _ = request("POST", "/api/programs/0/run", "Bearer v")
+	ass.Equal(http.StatusForbidden, status)
+	ass.False(s.config.Programs[0].Running())
+	status, _ = request("POST", "/api/requests/cancelProgram?programId=0", "bearer o")
+	ass.Equal(http.StatusOK, status)
+	status, _ = request("GET", "/api/events", "")
+	ass.Equal(http.StatusUnauthorized, status, "the event stream needs a token")
+}
+
+func (s *RESTSuite) TestStart() {
+	req := s.Require()
+	req.NoError(s.server.Start())
+	defer s.server.Stop()
+	res, err := http.Get("http://" + s.server.Addr().String() + "/api/sections")
+	req.NoError(err)
+	defer res.Body.Close()
+	s.Equal(http.StatusOK, res.StatusCode)
+}
+
+func TestREST(t *testing.T) {
+	suite.Run(t, new(RESTSuite))
+}
+
+func TestStatusCode(t *testing.T) {
+	ass := assert.New(t)
+	ass.Equal(http.StatusBadRequest, StatusCode(util.EC_Parse))
+	ass.Equal(http.StatusUnauthorized, StatusCode(util.EC_BadToken))
+	ass.Equal(http.StatusForbidden, StatusCode(util.EC_NoPermission))
+	ass.Equal(http.StatusGatewayTimeout, StatusCode(util.EC_Timeout))
+	ass.Equal(http.StatusInternalServerError, StatusCode(util.EC_Internal))
+	require.Equal(t, http.StatusNotImplemented, StatusCode(util.EC_NotImplemented))
+}
@@ -0,0 +1,180 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/config"
+	"git.amikhalev.com/amikhalev/grinklers/datamodel"
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// subscriberBuffer is the number of updates buffered for each event stream. Pending updates to the same
+	// section, program or section runner are coalesced.
+	subscriberBuffer = 32
+	// keepAliveInterval is how often a comment is sent to idle event streams, so proxies do not close them
+	keepAliveInterval = 30 * time.Second
+)
+
+// Event is an event sent on an event stream
+type Event struct {
+	// Type is the type of the event: section, sections, program, programs or sectionRunner
+	Type string
+	// Data is the JSON data of the event
+	Data []byte
+}
+
+// Stream streams the updates to sections, programs and the section runner published on an EventBus to any
+// number of clients
+type Stream struct {
+	config    *config.ConfigData
+	secRunner *logic.SectionRunner
+	events    *logic.EventBus
+	log       *logrus.Entry
+}
+
+// NewStream creates a new Stream of the updates published on events to the state in configData and secRunner
+func NewStream(configData *config.ConfigData, secRunner *logic.SectionRunner, events *logic.EventBus) *Stream {
+	return &Stream{configData, secRunner, events, util.Logger.WithField("module", "stream")}
+}
+
+func (s *Stream) sectionJSON(sec *logic.Section) datamodel.SectionStateJSON {
+	return datamodel.SectionToStateJSON(sec, s.config.SectionInterface)
+}
+
+// sectionsJSON gets all sections, which is sent when sections are added or removed
+func (s *Stream) sectionsJSON() []datamodel.SectionStateJSON {
+	sectionList := s.config.SectionList()
+	sections := make([]datamodel.SectionStateJSON, len(sectionList))
+	for i := range sectionList {
+		sections[i] = s.sectionJSON(sectionList[i])
+	}
+	return sections
+}
+
+// programsJSON gets all programs, which is sent when programs are added, removed or reordered
+func (s *Stream) programsJSON() []datamodel.ProgramStateJSON {
+	programList := s.config.ProgramList()
+	programs := make([]datamodel.ProgramStateJSON, len(programList))
+	for i, prog := range programList {
+		programs[i] = datamodel.ProgramToStateJSON(prog)
+	}
+	return programs
+}
+
+func srStateJSON(state *logic.SRState) (stateJSON datamodel.SRStateJSON, err error) {
+	state.Lock()
+	defer state.Unlock()
+	return datamodel.SRStateToJSON(state)
+}
+
+// toEvent converts an update published on the EventBus to an Event
+func (s *Stream) toEvent(update logic.Event) (event Event, err error) {
+	var data interface{}
+	switch update := update.(type) {
+	case logic.SecUpdate:
+		event.Type, data = "section", s.sectionJSON(update.Sec)
+	case logic.ProgUpdate:
+		event.Type, data = "program", datamodel.ProgramToStateJSON(update.Prog)
+	case logic.SectionsUpdate:
+		event.Type, data = "sections", s.sectionsJSON()
+	case logic.ProgramsUpdate:
+		event.Type, data = "programs", s.programsJSON()
+	case logic.SRUpdate:
+		event.Type = "sectionRunner"
+		data, err = srStateJSON(update.State)
+		if err != nil {
+			return
+		}
+	default:
+		err = fmt.Errorf("unknown update type %T", update)
+		return
+	}
+	event.Data, err = json.Marshal(data)
+	return
+}
+
+// snapshot gets events for the current state of all sections, programs and the section runner
+func (s *Stream) snapshot() (events []Event, err error) {
+	add := func(eventType string, data interface{}) {
+		if err != nil {
+			return
+		}
+		var bytes []byte
+		bytes, err = json.Marshal(data)
+		events = append(events, Event{eventType, bytes})
+	}
+	sections := s.config.SectionList()
+	for _, sec := range sections {
+		add("section", s.sectionJSON(sec))
+	}
+	for _, prog := range s.config.ProgramList() {
+		add("program", datamodel.ProgramToStateJSON(prog))
+	}
+	stateJSON, serr := srStateJSON(&s.secRunner.State)
+	if serr != nil {
+		return nil, serr
+	}
+	add("sectionRunner", stateJSON)
+	return
+}
+
+// serveEvents serves the Stream as Server-Sent Events. The current state is sent first, then every update
+// until the client disconnects or done is closed.
+func (s *Stream) serveEvents(w http.ResponseWriter, r *http.Request, done <-chan struct{}) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	// subscribed before getting the snapshot so no update in between is missed
+	updates := s.events.Subscribe("stream "+r.RemoteAddr, subscriberBuffer, logic.Coalesce)
+	defer updates.Close()
+	snapshot, err := s.snapshot()
+	if err != nil {
+		s.log.WithError(err).Error("error getting current state for event stream")
+		http.Error(w, "error getting current state", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	for _, event := range snapshot {
+		writeEvent(w, event)
+	}
+	flusher.Flush()
+	s.log.WithField("remoteAddr", r.RemoteAddr).Debug("event stream opened")
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case update := <-updates.C:
+			event, err := s.toEvent(update)
+			if err != nil {
+				s.log.WithError(err).Error("error converting update to event")
+				continue
+			}
+			writeEvent(w, event)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			s.log.WithField("remoteAddr", r.RemoteAddr).Debug("event stream closed")
+			return
+		case <-done:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event Event) {
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, event.Data)
+}
@@ -0,0 +1,84 @@
+package rest
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// readEvent reads the next event from an event stream, skipping comments
+func readEvent(r *bufio.Reader) (event Event, err error) {
+	for {
+		var line string
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event.Type != "":
+			return
+		case strings.HasPrefix(line, "event: "):
+			event.Type = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.Data = []byte(strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
+
+func (s *RESTSuite) TestEvents() {
+	ass, req := s.Assert(), s.Require()
+	req.NoError(s.server.Start())
+	res, err := http.Get("http://" + s.server.Addr().String() + "/api/events")
+	req.NoError(err)
+	defer res.Body.Close()
+	ass.Equal(http.StatusOK, res.StatusCode)
+	ass.Equal("text/event-stream", res.Header.Get("Content-Type"))
+	body := bufio.NewReader(res.Body)
+
+	// the current state is sent first
+	var types []string
+	for i := 0; i < 4; i++ {
+		event, err := readEvent(body)
+		req.NoError(err)
+		ass.True(json.Valid(event.Data), string(event.Data))
+		types = append(types, event.Type)
+	}
+	ass.Equal([]string{"section", "section", "program", "sectionRunner"}, types)
+
+	// then updates as they are published
+	s.config.Sections[1].SetData("renamed", 0)
+	event, err := readEvent(body)
+	req.NoError(err)
+	ass.Equal("section", event.Type)
+	ass.JSONEq(`{"id": 1, "name": "renamed", "interfaceId": 1, "state": false}`, string(event.Data))
+
+	s.config.Programs[0].Run()
+	event, err = readEvent(body)
+	req.NoError(err)
+	ass.Equal("program", event.Type)
+	var prog map[string]interface{}
+	req.NoError(json.Unmarshal(event.Data, &prog))
+	ass.Equal(true, prog["running"])
+	s.config.Programs[0].Cancel()
+
+	// all programs are sent when one is added, after any other pending updates
+	status, _ := s.request("POST", "/api/programs/0/duplicate", "")
+	ass.Equal(http.StatusOK, status)
+	for i := 0; event.Type != "programs" && i < 10; i++ {
+		event, err = readEvent(body)
+		req.NoError(err)
+	}
+	ass.Equal("programs", event.Type)
+	var programs []map[string]interface{}
+	req.NoError(json.Unmarshal(event.Data, &programs))
+	ass.Len(programs, 2)
+
+	// streams are closed when the server stops
+	s.server.Stop()
+	for i := 0; err == nil && i < 10; i++ {
+		_, err = readEvent(body)
+	}
+	ass.Error(err)
+}
@@ -0,0 +1,501 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/datamodel"
+	"git.amikhalev.com/amikhalev/grinklers/http"
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/Sirupsen/logrus"
+	// registers the sqlite3 driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteSchema creates all of the tables of a SQLiteStore
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS meta (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS sections (
+	id           INTEGER PRIMARY KEY,
+	name         TEXT NOT NULL,
+	interface_id INTEGER NOT NULL,
+	max_run_time REAL NOT NULL DEFAULT 0,
+	position     INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS programs (
+	id       INTEGER PRIMARY KEY,
+	name     TEXT NOT NULL,
+	sequence TEXT NOT NULL,
+	schedule TEXT,
+	enabled  INTEGER NOT NULL DEFAULT 0,
+	position INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS device_data (
+	id           INTEGER PRIMARY KEY CHECK (id = 0),
+	device_id    TEXT NOT NULL,
+	device_token TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS runs (
+	id                 INTEGER PRIMARY KEY AUTOINCREMENT,
+	time               INTEGER NOT NULL,
+	section            INTEGER NOT NULL,
+	program            INTEGER,
+	requested_duration REAL NOT NULL,
+	actual_duration    REAL NOT NULL,
+	start_time         INTEGER,
+	end_time           INTEGER NOT NULL,
+	cancelled          INTEGER NOT NULL,
+	cancel_reason      TEXT NOT NULL DEFAULT '',
+	skip_reason        TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS runs_time ON runs (time);
+`
+
+// sqliteSchemaVersion is the version of sqliteSchema, stored in the meta table
+const sqliteSchemaVersion = "2"
+
+// sqliteMigrations upgrade the schema of an existing database. sqliteMigrations[v] upgrades it from version v
+// to the next one. They run before sqliteSchema, so they are only applied to tables which already exist.
+var sqliteMigrations = map[string]struct {
+	to    string
+	query string
+}{
+	// sections and programs used to be ordered by their id, which was their position
+	"1": {"2", `
+ALTER TABLE sections ADD COLUMN position INTEGER NOT NULL DEFAULT 0;
+UPDATE sections SET position = id;
+ALTER TABLE programs ADD COLUMN position INTEGER NOT NULL DEFAULT 0;
+UPDATE programs SET position = id;
+`},
+}
+
+// SQLiteStore is a Store backed by a SQLite database
+type SQLiteStore struct {
+	db  *sql.DB
+	log *logrus.Entry
+}
+
+// OpenSQLite opens the SQLite database at path, creating it and its tables if they do not exist
+func OpenSQLite(path string) (s *SQLiteStore, err error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=1&_journal_mode=WAL&_synchronous=NORMAL")
+	if err != nil {
+		err = fmt.Errorf("could not open database: %v", err)
+		return
+	}
+	// sqlite only supports one writer at a time
+	db.SetMaxOpenConns(1)
+	s = &SQLiteStore{db, util.Logger.WithFields(logrus.Fields{"module": "storage", "path": path})}
+	if err = s.migrate(); err != nil {
+		db.Close()
+		s, err = nil, fmt.Errorf("could not migrate database schema: %v", err)
+		return
+	}
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		s, err = nil, fmt.Errorf("could not create database schema: %v", err)
+		return
+	}
+	if _, err = db.Exec("INSERT OR IGNORE INTO meta (key, value) VALUES ('schema_version', ?)",
+		sqliteSchemaVersion); err != nil {
+		db.Close()
+		s, err = nil, fmt.Errorf("could not check database schema: %v", err)
+	}
+	return
+}
+
+// migrate upgrades the schema of an existing database to sqliteSchemaVersion. A new database is left alone.
+func (s *SQLiteStore) migrate() (err error) {
+	var version string
+	err = s.db.QueryRow("SELECT value FROM meta WHERE key = 'schema_version'").Scan(&version)
+	if err != nil {
+		if err == sql.ErrNoRows || isNoSuchTable(err) {
+			err = nil
+		}
+		return
+	}
+	for version != sqliteSchemaVersion {
+		m, ok := sqliteMigrations[version]
+		if !ok {
+			return fmt.Errorf("unsupported schema version %s", version)
+		}
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(m.query); err == nil {
+			_, err = tx.Exec("UPDATE meta SET value = ? WHERE key = 'schema_version'", m.to)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("from version %s: %v", version, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		s.log.WithFields(logrus.Fields{"from": version, "to": m.to}).Info("migrated database schema")
+		version = m.to
+	}
+	return
+}
+
+// isNoSuchTable checks if err is the error sqlite returns when a table does not exist
+func isNoSuchTable(err error) bool {
+	return strings.HasPrefix(err.Error(), "no such table")
+}
+
+var _ Store = (*SQLiteStore)(nil)
+
+// Empty implements Store
+func (s *SQLiteStore) Empty() (empty bool, err error) {
+	var imported int
+	err = s.db.QueryRow("SELECT COUNT(*) FROM meta WHERE key = 'imported'").Scan(&imported)
+	empty = imported == 0
+	return
+}
+
+// Load implements Store
+func (s *SQLiteStore) Load() (data *Data, err error) {
+	data = &Data{}
+	if data.Sections, err = s.loadSections(); err != nil {
+		err = fmt.Errorf("could not load sections: %v", err)
+		return
+	}
+	if data.Programs, err = s.loadPrograms(); err != nil {
+		err = fmt.Errorf("could not load programs: %v", err)
+		return
+	}
+	if data.DeviceData, err = s.loadDeviceData(); err != nil {
+		err = fmt.Errorf("could not load device data: %v", err)
+		return
+	}
+	// runs recorded before the next ids were stored still keep the ids of their sections and programs from being
+	// given out again
+	if data.NextSectionID, err = s.loadNextID("next_section_id", "section"); err != nil {
+		err = fmt.Errorf("could not load next section id: %v", err)
+		return
+	}
+	if data.NextProgramID, err = s.loadNextID("next_program_id", "program"); err != nil {
+		err = fmt.Errorf("could not load next program id: %v", err)
+		return
+	}
+	return
+}
+
+// loadNextID gets the next id stored under key in the meta table, or the id after the highest one in column of
+// the runs if that is higher
+func (s *SQLiteStore) loadNextID(key, column string) (nextID int, err error) {
+	err = s.db.QueryRow(`SELECT MAX(COALESCE((SELECT CAST(value AS INTEGER) FROM meta WHERE key = ?), 0),
+		COALESCE((SELECT MAX(`+column+`) + 1 FROM runs), 0))`, key).Scan(&nextID)
+	return
+}
+
+// saveNextID makes the next id stored under key in the meta table higher than id, if it is not already
+func saveNextID(db execer, key string, id int) (err error) {
+	_, err = db.Exec(`INSERT INTO meta (key, value) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = MAX(CAST(value AS INTEGER), CAST(excluded.value AS INTEGER))`,
+		key, id+1)
+	return
+}
+
+func (s *SQLiteStore) loadSections() (sections logic.Sections, err error) {
+	rows, err := s.db.Query("SELECT id, name, interface_id, max_run_time FROM sections ORDER BY position, id")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sec logic.Section
+		if err = rows.Scan(&sec.ID, &sec.Name, &sec.InterfaceID, &sec.MaxRunTime); err != nil {
+			return
+		}
+		sections = append(sections, sec)
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *SQLiteStore) loadPrograms() (programs datamodel.ProgramsJSON, err error) {
+	rows, err := s.db.Query("SELECT id, name, sequence, schedule, enabled FROM programs ORDER BY position, id")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			prog               datamodel.ProgramJSON
+			name               string
+			sequence, schedule []byte
+			enabled            bool
+		)
+		if err = rows.Scan(&prog.ID, &name, &sequence, &schedule, &enabled); err != nil {
+			return
+		}
+		prog.Name, prog.Enabled = &name, &enabled
+		if err = json.Unmarshal(sequence, &prog.Sequence); err != nil {
+			err = util.NewParseError("program sequence", err)
+			return
+		}
+		if schedule != nil {
+			if err = json.Unmarshal(schedule, &prog.Sched); err != nil {
+				err = util.NewParseError("program schedule", err)
+				return
+			}
+		}
+		programs = append(programs, prog)
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *SQLiteStore) loadDeviceData() (deviceData *http.DeviceData, err error) {
+	deviceData = &http.DeviceData{}
+	err = s.db.QueryRow("SELECT device_id, device_token FROM device_data").
+		Scan(&deviceData.DeviceID, &deviceData.DeviceToken)
+	if err == sql.ErrNoRows {
+		deviceData, err = nil, nil
+	}
+	return
+}
+
+// execer is implemented by both sql.DB and sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// saveSection inserts or updates sec. If position is nil, an existing section keeps its position and a new one
+// is put after all others.
+func saveSection(db execer, section *logic.Section, position *int) (err error) {
+	sec := section.Snapshot()
+	_, err = db.Exec(`INSERT INTO sections (id, name, interface_id, max_run_time, position)
+		VALUES (?, ?, ?, ?, COALESCE(?, (SELECT COALESCE(MAX(position) + 1, 0) FROM sections)))
+		ON CONFLICT (id) DO UPDATE SET name = excluded.name, interface_id = excluded.interface_id,
+		max_run_time = excluded.max_run_time, position = COALESCE(?, position)`,
+		sec.ID, sec.Name, sec.InterfaceID, sec.MaxRunTime, position, position)
+	if err == nil {
+		err = saveNextID(db, "next_section_id", sec.ID)
+	}
+	return
+}
+
+// saveProgram inserts or updates prog. If position is nil, an existing program keeps its position and a new one
+// is put after all others.
+func saveProgram(db execer, prog *datamodel.ProgramJSON, position *int) (err error) {
+	if err = util.CheckNotNil(prog.Name, "name"); err != nil {
+		return
+	}
+	sequence := prog.Sequence
+	if sequence == nil {
+		sequence = datamodel.ProgSequenceJSON{}
+	}
+	seqBytes, err := json.Marshal(sequence)
+	if err != nil {
+		return
+	}
+	var schedBytes []byte
+	if prog.Sched != nil {
+		if schedBytes, err = json.Marshal(prog.Sched); err != nil {
+			return
+		}
+	}
+	enabled := prog.Enabled != nil && *prog.Enabled
+	_, err = db.Exec(`INSERT INTO programs (id, name, sequence, schedule, enabled, position)
+		VALUES (?, ?, ?, ?, ?, COALESCE(?, (SELECT COALESCE(MAX(position) + 1, 0) FROM programs)))
+		ON CONFLICT (id) DO UPDATE SET name = excluded.name, sequence = excluded.sequence,
+		schedule = excluded.schedule, enabled = excluded.enabled, position = COALESCE(?, position)`,
+		prog.ID, *prog.Name, seqBytes, schedBytes, enabled, position, position)
+	if err == nil {
+		err = saveNextID(db, "next_program_id", prog.ID)
+	}
+	return
+}
+
+func saveDeviceData(db execer, deviceData *http.DeviceData) (err error) {
+	if deviceData == nil {
+		_, err = db.Exec("DELETE FROM device_data")
+		return
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO device_data (id, device_id, device_token) VALUES (0, ?, ?)",
+		deviceData.DeviceID, deviceData.DeviceToken)
+	return
+}
+
+// Import implements Store. It is done in a single transaction, so the Store is left unchanged if it fails.
+func (s *SQLiteStore) Import(data *Data) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("could not import data: %v", err)
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	for _, table := range []string{"sections", "programs", "device_data"} {
+		if _, err = tx.Exec("DELETE FROM " + table); err != nil {
+			return
+		}
+	}
+	for i := range data.Sections {
+		position := i
+		if err = saveSection(tx, &data.Sections[i], &position); err != nil {
+			return
+		}
+	}
+	for i := range data.Programs {
+		position := i
+		if err = saveProgram(tx, &data.Programs[i], &position); err != nil {
+			return
+		}
+	}
+	if err = saveDeviceData(tx, data.DeviceData); err != nil {
+		return
+	}
+	// the next ids are never lowered, since runs of deleted sections and programs are kept
+	if err = saveNextID(tx, "next_section_id", data.NextSectionID-1); err != nil {
+		return
+	}
+	if err = saveNextID(tx, "next_program_id", data.NextProgramID-1); err != nil {
+		return
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO meta (key, value) VALUES ('imported', ?)",
+		time.Now().Format(time.RFC3339))
+	if err == nil {
+		s.log.WithFields(logrus.Fields{
+			"lenSections": len(data.Sections), "lenPrograms": len(data.Programs),
+		}).Info("imported data")
+	}
+	return
+}
+
+// SaveSection implements Store
+func (s *SQLiteStore) SaveSection(sec *logic.Section) error {
+	return saveSection(s.db, sec, nil)
+}
+
+// SaveProgram implements Store
+func (s *SQLiteStore) SaveProgram(prog *datamodel.ProgramJSON) error {
+	return saveProgram(s.db, prog, nil)
+}
+
+// replaceAll replaces all rows of table in a single transaction by calling save, so the table is left unchanged
+// if it fails
+func (s *SQLiteStore) replaceAll(table string, save func(tx execer) error) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("could not save %s: %v", table, err)
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	if _, err = tx.Exec("DELETE FROM " + table); err != nil {
+		return
+	}
+	return save(tx)
+}
+
+// SaveSections implements Store. The sections are ordered by their position in sections.
+func (s *SQLiteStore) SaveSections(sections logic.Sections) error {
+	return s.replaceAll("sections", func(tx execer) (err error) {
+		for i := range sections {
+			position := i
+			if err = saveSection(tx, &sections[i], &position); err != nil {
+				return
+			}
+		}
+		return
+	})
+}
+
+// SavePrograms implements Store. The programs are ordered by their position in programs.
+func (s *SQLiteStore) SavePrograms(programs datamodel.ProgramsJSON) error {
+	return s.replaceAll("programs", func(tx execer) (err error) {
+		for i := range programs {
+			position := i
+			if err = saveProgram(tx, &programs[i], &position); err != nil {
+				return
+			}
+		}
+		return
+	})
+}
+
+// SaveDeviceData implements Store
+func (s *SQLiteStore) SaveDeviceData(deviceData *http.DeviceData) error {
+	return saveDeviceData(s.db, deviceData)
+}
+
+func unixNanos(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UnixNano()
+}
+
+// Append implements history.Store
+func (s *SQLiteStore) Append(record datamodel.RunRecordJSON) (err error) {
+	_, err = s.db.Exec(`INSERT INTO runs (time, section, program, requested_duration, actual_duration,
+		start_time, end_time, cancelled, cancel_reason, skip_reason) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		record.Time().UnixNano(), record.Section, record.Program, record.RequestedDuration, record.ActualDuration,
+		unixNanos(record.StartTime), record.EndTime.UnixNano(), record.Cancelled,
+		record.CancelReason, record.SkipReason)
+	if err != nil {
+		err = fmt.Errorf("could not record run: %v", err)
+	}
+	return
+}
+
+// Entries implements history.Store
+func (s *SQLiteStore) Entries(since time.Time) (entries []datamodel.RunRecordJSON, err error) {
+	rows, err := s.db.Query(`SELECT section, program, requested_duration, actual_duration, start_time, end_time,
+		cancelled, cancel_reason, skip_reason FROM runs WHERE time >= ? ORDER BY id`, since.UnixNano())
+	if err != nil {
+		err = fmt.Errorf("could not query runs: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			entry     datamodel.RunRecordJSON
+			program   sql.NullInt64
+			startTime sql.NullInt64
+			endTime   int64
+		)
+		err = rows.Scan(&entry.Section, &program, &entry.RequestedDuration, &entry.ActualDuration,
+			&startTime, &endTime, &entry.Cancelled, &entry.CancelReason, &entry.SkipReason)
+		if err != nil {
+			return
+		}
+		if program.Valid {
+			id := int(program.Int64)
+			entry.Program = &id
+		}
+		if startTime.Valid {
+			t := time.Unix(0, startTime.Int64)
+			entry.StartTime = &t
+		}
+		entry.EndTime = time.Unix(0, endTime)
+		entries = append(entries, entry)
+	}
+	err = rows.Err()
+	return
+}
+
+// Close implements Store
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
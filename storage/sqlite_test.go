@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/datamodel"
+	"git.amikhalev.com/amikhalev/grinklers/http"
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/sched"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type SQLiteStoreSuite struct {
+	suite.Suite
+	dir   string
+	path  string
+	store *SQLiteStore
+}
+
+func (s *SQLiteStoreSuite) SetupSuite() {
+	util.Logger.Out = ioutil.Discard
+}
+
+func (s *SQLiteStoreSuite) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "storage")
+	s.Require().NoError(err)
+	s.path = filepath.Join(s.dir, "grinklers.db")
+	s.store, err = OpenSQLite(s.path)
+	s.Require().NoError(err)
+}
+
+func (s *SQLiteStoreSuite) TearDownTest() {
+	s.store.Close()
+	os.RemoveAll(s.dir)
+}
+
+func (s *SQLiteStoreSuite) reopen() {
+	s.Require().NoError(s.store.Close())
+	var err error
+	s.store, err = OpenSQLite(s.path)
+	s.Require().NoError(err)
+}
+
+func testData() *Data {
+	name1, name2 := "morning", "evening"
+	enabled := true
+	schedule := sched.Schedule{Times: []sched.TimeOfDay{{Hour: 6, Minute: 30}}}
+	return &Data{
+		Sections: logic.Sections{
+			logic.NewSection(0, "front", 0),
+			{ID: 1, Name: "back", InterfaceID: 3, MaxRunTime: 1800},
+		},
+		Programs: datamodel.ProgramsJSON{
+			{ID: 0, Name: &name1, Sequence: datamodel.ProgSequenceJSON{{Section: 0, Duration: 60}, {Section: 1, Duration: 90}},
+				Sched: &schedule, Enabled: &enabled},
+			{ID: 1, Name: &name2, Sequence: datamodel.ProgSequenceJSON{}},
+		},
+		DeviceData: &http.DeviceData{DeviceID: "device", DeviceToken: "token"},
+	}
+}
+
+func (s *SQLiteStoreSuite) TestImport() {
+	ass, req := s.Assert(), s.Require()
+	empty, err := s.store.Empty()
+	req.NoError(err)
+	ass.True(empty)
+
+	req.NoError(s.store.Import(testData()))
+	empty, err = s.store.Empty()
+	req.NoError(err)
+	ass.False(empty)
+
+	s.reopen()
+	data, err := s.store.Load()
+	req.NoError(err)
+	expected := testData()
+	ass.Equal(expected.Sections, data.Sections)
+	ass.Equal(expected.DeviceData, data.DeviceData)
+	req.Len(data.Programs, 2)
+	ass.Equal(0, data.Programs[0].ID)
+	ass.Equal("morning", *data.Programs[0].Name)
+	ass.Equal(expected.Programs[0].Sequence, data.Programs[0].Sequence)
+	ass.Equal(expected.Programs[0].Sched, data.Programs[0].Sched)
+	ass.True(*data.Programs[0].Enabled)
+	ass.Equal(1, data.Programs[1].ID)
+	ass.Nil(data.Programs[1].Sched)
+	ass.False(*data.Programs[1].Enabled)
+	ass.Equal(datamodel.ProgSequenceJSON{}, data.Programs[1].Sequence)
+
+	// importing replaces everything
+	req.NoError(s.store.Import(&Data{Sections: logic.Sections{logic.NewSection(0, "only", 1)}}))
+	data, err = s.store.Load()
+	req.NoError(err)
+	ass.Len(data.Sections, 1)
+	ass.Empty(data.Programs)
+	ass.Nil(data.DeviceData)
+
+	// a failed import leaves the store unchanged
+	ass.Error(s.store.Import(&Data{Programs: datamodel.ProgramsJSON{{}}}))
+	data, err = s.store.Load()
+	req.NoError(err)
+	ass.Len(data.Sections, 1)
+}
+
+func (s *SQLiteStoreSuite) TestSave() {
+	ass, req := s.Assert(), s.Require()
+	req.NoError(s.store.Import(testData()))
+
+	sec := logic.NewSection(1, "renamed", 4)
+	req.NoError(s.store.SaveSection(&sec))
+	name := "renamed"
+	req.NoError(s.store.SaveProgram(&datamodel.ProgramJSON{ID: 1, Name: &name}))
+	// a new program is put after the others, even if its id is lower
+	added := "added"
+	req.NoError(s.store.SavePrograms(datamodel.ProgramsJSON{testData().Programs[1], testData().Programs[0]}))
+	req.NoError(s.store.SaveProgram(&datamodel.ProgramJSON{ID: 1, Name: &name}))
+	req.NoError(s.store.SaveProgram(&datamodel.ProgramJSON{ID: -1, Name: &added}))
+	req.NoError(s.store.SaveDeviceData(&http.DeviceData{DeviceID: "new", DeviceToken: "new token"}))
+	s.reopen()
+
+	data, err := s.store.Load()
+	req.NoError(err)
+	ass.Equal(sec, data.Sections[1])
+	ass.Equal("front", data.Sections[0].Name)
+	req.Len(data.Programs, 3)
+	ass.Equal("renamed", *data.Programs[0].Name, "an updated program keeps its position")
+	ass.Equal(1, data.Programs[0].ID)
+	ass.Equal("morning", *data.Programs[1].Name)
+	ass.Equal(-1, data.Programs[2].ID)
+	ass.Equal("added", *data.Programs[2].Name)
+	ass.Equal("new", data.DeviceData.DeviceID)
+
+	req.NoError(s.store.SaveDeviceData(nil))
+	data, err = s.store.Load()
+	req.NoError(err)
+	ass.Nil(data.DeviceData)
+}
+
+func (s *SQLiteStoreSuite) TestSaveSections() {
+	ass, req := s.Assert(), s.Require()
+	req.NoError(s.store.Import(testData()))
+
+	sections := testData().Sections[1:]
+	sections = append(sections, logic.NewSection(7, "added", 2))
+	req.NoError(s.store.SaveSections(sections))
+	s.reopen()
+
+	data, err := s.store.Load()
+	req.NoError(err)
+	req.Len(data.Sections, 2)
+	ass.Equal(logic.Section{ID: 1, Name: "back", InterfaceID: 3, MaxRunTime: 1800}, data.Sections[0])
+	ass.Equal(7, data.Sections[1].ID)
+	ass.Equal("added", data.Sections[1].Name)
+	ass.Len(data.Programs, 2, "programs are kept")
+}
+
+func (s *SQLiteStoreSuite) TestSavePrograms() {
+	ass, req := s.Assert(), s.Require()
+	req.NoError(s.store.Import(testData()))
+
+	programs := testData().Programs
+	name := "added"
+	// the programs keep their ids and are ordered by position
+	programs = datamodel.ProgramsJSON{programs[1], {ID: 5, Name: &name}, programs[0]}
+	req.NoError(s.store.SavePrograms(programs))
+	s.reopen()
+
+	data, err := s.store.Load()
+	req.NoError(err)
+	req.Len(data.Programs, 3)
+	ass.Equal("evening", *data.Programs[0].Name)
+	ass.Equal(1, data.Programs[0].ID)
+	ass.Equal(5, data.Programs[1].ID)
+	ass.Equal("added", *data.Programs[1].Name)
+	ass.Equal("morning", *data.Programs[2].Name)
+	ass.Equal(0, data.Programs[2].ID)
+	ass.Len(data.Sections, 2, "sections are kept")
+
+	// a failed save leaves the programs unchanged
+	ass.Error(s.store.SavePrograms(datamodel.ProgramsJSON{{}}))
+	data, err = s.store.Load()
+	req.NoError(err)
+	ass.Len(data.Programs, 3)
+}
+
+func (s *SQLiteStoreSuite) TestNextIDs() {
+	ass, req := s.Assert(), s.Require()
+	data := testData()
+	data.NextSectionID = 5
+	req.NoError(s.store.Import(data))
+	loaded, err := s.store.Load()
+	req.NoError(err)
+	ass.Equal(5, loaded.NextSectionID)
+	ass.Equal(2, loaded.NextProgramID, "the next id is after the saved ones")
+
+	// removing sections and programs does not lower the next ids
+	req.NoError(s.store.SaveSections(logic.Sections{logic.NewSection(7, "added", 0)}))
+	req.NoError(s.store.SaveSections(nil))
+	req.NoError(s.store.SavePrograms(nil))
+	req.NoError(s.store.Import(&Data{}))
+	s.reopen()
+	loaded, err = s.store.Load()
+	req.NoError(err)
+	ass.Equal(8, loaded.NextSectionID)
+	ass.Equal(2, loaded.NextProgramID)
+
+	// ids used by recorded runs are not given out again
+	progID := 4
+	req.NoError(s.store.Append(datamodel.RunRecordJSON{Section: 9, Program: &progID, EndTime: time.Now()}))
+	loaded, err = s.store.Load()
+	req.NoError(err)
+	ass.Equal(10, loaded.NextSectionID)
+	ass.Equal(5, loaded.NextProgramID)
+}
+
+func (s *SQLiteStoreSuite) TestHistory() {
+	ass, req := s.Assert(), s.Require()
+	now := time.Now()
+	start := now.Add(-time.Hour)
+	progID := 2
+	req.NoError(s.store.Append(datamodel.RunRecordJSON{
+		Section: 1, Program: &progID, RequestedDuration: 60, ActualDuration: 30, StartTime: &start, EndTime: now,
+		Cancelled: true, CancelReason: logic.CancelByMaxRunTime,
+	}))
+	req.NoError(s.store.Append(datamodel.RunRecordJSON{
+		Section: 0, RequestedDuration: 60, EndTime: now, Cancelled: true, SkipReason: logic.SkipDiscarded,
+	}))
+	s.reopen()
+
+	entries, err := s.store.Entries(time.Time{})
+	req.NoError(err)
+	req.Len(entries, 2)
+	ass.Equal(1, entries[0].Section)
+	ass.Equal(2, *entries[0].Program)
+	ass.Equal(30.0, entries[0].ActualDuration)
+	ass.True(start.Equal(*entries[0].StartTime))
+	ass.True(now.Equal(entries[0].EndTime))
+	ass.True(entries[0].Cancelled)
+	ass.Equal(logic.CancelByMaxRunTime, entries[0].CancelReason)
+	ass.Nil(entries[1].Program)
+	ass.Nil(entries[1].StartTime)
+	ass.Equal(logic.SkipDiscarded, entries[1].SkipReason)
+
+	entries, err = s.store.Entries(now.Add(-time.Minute))
+	req.NoError(err)
+	req.Len(entries, 1)
+	ass.Equal(0, entries[0].Section)
+
+	// history is kept when importing
+	req.NoError(s.store.Import(testData()))
+	entries, err = s.store.Entries(time.Time{})
+	req.NoError(err)
+	ass.Len(entries, 2)
+}
+
+func (s *SQLiteStoreSuite) TestMigrate() {
+	ass, req := s.Assert(), s.Require()
+	s.store.Close()
+	db, err := sql.Open("sqlite3", "file:"+s.path)
+	req.NoError(err)
+	// the schema of version 1, before sections and programs had a position
+	_, err = db.Exec(`DROP TABLE sections; DROP TABLE programs;
+CREATE TABLE sections (id INTEGER PRIMARY KEY, name TEXT NOT NULL, interface_id INTEGER NOT NULL,
+	max_run_time REAL NOT NULL DEFAULT 0);
+CREATE TABLE programs (id INTEGER PRIMARY KEY, name TEXT NOT NULL, sequence TEXT NOT NULL, schedule TEXT,
+	enabled INTEGER NOT NULL DEFAULT 0);
+INSERT INTO sections (id, name, interface_id) VALUES (1, "b", 1), (0, "a", 0);
+INSERT INTO programs (id, name, sequence) VALUES (0, "p", "[]");
+UPDATE meta SET value = '1' WHERE key = 'schema_version';`)
+	req.NoError(err)
+	req.NoError(db.Close())
+
+	s.store, err = OpenSQLite(s.path)
+	req.NoError(err)
+	data, err := s.store.Load()
+	req.NoError(err)
+	req.Len(data.Sections, 2)
+	ass.Equal("a", data.Sections[0].Name)
+	ass.Equal(1, data.Sections[1].ID)
+	req.Len(data.Programs, 1)
+	ass.Equal("p", *data.Programs[0].Name)
+	req.NoError(s.store.SaveSection(&logic.Section{ID: 5, Name: "c"}))
+	data, err = s.store.Load()
+	req.NoError(err)
+	ass.Equal("c", data.Sections[2].Name)
+
+	s.reopen()
+	var version string
+	req.NoError(s.store.db.QueryRow("SELECT value FROM meta WHERE key = 'schema_version'").Scan(&version))
+	ass.Equal(sqliteSchemaVersion, version)
+
+	_, err = s.store.db.Exec("UPDATE meta SET value = '0' WHERE key = 'schema_version'")
+	req.NoError(err)
+	s.store.Close()
+	_, err = OpenSQLite(s.path)
+	ass.EqualError(err, "could not migrate database schema: unsupported schema version 0")
+	s.store, err = OpenSQLite(s.path + ".new")
+	req.NoError(err)
+}
+
+func TestSQLiteStore(t *testing.T) {
+	suite.Run(t, new(SQLiteStoreSuite))
+}
+
+func TestConfig(t *testing.T) {
+	ass := assert.New(t)
+	ass.Error((&Config{}).Validate())
+	ass.Error((&Config{Type: "postgres", Path: "db"}).Validate())
+	ass.NoError((&Config{Path: "db"}).Validate())
+	ass.NoError((&Config{Type: "sqlite", Path: "db"}).Validate())
+	_, err := (&Config{Type: "postgres"}).Open()
+	ass.Error(err)
+}
@@ -0,0 +1,77 @@
+// Package storage stores the data of grinklers which changes at runtime, such as sections, programs, device
+// data and run history, separately from the static configuration.
+package storage
+
+import (
+	"fmt"
+
+	"git.amikhalev.com/amikhalev/grinklers/datamodel"
+	"git.amikhalev.com/amikhalev/grinklers/history"
+	"git.amikhalev.com/amikhalev/grinklers/http"
+	"git.amikhalev.com/amikhalev/grinklers/logic"
+	"git.amikhalev.com/amikhalev/grinklers/util"
+)
+
+// Data is all of the data kept in a Store, other than run history
+type Data struct {
+	Sections   logic.Sections
+	Programs   datamodel.ProgramsJSON
+	DeviceData *http.DeviceData
+	// NextSectionID and NextProgramID are the ids of the next section and program which are created. Saving a
+	// section or program makes them higher than its id, so ids are never given out again.
+	NextSectionID int
+	NextProgramID int
+}
+
+// Store stores Data and run history
+type Store interface {
+	history.Store
+	// Empty checks if no Data has been imported into the Store yet
+	Empty() (bool, error)
+	// Load loads all of the Data in the Store
+	Load() (*Data, error)
+	// Import replaces all of the Data in the Store with data. Run history is kept.
+	Import(data *Data) error
+	// SaveSection saves the data of a single section
+	SaveSection(sec *logic.Section) error
+	// SaveSections replaces all sections with sections, which is needed when they are added or removed
+	SaveSections(sections logic.Sections) error
+	// SaveProgram saves the data of a single program
+	SaveProgram(prog *datamodel.ProgramJSON) error
+	// SavePrograms replaces all programs with programs, which is needed when they are added, removed or
+	// reordered
+	SavePrograms(programs datamodel.ProgramsJSON) error
+	// SaveDeviceData saves the device data, or removes it if deviceData is nil
+	SaveDeviceData(deviceData *http.DeviceData) error
+	// Close closes the Store
+	Close() error
+}
+
+// Config is the configuration of the Store
+type Config struct {
+	// Type is the type of Store. Only "sqlite" is supported, which is the default
+	Type string `json:"type,omitempty"`
+	// Path is the path of the database
+	Path string `json:"path"`
+}
+
+// Validate checks that the configuration is valid
+func (c *Config) Validate() (err error) {
+	switch c.Type {
+	case "", "sqlite":
+	default:
+		return fmt.Errorf("unknown storage type '%s'", c.Type)
+	}
+	if c.Path == "" {
+		err = util.NewNotSpecifiedError("storage path")
+	}
+	return
+}
+
+// Open opens the Store described by this configuration
+func (c *Config) Open() (Store, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return OpenSQLite(c.Path)
+}
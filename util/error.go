@@ -3,6 +3,7 @@ package util
 import (
 	"fmt"
 	"reflect"
+	"strings"
 )
 
 type ErrorCode int32
@@ -59,6 +60,12 @@ func NewInternalError(cause error) *Error {
 	return &Error{EC_Internal, "internal error", "", cause}
 }
 
+// NewNotFoundError creates an error for an id of name which does not exist. It has the same code as the errors
+// of CheckRange, since ids used to be indexes.
+func NewNotFoundError(name string, id int) error {
+	return &Error{EC_Range, fmt.Sprintf("%s %d does not exist", name, id), name, nil}
+}
+
 // CheckNotNil checks that ref is not nil and produces an err with a Message if it is. name should be the
 // name of what ref is
 func CheckNotNil(ref interface{}, whatWasNil string) (err error) {
@@ -87,3 +94,24 @@ func CheckRange(ref *int, name string, max int) (err error) {
 	}
 	return
 }
+
+// Errors is a list of errors that happened together, which is itself an error
+type Errors []error
+
+var _ error = Errors{}
+
+func (errs Errors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ErrorOrNil returns nil if errs is empty, and errs otherwise
+func (errs Errors) ErrorOrNil() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -24,3 +25,15 @@ func TestCheckRange(t *testing.T) {
 	ass.Error(CheckRange(&num2, "test", 6))
 	ass.Error(CheckRange(&num, "test", 10))
 }
+
+func TestErrors(t *testing.T) {
+	ass := assert.New(t)
+
+	var errs Errors
+	ass.NoError(errs.ErrorOrNil())
+
+	errs = append(errs, fmt.Errorf("first"), NewNotSpecifiedError("second"))
+	err := errs.ErrorOrNil()
+	ass.Error(err)
+	ass.Equal("first; second not specified", err.Error())
+}
@@ -0,0 +1,60 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes data to the file at path so that the file either has its old contents or all of data,
+// even if the process crashes or the system loses power. The data is written to a temporary file in the same
+// directory, synced to disk, and then renamed over path.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return WriteFileAtomicCheck(path, data, perm, nil)
+}
+
+// WriteFileAtomicCheck is like WriteFileAtomic, but calls check with the path of the temporary file once it has
+// been written and synced, right before it is renamed over path. If check returns an error, the temporary file
+// is removed and path is left unchanged.
+func WriteFileAtomicCheck(path string, data []byte, perm os.FileMode, check func(tmpPath string) error) (err error) {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(data); err != nil {
+		return
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		return
+	}
+	if err = tmp.Sync(); err != nil {
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	if check != nil {
+		if err = check(tmp.Name()); err != nil {
+			return
+		}
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return
+	}
+	// sync the directory so the rename itself is durable
+	if d, derr := os.Open(dir); derr == nil {
+		d.Sync()
+		d.Close()
+	}
+	return
+}
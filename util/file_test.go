@@ -0,0 +1,68 @@
+package util
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	dir, err := ioutil.TempDir("", "util")
+	req.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file.json")
+
+	req.NoError(WriteFileAtomic(path, []byte("first"), 0600))
+	contents, err := ioutil.ReadFile(path)
+	req.NoError(err)
+	ass.Equal("first", string(contents))
+	info, err := os.Stat(path)
+	req.NoError(err)
+	ass.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	req.NoError(WriteFileAtomic(path, []byte("second"), 0644))
+	contents, err = ioutil.ReadFile(path)
+	req.NoError(err)
+	ass.Equal("second", string(contents))
+
+	// no temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	req.NoError(err)
+	ass.Len(files, 1)
+
+	ass.Error(WriteFileAtomic(filepath.Join(dir, "nonexistent", "file.json"), nil, 0600))
+}
+
+func TestWriteFileAtomicCheck(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	dir, err := ioutil.TempDir("", "util")
+	req.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file.json")
+	req.NoError(WriteFileAtomic(path, []byte("old"), 0600))
+
+	err = WriteFileAtomicCheck(path, []byte("new"), 0600, func(tmpPath string) error {
+		contents, err := ioutil.ReadFile(tmpPath)
+		req.NoError(err)
+		ass.Equal("new", string(contents), "the temporary file should be written before it is checked")
+		return errors.New("invalid")
+	})
+	ass.EqualError(err, "invalid")
+	contents, err := ioutil.ReadFile(path)
+	req.NoError(err)
+	ass.Equal("old", string(contents), "file should be unchanged if check fails")
+	files, err := ioutil.ReadDir(dir)
+	req.NoError(err)
+	ass.Len(files, 1)
+
+	req.NoError(WriteFileAtomicCheck(path, []byte("new"), 0600, func(string) error { return nil }))
+	contents, err = ioutil.ReadFile(path)
+	req.NoError(err)
+	ass.Equal("new", string(contents))
+}
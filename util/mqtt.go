@@ -0,0 +1,23 @@
+package util
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// ParseBrokerURL parses the URL of an MQTT broker, translating the mqtt and mqtts schemes to the
+// tcp and ssl schemes understood by the paho client. A URL with no scheme is treated as tcp.
+func ParseBrokerURL(rawURL string) (brokerURL *url.URL, err error) {
+	brokerURL, err = url.Parse(rawURL)
+	if err != nil {
+		err = fmt.Errorf("error parsing broker url: %v", err)
+		return
+	}
+	switch brokerURL.Scheme {
+	case "mqtt", "":
+		brokerURL.Scheme = "tcp"
+	case "mqtts":
+		brokerURL.Scheme = "ssl"
+	}
+	return
+}
@@ -0,0 +1,27 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBrokerURL(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+
+	u, err := ParseBrokerURL("mqtt://localhost:1883")
+	req.NoError(err)
+	ass.Equal("tcp://localhost:1883", u.String())
+
+	u, err = ParseBrokerURL("mqtts://broker.example.com:8883")
+	req.NoError(err)
+	ass.Equal("ssl://broker.example.com:8883", u.String())
+
+	u, err = ParseBrokerURL("ws://localhost:9001/mqtt")
+	req.NoError(err)
+	ass.Equal("ws://localhost:9001/mqtt", u.String())
+
+	_, err = ParseBrokerURL("mqtt://local host:%zz")
+	ass.Error(err)
+}
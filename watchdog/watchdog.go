@@ -0,0 +1,96 @@
+// Package watchdog integrates with a hardware watchdog device, such as /dev/watchdog on linux, which
+// reboots the system if it is not written to regularly.
+package watchdog
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/Sirupsen/logrus"
+)
+
+// DefaultDevice is the default watchdog device on linux
+const DefaultDevice = "/dev/watchdog"
+
+// Heartbeat is implemented by something whose liveness is monitored by a Watchdog
+type Heartbeat interface {
+	// LastHeartbeat gets the last time it was known to be alive
+	LastHeartbeat() time.Time
+}
+
+// Watchdog pets a watchdog device for as long as a Heartbeat stays alive. If the heartbeat stops for longer
+// than the stale timeout, the Watchdog stops petting the device, and the system will be rebooted when the
+// device times out.
+type Watchdog struct {
+	device    string
+	heartbeat Heartbeat
+	interval  time.Duration
+	stale     time.Duration
+	file      *os.File
+	quit      chan struct{}
+	done      chan struct{}
+	log       *logrus.Entry
+}
+
+// New creates a new Watchdog which pets device every interval as long as heartbeat has beat within stale
+func New(device string, heartbeat Heartbeat, interval time.Duration, stale time.Duration) *Watchdog {
+	return &Watchdog{
+		device, heartbeat, interval, stale,
+		nil, make(chan struct{}), make(chan struct{}),
+		util.Logger.WithFields(logrus.Fields{"module": "watchdog", "device": device}),
+	}
+}
+
+// Start opens the watchdog device and starts petting it in the background. Once the device is opened,
+// the system will reboot if it is not petted regularly.
+func (w *Watchdog) Start() (err error) {
+	w.file, err = os.OpenFile(w.device, os.O_WRONLY, 0)
+	if err != nil {
+		err = fmt.Errorf("error opening watchdog device: %v", err)
+		return
+	}
+	w.log.WithFields(logrus.Fields{"interval": w.interval, "stale": w.stale}).Info("started watchdog")
+	go w.run()
+	return
+}
+
+func (w *Watchdog) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	stalled := false
+	for {
+		sinceBeat := time.Since(w.heartbeat.LastHeartbeat())
+		if sinceBeat < w.stale {
+			if stalled {
+				w.log.Warn("heartbeat resumed, petting watchdog again")
+				stalled = false
+			}
+			if _, err := w.file.Write([]byte{0}); err != nil {
+				w.log.WithError(err).Error("error petting watchdog")
+			}
+		} else if !stalled {
+			w.log.WithField("sinceBeat", sinceBeat).Error("heartbeat stopped, no longer petting watchdog")
+			stalled = true
+		}
+		select {
+		case <-w.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops petting the watchdog device and disarms it by writing the magic close character
+func (w *Watchdog) Stop() (err error) {
+	close(w.quit)
+	<-w.done
+	if _, err = w.file.Write([]byte("V")); err != nil {
+		w.log.WithError(err).Warn("error disarming watchdog")
+	}
+	err = w.file.Close()
+	w.log.Info("stopped watchdog")
+	return
+}
@@ -0,0 +1,78 @@
+package watchdog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.amikhalev.com/amikhalev/grinklers/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testHeartbeat struct {
+	last int64
+}
+
+func (h *testHeartbeat) beat() {
+	atomic.StoreInt64(&h.last, time.Now().UnixNano())
+}
+
+func (h *testHeartbeat) LastHeartbeat() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&h.last))
+}
+
+func TestWatchdog(t *testing.T) {
+	ass, req := assert.New(t), require.New(t)
+	util.Logger.Out = ioutil.Discard
+
+	dir, err := ioutil.TempDir("", "watchdog")
+	req.NoError(err)
+	defer os.RemoveAll(dir)
+	device := filepath.Join(dir, "watchdog")
+	req.NoError(ioutil.WriteFile(device, nil, 0600))
+
+	heartbeat := &testHeartbeat{}
+	heartbeat.beat()
+	w := New(device, heartbeat, 5*time.Millisecond, 20*time.Millisecond)
+	req.NoError(w.Start())
+
+	size := func() int64 {
+		info, err := os.Stat(device)
+		req.NoError(err)
+		return info.Size()
+	}
+
+	// petted while the heartbeat is alive
+	for i := 0; i < 5; i++ {
+		time.Sleep(5 * time.Millisecond)
+		heartbeat.beat()
+	}
+	petted := size()
+	ass.True(petted >= 3, "watchdog should have been petted while heartbeat is alive")
+
+	// not petted once the heartbeat stops
+	time.Sleep(30 * time.Millisecond)
+	stalled := size()
+	time.Sleep(30 * time.Millisecond)
+	ass.Equal(stalled, size(), "watchdog should not be petted after heartbeat stops")
+
+	// petted again once it resumes
+	heartbeat.beat()
+	time.Sleep(10 * time.Millisecond)
+	ass.True(size() > stalled, "watchdog should be petted after heartbeat resumes")
+
+	req.NoError(w.Stop())
+	contents, err := ioutil.ReadFile(device)
+	req.NoError(err)
+	ass.Equal(byte('V'), contents[len(contents)-1], "watchdog should be disarmed on stop")
+}
+
+func TestWatchdog_NoDevice(t *testing.T) {
+	util.Logger.Out = ioutil.Discard
+	w := New("/nonexistent/watchdog", &testHeartbeat{}, time.Second, time.Second)
+	assert.Error(t, w.Start())
+}